@@ -170,6 +170,10 @@ func (h *AlwaysOnInboundHandler) Close() error {
 	for _, worker := range h.workers {
 		errs = append(errs, worker.Close())
 	}
+	// The workers share the proxy, so it is closed once, after every one
+	// of them has stopped accepting. It may then let the connections it is
+	// serving finish before they are closed.
+	errs = append(errs, common.Close(h.proxy))
 	errs = append(errs, h.mux.Close())
 	if err := errors.Combine(errs...); err != nil {
 		return errors.New("failed to close all resources").Base(err)
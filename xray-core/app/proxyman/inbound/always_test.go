@@ -0,0 +1,81 @@
+package inbound
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/xtls/xray-core/common/mux"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/transport/internet/stat"
+)
+
+// closeLog records the order in which workers and the proxy are closed.
+type closeLog struct {
+	sync.Mutex
+	events []string
+}
+
+func (l *closeLog) add(event string) {
+	l.Lock()
+	defer l.Unlock()
+	l.events = append(l.events, event)
+}
+
+// closableProxy is an inbound proxy that logs every Close.
+type closableProxy struct {
+	log *closeLog
+}
+
+func (*closableProxy) Network() []net.Network {
+	return []net.Network{net.Network_TCP, net.Network_UDP}
+}
+
+func (*closableProxy) Process(context.Context, net.Network, stat.Connection, routing.Dispatcher) error {
+	return nil
+}
+
+func (p *closableProxy) Close() error {
+	p.log.add("proxy")
+	return nil
+}
+
+// loggedWorker logs when the worker it wraps is closed.
+type loggedWorker struct {
+	worker
+	name string
+	log  *closeLog
+}
+
+func (w *loggedWorker) Close() error {
+	err := w.worker.Close()
+	w.log.add(w.name)
+	return err
+}
+
+func TestAlwaysOnInboundHandlerClosesProxyOnce(t *testing.T) {
+	log := &closeLog{}
+	p := &closableProxy{log: log}
+	h := &AlwaysOnInboundHandler{
+		proxy: p,
+		workers: []worker{
+			&loggedWorker{worker: &tcpWorker{proxy: p, port: 1080}, name: "tcp 1080", log: log},
+			&loggedWorker{worker: &tcpWorker{proxy: p, port: 1081}, name: "tcp 1081", log: log},
+			&loggedWorker{worker: &udpWorker{proxy: p, port: 1080}, name: "udp 1080", log: log},
+			&loggedWorker{worker: &dsWorker{proxy: p}, name: "ds", log: log},
+		},
+		mux: &mux.Server{},
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// No worker closes the proxy they share, and the handler closes it
+	// once, after every worker has stopped accepting.
+	want := "tcp 1080, tcp 1081, udp 1080, ds, proxy"
+	if got := strings.Join(log.events, ", "); got != want {
+		t.Errorf("closed %s, want %s", got, want)
+	}
+}
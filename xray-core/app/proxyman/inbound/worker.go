@@ -154,9 +154,6 @@ func (w *tcpWorker) Close() error {
 		if err := common.Close(w.hub); err != nil {
 			errs = append(errs, err)
 		}
-		if err := common.Close(w.proxy); err != nil {
-			errs = append(errs, err)
-		}
 	}
 	if len(errs) > 0 {
 		return errors.New("failed to close all resources").Base(errors.New(serial.Concat(errs...)))
@@ -454,10 +451,6 @@ func (w *udpWorker) Close() error {
 		}
 	}
 
-	if err := common.Close(w.proxy); err != nil {
-		errs = append(errs, err)
-	}
-
 	if len(errs) > 0 {
 		return errors.New("failed to close all resources").Base(errors.New(serial.Concat(errs...)))
 	}
@@ -552,9 +545,6 @@ func (w *dsWorker) Close() error {
 		if err := common.Close(w.hub); err != nil {
 			errs = append(errs, err)
 		}
-		if err := common.Close(w.proxy); err != nil {
-			errs = append(errs, err)
-		}
 	}
 	if len(errs) > 0 {
 		return errors.New("failed to close all resources").Base(errors.New(serial.Concat(errs...)))
@@ -5,8 +5,31 @@ package reflex
 
 // User represents a client (step1 spec).
 type User struct {
-	Id     string // UUID
+	// Id is the UUID the client authenticates with.
+	Id     string
 	Policy string
+
+	// IdHash, set in place of Id, lists the client by the hex SHA-256 of
+	// the ID it authenticates with, see inbound.UserIDHash. It is meant
+	// for clients with an IdSalt, so the server config holds nothing a
+	// client could authenticate with.
+	IdHash string
+
+	// TokenSecret, if set, requires the client to send a rotating
+	// authentication token derived from it in its handshake.
+	TokenSecret string
+
+	// RouteTags lists the routing tags the user may request in its first
+	// DATA frame. A request for any other tag is refused.
+	RouteTags []string
+
+	// MaxConns caps the user's concurrent sessions, overriding the
+	// inbound's MaxConnsPerUser. Zero keeps that default.
+	MaxConns uint32
+
+	// Level is the Xray policy level the user's sessions are served at,
+	// which sets their timeouts and buffer sizes.
+	Level uint32
 }
 
 // Account for protocol.Account (step1).
@@ -17,12 +40,319 @@ type Account struct {
 // Fallback config (step1).
 type Fallback struct {
 	Dest uint32
+
+	// KeepAlive forwards HTTP/1.x probes request by request and keeps the
+	// backend connection open afterwards for the next probe from the same
+	// client IP, instead of dialing the backend for every connection.
+	KeepAlive bool
+
+	// MaxBytes, when non-zero, closes a fallback connection once it has
+	// carried this many bytes, both directions together.
+	MaxBytes uint64
+
+	// MaxConns, when non-zero, caps how many connections may be in
+	// fallback at once. Connections beyond it get the decoy if there is
+	// one. Otherwise they wait, up to the handshake timeout, for another
+	// connection to leave fallback, and are closed quietly without dialing
+	// the backend if none does.
+	MaxConns uint32
+
+	// Rules send fallback connections to other backends than Dest. The
+	// first rule that matches a connection picks its backend; Dest takes
+	// the connections no rule matches.
+	Rules []*FallbackRule
+
+	// TLS makes the inbound connect to backends over TLS, for backends
+	// that only serve HTTPS. What the client sends is forwarded inside it,
+	// so this suits an inbound whose transport already terminates the
+	// client's TLS. ServerName is sent as SNI and verified, 127.0.0.1 if
+	// empty; CA is a PEM file of the CAs to verify against instead of the
+	// system's; AllowInsecure skips verification.
+	TLS           bool
+	ServerName    string
+	CA            string
+	AllowInsecure bool
+}
+
+// FallbackRule sends the fallback connections it matches to Dest. Empty
+// fields match every connection.
+type FallbackRule struct {
+	// Name matches the server name the client asked for: the SNI of the
+	// inbound's TLS or, without it, that of a TLS ClientHello sent in the
+	// clear or the host of an HTTP Host header.
+	Name string
+	// Alpn matches the ALPN the inbound's TLS negotiated.
+	Alpn string
+	// Path matches HTTP requests whose path starts with it.
+	Path string
+	Dest uint32
+}
+
+// Decoy is a canned HTTP response served when there is no fallback: to
+// probes that are not Reflex and in place of the error page on a failed
+// handshake.
+type Decoy struct {
+	Status      uint32 // 200 if zero
+	ContentType string // "text/html" if empty
+	Body        string
+}
+
+// HandshakeDelay is one bucket of the handshake response delay
+// distribution. Weights need not sum to 1; they are normalized.
+type HandshakeDelay struct {
+	DelayMs uint32
+	Weight  float64
+}
+
+// Profile is a custom traffic profile, which users can name as their
+// Policy like a built-in one. Weights need not sum to 1; they are
+// normalized.
+type Profile struct {
+	Name        string
+	PacketSizes []ProfilePacketSize
+	Delays      []ProfileDelay
+
+	// Pcap, if set, builds the profile from a capture instead of
+	// PacketSizes and Delays: from the payload sizes and spacing of the
+	// packets of one flow of this pcap file. PcapFlow picks the flow, as
+	// in "tcp 192.0.2.1:443 > 198.51.100.7:50312"; empty picks the one
+	// with the most packets.
+	Pcap     string
+	PcapFlow string
+
+	// CompressionDictionary, if set, is a preset dictionary, such as common
+	// HTTP headers, that compressed frames of sessions with this profile
+	// are compressed against. Peers must use the same dictionary.
+	CompressionDictionary string
+}
+
+// ProfilePacketSize is one bucket of a custom profile's packet sizes.
+type ProfilePacketSize struct {
+	Size   uint32
+	Weight float64
+}
+
+// ProfileDelay is one bucket of a custom profile's inter-packet delays,
+// in milliseconds.
+type ProfileDelay struct {
+	Ms     uint32
+	Weight float64
 }
 
 // InboundConfig is the inbound config (step1).
 type InboundConfig struct {
 	Clients  []*User
 	Fallback *Fallback
+
+	// Tag is set as the inbound tag of dispatched connections, so routing
+	// rules can match on it. Empty keeps the tag Xray assigned.
+	Tag string
+
+	// HandshakeMode selects the handshake flight layout: "" or "single" for
+	// one client flight and one server flight, "tls-like" for
+	// client hello -> server hello -> client finished.
+	HandshakeMode string
+	// HandshakeFlightGapMs is the minimum time, in milliseconds, between
+	// receiving the client hello and sending the server hello in "tls-like"
+	// mode. Up to half of it again is added as random jitter.
+	HandshakeFlightGapMs uint32
+	// HandshakeDelays, if set, holds every handshake response until a delay
+	// drawn from this distribution has passed since the client hello
+	// arrived, so response times vary like a real server's instead of
+	// tracking the server's own processing time. In "tls-like" mode it
+	// replaces the flight gap.
+	HandshakeDelays []HandshakeDelay
+	// MaxConnsPerUser caps the concurrent sessions of each user without a
+	// MaxConns of their own. Handshakes over the cap get HTTP 429. Zero
+	// means no cap.
+	MaxConnsPerUser uint32
+
+	// ShedHighConns, when non-zero, makes the inbound shed load once it is
+	// serving this many connections, fallback ones included: new
+	// connections are closed unread, or handed to fallback with
+	// ShedToFallback, until fewer than ShedLowConns remain. ShedLowConns
+	// must not exceed ShedHighConns; zero resumes below ShedHighConns.
+	ShedHighConns  uint32
+	ShedLowConns   uint32
+	ShedToFallback bool
+	// MaxConnections, when non-zero, caps how many connections the inbound
+	// serves at once, fallback ones included. A connection over the cap
+	// goes straight to fallback without a handshake, or is closed unread
+	// if there is no fallback. Unless Fallback.MaxConns sets its own cap,
+	// fallback then holds at most MaxConnections connections at once.
+	MaxConnections uint32
+
+	// ReadIdleTimeoutMs and WriteIdleTimeoutMs, when either is set, give
+	// a relayed connection separate idle timeouts, in milliseconds, for
+	// reading from the client and writing to it. The connection closes
+	// once both directions have been idle for their timeouts, so a long
+	// download the client sends nothing during stays open. Zero uses the
+	// policy's connection idle timeout for that direction.
+	ReadIdleTimeoutMs  uint32
+	WriteIdleTimeoutMs uint32
+
+	// DrainGraceMs is how long, in milliseconds, closing the inbound lets
+	// connections in progress finish before they are closed. Zero means
+	// 5000.
+	DrainGraceMs uint32
+
+	// FutureSkewToleranceSec is how far, in seconds, a client's clock may be
+	// ahead of the server's. A hello stamped further in the future is
+	// rejected and counted apart from ones that are too old, as it points
+	// to a misconfigured or forging client rather than drift. Zero means
+	// 300, which is also the most allowed.
+	FutureSkewToleranceSec uint32
+	// DisableHTTPHandshake turns off recognition of the HTTP POST handshake,
+	// so only the magic handshake is accepted and every other connection,
+	// POST requests included, goes to fallback.
+	DisableHTTPHandshake bool
+	// GreaseMaxBytes, when non-zero, makes the server skip up to this many
+	// grease bytes (each 0x?A, as in TLS GREASE) a client sends before the
+	// magic, at most 16. Clients send them with the same outbound setting.
+	GreaseMaxBytes uint32
+	// MagicSecret, if set, replaces the fixed magic with one derived from
+	// this secret and the current minute, see protocol.TimeGatedMagic, so
+	// a recorded first flight replayed minutes later is not recognized.
+	// Clients must set the same outbound MagicSecret. The HTTP POST and
+	// upgrade handshakes then carry the magic too, ahead of the handshake
+	// in their data, and go to fallback without it.
+	MagicSecret string
+	// RequiredAlpn, if set, accepts a handshake only on connections whose
+	// TLS layer, such as the inbound's TLS or REALITY stream security,
+	// negotiated this ALPN. Other connections, including ones without TLS,
+	// go to fallback.
+	RequiredAlpn string
+	// WebSocketPath, if set, accepts WebSocket upgrades of GET requests for
+	// this path and runs the handshake and the session over the WebSocket,
+	// every flight and frame in a binary message of its own. A message
+	// holding more or less than one fails the connection. Requests for
+	// other paths go to fallback.
+	WebSocketPath string
+	// HTTPUpgrade, if set, accepts the handshake as an HTTP GET asking to
+	// upgrade the connection to this protocol, as clients with the same
+	// HTTPUpgrade send it, and answers it with 101 Switching Protocols.
+	// GET requests that ask for another protocol go to fallback, or to
+	// the WebSocket upgrade if they are for WebSocketPath.
+	HTTPUpgrade string
+
+	// FrameReadTimeoutMs bounds reading the rest of a frame once its header
+	// has arrived, and FrameWriteTimeoutMs bounds writing one frame. Zero
+	// leaves only the inactivity timeout in charge.
+	FrameReadTimeoutMs  uint32
+	FrameWriteTimeoutMs uint32
+
+	// RekeyAfterFrames makes the server replace the session key with a new
+	// one from a fresh key exchange after writing this many frames under it.
+	// Zero leaves starting a rekey to the client.
+	RekeyAfterFrames uint32
+
+	// MaxInFlightBytes caps how much of a connection's data may wait in
+	// Xray's buffers for a slow peer. Once the cap is reached the inbound
+	// stops reading frames until the upstream catches up. Zero keeps the
+	// buffer size from the level policy.
+	MaxInFlightBytes uint32
+
+	// SocketBufferSize, when non-zero, sets the send and receive buffers of
+	// client and fallback connections to this many bytes. Links with a
+	// large bandwidth-delay product need buffers of about bandwidth × RTT,
+	// e.g. 4MB for 320Mbit/s at 100ms; compare throughput with and without
+	// it before settling on a value, as the kernel may cap or double it.
+	SocketBufferSize uint32
+
+	// CoalesceBytes, when non-zero, batches the payloads of small DATA
+	// frames into fewer upstream writes: a write goes out once this many
+	// bytes are pending or CoalesceDelayMs has passed since the first of
+	// them arrived. Zero CoalesceDelayMs means 5. Chatty clients sending
+	// many small frames benefit; interactive ones pay up to the delay.
+	CoalesceBytes   uint32
+	CoalesceDelayMs uint32
+
+	// BlockedPorts lists destination ports clients may not connect to. If
+	// it is nil, the mail submission ports abused for spam (25, 465 and
+	// 587) are blocked; an empty list blocks nothing.
+	BlockedPorts []uint32
+
+	// ResolveLocally makes the inbound resolve domain destinations with
+	// Xray's DNS and dispatch the resulting IP, instead of passing the
+	// domain on for the outbound to resolve.
+	ResolveLocally bool
+	// AllowConnectByDomain lets clients with ConnectByDomain have a domain
+	// destination passed on by name despite ResolveLocally. Without it
+	// their request is resolved like any other.
+	AllowConnectByDomain bool
+
+	// RouteBySNI makes the server name of a TLS client hello at the start
+	// of a request to an IP destination its route target, so domain rules
+	// match it while the connection still goes to the IP, as with the
+	// dispatcher's routeOnly sniffing. The name is exposed to routing as
+	// an attribute either way.
+	RouteBySNI bool
+
+	// LogDestination sets how much of a destination the logs show: "full"
+	// or "" for the whole destination, "domain" for the registrable domain
+	// (or the IP) without the port, "hash" for a keyed hash of it that is
+	// stable until restart, "none" for nothing but a placeholder.
+	LogDestination string
+
+	// AccessLog chooses when a TCP connection appears in the access log:
+	// "start" or "" when it is dispatched, "completion" when it ends, with
+	// its duration and the payload bytes relayed each way, or "both".
+	AccessLog string
+
+	// Profiles declares custom traffic profiles, registered by name when the
+	// inbound is created, and unregistered when it is closed, so that user
+	// Policies and NetworkProfiles can select them. A name must not clash
+	// with a built-in or an already registered profile. Clients must know
+	// the same profiles to morph their uplink with them.
+	Profiles []Profile
+
+	// LearnProfiles makes the inbound learn, per user, the sizes and
+	// spacing of the payloads it sends them over their most recent
+	// traffic, from which InboundHandler.LearnedProfile derives a custom
+	// profile shaped like real usage.
+	LearnProfiles bool
+
+	// NetworkProfiles maps a network ("tcp" or "udp") to the traffic
+	// profile of users without a Policy when the inbound serves on it, as
+	// the profile that blends in over a stream transport differs from the
+	// one for a datagram transport such as QUIC.
+	NetworkProfiles map[string]string
+
+	// StrictPolicy makes a user Policy that names no known profile a
+	// configuration error. Otherwise it is logged and the user is served
+	// without morphing.
+	StrictPolicy bool
+
+	// PowDifficulty, when non-zero, requires every client hello to carry a
+	// proof of work with this many leading zero bits, checked before any key
+	// exchange. The challenge changes every minute and is derived from
+	// MagicSecret, so clients configured with the same secret and difficulty
+	// solve it before they connect. A hello without a valid proof goes to
+	// fallback like any connection that is not Reflex.
+	PowDifficulty uint32
+
+	// IdleCoverMs, when non-zero, makes the server send cover frames shaped
+	// by the user's profile whenever a session has sent nothing for this
+	// many milliseconds, one per interval until real data resumes. Users
+	// without a profile get no cover.
+	IdleCoverMs uint32
+	// IdleCoverMinClientVersion, if set, sends idle cover only to clients
+	// announcing this version or later, as in "1.1.0". Older clients and
+	// ones that announce no version get none.
+	IdleCoverMinClientVersion string
+
+	// MaxSessionLifetimeMs closes a session this many milliseconds after its
+	// handshake completes, however active it is. Zero means no limit.
+	MaxSessionLifetimeMs uint32
+
+	// HandshakeStatus is the 2xx status of a successful handshake response,
+	// 200 if zero. With 204 or 205 the server key is sent in an ETag header,
+	// as those responses have no body.
+	HandshakeStatus uint32
+
+	// Decoy, if set, answers probes and failed handshakes when Fallback is
+	// not set, so a bare server still looks like an ordinary web server.
+	Decoy *Decoy
 }
 
 // OutboundConfig (step1).
@@ -30,4 +360,78 @@ type OutboundConfig struct {
 	Address string
 	Port    uint32
 	Id      string
+
+	// HandshakeRetries is how many times a handshake the server rejects or
+	// answers malformed is retried, each time on a new connection with new
+	// ephemeral keys.
+	HandshakeRetries uint32
+
+	// IdSalt, if set, makes the client authenticate with the ID derived
+	// from Id and this salt instead of Id itself. The server lists the
+	// hash of the derived ID as the client's IdHash.
+	IdSalt string
+
+	// WebSocketPath, if set, runs the session over a WebSocket upgrade of
+	// this path, for servers with the same WebSocketPath.
+	WebSocketPath string
+
+	// CipherSuite names the session cipher, "chacha20-poly1305" (the default),
+	// "xchacha20-poly1305" or "aes-256-gcm".
+	CipherSuite string
+
+	// Policy names the traffic profile the client morphs its frames with.
+	// Empty disables morphing.
+	Policy string
+	// MorphingBaseRttMs is the round-trip time, in milliseconds, of the link
+	// the profile was captured on. When set, profile delays are scaled by the
+	// measured RTT relative to it. Zero uses the profile's delays as they are.
+	MorphingBaseRttMs uint32
+	// MorphDownlink asks the server to morph what it sends back with the
+	// profile it grants. Without it only the uplink is morphed.
+	MorphDownlink bool
+	// Compression makes the client compress the data it sends, against
+	// the CompressionDictionary of its session's profile if that has one.
+	// The server's profile must have the same dictionary.
+	Compression bool
+
+	// RekeyAfterFrames makes the client replace the session key with a new
+	// one from a fresh key exchange after writing this many frames under it.
+	// Zero leaves starting a rekey to the server.
+	RekeyAfterFrames uint32
+
+	// GreaseMaxBytes, when non-zero, makes the client open every connection
+	// with between 1 and this many random grease bytes, at most 16, so its
+	// first bytes vary. The server must allow at least as many.
+	GreaseMaxBytes uint32
+	// MagicSecret opens the handshake with the time-gated magic of servers
+	// with the same MagicSecret instead of the fixed one. With HTTPUpgrade
+	// the magic leads the handshake in the upgrade request.
+	MagicSecret string
+	// PowDifficulty makes the client solve the proof of work that servers
+	// with the same PowDifficulty and MagicSecret require before sending
+	// each hello.
+	PowDifficulty uint32
+	// HTTP2Preface sends the handshake the way an HTTP/2 client opens a
+	// connection: after the HTTP/2 connection preface, in a frame shaped
+	// like SETTINGS. The server answers in HTTP/2 frames too. It cannot be
+	// combined with GreaseMaxBytes.
+	HTTP2Preface bool
+	// HTTPUpgrade, if set, sends the handshake as an HTTP GET asking to
+	// upgrade the connection to this protocol, as in "websocket", for CDNs
+	// and proxies that pass a connection through once it is upgraded. The
+	// server must have the same HTTPUpgrade, and the session follows its
+	// 101 Switching Protocols. It cannot be
+	// combined with GreaseMaxBytes, HTTP2Preface or WebSocketPath.
+	HTTPUpgrade string
+
+	// SendDomain makes the client send the domain it was asked for even when
+	// routing already resolved it to an IP, so the server never learns which
+	// requests were resolved client-side.
+	SendDomain bool
+
+	// ConnectByDomain asks the server to connect to domain destinations by
+	// name, without resolving them first even if it resolves domains
+	// itself, so the upstream sees the name, as TLS SNI needs. Servers
+	// honour it only with AllowConnectByDomain.
+	ConnectByDomain bool
 }
@@ -36,6 +36,8 @@ import (
 type mockDispatcher struct{}
 
 func (m *mockDispatcher) Type() interface{} { return (*routing.Dispatcher)(nil) }
+func (m *mockDispatcher) Start() error      { return nil }
+func (m *mockDispatcher) Close() error      { return nil }
 func (m *mockDispatcher) Dispatch(ctx context.Context, dest net.Destination) (*transport.Link, error) {
 	return nil, fmt.Errorf("mock: no outbound")
 }
@@ -654,7 +656,7 @@ func TestStep4Fallback(t *testing.T) {
 
 	ctx := context.Background()
 	cfg := &reflex.InboundConfig{
-		Clients: []*reflex.User{{Id: "40000000-2000-4000-8000-000000000006", Policy: "default"}},
+		Clients:  []*reflex.User{{Id: "40000000-2000-4000-8000-000000000006", Policy: "default"}},
 		Fallback: &reflex.Fallback{Dest: fallbackPort},
 	}
 	obj, err := common.CreateObject(ctx, cfg)
@@ -0,0 +1,64 @@
+package reflex
+
+import (
+	"time"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/proxy"
+)
+
+// InboundHandler is the interface the Reflex inbound handler implements.
+// Code that gets the handler from common.CreateObject can assert to it
+// instead of spelling out the methods it needs.
+type InboundHandler interface {
+	proxy.Inbound
+	// Close drains the connections in progress, see
+	// InboundConfig.DrainGraceMs.
+	common.Closable
+
+	// Stats returns the handler's handshake and traffic statistics.
+	Stats() Stats
+
+	// LearnedProfile returns the profile learned from the traffic sent to
+	// a user, see InboundConfig.LearnProfiles.
+	LearnedProfile(email string) (Profile, bool)
+}
+
+// Stats is a snapshot of a Reflex inbound's statistics.
+type Stats struct {
+	// Handshakes is the number of handshakes that established a session.
+	Handshakes uint64
+	// HandshakeP50, HandshakeP90 and HandshakeP99 are percentiles of the
+	// time from the first byte of a connection to its session being
+	// established, rounded up to a power-of-two bucket.
+	HandshakeP50 time.Duration
+	HandshakeP90 time.Duration
+	HandshakeP99 time.Duration
+
+	// Profiles counts the traffic of sessions that were morphed, keyed by
+	// the name of their traffic profile. Profiles nothing used are absent.
+	Profiles map[string]ProfileStats
+
+	// ClientVersions counts established sessions by the client software
+	// version announced in the handshake: "unknown" for none, "other" for
+	// versions beyond the first 32 seen.
+	ClientVersions map[string]uint64
+
+	// ShedConnections is the number of connections turned away while the
+	// inbound was shedding load, see InboundConfig.ShedHighConns.
+	ShedConnections uint64
+
+	// LimitedConnections is the number of connections turned away at
+	// InboundConfig.MaxConnections.
+	LimitedConnections uint64
+}
+
+// ProfileStats is the usage of one traffic profile.
+type ProfileStats struct {
+	// Connections is the number of proxied connections served under it.
+	Connections uint64
+	// UplinkBytes and DownlinkBytes count the payload carried from and to
+	// clients, without framing, padding or cover traffic.
+	UplinkBytes   uint64
+	DownlinkBytes uint64
+}
@@ -0,0 +1,42 @@
+package inbound
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/xtls/xray-core/common/net"
+)
+
+type contextKey int
+
+const (
+	affinityContextKey contextKey = iota
+	routeTagContextKey
+	networkContextKey
+	clientVersionContextKey
+	authenticatedContextKey
+	downlinkMorphingContextKey
+)
+
+// ContextWithAffinityKey returns a context carrying a routing affinity key.
+func ContextWithAffinityKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, affinityContextKey, key)
+}
+
+// AffinityKeyFromContext returns the routing affinity key set by the reflex
+// inbound, or "" if there is none. Balancers can use it to keep connections
+// of the same user to the same destination on the same upstream.
+func AffinityKeyFromContext(ctx context.Context) string {
+	if key, ok := ctx.Value(affinityContextKey).(string); ok {
+		return key
+	}
+	return ""
+}
+
+// affinityKey derives a stable affinity key from the user and destination.
+// It is hashed so that neither leaks wherever the key ends up logged.
+func affinityKey(email string, dest net.Destination) string {
+	sum := sha256.Sum256([]byte(email + "\x00" + dest.NetAddr()))
+	return hex.EncodeToString(sum[:16])
+}
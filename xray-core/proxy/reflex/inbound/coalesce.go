@@ -0,0 +1,107 @@
+package inbound
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/xtls/xray-core/common/buf"
+)
+
+// defaultCoalesceDelay is how long a pending upstream write may wait for
+// more data when CoalesceDelayMs is not set.
+const defaultCoalesceDelay = 5 * time.Millisecond
+
+// coalescingWriter batches small writes to an upstream buf.Writer. Data is
+// copied into full-sized buffers and written once size bytes are pending
+// or delay has passed since the first of them arrived.
+type coalescingWriter struct {
+	writer buf.Writer
+	size   int
+	delay  time.Duration
+
+	// writeMu orders flushes and is taken before mu, so a flush blocked on
+	// a slow upstream does not hold up discard.
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	pending   buf.MultiBuffer
+	timer     *time.Timer
+	err       error // from a timed flush, returned by the next call
+	discarded bool
+}
+
+func newCoalescingWriter(writer buf.Writer, size int, delay time.Duration) *coalescingWriter {
+	return &coalescingWriter{writer: writer, size: size, delay: delay}
+}
+
+// WriteMultiBuffer implements buf.Writer. It takes ownership of mb.
+func (w *coalescingWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	defer buf.ReleaseMulti(mb)
+	w.mu.Lock()
+	if w.err != nil || w.discarded {
+		err := w.err
+		w.mu.Unlock()
+		if err == nil {
+			err = io.ErrClosedPipe
+		}
+		return err
+	}
+	for _, b := range mb {
+		w.pending = buf.MergeBytes(w.pending, b.Bytes())
+	}
+	full := int(w.pending.Len()) >= w.size
+	if !full && w.timer == nil && !w.pending.IsEmpty() {
+		w.timer = time.AfterFunc(w.delay, func() { w.flush() })
+	}
+	w.mu.Unlock()
+	if full {
+		return w.flush()
+	}
+	return nil
+}
+
+// Flush writes whatever is pending.
+func (w *coalescingWriter) Flush() error {
+	return w.flush()
+}
+
+func (w *coalescingWriter) flush() error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	w.mu.Lock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if w.err != nil || w.discarded || w.pending.IsEmpty() {
+		err := w.err
+		w.mu.Unlock()
+		return err
+	}
+	mb := w.pending
+	w.pending = nil
+	w.mu.Unlock()
+
+	if err := w.writer.WriteMultiBuffer(mb); err != nil {
+		w.mu.Lock()
+		w.err = err
+		w.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// discard drops whatever is pending and stops timed flushes. It does not
+// wait for a flush in progress.
+func (w *coalescingWriter) discard() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.discarded = true
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	buf.ReleaseMulti(w.pending)
+	w.pending = nil
+}
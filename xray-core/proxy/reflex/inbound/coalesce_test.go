@@ -0,0 +1,137 @@
+package inbound
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+	"github.com/xtls/xray-core/transport"
+	"github.com/xtls/xray-core/transport/pipe"
+)
+
+// countingWriter counts the writes made to an upstream.
+type countingWriter struct {
+	*pipe.Writer
+	writes *atomic.Int32
+}
+
+func (w *countingWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	w.writes.Add(1)
+	return w.Writer.WriteMultiBuffer(mb)
+}
+
+// countingDispatcher's upstream echoes what it receives and counts the
+// writes it arrives in.
+type countingDispatcher struct {
+	writes atomic.Int32
+}
+
+func (*countingDispatcher) Type() interface{} { return nil }
+func (*countingDispatcher) Start() error      { return nil }
+func (*countingDispatcher) Close() error      { return nil }
+
+func (d *countingDispatcher) Dispatch(ctx context.Context, dest net.Destination) (*transport.Link, error) {
+	upReader, upWriter := pipe.New()
+	downReader, downWriter := pipe.New()
+	go func() {
+		buf.Copy(upReader, downWriter)
+		downWriter.Close()
+	}()
+	return &transport.Link{Reader: downReader, Writer: &countingWriter{Writer: upWriter, writes: &d.writes}}, nil
+}
+
+func (d *countingDispatcher) DispatchLink(ctx context.Context, dest net.Destination, link *transport.Link) error {
+	return errors.New("not implemented")
+}
+
+func TestCoalesceUpstreamWrites(t *testing.T) {
+	const frames, frameSize = 50, 10
+	for _, tc := range []struct {
+		config *reflex.InboundConfig
+		writes int32
+	}{
+		{&reflex.InboundConfig{}, frames},
+		// Nothing is flushed by time: twice at 200 bytes, then the rest
+		// when the client is done sending.
+		{&reflex.InboundConfig{CoalesceBytes: 200, CoalesceDelayMs: 10000}, 3},
+	} {
+		h := newTestHandler(t, tc.config)
+		dispatcher := &countingDispatcher{}
+		conn, done := serve(t, h, dispatcher)
+
+		hs, priv := newTestClientHandshake(t, testUserID)
+		go writeClientHandshakeMagic(conn, hs)
+		reader := bufio.NewReader(conn)
+		sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+		header, err := protocol.EncodeDestination(net.TCPDestination(net.LocalHostIP, 80))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sent []byte
+		go func() {
+			for i := 0; i < frames; i++ {
+				payload := []byte(fmt.Sprintf("frame %03d ", i))[:frameSize]
+				if i == 0 {
+					payload = append(header, payload...)
+				}
+				sess.WriteFrame(conn, protocol.FrameTypeData, payload)
+			}
+			sess.WriteFrame(conn, protocol.FrameTypeCloseWrite, nil)
+		}()
+		for i := 0; i < frames; i++ {
+			sent = append(sent, fmt.Sprintf("frame %03d ", i)[:frameSize]...)
+		}
+
+		var echoed []byte
+		for {
+			frame, err := sess.ReadFrame(reader)
+			if err != nil {
+				t.Fatalf("CoalesceBytes %d: %v", tc.config.CoalesceBytes, err)
+			}
+			if frame.Type == protocol.FrameTypeCloseWrite {
+				break
+			}
+			echoed = append(echoed, frame.Payload...)
+		}
+		if !bytes.Equal(echoed, sent) {
+			t.Errorf("CoalesceBytes %d: echoed %q, want %q", tc.config.CoalesceBytes, echoed, sent)
+		}
+		if got := dispatcher.writes.Load(); got != tc.writes {
+			t.Errorf("CoalesceBytes %d: %d upstream writes, want %d", tc.config.CoalesceBytes, got, tc.writes)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("CoalesceBytes %d: session ended with %v", tc.config.CoalesceBytes, err)
+		}
+	}
+}
+
+func TestCoalesceFlushesAfterDelay(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{CoalesceBytes: 1 << 20, CoalesceDelayMs: 20})
+	dispatcher := &countingDispatcher{}
+	conn, _ := serve(t, h, dispatcher)
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+
+	// Far below CoalesceBytes and the client keeps sending, so only the
+	// delay can release the request.
+	start := time.Now()
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "small")
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("request written after %v, before the 20ms delay", elapsed)
+	}
+	if got := dispatcher.writes.Load(); got != 1 {
+		t.Errorf("%d upstream writes, want 1", got)
+	}
+}
@@ -0,0 +1,46 @@
+package inbound
+
+import (
+	"context"
+
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+)
+
+// parseNoResolve reports whether data starts with protocol.NoResolveMarker
+// and returns the rest of data. The marker is honoured only with
+// AllowConnectByDomain, and makes a difference only with ResolveLocally.
+func parseNoResolve(data []byte) (bool, []byte) {
+	if len(data) > 0 && data[0] == protocol.NoResolveMarker {
+		return true, data[1:]
+	}
+	return false, data
+}
+
+// errUnauthenticated is the cause of the error for a destination that would
+// be parsed before the connection completed authentication.
+var errUnauthenticated = errors.New("destination sent before authentication completed")
+
+// contextWithAuthenticated marks ctx as belonging to a connection whose
+// handshake passed every check. Only processHandshake sets it.
+func contextWithAuthenticated(ctx context.Context) context.Context {
+	return context.WithValue(ctx, authenticatedContextKey, true)
+}
+
+// sessionDestination decodes the destination header at the start of data
+// like protocol.DecodeDestination, as a destination of network, but only
+// on a connection marked authenticated. It is how handlers decode
+// destinations, so nothing an unauthenticated peer sends is ever parsed as
+// a destination, let alone logged.
+func sessionDestination(ctx context.Context, network net.Network, data []byte) (net.Destination, []byte, error) {
+	if authenticated, _ := ctx.Value(authenticatedContextKey).(bool); !authenticated {
+		return net.Destination{}, nil, errUnauthenticated
+	}
+	dest, rest, err := protocol.DecodeDestination(data)
+	if err != nil {
+		return net.Destination{}, nil, errors.New("invalid destination").Base(err)
+	}
+	dest.Network = network
+	return dest, rest, nil
+}
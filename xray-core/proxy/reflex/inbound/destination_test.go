@@ -0,0 +1,91 @@
+package inbound
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	stdnet "net"
+	"testing"
+
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+)
+
+func TestSessionDestinationRequiresAuthentication(t *testing.T) {
+	dest := net.UDPDestination(net.DomainAddress("example.com"), 53)
+	header, err := protocol.EncodeDestination(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sessionDestination(context.Background(), net.Network_UDP, header); errors.Cause(err) != errUnauthenticated {
+		t.Errorf("unauthenticated context: %v, want errUnauthenticated", err)
+	}
+	got, _, err := sessionDestination(contextWithAuthenticated(context.Background()), net.Network_UDP, header)
+	if err != nil || got != dest {
+		t.Errorf("authenticated context: %v, %v, want %v", got, err, dest)
+	}
+}
+
+func TestUnauthenticatedConnectionParsesNoDestination(t *testing.T) {
+	header, err := protocol.EncodeDestination(net.TCPDestination(net.DomainAddress("example.com"), 443))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// In "tls-like" mode the client holds the session key after the server
+	// hello, but authentication is not complete until its finished flight
+	// checks out. A DATA frame right behind a bad one is never parsed.
+	h := newTestHandler(t, &reflex.InboundConfig{
+		HandshakeMode:        HandshakeModeTLSLike,
+		HandshakeFlightGapMs: 10,
+	})
+	dispatcher := newEchoDispatcher()
+	conn, done := serve(t, h, dispatcher)
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	go func() {
+		conn.Write(make([]byte, clientFinishedSize))
+		sess.WriteFrame(conn, protocol.FrameTypeData, append(header, "hello"...))
+	}()
+	go io.Copy(io.Discard, reader)
+	if err := <-done; err == nil {
+		t.Error("a bad finished flight was accepted")
+	}
+	select {
+	case dest := <-dispatcher.dests:
+		t.Errorf("dispatched %v for an unauthenticated connection", dest)
+	default:
+	}
+
+	// A session reached without going through processHandshake refuses
+	// the destination itself.
+	key := make([]byte, 32)
+	client, err := protocol.NewSession(key, protocol.RoleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wire bytes.Buffer
+	if err := client.WriteFrame(&wire, protocol.FrameTypeData, header); err != nil {
+		t.Fatal(err)
+	}
+	server, err := protocol.NewSession(bytes.Clone(key), protocol.RoleServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := stdnet.Pipe()
+	defer clientConn.Close()
+	err = h.handleSession(context.Background(), sessionConn{}, bufio.NewReader(&wire), serverConn, dispatcher, server, h.clients[0])
+	if errors.Cause(err) != errUnauthenticated {
+		t.Errorf("handleSession without authentication: %v, want errUnauthenticated", err)
+	}
+	select {
+	case dest := <-dispatcher.dests:
+		t.Errorf("dispatched %v without authentication", dest)
+	default:
+	}
+}
@@ -0,0 +1,110 @@
+package inbound
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/transport/internet/stat"
+)
+
+// defaultDrainGrace is how long Close lets connections finish when
+// DrainGraceMs is not set.
+const defaultDrainGrace = 5 * time.Second
+
+// drainer tracks the connections being processed so that Close can let
+// them finish and end the ones that do not in time.
+type drainer struct {
+	mu     sync.Mutex
+	conns  map[*drainingConn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type drainingConn struct {
+	conn   stat.Connection
+	cancel context.CancelFunc
+}
+
+// track registers a connection being processed and returns the context to
+// process it with and the function to call when done. It reports false
+// once Close has been called.
+func (d *drainer) track(ctx context.Context, conn stat.Connection) (context.Context, func(), bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return ctx, nil, false
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	c := &drainingConn{conn: conn, cancel: cancel}
+	if d.conns == nil {
+		d.conns = make(map[*drainingConn]struct{})
+	}
+	d.conns[c] = struct{}{}
+	d.wg.Add(1)
+	return ctx, func() {
+		d.mu.Lock()
+		delete(d.conns, c)
+		d.mu.Unlock()
+		cancel()
+		d.wg.Done()
+	}, true
+}
+
+// wait waits up to timeout for every tracked connection to be done,
+// reporting whether they all were.
+func (d *drainer) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// close stops new connections from being tracked, gives the ones in
+// progress grace to finish, then cancels and closes the rest and waits
+// for them.
+func (d *drainer) close(grace time.Duration) {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+	if d.wait(grace) {
+		return
+	}
+
+	d.mu.Lock()
+	remaining := make([]*drainingConn, 0, len(d.conns))
+	for c := range d.conns {
+		remaining = append(remaining, c)
+	}
+	d.mu.Unlock()
+	errors.LogInfo(context.Background(), "reflex inbound closing ", len(remaining), " connections still open after ", grace)
+	for _, c := range remaining {
+		c.cancel()
+		c.conn.Close()
+	}
+	d.wg.Wait()
+}
+
+// Close implements common.Closable. It stops accepting connections and
+// lets the ones in progress finish their current frames, requests and
+// fallback responses for up to DrainGraceMs. Those still open then are
+// closed, and Close returns once every Process call has. The inbound's
+// custom profiles are unregistered last.
+func (h *Handler) Close() error {
+	h.closeOnce.Do(func() {
+		h.drain.close(h.drainGrace)
+		if h.fallbackPool != nil {
+			h.fallbackPool.closeIdle()
+		}
+		unregisterProfiles(h.profiles)
+	})
+	return nil
+}
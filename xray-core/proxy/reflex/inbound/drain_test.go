@@ -0,0 +1,132 @@
+package inbound
+
+import (
+	"bufio"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+)
+
+// waitNoHandlerGoroutines waits for every goroutine running inbound code,
+// other than the test's own, to end.
+func waitNoHandlerGoroutines(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stacks := make([]byte, 1<<20)
+		stacks = stacks[:runtime.Stack(stacks, true)]
+		var left []string
+		// The first stack is the test's.
+		for _, g := range strings.Split(string(stacks), "\n\n")[1:] {
+			if strings.Contains(g, "proxy/reflex/inbound.") && !strings.Contains(g, "testing.tRunner") {
+				left = append(left, g)
+			}
+		}
+		if len(left) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left:\n%s", len(left), strings.Join(left, "\n\n"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCloseEndsConnections(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{DrainGraceMs: 100, MaxConnections: 10})
+
+	// An established session idle between requests, and a connection
+	// that has sent nothing yet.
+	conn, sessionDone := serve(t, h, newEchoDispatcher())
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "hello")
+	_, silentDone := serve(t, h, newEchoDispatcher())
+	waitConnections(t, h, 2)
+
+	start := time.Now()
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close took %v with a 100ms grace", elapsed)
+	}
+	for _, done := range []<-chan error{sessionDone, silentDone} {
+		select {
+		case <-done:
+		default:
+			t.Error("Process still running after Close returned")
+		}
+	}
+	conn.Close()
+	waitNoHandlerGoroutines(t)
+
+	_, done := serve(t, h, newEchoDispatcher())
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("closed inbound processed a new connection")
+		}
+	case <-time.After(time.Second):
+		t.Error("closed inbound is processing a new connection")
+	}
+}
+
+func TestCloseLetsSessionsFinish(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{DrainGraceMs: 5000})
+	conn, done := serve(t, h, newEchoDispatcher())
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "hello")
+
+	closed := make(chan struct{})
+	go func() {
+		h.Close()
+		close(closed)
+	}()
+
+	// The session keeps working within the grace period.
+	time.Sleep(50 * time.Millisecond)
+	if err := sess.WriteFrame(conn, protocol.FrameTypeData, []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := sess.ReadFrame(reader); err != nil || string(frame.Payload) != "again" {
+		t.Fatalf("echo while draining: %v", err)
+	}
+	select {
+	case <-closed:
+		t.Fatal("Close returned while a session was open")
+	default:
+	}
+
+	start := time.Now()
+	if err := sess.WriteFrame(conn, protocol.FrameTypeClose, nil); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		frame, err := sess.ReadFrame(reader)
+		if err != nil || frame.Type == protocol.FrameTypeCloseWrite {
+			break
+		}
+	}
+	if err := <-done; err != nil {
+		t.Errorf("drained session ended with %v", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return once the last session ended")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close returned %v after the last session ended", elapsed)
+	}
+}
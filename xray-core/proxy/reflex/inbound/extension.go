@@ -0,0 +1,63 @@
+package inbound
+
+import (
+	"context"
+
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+)
+
+// cipherSuiteFromExtensions returns the cipher suite the client asked for,
+// ChaCha20-Poly1305 if it did not ask.
+func cipherSuiteFromExtensions(exts map[uint8][]byte) (uint8, error) {
+	value, found := exts[protocol.ExtCipherSuite]
+	if !found {
+		return protocol.CipherSuiteChaCha20Poly1305, nil
+	}
+	if len(value) != 1 {
+		return 0, errors.New("invalid cipher suite extension")
+	}
+	switch value[0] {
+	case protocol.CipherSuiteChaCha20Poly1305, protocol.CipherSuiteXChaCha20Poly1305, protocol.CipherSuiteAES256GCM:
+		return value[0], nil
+	}
+	return 0, errors.New("unsupported cipher suite: ", value[0])
+}
+
+// sealPolicyGrant seals grant as the first frame sess writes, so only the
+// client can read which profile it is served with.
+func sealPolicyGrant(sess *protocol.Session, grant []byte) ([]byte, error) {
+	return sess.EncryptFrame(protocol.FrameTypeData, grant)
+}
+
+// grantedProfileKey returns the key of the profile a user's policy selects,
+// "" if it selects none.
+func grantedProfileKey(policy string) string {
+	if protocol.GetProfileByName(policy) == nil {
+		return ""
+	}
+	return protocol.ProfileKey(policy)
+}
+
+// policyGrant builds the grant announcing the profile a user's policy
+// selects, nil if it selects none.
+func policyGrant(policy string) []byte {
+	key := grantedProfileKey(policy)
+	if key == "" {
+		return nil
+	}
+	return protocol.AppendExtension(nil, protocol.ExtProfile, []byte(key))
+}
+
+// contextWithDownlinkMorphing marks ctx as belonging to a session whose
+// client asked for downlink morphing and was granted a profile.
+func contextWithDownlinkMorphing(ctx context.Context) context.Context {
+	return context.WithValue(ctx, downlinkMorphingContextKey, true)
+}
+
+// morphsDownlink reports whether the frames sent to the client of the
+// session of ctx are morphed, see protocol.ExtMorphDownlink.
+func morphsDownlink(ctx context.Context) bool {
+	morph, _ := ctx.Value(downlinkMorphingContextKey).(bool)
+	return morph
+}
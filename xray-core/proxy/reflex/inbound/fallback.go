@@ -0,0 +1,636 @@
+package inbound
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	goerrors "errors"
+	"io"
+	"math"
+	stdnet "net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/common/net"
+	httpsniff "github.com/xtls/xray-core/common/protocol/http"
+	tlssniff "github.com/xtls/xray-core/common/protocol/tls"
+	"github.com/xtls/xray-core/common/task"
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/transport/internet/stat"
+)
+
+// FallbackConfig is the runtime fallback configuration.
+type FallbackConfig struct {
+	Dest      uint32
+	KeepAlive bool
+	MaxBytes  uint64
+	Rules     []FallbackRule
+
+	// slots holds one token per connection in fallback, or is nil if
+	// their number is not capped.
+	slots chan struct{}
+
+	// tls, if set, is what backends are connected to over TLS with.
+	tls *tls.Config
+}
+
+// newFallbackTLSConfig builds the TLS configuration backends are connected
+// to over for config, nil if they are connected to over plain TCP.
+func newFallbackTLSConfig(config *reflex.Fallback) (*tls.Config, error) {
+	if !config.TLS {
+		if config.ServerName != "" || config.CA != "" || config.AllowInsecure {
+			return nil, errors.New("fallback TLS settings without TLS")
+		}
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.AllowInsecure,
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = "127.0.0.1"
+	}
+	if config.CA != "" {
+		pem, err := os.ReadFile(config.CA)
+		if err != nil {
+			return nil, errors.New("failed to read fallback CA").Base(err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in fallback CA ", config.CA)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// FallbackRule is the runtime form of reflex.FallbackRule, with Name in
+// lower case.
+type FallbackRule struct {
+	Name string
+	Alpn string
+	Path string
+	Dest uint32
+}
+
+func (r *FallbackRule) matches(name, alpn, path string) bool {
+	return (r.Name == "" || r.Name == name) &&
+		(r.Alpn == "" || r.Alpn == alpn) &&
+		(r.Path == "" || strings.HasPrefix(path, r.Path))
+}
+
+// fallbackDest returns the backend port for conn: that of the first rule
+// matching it, or Dest if none does. first is what the connection sent
+// before the fallback decision, and the only data inspected, so a Host
+// header or path is only seen if the first reads delivered it.
+func (h *Handler) fallbackDest(conn stat.Connection, first []byte) uint32 {
+	if len(h.fallback.Rules) == 0 {
+		return h.fallback.Dest
+	}
+	name, alpn := tlsState(conn)
+	if name == "" {
+		name = sniffServerName(first)
+	}
+	name = strings.ToLower(name)
+	path := requestPath(first)
+	for i := range h.fallback.Rules {
+		if rule := &h.fallback.Rules[i]; rule.matches(name, alpn, path) {
+			return rule.Dest
+		}
+	}
+	return h.fallback.Dest
+}
+
+// sniffServerName returns the SNI of a TLS ClientHello or the host of an
+// HTTP Host header at the start of data, or "" if it has neither.
+func sniffServerName(data []byte) string {
+	if hello, err := tlssniff.SniffTLS(data); err == nil {
+		return hello.Domain()
+	}
+	if request, err := httpsniff.SniffHTTP(data, context.Background()); err == nil {
+		return request.Domain()
+	}
+	return ""
+}
+
+// requestPath returns the path of an HTTP request line at the start of
+// data, or "" if data does not start with one.
+func requestPath(data []byte) string {
+	if !looksLikeHTTPRequest(data) {
+		return ""
+	}
+	line, _, _ := bytes.Cut(data, []byte("\r\n"))
+	fields := bytes.Fields(line)
+	if len(fields) < 2 {
+		return ""
+	}
+	return string(fields[1])
+}
+
+// recordingReader sits between the connection and the handshake parser and
+// remembers every byte read from the connection until the handshake is
+// accepted. Whenever a connection is handed to fallback, replay returns a
+// reader that yields those bytes again followed by the rest of the
+// connection, so nothing peeked, buffered or partially parsed is lost.
+type recordingReader struct {
+	reader    io.Reader
+	recorded  bytes.Buffer
+	recording bool
+}
+
+func newRecordingReader(reader io.Reader) *recordingReader {
+	return &recordingReader{reader: reader, recording: true}
+}
+
+func (r *recordingReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	if r.recording {
+		r.recorded.Write(b[:n])
+	}
+	return n, err
+}
+
+// stop ends recording once the handshake no longer needs to be replayed.
+func (r *recordingReader) stop() {
+	r.recording = false
+	r.recorded = bytes.Buffer{}
+}
+
+// replay stops recording and returns everything read so far followed by the
+// unread remainder of the connection.
+func (r *recordingReader) replay() io.Reader {
+	r.recording = false
+	return io.MultiReader(bytes.NewReader(r.recorded.Bytes()), r.reader)
+}
+
+// preloadedConn reads from the replayed stream, so bytes consumed before the
+// fallback decision are delivered before the rest of the connection.
+type preloadedConn struct {
+	Reader io.Reader
+	stat.Connection
+}
+
+func (pc *preloadedConn) Read(b []byte) (int, error) {
+	return pc.Reader.Read(b)
+}
+
+func (pc *preloadedConn) Write(b []byte) (int, error) {
+	return pc.Connection.Write(b)
+}
+
+// handleFallback forwards a non-Reflex connection, including everything
+// already read from it, to the local fallback web server.
+func (h *Handler) handleFallback(ctx context.Context, _ fallbackConn, recorder *recordingReader, conn stat.Connection) error {
+	if h.fallback == nil {
+		if h.decoy != nil {
+			return h.serveDecoy(ctx, recorder.replay(), conn)
+		}
+		return errors.New("not a reflex connection and no fallback configured")
+	}
+
+	if h.fallback.slots != nil {
+		select {
+		case h.fallback.slots <- struct{}{}:
+		default:
+			if h.decoy != nil {
+				return h.serveDecoy(ctx, recorder.replay(), conn)
+			}
+			if !h.waitFallbackSlot(ctx) {
+				errors.LogInfo(ctx, "no fallback connection freed up, connection closed")
+				return nil
+			}
+		}
+		defer func() { <-h.fallback.slots }()
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return errors.New("unable to set read deadline").Base(err).AtWarning()
+	}
+
+	// The backend is picked from the TLS state of the connection itself,
+	// which the budget wrapper below would hide.
+	port := h.fallbackDest(conn, recorder.recorded.Bytes())
+	client := recorder.replay()
+	if h.fallback.MaxBytes > 0 {
+		budget := newFallbackBudget(h.fallback.MaxBytes)
+		client = &budgetReader{Reader: client, budget: budget}
+		conn = &budgetConn{Connection: conn, budget: budget}
+	}
+
+	dest := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))
+	errors.LogInfo(ctx, "fallback to ", dest)
+	if h.fallbackPool != nil {
+		return h.handleFallbackKeepAlive(ctx, client, conn, dest)
+	}
+
+	target, err := h.dialFallback(ctx, dest)
+	if err != nil {
+		return err
+	}
+	return spliceFallback(ctx, &preloadedConn{Reader: client, Connection: conn}, target)
+}
+
+// waitFallbackSlot waits up to the handshake timeout for a connection to
+// leave fallback and takes its slot, reporting whether it got one. Like an
+// overloaded web server, the inbound then only seems slow to answer, and
+// at worst times the client out.
+func (h *Handler) waitFallbackSlot(ctx context.Context) bool {
+	timer := time.NewTimer(h.sessionPolicy(0).Timeouts.Handshake)
+	defer timer.Stop()
+	select {
+	case h.fallback.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+var errFallbackLimit = errors.New("fallback transfer limit reached")
+
+// fallbackBudget is the number of bytes a fallback connection may still
+// carry, shared by both directions.
+type fallbackBudget struct {
+	remaining atomic.Int64
+}
+
+func newFallbackBudget(limit uint64) *fallbackBudget {
+	b := &fallbackBudget{}
+	b.remaining.Store(int64(min(limit, math.MaxInt64)))
+	return b
+}
+
+// reserve takes up to n bytes from the budget and returns how many it got.
+func (b *fallbackBudget) reserve(n int) int {
+	for {
+		remaining := b.remaining.Load()
+		got := min(int64(n), remaining)
+		if got <= 0 || b.remaining.CompareAndSwap(remaining, remaining-got) {
+			return int(max(got, 0))
+		}
+	}
+}
+
+// refund returns bytes reserved but not transferred.
+func (b *fallbackBudget) refund(n int) {
+	b.remaining.Add(int64(n))
+}
+
+// budgetReader reads from the client within the budget. The budget is
+// charged once data has arrived, as a read may wait for a long time;
+// whatever no longer fits is dropped and the read fails.
+type budgetReader struct {
+	io.Reader
+	budget *fallbackBudget
+}
+
+func (r *budgetReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return r.Reader.Read(p)
+	}
+	remaining := r.budget.remaining.Load()
+	if remaining <= 0 {
+		return 0, errFallbackLimit
+	}
+	n, err := r.Reader.Read(p[:min(int64(len(p)), remaining)])
+	if got := r.budget.reserve(n); got < n {
+		return got, errFallbackLimit
+	}
+	return n, err
+}
+
+// budgetConn writes to the client within the budget. Whatever does not fit
+// is dropped and the write fails.
+type budgetConn struct {
+	stat.Connection
+	budget *fallbackBudget
+}
+
+func (c *budgetConn) Write(p []byte) (int, error) {
+	allowed := c.budget.reserve(len(p))
+	n, err := c.Connection.Write(p[:allowed])
+	c.budget.refund(allowed - n)
+	if err == nil && n < len(p) {
+		err = errFallbackLimit
+	}
+	return n, err
+}
+
+func (c *budgetConn) CloseWrite() error {
+	if cw, ok := c.Connection.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// spliceFallback copies between client and target in both directions until
+// both are done, then closes target.
+func spliceFallback(ctx context.Context, client *preloadedConn, target *backendConn) error {
+	defer target.Close()
+
+	request := func() error {
+		defer closeWrite(target.Conn)
+		_, err := io.Copy(target, client)
+		return normalClose(err)
+	}
+	response := func() error {
+		defer closeWrite(client.Connection)
+		_, err := io.Copy(client, target.reader)
+		return normalClose(err)
+	}
+	if err := task.Run(ctx, request, response); err != nil {
+		return errors.New("fallback connection ends").Base(err)
+	}
+	return nil
+}
+
+func (h *Handler) dialFallback(ctx context.Context, dest string) (*backendConn, error) {
+	var dialer net.Dialer
+	target, err := dialer.DialContext(ctx, "tcp", dest)
+	if err != nil {
+		return nil, errors.New("failed to dial fallback ", dest).Base(err).AtWarning()
+	}
+	if err := setSocketBuffers(target, h.socketBuffer); err != nil {
+		errors.LogWarningInner(ctx, err, "failed to set fallback socket buffers")
+	}
+	if h.fallback.tls != nil {
+		tlsConn := tls.Client(target, h.fallback.tls)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			target.Close()
+			return nil, errors.New("TLS handshake with fallback ", dest, " failed").Base(err).AtWarning()
+		}
+		target = tlsConn
+	}
+	return &backendConn{Conn: target, reader: bufio.NewReader(target)}, nil
+}
+
+// Idle backend connections are kept for at most fallbackIdleTimeout, and
+// at most maxIdleFallbackConns of them per backend.
+const (
+	fallbackIdleTimeout  = 30 * time.Second
+	maxIdleFallbackConns = 8
+)
+
+// backendConn is a connection to the fallback backend together with the
+// reader its responses are parsed from, which must survive between
+// requests when the connection is reused.
+type backendConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	idleSince time.Time
+}
+
+// fallbackPool keeps idle keep-alive connections to fallback backends for
+// reuse by later probes, keyed by fallbackPoolKey, so a connection is only
+// reused for the client address it was opened for.
+type fallbackPool struct {
+	mu   sync.Mutex
+	idle map[string][]*backendConn
+}
+
+// fallbackPoolKey returns the key the backend connections dest serves to
+// conn are pooled under: dest and the client's IP. It returns "" if the
+// client's address is unknown, and such connections are not pooled, as
+// they cannot be told apart from any other client's.
+func fallbackPoolKey(dest string, conn net.Conn) string {
+	switch addr := remoteAddr(conn).(type) {
+	case unknownAddr:
+		return ""
+	case *net.TCPAddr:
+		return dest + " " + addr.IP.String()
+	default:
+		return dest + " " + addr.String()
+	}
+}
+
+// get returns the most recently used idle connection under key, or nil.
+func (p *fallbackPool) get(key string) *backendConn {
+	if key == "" {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.idle[key]
+	for len(conns) > 0 {
+		c := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if time.Since(c.idleSince) < fallbackIdleTimeout {
+			p.idle[key] = conns
+			return c
+		}
+		c.Close()
+	}
+	delete(p.idle, key)
+	return nil
+}
+
+// put makes c available for reuse under key, or closes it if key is ""
+// or the pool is full.
+func (p *fallbackPool) put(key string, c *backendConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key == "" || len(p.idle[key]) >= maxIdleFallbackConns {
+		c.Close()
+		return
+	}
+	if p.idle == nil {
+		p.idle = make(map[string][]*backendConn)
+	}
+	c.idleSince = time.Now()
+	p.idle[key] = append(p.idle[key], c)
+}
+
+// closeIdle closes every idle connection.
+func (p *fallbackPool) closeIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conns := range p.idle {
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+	p.idle = nil
+}
+
+// handleFallbackKeepAlive forwards HTTP/1.x requests one at a time over a
+// pooled backend connection, which goes back to the pool once the probe is
+// done with it, for later probes from the same address. Anything that is
+// not plain HTTP/1.x, and any request that takes the connection over, is
+// spliced as without keep-alive.
+func (h *Handler) handleFallbackKeepAlive(ctx context.Context, reader io.Reader, conn stat.Connection, dest string) error {
+	key := fallbackPoolKey(dest, conn)
+	recorder := newRecordingReader(reader)
+	client := bufio.NewReader(recorder)
+	var req *http.Request
+	peeked, err := client.Peek(1)
+	if err == nil && looksLikeHTTPRequest(peeked[:client.Buffered()]) {
+		req, err = http.ReadRequest(client)
+	} else if err == nil {
+		err = errors.New("not an HTTP request")
+	}
+	if err != nil {
+		target, err := h.dialFallback(ctx, dest)
+		if err != nil {
+			return err
+		}
+		return spliceFallback(ctx, &preloadedConn{Reader: recorder.replay(), Connection: conn}, target)
+	}
+	recorder.stop()
+
+	for {
+		if req.Method == http.MethodConnect || req.Header.Get("Upgrade") != "" || req.Header.Get("Expect") != "" {
+			target, err := h.dialFallback(ctx, dest)
+			if err != nil {
+				return err
+			}
+			if err := req.Write(target); err != nil {
+				target.Close()
+				return errors.New("failed to forward request to fallback").Base(err)
+			}
+			return spliceFallback(ctx, &preloadedConn{Reader: client, Connection: conn}, target)
+		}
+
+		// Whether the client wants to close is its own business: the
+		// backend is always asked to keep the connection open.
+		clientClose := req.Close
+		req.Close = false
+		req.Header.Del("Connection")
+
+		target, resp, err := h.fallbackRoundTrip(ctx, dest, key, req)
+		if err != nil {
+			return err
+		}
+		reusable := !resp.Close
+		resp.Close = resp.Close || clientClose
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil || !reusable {
+			target.Close()
+		} else {
+			h.fallbackPool.put(key, target)
+		}
+		if err != nil {
+			return errors.New("failed to write fallback response").Base(err)
+		}
+		if resp.Close {
+			return nil
+		}
+
+		req, err = http.ReadRequest(client)
+		if err != nil {
+			return normalClose(err)
+		}
+	}
+}
+
+// looksLikeHTTPRequest reports whether data starts with a method token and
+// a space. It only looks at what has already arrived, so a probe that never
+// sends a line end does not stall waiting for a request line.
+func looksLikeHTTPRequest(data []byte) bool {
+	for i, c := range data {
+		switch {
+		case c == ' ':
+			return i > 0
+		case c < 'A' || c > 'Z' || i >= 16:
+			return false
+		}
+	}
+	return false
+}
+
+// fallbackRoundTrip sends req to the backend at dest, on a connection
+// pooled under key if there is one, and reads the final response.
+// Informational responses are dropped, as requests that expect one are
+// spliced instead. A request without a body is retried once on a fresh
+// connection if a pooled one turns out to have been closed by the backend.
+func (h *Handler) fallbackRoundTrip(ctx context.Context, dest, key string, req *http.Request) (*backendConn, *http.Response, error) {
+	for {
+		target := h.fallbackPool.get(key)
+		pooled := target != nil
+		if !pooled {
+			var err error
+			if target, err = h.dialFallback(ctx, dest); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		err := req.Write(target)
+		var resp *http.Response
+		if err == nil {
+			resp, err = http.ReadResponse(target.reader, req)
+			for err == nil && resp.StatusCode < http.StatusOK {
+				resp, err = http.ReadResponse(target.reader, req)
+			}
+		}
+		if err != nil {
+			target.Close()
+			if pooled && req.Body == http.NoBody {
+				continue
+			}
+			return nil, nil, errors.New("fallback request failed").Base(err)
+		}
+		return target, resp, nil
+	}
+}
+
+// normalClose maps the errors a copy sees when either side simply closes
+// its connection to nil, so only genuine failures are reported.
+func normalClose(err error) error {
+	if err == nil || err == io.EOF || err == io.ErrClosedPipe || goerrors.Is(err, stdnet.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// closeWrite half-closes conn if it supports it.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+// maxDecoyDrain bounds how much of a probe's request body is read before
+// the decoy is sent.
+const maxDecoyDrain = 64 << 10
+
+// formatDecoy renders the decoy as a complete HTTP response.
+func formatDecoy(d *reflex.Decoy) []byte {
+	status := int(d.Status)
+	if status == 0 {
+		status = http.StatusOK
+	}
+	contentType := d.ContentType
+	if contentType == "" {
+		contentType = "text/html"
+	}
+	var b bytes.Buffer
+	b.WriteString("HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\n")
+	b.WriteString("Content-Type: " + contentType + "\r\n")
+	b.WriteString("Content-Length: " + strconv.Itoa(len(d.Body)) + "\r\n")
+	b.WriteString("Connection: close\r\n\r\n")
+	b.WriteString(d.Body)
+	return b.Bytes()
+}
+
+// serveDecoy answers a connection that is not Reflex with the decoy. The
+// probe's request is read first, where it is one, so closing with unread
+// data does not reset the connection before the decoy arrives.
+func (h *Handler) serveDecoy(ctx context.Context, reader io.Reader, conn stat.Connection) error {
+	if req, err := http.ReadRequest(bufio.NewReader(reader)); err == nil {
+		io.Copy(io.Discard, io.LimitReader(req.Body, maxDecoyDrain))
+		req.Body.Close()
+	}
+	errors.LogInfo(ctx, "not a reflex connection, serving decoy")
+	if _, err := conn.Write(h.decoy); err != nil {
+		return errors.New("failed to write decoy").Base(err)
+	}
+	return nil
+}
@@ -0,0 +1,648 @@
+package inbound
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	gotls "crypto/tls"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	stdnet "net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/features/policy"
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+)
+
+// startFallbackServer accepts one connection, records the first n bytes it
+// receives, answers with reply and closes.
+func startFallbackServer(t *testing.T, n int, reply string) (uint32, <-chan string) {
+	t.Helper()
+	ln, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		got := make([]byte, n)
+		n, _ := io.ReadFull(conn, got)
+		received <- string(got[:n])
+		conn.Write([]byte(reply))
+	}()
+	return uint32(ln.Addr().(*stdnet.TCPAddr).Port), received
+}
+
+// fallbackRoundTrip sends request through h and checks that the fallback
+// received it unchanged and that its reply made it back.
+func fallbackRoundTrip(t *testing.T, request string) {
+	t.Helper()
+	port, received := startFallbackServer(t, len(request), "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	h := newTestHandler(t, &reflex.InboundConfig{Fallback: &reflex.Fallback{Dest: port}})
+	conn, done := serve(t, h, newEchoDispatcher())
+
+	go conn.Write([]byte(request))
+	select {
+	case got := <-received:
+		if got != request {
+			t.Errorf("fallback received %q, want %q", got, request)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fallback received nothing")
+	}
+	reply := make([]byte, 64)
+	n, _ := io.ReadAtLeast(conn, reply, len("HTTP/1.1 200 OK"))
+	if !strings.HasPrefix(string(reply[:n]), "HTTP/1.1 200 OK") {
+		t.Errorf("unexpected fallback reply %q", reply[:n])
+	}
+	conn.Close()
+	if err := <-done; err != nil {
+		t.Errorf("fallback did not end cleanly: %v", err)
+	}
+}
+
+func TestFallbackNonReflex(t *testing.T) {
+	fallbackRoundTrip(t, "GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n")
+}
+
+func TestFallbackAfterPartialMagicRead(t *testing.T) {
+	// A magic prefix followed by a handshake whose policy length is out of
+	// range: the parser has consumed the fixed part before it gives up.
+	request, err := protocol.AppendClientHandshake(nil, protocol.ReflexMagic, &protocol.ClientHandshake{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The policy length closes the fixed part.
+	binary.BigEndian.PutUint16(request[len(request)-2:], 0xffff)
+	fallbackRoundTrip(t, string(append(request, make([]byte, 16)...)))
+}
+
+func TestFallbackAfterMalformedHTTPPost(t *testing.T) {
+	fallbackRoundTrip(t, "POST /login HTTP/1.1\r\nHost: example.com\r\nContent-Length: 9\r\n\r\nuser=test")
+}
+
+func TestFallbackHTTPHandshakeDisabled(t *testing.T) {
+	hs, _ := newTestClientHandshake(t, testUserID)
+	var request strings.Builder
+	if err := writeClientHandshakeHTTP(&request, hs, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	port, received := startFallbackServer(t, request.Len(), "HTTP/1.1 404 Not Found\r\n\r\n")
+	h := newTestHandler(t, &reflex.InboundConfig{
+		Fallback:             &reflex.Fallback{Dest: port},
+		DisableHTTPHandshake: true,
+	})
+	conn, _ := serve(t, h, newEchoDispatcher())
+
+	go conn.Write([]byte(request.String()))
+	select {
+	case got := <-received:
+		if got != request.String() {
+			t.Errorf("fallback received %q, want the POST handshake", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("POST handshake was not sent to fallback")
+	}
+	reply, _ := bufio.NewReader(conn).ReadString('\n')
+	if !strings.HasPrefix(reply, "HTTP/1.1 404") {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func TestFallbackKeepAliveReusesConnection(t *testing.T) {
+	ln, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accepted atomic.Int32
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "page "+r.URL.Path)
+		}),
+		ConnState: func(_ stdnet.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				accepted.Add(1)
+			}
+		},
+	}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+
+	h := newTestHandler(t, &reflex.InboundConfig{Fallback: &reflex.Fallback{
+		Dest:      uint32(ln.Addr().(*stdnet.TCPAddr).Port),
+		KeepAlive: true,
+	}})
+	for _, path := range []string{"/a", "/b"} {
+		conn, done := serve(t, h, newEchoDispatcher())
+		go conn.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "page "+path {
+			t.Errorf("probe for %s got %q", path, body)
+		}
+		conn.Close()
+		if err := <-done; err != nil {
+			t.Errorf("fallback did not end cleanly: %v", err)
+		}
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("backend accepted %d connections, want 1", n)
+	}
+}
+
+func TestFallbackKeepAlivePerClient(t *testing.T) {
+	ln, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accepted atomic.Int32
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		ConnState: func(_ stdnet.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				accepted.Add(1)
+			}
+		},
+	}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+
+	h := newTestHandler(t, &reflex.InboundConfig{Fallback: &reflex.Fallback{
+		Dest:      uint32(ln.Addr().(*stdnet.TCPAddr).Port),
+		KeepAlive: true,
+	}})
+	// A backend connection is reused for another port of the same IP,
+	// never for another IP, and not at all without an address.
+	for _, tc := range []struct {
+		conn func(stdnet.Conn) stdnet.Conn
+		want int32
+	}{
+		{func(c stdnet.Conn) stdnet.Conn { return &tcpAddrConn{c, "192.0.2.1:1000"} }, 1},
+		{func(c stdnet.Conn) stdnet.Conn { return &tcpAddrConn{c, "192.0.2.1:2000"} }, 1},
+		{func(c stdnet.Conn) stdnet.Conn { return &tcpAddrConn{c, "192.0.2.2:1000"} }, 2},
+		{func(c stdnet.Conn) stdnet.Conn { return noAddrConn{c} }, 3},
+		{func(c stdnet.Conn) stdnet.Conn { return noAddrConn{c} }, 4},
+	} {
+		client, conn := stdnet.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			done <- h.Process(context.Background(), net.Network_TCP, tc.conn(conn), newEchoDispatcher())
+			conn.Close()
+		}()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		go client.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		if _, err := http.ReadResponse(bufio.NewReader(client), nil); err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+		if err := <-done; err != nil {
+			t.Errorf("fallback did not end cleanly: %v", err)
+		}
+		if n := accepted.Load(); n != tc.want {
+			t.Errorf("from %v: backend accepted %d connections, want %d", tc.conn(client).RemoteAddr(), n, tc.want)
+		}
+	}
+}
+
+// tcpAddrConn reports addr as its remote TCP address.
+type tcpAddrConn struct {
+	stdnet.Conn
+	addr string
+}
+
+func (c *tcpAddrConn) RemoteAddr() stdnet.Addr {
+	return stdnet.TCPAddrFromAddrPort(netip.MustParseAddrPort(c.addr))
+}
+
+func TestFallbackKeepAliveNonHTTP(t *testing.T) {
+	request := "\x16\x03\x01 not http at all"
+	port, received := startFallbackServer(t, len(request), "bye")
+	h := newTestHandler(t, &reflex.InboundConfig{Fallback: &reflex.Fallback{Dest: port, KeepAlive: true}})
+	conn, _ := serve(t, h, newEchoDispatcher())
+
+	go conn.Write([]byte(request))
+	select {
+	case got := <-received:
+		if got != request {
+			t.Errorf("fallback received %q, want %q", got, request)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fallback received nothing")
+	}
+	reply := make([]byte, len("bye"))
+	io.ReadFull(conn, reply)
+	if string(reply) != "bye" {
+		t.Errorf("unexpected fallback reply %q", reply)
+	}
+}
+
+func TestFallbackMaxBytes(t *testing.T) {
+	const limit = 16 << 10
+	request := "GET /large HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	port, _ := startFallbackServer(t, len(request), strings.Repeat("x", 1<<20))
+	h := newTestHandler(t, &reflex.InboundConfig{Fallback: &reflex.Fallback{Dest: port, MaxBytes: limit}})
+	conn, done := serve(t, h, newEchoDispatcher())
+
+	go conn.Write([]byte(request))
+	got, _ := io.Copy(io.Discard, conn)
+	if got+int64(len(request)) > limit {
+		t.Errorf("fallback carried %d bytes, limit %d", got+int64(len(request)), limit)
+	}
+	if got == 0 {
+		t.Error("nothing was forwarded within the limit")
+	}
+	if err := <-done; err == nil {
+		t.Error("expected the fallback to end with an error at the limit")
+	}
+}
+
+func TestFallbackMaxConns(t *testing.T) {
+	ln, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var active, peak atomic.Int32
+	accepted := make(chan struct{}, 8)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			n := active.Add(1)
+			for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+			}
+			accepted <- struct{}{}
+			go func() {
+				io.Copy(io.Discard, conn)
+				active.Add(-1)
+				conn.Close()
+			}()
+		}
+	}()
+
+	const limit = 2
+	h := newTestHandler(t, &reflex.InboundConfig{Fallback: &reflex.Fallback{
+		Dest:     uint32(ln.Addr().(*stdnet.TCPAddr).Port),
+		MaxConns: limit,
+	}})
+	h.policyManager = testPolicy(func(_ uint32, s *policy.Session) {
+		s.Timeouts.Handshake = time.Second
+	})
+	request := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	probe := func() (stdnet.Conn, <-chan error) {
+		conn, done := serve(t, h, newEchoDispatcher())
+		go conn.Write(request)
+		return conn, done
+	}
+	waitAccepted := func() {
+		t.Helper()
+		select {
+		case <-accepted:
+		case <-time.After(5 * time.Second):
+			t.Fatal("backend was not dialed")
+		}
+	}
+
+	var held []stdnet.Conn
+	var heldDone []<-chan error
+	for i := 0; i < limit; i++ {
+		conn, done := probe()
+		waitAccepted()
+		held = append(held, conn)
+		heldDone = append(heldDone, done)
+	}
+	// A connection beyond the limit waits for a slot rather than being
+	// turned away, and is served once a connection leaves fallback.
+	probe()
+	select {
+	case <-accepted:
+		t.Fatal("fallback connection beyond the limit was served")
+	case <-time.After(100 * time.Millisecond):
+	}
+	held[0].Close()
+	<-heldDone[0]
+	waitAccepted()
+	if got := peak.Load(); got > limit {
+		t.Errorf("backend saw %d concurrent connections, limit %d", got, limit)
+	}
+
+	// One that no slot frees up for within the handshake timeout is
+	// closed without an error or a word, and the backend is never dialed.
+	conn, done := probe()
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read %d bytes, %v from a connection beyond the limit, want EOF", n, err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("connection beyond the limit failed: %v", err)
+	}
+	select {
+	case <-accepted:
+		t.Error("backend dialed for a connection beyond the limit")
+	default:
+	}
+}
+
+func TestFallbackNotConfigured(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	conn, done := serve(t, h, newEchoDispatcher())
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	if err := <-done; err == nil {
+		t.Error("expected an error without a fallback")
+	}
+}
+
+func TestDecoyWithoutFallback(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{
+		Decoy: &reflex.Decoy{Body: "<html><body>Welcome</body></html>"},
+	})
+
+	conn, done := serve(t, h, newEchoDispatcher())
+	go conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "<html><body>Welcome</body></html>" {
+		t.Errorf("probe got %s %q, want the decoy", resp.Status, body)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("serving the decoy failed: %v", err)
+	}
+
+	// A failed handshake gets the same page instead of a 403.
+	conn, _ = serve(t, h, newEchoDispatcher())
+	hs, _ := newTestClientHandshake(t, "00000000-0000-0000-0000-000000000001")
+	go writeClientHandshakeMagic(conn, hs)
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	if line != "HTTP/1.1 200 OK\r\n" {
+		t.Errorf("failed handshake answered with %q, want the decoy", line)
+	}
+}
+
+func TestNormalClose(t *testing.T) {
+	for _, err := range []error{nil, io.EOF, io.ErrClosedPipe, stdnet.ErrClosed, &stdnet.OpError{Op: "read", Err: stdnet.ErrClosed}} {
+		if got := normalClose(err); got != nil {
+			t.Errorf("normalClose(%v) = %v, want nil", err, got)
+		}
+	}
+	if normalClose(io.ErrUnexpectedEOF) == nil {
+		t.Error("a genuine error was swallowed")
+	}
+}
+
+// fallbackTarget serves a connection with a default fallback and a second
+// backend picked by rule, lets send write to it, and reports whether the
+// rule's backend got the connection.
+func fallbackTarget(t *testing.T, rule reflex.FallbackRule, send func(conn stdnet.Conn)) bool {
+	t.Helper()
+	defaultPort, toDefault := startFallbackServer(t, 1, "")
+	rulePort, toRule := startFallbackServer(t, 1, "")
+	rule.Dest = rulePort
+	h := newTestHandler(t, &reflex.InboundConfig{
+		Fallback: &reflex.Fallback{Dest: defaultPort, Rules: []*reflex.FallbackRule{&rule}},
+	})
+	conn, _ := serve(t, h, newEchoDispatcher())
+
+	go send(conn)
+	select {
+	case <-toRule:
+		return true
+	case <-toDefault:
+		return false
+	case <-time.After(5 * time.Second):
+		t.Fatal("no fallback backend received the connection")
+		return false
+	}
+}
+
+func TestFallbackRuleSNI(t *testing.T) {
+	clientHello := func(serverName string) func(stdnet.Conn) {
+		return func(conn stdnet.Conn) {
+			gotls.Client(conn, &gotls.Config{ServerName: serverName}).Handshake()
+		}
+	}
+	rule := reflex.FallbackRule{Name: "Admin.Example.com"}
+	if !fallbackTarget(t, rule, clientHello("admin.example.com")) {
+		t.Error("ClientHello with the rule's SNI went to the default backend")
+	}
+	if fallbackTarget(t, rule, clientHello("www.example.com")) {
+		t.Error("ClientHello with another SNI went to the rule's backend")
+	}
+}
+
+func TestFallbackRuleHostAndPath(t *testing.T) {
+	request := func(path, host string) func(stdnet.Conn) {
+		return func(conn stdnet.Conn) {
+			conn.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+		}
+	}
+	rule := reflex.FallbackRule{Name: "api.example.com", Path: "/v1/"}
+	if !fallbackTarget(t, rule, request("/v1/users", "api.example.com:8080")) {
+		t.Error("request matching the rule's host and path went to the default backend")
+	}
+	if fallbackTarget(t, rule, request("/v1/users", "www.example.com")) {
+		t.Error("request for another host went to the rule's backend")
+	}
+	if fallbackTarget(t, rule, request("/index.html", "api.example.com")) {
+		t.Error("request for another path went to the rule's backend")
+	}
+}
+
+func TestFallbackRuleDefault(t *testing.T) {
+	rule := reflex.FallbackRule{Alpn: "h2"}
+	if fallbackTarget(t, rule, func(conn stdnet.Conn) { conn.Write([]byte("SSH-2.0-OpenSSH_9.6\r\n")) }) {
+		t.Error("connection without TLS matched an ALPN rule")
+	}
+}
+
+func TestNewRejectsFallbackRuleWithoutDest(t *testing.T) {
+	_, err := New(context.Background(), &reflex.InboundConfig{
+		Fallback: &reflex.Fallback{Dest: 80, Rules: []*reflex.FallbackRule{{Name: "example.com"}}},
+	})
+	if err == nil {
+		t.Error("expected an error for a fallback rule without dest")
+	}
+}
+
+// startTLSFallbackServer starts an HTTPS backend on 127.0.0.1, with a
+// certificate for example.com and 127.0.0.1, that answers every request
+// with its path and the SNI it was reached with. It returns the backend's
+// port and the file holding its certificate as a PEM CA.
+func startTLSFallbackServer(t *testing.T) (uint32, string) {
+	t.Helper()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		fmt.Fprintf(w, "%s via %s", r.URL.Path, r.TLS.ServerName)
+	}))
+	t.Cleanup(server.Close)
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(ca, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return uint32(server.Listener.Addr().(*stdnet.TCPAddr).Port), ca
+}
+
+func TestFallbackTLS(t *testing.T) {
+	port, ca := startTLSFallbackServer(t)
+	for _, tc := range []struct {
+		name     string
+		fallback reflex.Fallback
+		want     string // "" for no response
+	}{
+		{"server name", reflex.Fallback{TLS: true, ServerName: "example.com", CA: ca}, "/probe via example.com"},
+		{"default server name", reflex.Fallback{TLS: true, CA: ca}, "/probe via "},
+		{"unverified", reflex.Fallback{TLS: true, ServerName: "example.com"}, ""},
+		{"insecure", reflex.Fallback{TLS: true, ServerName: "example.com", AllowInsecure: true}, "/probe via example.com"},
+	} {
+		tc.fallback.Dest = port
+		h := newTestHandler(t, &reflex.InboundConfig{Fallback: &tc.fallback})
+		conn, done := serve(t, h, newEchoDispatcher())
+		go conn.Write([]byte("GET /probe HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s: got %s from a backend that failed verification", tc.name, resp.Status)
+			}
+			if err := <-done; err == nil {
+				t.Errorf("%s: fallback to an unverified backend succeeded", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != tc.want {
+			t.Errorf("%s: backend answered %q, want %q", tc.name, body, tc.want)
+		}
+		conn.Close()
+		<-done
+	}
+}
+
+func TestFallbackTLSSettingsWithoutTLS(t *testing.T) {
+	_, err := New(context.Background(), &reflex.InboundConfig{
+		Clients:  []*reflex.User{{Id: testUserID}},
+		Fallback: &reflex.Fallback{Dest: 8080, ServerName: "example.com"},
+	})
+	if err == nil {
+		t.Error("expected an error for fallback TLS settings without TLS")
+	}
+	_, err = New(context.Background(), &reflex.InboundConfig{
+		Clients:  []*reflex.User{{Id: testUserID}},
+		Fallback: &reflex.Fallback{Dest: 8080, TLS: true, CA: filepath.Join(t.TempDir(), "missing.pem")},
+	})
+	if err == nil {
+		t.Error("expected an error for a missing fallback CA")
+	}
+}
+
+func TestTimeGatedMagic(t *testing.T) {
+	secret := []byte("magic secret")
+	newHandler := func(port uint32) *Handler {
+		return newTestHandler(t, &reflex.InboundConfig{
+			Fallback:       &reflex.Fallback{Dest: port},
+			GreaseMaxBytes: 4,
+			MagicSecret:    string(secret),
+			HTTPUpgrade:    "reflex",
+		})
+	}
+	// hello returns hs opening with magic in the given handshake variant.
+	hello := func(variant string, magic uint32, hs *protocol.ClientHandshake) []byte {
+		var packet bytes.Buffer
+		var err error
+		if variant == "http2" {
+			err = writeClientHandshakeHTTP2(&packet, magic, hs)
+		} else {
+			err = writeClientHandshakeWithMagic(&packet, magic, hs)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch variant {
+		case "post":
+			return protocol.AppendHTTPData(nil, packet.Bytes(), "example.com")
+		case "upgrade":
+			return protocol.AppendHTTPUpgradeHandshake(nil, packet.Bytes(), "example.com", "reflex")
+		}
+		return packet.Bytes()
+	}
+
+	// The magic of the current bucket opens a session, with grease too,
+	// and leads the handshake of the HTTP hellos.
+	for _, variant := range []string{"magic", "grease", "post", "upgrade"} {
+		conn, _ := serve(t, newHandler(1), newEchoDispatcher())
+		hs, priv := newTestClientHandshake(t, testUserID)
+		request := hello(variant, protocol.TimeGatedMagic(secret, time.Now()), hs)
+		if variant == "grease" {
+			request = append(protocol.AppendGrease(nil, 4), request...)
+		}
+		go conn.Write(request)
+		reader := bufio.NewReader(conn)
+		sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+		echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "hello "+variant)
+	}
+
+	// A first flight recorded buckets ago, or with the fixed magic, is not
+	// recognized in any variant and goes to fallback as it is. Neither is
+	// an HTTP hello that carries the handshake alone.
+	for _, variant := range []string{"magic", "http2", "post", "upgrade"} {
+		for name, magic := range map[string]uint32{
+			"stale": protocol.TimeGatedMagic(secret, time.Now().Add(-3*protocol.MagicBucket)),
+			"fixed": protocol.ReflexMagic,
+		} {
+			hs, _ := newTestClientHandshake(t, testUserID)
+			checkFallsBack(t, newHandler, variant+" "+name, hello(variant, magic, hs))
+		}
+	}
+	hs, _ := newTestClientHandshake(t, testUserID)
+	raw, err := hs.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFallsBack(t, newHandler, "post without magic", protocol.AppendHTTPData(nil, raw, "example.com"))
+	checkFallsBack(t, newHandler, "upgrade without magic", protocol.AppendHTTPUpgradeHandshake(nil, raw, "example.com", "reflex"))
+}
+
+// checkFallsBack sends request to a handler from newHandler and checks
+// that all of it reaches the fallback.
+func checkFallsBack(t *testing.T, newHandler func(port uint32) *Handler, name string, request []byte) {
+	t.Helper()
+	port, received := startFallbackServer(t, len(request), "HTTP/1.1 404 Not Found\r\n\r\n")
+	conn, _ := serve(t, newHandler(port), newEchoDispatcher())
+	defer conn.Close()
+	go conn.Write(request)
+	select {
+	case got := <-received:
+		if got != string(request) {
+			t.Errorf("%s: fallback received %q, want the handshake", name, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: handshake was not sent to fallback", name)
+	}
+}
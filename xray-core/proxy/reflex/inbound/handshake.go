@@ -0,0 +1,129 @@
+package inbound
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+)
+
+const (
+	// ReflexMinHandshakeSize is the number of bytes Process peeks at most
+	// before deciding between Reflex and fallback.
+	ReflexMinHandshakeSize = 64
+
+	// handshakeTimestampWindow is the accepted clock skew, in seconds.
+	handshakeTimestampWindow = 300
+
+	// clientFinishedSize is the size of the client finished flight in
+	// "tls-like" handshake mode.
+	clientFinishedSize = sha256.Size
+)
+
+// computeClientFinished returns the client finished message of a "tls-like"
+// handshake: an HMAC over both ephemeral public keys under the session key.
+func computeClientFinished(sessionKey []byte, clientPublicKey, serverPublicKey [32]byte) []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("reflex client finished"))
+	mac.Write(clientPublicKey[:])
+	mac.Write(serverPublicKey[:])
+	return mac.Sum(nil)
+}
+
+func verifyClientFinished(sessionKey []byte, clientPublicKey, serverPublicKey [32]byte, finished []byte) bool {
+	return hmac.Equal(finished, computeClientFinished(sessionKey, clientPublicKey, serverPublicKey))
+}
+
+// upgradeProtocol returns the protocol an HTTP/1.1 request asks to upgrade
+// to: its Upgrade header, if its Connection header lists "upgrade".
+func upgradeProtocol(header http.Header) string {
+	for _, value := range header.Values("Connection") {
+		for _, option := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(option), "upgrade") {
+				return strings.TrimSpace(header.Get("Upgrade"))
+			}
+		}
+	}
+	return ""
+}
+
+// readClientHandshakeUpgrade parses the client handshake carried by an
+// HTTP upgrade request, see protocol.AppendHTTPUpgradeHandshake.
+func (h *Handler) readClientHandshakeUpgrade(req *http.Request) (protocol.ClientHandshake, error) {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return protocol.ClientHandshake{}, errors.New("no handshake in upgrade request")
+	}
+	raw, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return protocol.ClientHandshake{}, errors.New("failed to decode handshake data").Base(err)
+	}
+	return h.readClientHandshakeData(raw)
+}
+
+// readClientHandshakeHTTP parses an HTTP POST-like client handshake whose
+// JSON body carries the base64-encoded handshake.
+func (h *Handler) readClientHandshakeHTTP(reader *bufio.Reader) (protocol.ClientHandshake, error) {
+	raw, err := protocol.ReadHTTPData(reader)
+	if err != nil {
+		return protocol.ClientHandshake{}, err
+	}
+	return h.readClientHandshakeData(raw)
+}
+
+// readClientHandshakeData parses the client handshake an HTTP hello
+// carries. Without a MagicSecret that is the handshake alone; with one it
+// opens with the time-gated magic and version like a magic-mode hello, so
+// a recorded HTTP hello goes stale as fast as a magic one.
+func (h *Handler) readClientHandshakeData(raw []byte) (protocol.ClientHandshake, error) {
+	if h.magicSecret == nil {
+		return protocol.ReadClientHandshake(bytes.NewReader(raw))
+	}
+	if !h.isReflexMagic(raw) {
+		return protocol.ClientHandshake{}, errors.New("HTTP handshake without the time-gated magic")
+	}
+	return protocol.ReadVersionedClientHandshake(bytes.NewReader(raw[4:]))
+}
+
+// readClientFinished reads the client finished flight of a "tls-like"
+// handshake. After an HTTP POST-like hello it arrives as a second POST so
+// the exchange keeps its HTTP shape; after a magic hello it is sent raw.
+func readClientFinished(reader *bufio.Reader, overHTTP bool) ([]byte, error) {
+	if overHTTP {
+		finished, err := protocol.ReadHTTPData(reader)
+		if err != nil {
+			return nil, err
+		}
+		if len(finished) != clientFinishedSize {
+			return nil, errors.New("invalid client finished length: ", len(finished))
+		}
+		return finished, nil
+	}
+	finished := make([]byte, clientFinishedSize)
+	if _, err := io.ReadFull(reader, finished); err != nil {
+		return nil, errors.New("failed to read client finished").Base(err)
+	}
+	return finished, nil
+}
+
+// formatHTTPError renders a plain HTTP error response, used on every
+// handshake failure so that failures look like an ordinary web server.
+func formatHTTPError(status int) []byte {
+	text := http.StatusText(status)
+	body := "<html><head><title>" + strconv.Itoa(status) + " " + text + "</title></head><body><h1>" + text + "</h1></body></html>\n"
+	var b bytes.Buffer
+	b.WriteString("HTTP/1.1 " + strconv.Itoa(status) + " " + text + "\r\n")
+	b.WriteString("Content-Type: text/html\r\n")
+	b.WriteString("Content-Length: " + strconv.Itoa(len(body)) + "\r\n")
+	b.WriteString("Connection: close\r\n\r\n")
+	b.WriteString(body)
+	return b.Bytes()
+}
@@ -0,0 +1,65 @@
+package inbound
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+)
+
+// writeClientHandshakeMagic writes a magic-mode client handshake.
+func writeClientHandshakeMagic(writer io.Writer, hs *protocol.ClientHandshake) error {
+	return writeClientHandshakeWithMagic(writer, protocol.ReflexMagic, hs)
+}
+
+// writeClientHandshakeWithMagic writes a magic-mode client handshake
+// opening with magic, such as a time-gated one.
+func writeClientHandshakeWithMagic(writer io.Writer, magic uint32, hs *protocol.ClientHandshake) error {
+	packet, err := protocol.AppendClientHandshake(nil, magic, hs)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(packet)
+	return err
+}
+
+// writeClientHandshakeHTTP2 writes hs in the HTTP/2 variant, opening with
+// magic, such as a time-gated one.
+func writeClientHandshakeHTTP2(writer io.Writer, magic uint32, hs *protocol.ClientHandshake) error {
+	packet, err := protocol.AppendClientHandshake(nil, magic, hs)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(protocol.AppendHTTP2Handshake(nil, packet))
+	return err
+}
+
+// writeHTTPData writes data as the JSON body of an HTTP POST-like request.
+func writeHTTPData(writer io.Writer, data []byte, host string) error {
+	_, err := writer.Write(protocol.AppendHTTPData(nil, data, host))
+	return err
+}
+
+// writeClientHandshakeHTTP writes an HTTP POST-like client handshake.
+func writeClientHandshakeHTTP(writer io.Writer, hs *protocol.ClientHandshake, host string) error {
+	raw, err := hs.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return writeHTTPData(writer, raw, host)
+}
+
+// readServerHandshake parses the server's HTTP response to a client handshake.
+func readServerHandshake(reader *bufio.Reader) (*protocol.ServerHandshake, error) {
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return nil, errors.New("failed to read server handshake").Base(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return nil, errors.New("handshake rejected: ", resp.Status)
+	}
+	return protocol.DecodeHTTPServerHandshake(resp)
+}
@@ -0,0 +1,46 @@
+package inbound
+
+import (
+	"bufio"
+	"context"
+	"time"
+
+	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+	"github.com/xtls/xray-core/transport/internet/stat"
+)
+
+// isHTTP2PrefaceLike reports whether data, of at least 4 bytes, is the
+// start of the HTTP/2 preface.
+func isHTTP2PrefaceLike(data []byte) bool {
+	n := min(len(data), len(protocol.HTTP2Preface))
+	return string(data[:n]) == protocol.HTTP2Preface[:n]
+}
+
+// isReflexHTTP2 reports whether reader starts with the HTTP/2 variant of
+// the handshake. It waits for no more than the preface and a frame header,
+// which real HTTP/2 clients send at once, unless the frame is a SETTINGS
+// frame long enough to hold the magic.
+func (h *Handler) isReflexHTTP2(reader *bufio.Reader) bool {
+	data, err := reader.Peek(protocol.HTTP2OpeningSize)
+	if err != nil {
+		return false
+	}
+	if length, ok := protocol.HTTP2SettingsLength(data); !ok || length < 4 {
+		return false
+	}
+	data, err = reader.Peek(protocol.HTTP2OpeningSize + 4)
+	return err == nil && h.isReflexMagic(data[protocol.HTTP2OpeningSize:])
+}
+
+func (h *Handler) handleReflexHTTP2(reader *bufio.Reader, recorder *recordingReader, conn stat.Connection, dispatcher routing.Dispatcher, ctx context.Context, c peekedConn, start time.Time) error {
+	clientHS, err := protocol.ReadHTTP2ClientHandshake(reader)
+	if err != nil {
+		return h.handleMalformedHandshake(ctx, c, recorder, conn, helloFraming{http2: true}, err)
+	}
+	if !h.hasProofOfWork(&clientHS) {
+		return h.handleMissingProofOfWork(ctx, c, recorder, conn)
+	}
+	recorder.stop()
+	return h.processHandshake(reader, conn, dispatcher, ctx, c, clientHS, helloFraming{http2: true}, start)
+}
@@ -0,0 +1,67 @@
+package inbound
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+)
+
+func TestHandshakeHTTP2Preface(t *testing.T) {
+	secret := []byte("magic secret")
+	h := newTestHandler(t, &reflex.InboundConfig{MagicSecret: string(secret)})
+	dest := net.TCPDestination(net.DomainAddress("example.com"), 443)
+
+	t.Run("http2", func(t *testing.T) {
+		conn, _ := serve(t, h, newEchoDispatcher())
+		hs, priv := newTestClientHandshake(t, testUserID)
+		go writeClientHandshakeHTTP2(conn, protocol.TimeGatedMagic(secret, time.Now()), hs)
+		reader := bufio.NewReader(conn)
+		// The answer is framed the way an HTTP/2 server opens.
+		serverHS, err := protocol.ReadHTTP2ServerHandshake(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess, _ := clientSessionFromServer(t, hs, priv, serverHS)
+		echoRoundTrip(t, conn, reader, sess, dest, "hello http2")
+	})
+	t.Run("plain", func(t *testing.T) {
+		conn, _ := serve(t, h, newEchoDispatcher())
+		hs, priv := newTestClientHandshake(t, testUserID)
+		go writeClientHandshakeWithMagic(conn, protocol.TimeGatedMagic(secret, time.Now()), hs)
+		reader := bufio.NewReader(conn)
+		sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+		echoRoundTrip(t, conn, reader, sess, dest, "hello plain")
+	})
+}
+
+func TestHandshakeHTTP2Rejected(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	conn, done := serve(t, h, newEchoDispatcher())
+	hs, _ := newTestClientHandshake(t, "00000000-0000-0000-0000-000000000001")
+	go writeClientHandshakeHTTP2(conn, protocol.ReflexMagic, hs)
+
+	// An unknown user is refused with a GOAWAY, not an HTTP/1.1 error.
+	goAway := protocol.FormatHTTP2Error()
+	frame := make([]byte, len(goAway))
+	if _, err := io.ReadFull(conn, frame); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame, goAway) {
+		t.Errorf("refused with % x, want a GOAWAY frame", frame)
+	}
+	if err := <-done; err == nil {
+		t.Error("expected Process to fail for an unknown user")
+	}
+}
+
+func TestHTTP2ClientFallsBack(t *testing.T) {
+	// A real HTTP/2 client's opening: the preface and an empty SETTINGS
+	// frame, after which it waits for the server's SETTINGS.
+	fallbackRoundTrip(t, protocol.HTTP2Preface+"\x00\x00\x00\x04\x00\x00\x00\x00\x00")
+}
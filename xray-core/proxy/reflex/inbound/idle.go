@@ -0,0 +1,150 @@
+package inbound
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/xtls/xray-core/common/signal"
+)
+
+// idleTimer tears a relayed connection down once it has gone idle. The
+// request side reports activity to uplink and the response side to
+// downlink, and each reports when it is done, leaving timeout for the
+// other.
+type idleTimer interface {
+	uplink() signal.ActivityUpdater
+	downlink() signal.ActivityUpdater
+	uplinkDone(timeout time.Duration)
+	downlinkDone(timeout time.Duration)
+}
+
+// newIdleTimer returns the idle timer of a connection canceled with cancel.
+// It is the policy's single inactivity timer, connectionIdle, unless
+// ReadIdleTimeoutMs or WriteIdleTimeoutMs is set.
+func (h *Handler) newIdleTimer(ctx context.Context, cancel context.CancelFunc, connectionIdle time.Duration) idleTimer {
+	if h.readIdle == 0 && h.writeIdle == 0 {
+		return sharedIdle{signal.CancelAfterInactivity(ctx, cancel, connectionIdle)}
+	}
+	read, write := h.readIdle, h.writeIdle
+	if read == 0 {
+		read = connectionIdle
+	}
+	if write == 0 {
+		write = connectionIdle
+	}
+	return newSplitIdle(ctx, cancel, read, write)
+}
+
+// sharedIdle is an idle timer that activity in either direction resets.
+type sharedIdle struct {
+	timer *signal.ActivityTimer
+}
+
+func (t sharedIdle) uplink() signal.ActivityUpdater   { return t.timer }
+func (t sharedIdle) downlink() signal.ActivityUpdater { return t.timer }
+
+func (t sharedIdle) uplinkDone(timeout time.Duration)   { t.timer.SetTimeout(timeout) }
+func (t sharedIdle) downlinkDone(timeout time.Duration) { t.timer.SetTimeout(timeout) }
+
+// splitIdle is an idle timer with a timeout for each direction. The
+// connection is idle only once neither direction has been active within
+// its timeout, so a long download is not torn down because the client
+// sends nothing, nor a long upload because nothing comes back.
+type splitIdle struct {
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	up, down idleDirection
+	timer    *time.Timer
+	stopped  bool
+}
+
+// idleDirection is the activity in one direction of a connection.
+type idleDirection struct {
+	timeout time.Duration
+	last    time.Time
+	done    bool
+}
+
+// expiry is when the direction goes idle, the zero time once it is done.
+func (d *idleDirection) expiry() time.Time {
+	if d.done {
+		return time.Time{}
+	}
+	return d.last.Add(d.timeout)
+}
+
+func newSplitIdle(ctx context.Context, cancel context.CancelFunc, up, down time.Duration) *splitIdle {
+	now := time.Now()
+	t := &splitIdle{
+		cancel: cancel,
+		up:     idleDirection{timeout: up, last: now},
+		down:   idleDirection{timeout: down, last: now},
+	}
+	t.mu.Lock()
+	t.timer = time.AfterFunc(max(up, down), t.check)
+	t.mu.Unlock()
+	context.AfterFunc(ctx, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.stopped = true
+		t.timer.Stop()
+	})
+	return t
+}
+
+// check cancels the connection if both directions have gone idle, and
+// otherwise checks again when the later of them would.
+func (t *splitIdle) check() {
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		return
+	}
+	expiry := t.up.expiry()
+	if down := t.down.expiry(); down.After(expiry) {
+		expiry = down
+	}
+	if wait := time.Until(expiry); wait > 0 {
+		t.timer.Reset(wait)
+		t.mu.Unlock()
+		return
+	}
+	t.stopped = true
+	t.mu.Unlock()
+	t.cancel()
+}
+
+// active records activity in d. Activity only ever moves the expiry
+// later, so the timer already set catches it on its next check.
+func (t *splitIdle) active(d *idleDirection) {
+	t.mu.Lock()
+	d.last = time.Now()
+	t.mu.Unlock()
+}
+
+// done ends d and gives other timeout from now, as SetTimeout does for
+// the shared timer.
+func (t *splitIdle) done(d, other *idleDirection, timeout time.Duration) {
+	t.mu.Lock()
+	d.done = true
+	other.timeout = timeout
+	other.last = time.Now()
+	t.mu.Unlock()
+	t.check()
+}
+
+func (t *splitIdle) uplink() signal.ActivityUpdater   { return splitUpdater{t, &t.up} }
+func (t *splitIdle) downlink() signal.ActivityUpdater { return splitUpdater{t, &t.down} }
+
+func (t *splitIdle) uplinkDone(timeout time.Duration)   { t.done(&t.up, &t.down, timeout) }
+func (t *splitIdle) downlinkDone(timeout time.Duration) { t.done(&t.down, &t.up, timeout) }
+
+// splitUpdater reports activity in one direction of a splitIdle.
+type splitUpdater struct {
+	timer     *splitIdle
+	direction *idleDirection
+}
+
+func (u splitUpdater) Update() { u.timer.active(u.direction) }
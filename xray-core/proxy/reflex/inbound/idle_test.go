@@ -0,0 +1,77 @@
+package inbound
+
+import (
+	"bufio"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+)
+
+func TestReadIdleTimeoutSparesDownloads(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{ReadIdleTimeoutMs: 50, WriteIdleTimeoutMs: 50})
+	dispatcher := &streamingDispatcher{interrupted: make(chan struct{})}
+	conn, done := serve(t, h, dispatcher)
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	header, err := protocol.EncodeDestination(net.TCPDestination(net.LocalHostIP, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.WriteFrame(conn, protocol.FrameTypeData, header); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client sends nothing more for ten read timeouts while the
+	// download keeps coming.
+	for start := time.Now(); time.Since(start) < 500*time.Millisecond; {
+		frame, err := sess.ReadFrame(reader)
+		if err != nil {
+			t.Fatalf("download cut off after %v: %v", time.Since(start), err)
+		}
+		if frame.Type != protocol.FrameTypeData {
+			t.Fatalf("download ended with frame type %d after %v", frame.Type, time.Since(start))
+		}
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("connection closed during the download: %v", err)
+	default:
+	}
+}
+
+func TestSplitIdleTimeoutsCloseIdleConnections(t *testing.T) {
+	for _, tc := range []struct {
+		config  *reflex.InboundConfig
+		timeout time.Duration
+	}{
+		{&reflex.InboundConfig{ReadIdleTimeoutMs: 50, WriteIdleTimeoutMs: 300}, 300 * time.Millisecond},
+		{&reflex.InboundConfig{ReadIdleTimeoutMs: 300, WriteIdleTimeoutMs: 50}, 300 * time.Millisecond},
+	} {
+		h := newTestHandler(t, tc.config)
+		dispatcher := newEchoDispatcher()
+		conn, _ := serve(t, h, dispatcher)
+		hs, priv := newTestClientHandshake(t, testUserID)
+		go writeClientHandshakeMagic(conn, hs)
+		reader := bufio.NewReader(conn)
+		sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+		echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "hello")
+		ctx := <-dispatcher.contexts
+
+		// Nothing flows either way; the connection lasts until the longer
+		// timeout.
+		start := time.Now()
+		select {
+		case <-ctx.Done():
+			if elapsed := time.Since(start); elapsed < tc.timeout-20*time.Millisecond {
+				t.Errorf("read %v write %v: closed after %v", tc.config.ReadIdleTimeoutMs, tc.config.WriteIdleTimeoutMs, elapsed)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("read %v write %v: idle connection not closed", tc.config.ReadIdleTimeoutMs, tc.config.WriteIdleTimeoutMs)
+		}
+	}
+}
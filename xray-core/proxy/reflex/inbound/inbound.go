@@ -1,16 +1,46 @@
 // Package inbound implements the Reflex inbound handler.
-// This is a stub; replace with full implementation per step docs.
 package inbound
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	mrand "math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/dice"
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/common/log"
 	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/common/task"
+	"github.com/xtls/xray-core/common/uuid"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/dns"
+	"github.com/xtls/xray-core/features/dns/localdns"
+	"github.com/xtls/xray-core/features/policy"
 	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/features/stats"
 	"github.com/xtls/xray-core/proxy"
 	"github.com/xtls/xray-core/proxy/reflex"
+	reflexprotocol "github.com/xtls/xray-core/proxy/reflex/internal/protocol"
 	"github.com/xtls/xray-core/transport/internet/stat"
+	"google.golang.org/protobuf/proto"
 )
 
 func init() {
@@ -19,26 +49,1231 @@ func init() {
 	}))
 }
 
-// Handler is the Reflex inbound handler (stub until implemented).
-type Handler struct{}
+// DefaultBlockedPorts are the destination ports blocked when the config
+// does not list any: SMTP and mail submission, the usual targets of spam
+// through open proxies.
+var DefaultBlockedPorts = []uint32{25, 465, 587}
+
+// Handshake modes.
+const (
+	HandshakeModeSingle  = "single"
+	HandshakeModeTLSLike = "tls-like"
+)
+
+var _ reflex.InboundHandler = (*Handler)(nil)
+
+// Handler is the Reflex inbound handler.
+type Handler struct {
+	clients       []*protocol.MemoryUser
+	fallback      *FallbackConfig
+	fallbackPool  *fallbackPool // nil unless the fallback keeps connections alive
+	policyManager policy.Manager
+	tag           string
+
+	handshakeMode string
+	flightGap     time.Duration
+	responseDelay *reflexprotocol.TrafficProfile
+	disableHTTP   bool
+	maxGrease     int
+	magicSecret   []byte // nil for the fixed magic
+	requiredALPN  string
+	webSocketPath string
+	httpUpgrade   string // see HTTPUpgrade, "" if not accepted
+
+	// networkProfiles holds the profile of users without a Policy per
+	// network served on.
+	networkProfiles map[net.Network]string
+
+	frameReadTimeout  time.Duration
+	frameWriteTimeout time.Duration
+	rekeyAfter        uint64
+
+	maxInFlight  int32
+	socketBuffer int
+
+	// coalesceBytes and coalesceDelay batch upstream writes, see
+	// CoalesceBytes. Zero coalesceBytes writes each payload at once.
+	coalesceBytes int
+	coalesceDelay time.Duration
+
+	blockedPorts map[net.Port]bool
+
+	// load sheds connections above the configured watermarks, nil without.
+	load           *loadShedder
+	shedToFallback bool
+
+	// limit caps the connections being served at MaxConnections, nil
+	// without: a shedder whose watermarks are both the cap.
+	limit *loadShedder
+
+	// drain tracks the connections being processed for Close, which gives
+	// them drainGrace to finish.
+	drain      drainer
+	drainGrace time.Duration
+	closeOnce  sync.Once
+
+	// profiles are the inbound's custom profiles, registered while it is
+	// open.
+	profiles []*reflexprotocol.TrafficProfile
+
+	// readIdle and writeIdle, when either is set, replace the policy's
+	// inactivity timeout with one per direction, see newIdleTimer.
+	readIdle  time.Duration
+	writeIdle time.Duration
+
+	// dns resolves domain destinations when set, see ResolveLocally.
+	// allowNoResolve lets a client opt out of it, see
+	// AllowConnectByDomain.
+	dns            dns.Client
+	allowNoResolve bool
+
+	// routeBySNI routes IP destinations by a sniffed server name, see
+	// RouteBySNI.
+	routeBySNI bool
+
+	// statsManager holds the per-user traffic counters, see
+	// countUserTraffic. It is nil without a stats manager.
+	statsManager stats.Manager
+
+	// clientDisconnects counts responses cut short because the client went
+	// away. It is nil without a stats manager.
+	clientDisconnects stats.Counter
+	// futureSkew and pastSkew count hellos rejected for a timestamp ahead
+	// of or behind the accepted window. They are nil without a stats
+	// manager.
+	futureSkew stats.Counter
+	pastSkew   stats.Counter
+
+	// maxFutureSkew is how many seconds ahead a hello may be stamped.
+	maxFutureSkew int64
+
+	powDifficulty uint32
+
+	maxLifetime time.Duration
+	idleCover   time.Duration
+	// idleCoverMinVersion is the oldest client version sent idle cover.
+	idleCoverMinVersion string
+
+	handshakeStatus int
+
+	logDestination    string
+	logDestinationKey []byte // keys destination hashes, see loggedDestination
+
+	accessLogStart      bool
+	accessLogCompletion bool
+
+	// replay remembers the nonces of accepted hellos for as long as their
+	// timestamps stay in the window, so a captured first flight cannot be
+	// replayed on a new connection.
+	replay *replayFilter
+
+	decoy []byte // rendered Decoy, nil without one
+
+	// handshakeLatency records the time from the first byte of a connection
+	// to its session being established, see Stats.
+	handshakeLatency latencyHistogram
+	profileUsage     profileUsage
+	clientVersions   versionCounts
+
+	// learners shape profiles after users' traffic with learnProfiles.
+	learnProfiles bool
+	learners      learners
+
+	// observeState, if set, is called with every state a connection
+	// enters, see connLifecycle.
+	observeState func(connState)
+}
+
+// MemoryAccount is the in-memory form of a Reflex user.
+type MemoryAccount struct {
+	Id          string
+	Policy      string
+	TokenSecret []byte
+	RouteTags   []string
+
+	// MaxConns caps the user's concurrent sessions, zero for no cap.
+	// active counts them.
+	MaxConns int32
+	active   atomic.Int32
+}
+
+// acquire takes one of the user's session slots, reporting false if they
+// are all in use. A successful acquire must be paired with a release.
+func (a *MemoryAccount) acquire() bool {
+	if a.MaxConns <= 0 {
+		return true
+	}
+	if a.active.Add(1) > a.MaxConns {
+		a.active.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (a *MemoryAccount) release() {
+	if a.MaxConns > 0 {
+		a.active.Add(-1)
+	}
+}
+
+// Equals implements protocol.Account.
+func (a *MemoryAccount) Equals(account protocol.Account) bool {
+	reflexAccount, ok := account.(*MemoryAccount)
+	if !ok {
+		return false
+	}
+	return a.Id == reflexAccount.Id
+}
+
+// ToProto implements protocol.Account. Reflex config types are plain Go
+// structs, so there is no protobuf form.
+func (a *MemoryAccount) ToProto() proto.Message {
+	return nil
+}
+
+// New creates a new Reflex inbound handler from config.
+func New(ctx context.Context, config *reflex.InboundConfig) (proxy.Inbound, error) {
+	if config == nil {
+		return nil, errors.New("reflex inbound config is nil").AtError()
+	}
+	handler := &Handler{
+		clients:       make([]*protocol.MemoryUser, 0, len(config.Clients)),
+		tag:           config.Tag,
+		disableHTTP:   config.DisableHTTPHandshake,
+		requiredALPN:  config.RequiredAlpn,
+		webSocketPath: config.WebSocketPath,
+		httpUpgrade:   config.HTTPUpgrade,
+		routeBySNI:    config.RouteBySNI,
+		replay:        newReplayFilter(2 * handshakeTimestampWindow * time.Second),
+	}
+
+	if v := core.FromContext(ctx); v != nil {
+		if pm, ok := v.GetFeature(policy.ManagerType()).(policy.Manager); ok {
+			handler.policyManager = pm
+		}
+		if config.ResolveLocally {
+			handler.dns, _ = v.GetFeature(dns.ClientType()).(dns.Client)
+		}
+		if sm, ok := v.GetFeature(stats.ManagerType()).(stats.Manager); ok {
+			handler.statsManager = sm
+			prefix := "inbound>>>" + handler.statsTag() + ">>>reflex>>>"
+			handler.clientDisconnects, _ = stats.GetOrRegisterCounter(sm, prefix+"client_disconnects")
+			handler.futureSkew, _ = stats.GetOrRegisterCounter(sm, prefix+"future_skew")
+			handler.pastSkew, _ = stats.GetOrRegisterCounter(sm, prefix+"past_skew")
+		}
+	}
+	if config.ResolveLocally && handler.dns == nil {
+		handler.dns = localdns.New()
+	}
+	handler.allowNoResolve = config.AllowConnectByDomain
+
+	if config.HTTPUpgrade != "" && !reflexprotocol.ValidUpgradeProtocol(config.HTTPUpgrade) {
+		return nil, errors.New("invalid reflex upgrade protocol: ", config.HTTPUpgrade).AtError()
+	}
+
+	profiles, err := buildProfiles(config.Profiles)
+	if err != nil {
+		return nil, err
+	}
+	handler.profiles = profiles
+	for _, client := range config.Clients {
+		id, err := clientID(client)
+		if err != nil {
+			return nil, err
+		}
+		if client.Policy != "" && !handler.knownProfile(client.Policy) {
+			if config.StrictPolicy {
+				return nil, errors.New("unknown reflex policy ", client.Policy, " for user ", id).AtError()
+			}
+			errors.LogWarning(ctx, "unknown reflex policy ", client.Policy, " for user ", id, ", morphing disabled")
+		}
+		maxConns := config.MaxConnsPerUser
+		if client.MaxConns > 0 {
+			maxConns = client.MaxConns
+		}
+		handler.clients = append(handler.clients, &protocol.MemoryUser{
+			Email: id,
+			Level: client.Level,
+			Account: &MemoryAccount{
+				Id:          id,
+				Policy:      client.Policy,
+				TokenSecret: []byte(client.TokenSecret),
+				RouteTags:   client.RouteTags,
+				MaxConns:    int32(min(maxConns, math.MaxInt32)),
+			},
+		})
+	}
+
+	for name, profile := range config.NetworkProfiles {
+		network, found := net.Network_value[strings.ToUpper(name)]
+		if !found || net.Network(network) == net.Network_Unknown {
+			return nil, errors.New("unknown network for reflex profile: ", name).AtError()
+		}
+		if !handler.knownProfile(profile) {
+			return nil, errors.New("unknown reflex profile ", profile, " for network ", name).AtError()
+		}
+		if handler.networkProfiles == nil {
+			handler.networkProfiles = make(map[net.Network]string)
+		}
+		handler.networkProfiles[net.Network(network)] = profile
+	}
+
+	if config.Fallback != nil {
+		handler.fallback = &FallbackConfig{
+			Dest:      config.Fallback.Dest,
+			KeepAlive: config.Fallback.KeepAlive,
+			MaxBytes:  config.Fallback.MaxBytes,
+		}
+		for _, rule := range config.Fallback.Rules {
+			if rule.Dest == 0 || rule.Dest > 65535 {
+				return nil, errors.New("invalid reflex fallback rule dest: ", rule.Dest).AtError()
+			}
+			handler.fallback.Rules = append(handler.fallback.Rules, FallbackRule{
+				Name: strings.ToLower(rule.Name),
+				Alpn: rule.Alpn,
+				Path: rule.Path,
+				Dest: rule.Dest,
+			})
+		}
+		// Connections over MaxConnections go to fallback uncounted, so
+		// without a cap of its own it takes that one.
+		if fallbackConns := cmp.Or(config.Fallback.MaxConns, config.MaxConnections); fallbackConns > 0 {
+			handler.fallback.slots = make(chan struct{}, fallbackConns)
+		}
+		if config.Fallback.KeepAlive {
+			handler.fallbackPool = &fallbackPool{}
+		}
+		tlsConfig, err := newFallbackTLSConfig(config.Fallback)
+		if err != nil {
+			return nil, errors.New("invalid reflex fallback").Base(err).AtError()
+		}
+		handler.fallback.tls = tlsConfig
+	}
+	if config.Decoy != nil {
+		if config.Decoy.Status != 0 && http.StatusText(int(config.Decoy.Status)) == "" {
+			return nil, errors.New("invalid reflex decoy status: ", config.Decoy.Status).AtError()
+		}
+		handler.decoy = formatDecoy(config.Decoy)
+	}
+
+	blockedPorts := config.BlockedPorts
+	if blockedPorts == nil {
+		blockedPorts = DefaultBlockedPorts
+	}
+	handler.blockedPorts = make(map[net.Port]bool, len(blockedPorts))
+	for _, port := range blockedPorts {
+		if port == 0 || port > 65535 {
+			return nil, errors.New("invalid reflex blocked port: ", port).AtError()
+		}
+		handler.blockedPorts[net.Port(port)] = true
+	}
+
+	handler.frameReadTimeout = time.Duration(config.FrameReadTimeoutMs) * time.Millisecond
+	handler.frameWriteTimeout = time.Duration(config.FrameWriteTimeoutMs) * time.Millisecond
+	handler.rekeyAfter = uint64(config.RekeyAfterFrames)
+	handler.maxLifetime = time.Duration(config.MaxSessionLifetimeMs) * time.Millisecond
+	handler.idleCover = time.Duration(config.IdleCoverMs) * time.Millisecond
+	if config.IdleCoverMinClientVersion != "" && parseVersion(config.IdleCoverMinClientVersion) == nil {
+		return nil, errors.New("invalid reflex client version: ", config.IdleCoverMinClientVersion).AtError()
+	}
+	handler.idleCoverMinVersion = config.IdleCoverMinClientVersion
+
+	handler.handshakeStatus = http.StatusOK
+	if config.HandshakeStatus != 0 {
+		if config.HandshakeStatus < 200 || config.HandshakeStatus > 299 || http.StatusText(int(config.HandshakeStatus)) == "" {
+			return nil, errors.New("invalid reflex handshake status: ", config.HandshakeStatus).AtError()
+		}
+		handler.handshakeStatus = int(config.HandshakeStatus)
+	}
+
+	if config.ShedLowConns > config.ShedHighConns {
+		return nil, errors.New("reflex low watermark ", config.ShedLowConns, " above high watermark ", config.ShedHighConns).AtError()
+	}
+	if config.ShedHighConns > 0 {
+		handler.load = newLoadShedder(int(config.ShedHighConns), int(config.ShedLowConns))
+		handler.shedToFallback = config.ShedToFallback
+	}
+	if config.MaxConnections > 0 {
+		handler.limit = newLoadShedder(int(min(config.MaxConnections, math.MaxInt32)), 0)
+	}
+
+	if config.MaxInFlightBytes > math.MaxInt32 {
+		return nil, errors.New("reflex max in-flight bytes too large: ", config.MaxInFlightBytes).AtError()
+	}
+	handler.maxInFlight = int32(config.MaxInFlightBytes)
+	if config.SocketBufferSize > math.MaxInt32 {
+		return nil, errors.New("reflex socket buffer size too large: ", config.SocketBufferSize).AtError()
+	}
+	handler.socketBuffer = int(config.SocketBufferSize)
+	handler.learnProfiles = config.LearnProfiles
+	if config.CoalesceBytes > math.MaxInt32 {
+		return nil, errors.New("reflex coalesce size too large: ", config.CoalesceBytes).AtError()
+	}
+	handler.coalesceBytes = int(config.CoalesceBytes)
+	handler.readIdle = time.Duration(config.ReadIdleTimeoutMs) * time.Millisecond
+	handler.writeIdle = time.Duration(config.WriteIdleTimeoutMs) * time.Millisecond
+	handler.drainGrace = defaultDrainGrace
+	if config.DrainGraceMs > 0 {
+		handler.drainGrace = time.Duration(config.DrainGraceMs) * time.Millisecond
+	}
+	handler.coalesceDelay = defaultCoalesceDelay
+	if config.CoalesceDelayMs > 0 {
+		handler.coalesceDelay = time.Duration(config.CoalesceDelayMs) * time.Millisecond
+	}
+
+	if config.PowDifficulty > 0 {
+		if config.PowDifficulty > reflexprotocol.MaxPoWDifficulty {
+			return nil, errors.New("reflex proof-of-work difficulty too high: ", config.PowDifficulty).AtError()
+		}
+		handler.powDifficulty = config.PowDifficulty
+	}
+
+	switch config.LogDestination {
+	case "", LogDestinationFull:
+		handler.logDestination = LogDestinationFull
+	case LogDestinationDomain, LogDestinationNone:
+		handler.logDestination = config.LogDestination
+	case LogDestinationHash:
+		handler.logDestination = LogDestinationHash
+		handler.logDestinationKey = make([]byte, 32)
+		if _, err := rand.Read(handler.logDestinationKey); err != nil {
+			return nil, errors.New("failed to generate destination log key").Base(err)
+		}
+	default:
+		return nil, errors.New("unknown reflex destination logging mode: ", config.LogDestination).AtError()
+	}
+	switch config.AccessLog {
+	case "", AccessLogStart:
+		handler.accessLogStart = true
+	case AccessLogCompletion:
+		handler.accessLogCompletion = true
+	case AccessLogBoth:
+		handler.accessLogStart, handler.accessLogCompletion = true, true
+	default:
+		return nil, errors.New("unknown reflex access logging mode: ", config.AccessLog).AtError()
+	}
+
+	// The replay filter only covers hellos stamped within the window, so
+	// the future tolerance cannot exceed it.
+	if config.FutureSkewToleranceSec > handshakeTimestampWindow {
+		return nil, errors.New("reflex future skew tolerance above ", handshakeTimestampWindow, "s").AtError()
+	}
+	handler.maxFutureSkew = handshakeTimestampWindow
+	if config.FutureSkewToleranceSec > 0 {
+		handler.maxFutureSkew = int64(config.FutureSkewToleranceSec)
+	}
+
+	if config.GreaseMaxBytes > reflexprotocol.MaxGreaseBytes {
+		return nil, errors.New("reflex grease of ", config.GreaseMaxBytes, " bytes exceeds ", reflexprotocol.MaxGreaseBytes).AtError()
+	}
+	handler.maxGrease = int(config.GreaseMaxBytes)
+	if config.MagicSecret != "" {
+		handler.magicSecret = []byte(config.MagicSecret)
+	}
+
+	if len(config.HandshakeDelays) > 0 {
+		var total float64
+		for _, d := range config.HandshakeDelays {
+			if !(d.Weight > 0) {
+				return nil, errors.New("reflex handshake delay weights must be positive").AtError()
+			}
+			total += d.Weight
+		}
+		delays := make([]reflexprotocol.DelayDist, len(config.HandshakeDelays))
+		for i, d := range config.HandshakeDelays {
+			delays[i] = reflexprotocol.DelayDist{
+				Delay:  time.Duration(d.DelayMs) * time.Millisecond,
+				Weight: d.Weight / total,
+			}
+		}
+		handler.responseDelay = &reflexprotocol.TrafficProfile{Name: "handshake", Delays: delays}
+	}
+
+	switch config.HandshakeMode {
+	case "", HandshakeModeSingle:
+		handler.handshakeMode = HandshakeModeSingle
+	case HandshakeModeTLSLike:
+		handler.handshakeMode = HandshakeModeTLSLike
+		handler.flightGap = time.Duration(config.HandshakeFlightGapMs) * time.Millisecond
+	default:
+		return nil, errors.New("unknown reflex handshake mode: ", config.HandshakeMode).AtError()
+	}
+
+	// The custom profiles are registered last, so that a config error
+	// leaves none of them behind. Close unregisters them.
+	if err := registerProfiles(handler.profiles); err != nil {
+		return nil, err
+	}
+	return handler, nil
+}
 
 // Network implements proxy.Inbound.Network().
 func (*Handler) Network() []net.Network {
 	return []net.Network{net.Network_TCP}
 }
 
-// Process implements proxy.Inbound.Process(). Stub: does nothing.
+// statsTag names the inbound in stats counters.
+func (h *Handler) statsTag() string {
+	if h.tag != "" {
+		return h.tag
+	}
+	return "reflex"
+}
+
+func (h *Handler) sessionPolicy(level uint32) policy.Session {
+	if h.policyManager == nil {
+		return policy.SessionDefault()
+	}
+	return h.policyManager.ForLevel(level)
+}
+
+// Process implements proxy.Inbound.Process().
 func (h *Handler) Process(ctx context.Context, network net.Network, conn stat.Connection, dispatcher routing.Dispatcher) error {
-	_ = ctx
-	_ = network
-	_ = conn
-	_ = dispatcher
+	ctx = context.WithValue(ctx, networkContextKey, network)
+	lifecycle := &connLifecycle{observe: h.observeState}
+	defer lifecycle.enter(ctx, stateClosed)
+	accepted := acceptedConn{lifecycle}
+	ctx, untrack, ok := h.drain.track(ctx, conn)
+	if !ok {
+		return errors.New("reflex inbound is closed").AtInfo()
+	}
+	defer untrack()
+	if h.limit != nil {
+		if !h.limit.admit(ctx) {
+			return h.limitConnection(ctx, accepted, conn)
+		}
+		defer h.limit.release(ctx)
+	}
+	if h.load != nil {
+		if !h.load.admit(ctx) {
+			return h.shedConnection(ctx, accepted, conn)
+		}
+		defer h.load.release(ctx)
+	}
+	if err := setSocketBuffers(conn, h.socketBuffer); err != nil {
+		errors.LogWarningInner(ctx, err, "failed to set socket buffers")
+	}
+	sessionPolicy := h.sessionPolicy(0)
+	if err := conn.SetReadDeadline(time.Now().Add(sessionPolicy.Timeouts.Handshake)); err != nil {
+		return errors.New("unable to set read deadline").Base(err).AtWarning()
+	}
+
+	recorder := newRecordingReader(conn)
+	reader := bufio.NewReader(recorder)
+	peeked, err := peekFirstBytes(reader)
+	if len(peeked) == 0 {
+		return errors.New("failed to read first bytes").Base(err)
+	}
+	peekedState := accepted.peeked(ctx)
+	start := time.Now()
+
+	// The TLS handshake, if any, has completed with the first read.
+	if h.requiredALPN != "" {
+		if _, alpn := tlsState(conn); alpn != h.requiredALPN {
+			errors.LogInfo(ctx, "ALPN \"", alpn, "\" is not the required one, falling back")
+			return h.handleFallback(ctx, peekedState.fallback(ctx), recorder, conn)
+		}
+	}
+	if h.isReflexMagic(peeked) {
+		return h.handleReflexMagic(reader, recorder, conn, dispatcher, ctx, peekedState, start)
+	}
+	if n := reflexprotocol.GreaseLen(peeked, h.maxGrease); n > 0 {
+		// The magic must follow the grease; wait for it if the first
+		// reads stopped short.
+		if greased, _ := reader.Peek(n + 4); h.isReflexMagic(greased[n:]) {
+			reader.Discard(n)
+			return h.handleReflexMagic(reader, recorder, conn, dispatcher, ctx, peekedState, start)
+		}
+	}
+	if isHTTP2PrefaceLike(peeked) && h.isReflexHTTP2(reader) {
+		return h.handleReflexHTTP2(reader, recorder, conn, dispatcher, ctx, peekedState, start)
+	}
+	if h.isHTTPPostLike(peeked) {
+		return h.handleReflexHTTP(reader, recorder, conn, dispatcher, ctx, peekedState, start)
+	}
+	if h.isHTTPGetLike(peeked) {
+		return h.handleHTTPGet(reader, recorder, conn, dispatcher, ctx, peekedState, start)
+	}
+	return h.handleFallback(ctx, peekedState.fallback(ctx), recorder, conn)
+}
+
+// peekFirstBytes returns up to ReflexMinHandshakeSize bytes without consuming
+// them. It waits for at least 4 bytes but never for more than what the first
+// reads delivered, so short probes are not stalled.
+func peekFirstBytes(reader *bufio.Reader) ([]byte, error) {
+	if peeked, err := reader.Peek(4); err != nil {
+		return peeked, err
+	}
+	n := reader.Buffered()
+	if n > ReflexMinHandshakeSize {
+		n = ReflexMinHandshakeSize
+	}
+	return reader.Peek(n)
+}
+
+// isReflexMagic reports whether data starts with the magic: the
+// time-gated magic of the current minute or one next to it with a
+// MagicSecret, ReflexMagic otherwise.
+func (h *Handler) isReflexMagic(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	magic := binary.BigEndian.Uint32(data[0:4])
+	if h.magicSecret != nil {
+		return reflexprotocol.IsTimeGatedMagic(h.magicSecret, magic, time.Now())
+	}
+	return magic == reflexprotocol.ReflexMagic
+}
+
+func (h *Handler) isHTTPPostLike(data []byte) bool {
+	if h.disableHTTP {
+		return false
+	}
+	return bytes.HasPrefix(data, []byte("POST /"))
+}
+
+// handleReflexMagic parses a magic-mode hello. Process has peeked and
+// checked the magic already, so it is skipped rather than parsed again and
+// only the handshake after it is read.
+func (h *Handler) handleReflexMagic(reader *bufio.Reader, recorder *recordingReader, conn stat.Connection, dispatcher routing.Dispatcher, ctx context.Context, c peekedConn, start time.Time) error {
+	if _, err := reader.Discard(4); err != nil {
+		return errors.New("failed to skip magic").Base(err)
+	}
+	clientHS, err := reflexprotocol.ReadVersionedClientHandshake(reader)
+	if err != nil {
+		return h.handleMalformedHandshake(ctx, c, recorder, conn, helloFraming{}, err)
+	}
+	if !h.hasProofOfWork(&clientHS) {
+		return h.handleMissingProofOfWork(ctx, c, recorder, conn)
+	}
+	recorder.stop()
+	return h.processHandshake(reader, conn, dispatcher, ctx, c, clientHS, helloFraming{}, start)
+}
+
+func (h *Handler) handleReflexHTTP(reader *bufio.Reader, recorder *recordingReader, conn stat.Connection, dispatcher routing.Dispatcher, ctx context.Context, c peekedConn, start time.Time) error {
+	clientHS, err := h.readClientHandshakeHTTP(reader)
+	if err != nil {
+		return h.handleMalformedHandshake(ctx, c, recorder, conn, helloFraming{}, err)
+	}
+	if !h.hasProofOfWork(&clientHS) {
+		return h.handleMissingProofOfWork(ctx, c, recorder, conn)
+	}
+	recorder.stop()
+	return h.processHandshake(reader, conn, dispatcher, ctx, c, clientHS, helloFraming{overHTTP: true}, start)
+}
+
+// handleMalformedHandshake deals with a first flight that looked like Reflex
+// but does not parse. Such a peer is not a Reflex client, so it is handed to
+// fallback with everything it sent; without a fallback it gets a 400. A
+// client of an unsupported handshake version is told so with a 426 instead.
+func (h *Handler) handleMalformedHandshake(ctx context.Context, c peekedConn, recorder *recordingReader, conn stat.Connection, framing helloFraming, err error) error {
+	if errors.Cause(err) == reflexprotocol.ErrUnsupportedVersion {
+		return h.rejectHandshake(ctx, conn, framing, http.StatusUpgradeRequired, err)
+	}
+	if h.fallback == nil {
+		return h.rejectHandshake(ctx, conn, framing, http.StatusBadRequest, err)
+	}
+	errors.LogInfo(ctx, "malformed reflex handshake, falling back: ", err)
+	return h.handleFallback(ctx, c.fallback(ctx), recorder, conn)
+}
+
+// rejectHandshake answers a failed handshake with a plain HTTP error, the
+// way a web server would, or with the decoy if there is one, and returns
+// err for the caller. A hello in the HTTP/2 variant gets a GOAWAY instead.
+func (h *Handler) rejectHandshake(ctx context.Context, conn stat.Connection, framing helloFraming, status int, err error) error {
+	log.Record(&log.AccessMessage{
+		From:   remoteAddr(conn),
+		To:     "",
+		Status: log.AccessRejected,
+		Reason: err,
+	})
+	switch {
+	case framing.http2:
+		conn.Write(reflexprotocol.FormatHTTP2Error())
+	case h.decoy != nil:
+		conn.Write(h.decoy)
+	default:
+		conn.Write(formatHTTPError(status))
+	}
+	return errors.New("reflex handshake failed").Base(err)
+}
+
+// unknownAddr stands in for the remote address of a connection that has
+// none, such as an in-memory one.
+type unknownAddr struct{}
+
+func (unknownAddr) Network() string { return "unknown" }
+func (unknownAddr) String() string  { return "unknown" }
+
+// remoteAddr returns the remote address of conn for logging, or unknownAddr
+// if it is nil or unset.
+func remoteAddr(conn net.Conn) net.Addr {
+	switch addr := conn.RemoteAddr().(type) {
+	case nil:
+		return unknownAddr{}
+	case *net.TCPAddr:
+		if addr == nil || (addr.IP == nil && addr.Port == 0) {
+			return unknownAddr{}
+		}
+	case *net.UDPAddr:
+		if addr == nil || (addr.IP == nil && addr.Port == 0) {
+			return unknownAddr{}
+		}
+	}
+	return conn.RemoteAddr()
+}
+
+// helloFraming is how a client hello arrived, which decides how it is
+// answered.
+type helloFraming struct {
+	// overHTTP is set for a hello sent as an HTTP POST, and upgrade for one
+	// sent as an HTTP upgrade request, which is answered with a 101
+	// switching to that protocol.
+	overHTTP bool
+	upgrade  string
+	// http2 is set for a hello sent after an HTTP/2 connection preface,
+	// which is answered in HTTP/2 frames.
+	http2 bool
+	// webSocket is set for a hello sent in a WebSocket message, after
+	// which every flight and frame must fill a message of its own.
+	webSocket bool
+}
+
+// processHandshake authenticates clientHS, which arrived with framing, and
+// serves the session.
+func (h *Handler) processHandshake(reader *bufio.Reader, conn stat.Connection, dispatcher routing.Dispatcher, ctx context.Context, c peekedConn, clientHS reflexprotocol.ClientHandshake, framing helloFraming, start time.Time) error {
+	helloAt := time.Now()
+	handshake := c.handshake(ctx)
+	// A rejection waits out the same response delay as a server hello, so
+	// its timing does not give away that a check failed.
+	reject := func(status int, err error) error {
+		if waitErr := h.waitResponseDelay(ctx, helloAt); waitErr != nil {
+			return waitErr
+		}
+		return h.rejectHandshake(ctx, conn, framing, status, err)
+	}
+
+	exts, err := reflexprotocol.ParseExtensions(clientHS.PolicyReq)
+	if err != nil {
+		return reject(http.StatusForbidden, err)
+	}
+	user, err := h.authenticateUser(clientHS.UserID)
+	if err != nil {
+		return reject(http.StatusForbidden, err)
+	}
+	if secret := user.Account.(*MemoryAccount).TokenSecret; len(secret) > 0 {
+		if !verifyAuthToken(secret, exts[reflexprotocol.ExtAuthToken], time.Now()) {
+			return reject(http.StatusForbidden, errors.New("invalid authentication token"))
+		}
+	}
+	suite, err := cipherSuiteFromExtensions(exts)
+	if err != nil {
+		return reject(http.StatusForbidden, err)
+	}
+
+	skew := time.Now().Unix() - clientHS.Timestamp
+	switch {
+	case skew < -h.maxFutureSkew:
+		if h.futureSkew != nil {
+			h.futureSkew.Add(1)
+		}
+		return reject(http.StatusForbidden, errors.New("client clock ahead by ", -skew, "s").AtWarning())
+	case skew > handshakeTimestampWindow:
+		if h.pastSkew != nil {
+			h.pastSkew.Add(1)
+		}
+		return reject(http.StatusForbidden, errors.New("handshake timestamp ", skew, "s old"))
+	}
+	if !h.replay.Check(clientHS.Nonce) {
+		return reject(http.StatusForbidden, errors.New("replay detected"))
+	}
+	account := user.Account.(*MemoryAccount)
+	if !account.acquire() {
+		return reject(http.StatusTooManyRequests, errors.New("user ", user.Email, " is at its limit of ", account.MaxConns, " connections").AtWarning())
+	}
+	defer account.release()
+
+	serverPrivateKey, serverPublicKey, err := reflexprotocol.GenerateKeyPair()
+	if err != nil {
+		return errors.New("failed to generate key pair").Base(err)
+	}
+	sharedKey, err := reflexprotocol.DeriveSharedKey(serverPrivateKey, clientHS.PublicKey)
+	if err != nil {
+		return reject(http.StatusForbidden, err)
+	}
+	sessionKey := reflexprotocol.DeriveSessionKey(sharedKey, clientHS.Nonce[:])
+	logSessionKey(clientHS.Nonce, sessionKey)
+
+	if err := h.waitResponseDelay(ctx, helloAt); err != nil {
+		return err
+	}
+
+	sess, err := reflexprotocol.NewSessionWithCipherSuite(sessionKey, suite, reflexprotocol.RoleServer)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	sess.SetFramePerMessage(framing.webSocket)
+	serverHS := reflexprotocol.ServerHandshake{PublicKey: serverPublicKey}
+	var response []byte
+	// The profile the client is told of, if any, is bound into every
+	// frame after the grant.
+	var granted string
+	if framing.http2 || (framing.upgrade == "" && reflexprotocol.StatusHasBody(h.handshakeStatus)) {
+		granted = grantedProfileKey(h.userPolicy(ctx, user))
+		if serverHS.PolicyGrant, err = sealPolicyGrant(sess, policyGrant(granted)); err != nil {
+			return errors.New("failed to seal policy grant").Base(err)
+		}
+	}
+	switch {
+	case framing.upgrade != "":
+		response = reflexprotocol.FormatHTTPUpgradeResponse(&serverHS, framing.upgrade)
+	case framing.http2:
+		response = reflexprotocol.FormatHTTP2Response(&serverHS)
+	default:
+		response = reflexprotocol.FormatHTTPResponse(&serverHS, h.handshakeStatus)
+	}
+	sess.BindIdentity(clientHS.UserID, granted)
+	if _, err := conn.Write(response); err != nil {
+		return errors.New("failed to write server handshake").Base(err)
+	}
+
+	if h.handshakeMode == HandshakeModeTLSLike {
+		// The response delay may have used up the deadline set in Process.
+		if err := conn.SetReadDeadline(time.Now().Add(h.sessionPolicy(0).Timeouts.Handshake)); err != nil {
+			return errors.New("unable to set read deadline").Base(err).AtWarning()
+		}
+		finished, err := readClientFinished(reader, framing.overHTTP)
+		if err == nil && framing.webSocket {
+			err = reflexprotocol.ReadMessageEnd(reader)
+		}
+		if err != nil {
+			return h.rejectHandshake(ctx, conn, framing, http.StatusBadRequest, err)
+		}
+		if !verifyClientFinished(sessionKey, clientHS.PublicKey, serverPublicKey, finished) {
+			return h.rejectHandshake(ctx, conn, framing, http.StatusForbidden, errors.New("invalid client finished"))
+		}
+	}
+
+	if _, asked := exts[reflexprotocol.ExtMorphDownlink]; asked && granted != "" {
+		ctx = contextWithDownlinkMorphing(ctx)
+	}
+
+	// Every check has passed: user, token, timestamp, replay, connection
+	// limit and, in "tls-like" mode, the finished flight. Only from here on
+	// does anything the client sends get parsed as a destination.
+	h.handshakeLatency.Observe(time.Since(start))
+	return h.handleSession(contextWithAuthenticated(ctx), handshake.session(ctx), reader, conn, dispatcher, sess, user)
+}
+
+// waitResponseDelay holds the server hello until a delay has passed since
+// the client hello arrived: one drawn from the configured distribution if
+// there is one, else in "tls-like" mode the flight gap plus a random jitter
+// of up to half of it.
+func (h *Handler) waitResponseDelay(ctx context.Context, helloAt time.Time) error {
+	var delay time.Duration
+	switch {
+	case h.responseDelay != nil:
+		delay = h.responseDelay.GetDelay()
+	case h.handshakeMode == HandshakeModeTLSLike && h.flightGap > 0:
+		delay = h.flightGap + time.Duration(mrand.Int63n(int64(h.flightGap/2)+1))
+	}
+	wait := delay - time.Since(helloAt)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *Handler) authenticateUser(userID [16]byte) (*protocol.MemoryUser, error) {
+	id := uuid.UUID(userID)
+	userIDStr := id.String()
+	hash := UserIDHash(id)
+	for _, user := range h.clients {
+		if accountID := user.Account.(*MemoryAccount).Id; accountID == userIDStr || accountID == hash {
+			return user, nil
+		}
+	}
+	return nil, errors.New("user not found")
+}
+
+// clientID returns the ID a configured client is known by: its Id, or if
+// it has none its IdHash in lower case. A UUID never reads as a hash, so
+// authenticateUser can match either against the same field.
+func clientID(client *reflex.User) (string, error) {
+	if client.IdHash == "" {
+		if _, err := uuid.ParseString(client.Id); err != nil {
+			return "", errors.New("invalid reflex user id: ", client.Id).Base(err).AtError()
+		}
+		return client.Id, nil
+	}
+	if client.Id != "" {
+		return "", errors.New("reflex user ", client.Id, " has both an id and an id hash").AtError()
+	}
+	hash := strings.ToLower(client.IdHash)
+	if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+		return "", errors.New("invalid reflex user id hash: ", client.IdHash).AtError()
+	}
+	return hash, nil
+}
+
+// userPolicy returns the profile name the user is served with: their own
+// Policy, or if they have none the default for the network being served.
+func (h *Handler) userPolicy(ctx context.Context, user *protocol.MemoryUser) string {
+	if policy := user.Account.(*MemoryAccount).Policy; policy != "" {
+		return policy
+	}
+	network, _ := ctx.Value(networkContextKey).(net.Network)
+	return h.networkProfiles[network]
+}
+
+func (h *Handler) handleSession(ctx context.Context, c sessionConn, reader *bufio.Reader, conn stat.Connection, dispatcher routing.Dispatcher, sess *reflexprotocol.Session, user *protocol.MemoryUser) error {
+	sess.SetProfile(reflexprotocol.GetProfileByName(h.userPolicy(ctx, user)))
+	sess.SetOperationTimeouts(conn, h.frameReadTimeout, h.frameWriteTimeout)
+	// Frames before the first DATA or UDP frame are still part of the
+	// handshake and bounded like it. The session restores this deadline
+	// after each frame read under its own timeout.
+	if err := sess.SetReadDeadline(time.Now().Add(h.sessionPolicy(0).Timeouts.Handshake)); err != nil {
+		return errors.New("unable to set read deadline").Base(err).AtWarning()
+	}
+	sess.SetRekeyThreshold(h.rekeyAfter)
+
+	// The lifetime limit is independent of the inactivity timer and runs
+	// from here, whatever the session goes on to carry: when it expires the
+	// context is canceled and the connection closed, which ends the frame
+	// loops below, in handleData and in handleUDP however busy they are.
+	if h.maxLifetime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.maxLifetime)
+		defer cancel()
+		expiry := time.AfterFunc(h.maxLifetime, func() { conn.Close() })
+		defer expiry.Stop()
+	}
+
+	// The client names its software in a frame of its own ahead of the
+	// first DATA or UDP frame; "" if it does not.
+	var version string
+	for {
+		frame, err := sess.ReadFrame(reader)
+		if err != nil {
+			if errors.Cause(err) == io.EOF {
+				return nil
+			}
+			return errors.New("failed to read frame").Base(err)
+		}
+
+		switch frame.Type {
+		case reflexprotocol.FrameTypeClientVersion:
+			if version = clientVersion(frame.Payload); version != "" {
+				errors.LogInfo(ctx, "reflex client ", user.Email, " runs ", version)
+			}
+		case reflexprotocol.FrameTypeData:
+			h.clientVersions.add(version)
+			return h.handleData(ContextWithClientVersion(ctx, version), c.data(ctx), frame.Payload, reader, conn, dispatcher, sess, user)
+		case reflexprotocol.FrameTypeUDP:
+			h.clientVersions.add(version)
+			return h.handleUDP(ContextWithClientVersion(ctx, version), c.data(ctx), frame.Payload, reader, conn, dispatcher, sess, user)
+		case reflexprotocol.FrameTypePadding, reflexprotocol.FrameTypeTiming:
+			if err := sess.HandleControlFrame(frame, sess.Profile()); err != nil {
+				return err
+			}
+		case reflexprotocol.FrameTypePing, reflexprotocol.FrameTypePong:
+			if err := sess.HandleHeartbeat(conn, frame); err != nil {
+				return err
+			}
+		case reflexprotocol.FrameTypeRekey:
+			if err := sess.HandleRekey(conn, frame); err != nil {
+				return err
+			}
+		case reflexprotocol.FrameTypeClose, reflexprotocol.FrameTypeCloseWrite:
+			return nil
+		}
+	}
+}
+
+// handleData dispatches the destination carried by the first DATA frame and
+// relays frames in both directions until either side closes.
+func (h *Handler) handleData(ctx context.Context, _ dataConn, data []byte, reader *bufio.Reader, conn stat.Connection, dispatcher routing.Dispatcher, sess *reflexprotocol.Session, user *protocol.MemoryUser) error {
+	routeTag, data, err := parseRouteTag(data)
+	if err != nil {
+		return errors.New("invalid route tag").Base(err)
+	}
+	if routeTag != "" && !user.Account.(*MemoryAccount).permitsRouteTag(routeTag) {
+		return errors.New("route tag ", routeTag, " not permitted for ", user.Email).AtWarning()
+	}
+	noResolve, data := parseNoResolve(data)
+	dest, payload, err := sessionDestination(ctx, net.Network_TCP, data)
+	if err != nil {
+		return err
+	}
+	if h.blockedPorts[dest.Port] {
+		return errors.New("destination port ", dest.Port, " is blocked").AtWarning()
+	}
+	if err := sess.SetReadDeadline(time.Time{}); err != nil {
+		return errors.New("unable to set read deadline").Base(err).AtWarning()
+	}
+	requested := dest
+	if !noResolve || !h.allowNoResolve {
+		if dest, err = h.resolveDestination(dest); err != nil {
+			return err
+		}
+	}
+
+	inbound := session.InboundFromContext(ctx)
+	if inbound == nil {
+		inbound = &session.Inbound{}
+		ctx = session.ContextWithInbound(ctx, inbound)
+	}
+	inbound.Name = "reflex"
+	if h.tag != "" {
+		inbound.Tag = h.tag
+	}
+	inbound.User = user
+	inbound.CanSpliceCopy = 3
+	sessionPolicy := h.sessionPolicy(user.Level)
+	h.countUserTraffic(sess, user)
+
+	loggedDest := h.loggedDestination(dest)
+	accessMessage := &log.AccessMessage{
+		From:   remoteAddr(conn),
+		To:     loggedDest,
+		Status: log.AccessAccepted,
+		Reason: "",
+		Email:  user.Email,
+	}
+	if h.accessLogStart {
+		// The dispatcher records the message once it has routed the request.
+		ctx = log.ContextWithAccessMessage(ctx, accessMessage)
+	}
+	errors.LogInfo(ctx, "received request for ", loggedDest)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	idle := h.newIdleTimer(ctx, cancel, sessionPolicy.Timeouts.ConnectionIdle)
+	ctx = policy.ContextWithBufferPolicy(ctx, h.bufferPolicy(sessionPolicy.Buffer))
+	ctx = ContextWithAffinityKey(ctx, affinityKey(user.Email, dest))
+	if routeTag != "" {
+		ctx = ContextWithRouteTag(ctx, routeTag)
+	}
+	ctx = contextWithSniffedContent(ctx, requested, payload, h.routeBySNI)
+
+	link, err := dispatcher.Dispatch(ctx, dest)
+	if err != nil {
+		return errors.New("failed to dispatch request to ", loggedDest).Base(err)
+	}
+
+	// Usage is counted under the profile the session starts with.
+	var usage *profileCounters
+	if profile := sess.Profile(); profile != nil {
+		usage = h.profileUsage.get(profile.Name)
+		usage.connections.Add(1)
+	}
+	var uplink, downlink atomic.Uint64
+	countUplink := func(n int) {
+		uplink.Add(uint64(n))
+		if usage != nil {
+			usage.uplink.Add(uint64(n))
+		}
+	}
+	if h.accessLogCompletion {
+		start := time.Now()
+		defer func() {
+			completed := *accessMessage
+			completed.Reason = fmt.Sprintf("closed after %v, %d bytes up, %d bytes down",
+				time.Since(start).Round(time.Millisecond), uplink.Load(), downlink.Load())
+			log.Record(&completed)
+		}()
+	}
+
+	requestDone := func() error {
+		defer idle.uplinkDone(sessionPolicy.Timeouts.DownlinkOnly)
+		activity := idle.uplink()
+		upstream := buf.Writer(link.Writer)
+		doneSending := func() error { return nil }
+		if h.coalesceBytes > 0 {
+			coalescer := newCoalescingWriter(link.Writer, h.coalesceBytes, h.coalesceDelay)
+			defer coalescer.discard()
+			upstream = coalescer
+			doneSending = func() error {
+				if err := coalescer.Flush(); err != nil {
+					return errors.New("failed to transfer request").Base(err)
+				}
+				return nil
+			}
+		}
+		if len(payload) > 0 {
+			countUplink(len(payload))
+			if err := upstream.WriteMultiBuffer(buf.MergeBytes(nil, payload)); err != nil {
+				return errors.New("failed to transfer request").Base(err)
+			}
+		}
+		for {
+			frame, err := sess.ReadFrame(reader)
+			if err != nil {
+				if errors.Cause(err) == io.EOF {
+					return doneSending()
+				}
+				return errors.New("failed to read frame").Base(err)
+			}
+			activity.Update()
+
+			switch frame.Type {
+			case reflexprotocol.FrameTypeData:
+				if len(frame.Payload) == 0 {
+					continue
+				}
+				countUplink(len(frame.Payload))
+				if err := upstream.WriteMultiBuffer(buf.MergeBytes(nil, frame.Payload)); err != nil {
+					return errors.New("failed to transfer request").Base(err)
+				}
+			case reflexprotocol.FrameTypePadding, reflexprotocol.FrameTypeTiming:
+				if err := sess.HandleControlFrame(frame, sess.Profile()); err != nil {
+					return err
+				}
+			case reflexprotocol.FrameTypePing, reflexprotocol.FrameTypePong:
+				if err := sess.HandleHeartbeat(conn, frame); err != nil {
+					return err
+				}
+			case reflexprotocol.FrameTypeRekey:
+				if err := sess.HandleRekey(conn, frame); err != nil {
+					return err
+				}
+			case reflexprotocol.FrameTypeClose, reflexprotocol.FrameTypeCloseWrite:
+				// The client is done sending. The upstream sees EOF while
+				// the response keeps flowing.
+				return doneSending()
+			}
+		}
+	}
+
+	// Cover frames stop before the CLOSE_WRITE that ends the response, so
+	// nothing follows it.
+	coverCtx, stopCover := context.WithCancel(ctx)
+	coverDone := make(chan struct{})
+	go func() {
+		defer close(coverDone)
+		if versionAtLeast(ClientVersionFromContext(ctx), h.idleCoverMinVersion) {
+			sess.SendIdleCover(coverCtx, conn, h.idleCover)
+		}
+	}()
+	defer stopCover()
+
+	responseDone := func() error {
+		defer idle.downlinkDone(sessionPolicy.Timeouts.UplinkOnly)
+		writer := &sessionWriter{session: sess, writer: conn, morph: morphsDownlink(ctx), counters: []*atomic.Uint64{&downlink}}
+		if usage != nil {
+			writer.counters = append(writer.counters, &usage.downlink)
+		}
+		if h.learnProfiles {
+			writer.learner = h.learners.get(user.Email)
+		}
+		if err := buf.Copy(link.Reader, writer, buf.UpdateActivity(idle.downlink())); err != nil {
+			if buf.IsWriteError(err) {
+				// The client went away. Failing this task makes task.Run
+				// return at once, and the link is interrupted below
+				// without waiting for the request side.
+				if h.clientDisconnects != nil {
+					h.clientDisconnects.Add(1)
+				}
+				return errors.New("client closed during response").Base(err)
+			}
+			return errors.New("failed to write response").Base(err)
+		}
+		// The upstream is done; the client may still be sending.
+		stopCover()
+		<-coverDone
+		if err := sess.FlushMorphed(); err != nil {
+			return errors.New("failed to write response").Base(err)
+		}
+		return sess.WriteFrame(conn, reflexprotocol.FrameTypeCloseWrite, nil)
+	}
+
+	requestDonePost := task.OnSuccess(requestDone, task.Close(link.Writer))
+	if err := task.Run(ctx, requestDonePost, responseDone); err != nil {
+		common.Interrupt(link.Reader)
+		common.Interrupt(link.Writer)
+		return errors.New("connection ends").Base(err)
+	}
 	return nil
 }
 
-// New creates a new Reflex inbound handler from config.
-func New(ctx context.Context, config *reflex.InboundConfig) (proxy.InboundHandler, error) {
-	_ = ctx
-	_ = config
-	return &Handler{}, nil
+// resolveDestination replaces a domain destination with one of its IPs when
+// the inbound resolves locally.
+func (h *Handler) resolveDestination(dest net.Destination) (net.Destination, error) {
+	if h.dns == nil || !dest.Address.Family().IsDomain() {
+		return dest, nil
+	}
+	ips, _, err := h.dns.LookupIP(dest.Address.Domain(), dns.IPOption{
+		IPv4Enable: true,
+		IPv6Enable: true,
+	})
+	if err != nil {
+		return dest, errors.New("failed to resolve ", h.loggedDestination(dest)).Base(err)
+	}
+	if len(ips) == 0 {
+		return dest, dns.ErrEmptyResponse
+	}
+	dest.Address = net.IPAddress(ips[dice.Roll(len(ips))])
+	return dest, nil
+}
+
+// bufferPolicy applies the in-flight cap to the level's buffer policy. The
+// dispatcher sizes the link's pipes from it, so writing a frame to a full
+// link blocks the read loop instead of buffering without bound.
+func (h *Handler) bufferPolicy(bp policy.Buffer) policy.Buffer {
+	if h.maxInFlight > 0 && (bp.PerConnection < 0 || bp.PerConnection > h.maxInFlight) {
+		bp.PerConnection = h.maxInFlight
+	}
+	return bp
+}
+
+// sessionWriter is a buf.Writer that encrypts everything into DATA frames,
+// morphed with the session's traffic profile if morph is set and it has
+// one.
+type sessionWriter struct {
+	session  *reflexprotocol.Session
+	writer   io.Writer
+	morph    bool             // see reflexprotocol.ExtMorphDownlink
+	counters []*atomic.Uint64 // each counts the payload bytes written
+
+	learner   *trafficLearner // records the payloads written, if set
+	lastWrite time.Time
+}
+
+func (w *sessionWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	defer buf.ReleaseMulti(mb)
+	for _, b := range mb {
+		if b.IsEmpty() {
+			continue
+		}
+		for _, counter := range w.counters {
+			counter.Add(uint64(b.Len()))
+		}
+		if w.learner != nil {
+			now := time.Now()
+			delay := time.Duration(-1)
+			if !w.lastWrite.IsZero() {
+				delay = now.Sub(w.lastWrite)
+			}
+			w.lastWrite = now
+			w.learner.observe(int(b.Len()), delay)
+		}
+		var err error
+		if profile := w.session.Profile(); w.morph && profile != nil {
+			err = w.session.WriteFrameWithMorphing(w.writer, reflexprotocol.FrameTypeData, b.Bytes(), profile)
+		} else {
+			err = w.session.WriteFrame(w.writer, reflexprotocol.FrameTypeData, b.Bytes())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,1659 @@
+package inbound
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	stdnet "net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	appstats "github.com/xtls/xray-core/app/stats"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/common/uuid"
+	"github.com/xtls/xray-core/features/dns"
+	"github.com/xtls/xray-core/features/policy"
+	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/proxy/reflex/internal/conntest"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+	"github.com/xtls/xray-core/transport"
+	"github.com/xtls/xray-core/transport/pipe"
+)
+
+const testUserID = "b831381d-6324-4d53-ad4f-8cda48b30811"
+
+// echoDispatcher echoes everything written to a dispatched link back to
+// the reader side and remembers the destinations and contexts it was
+// asked for.
+type echoDispatcher struct {
+	dests    chan net.Destination
+	contexts chan context.Context
+}
+
+func newEchoDispatcher() *echoDispatcher {
+	return &echoDispatcher{
+		dests:    make(chan net.Destination, 16),
+		contexts: make(chan context.Context, 16),
+	}
+}
+
+func (*echoDispatcher) Type() interface{} { return nil }
+func (*echoDispatcher) Start() error      { return nil }
+func (*echoDispatcher) Close() error      { return nil }
+
+func (d *echoDispatcher) Dispatch(ctx context.Context, dest net.Destination) (*transport.Link, error) {
+	d.dests <- dest
+	d.contexts <- ctx
+	upReader, upWriter := pipe.New()
+	downReader, downWriter := pipe.New()
+	go func() {
+		buf.Copy(upReader, downWriter)
+		downWriter.Close()
+	}()
+	return &transport.Link{Reader: downReader, Writer: upWriter}, nil
+}
+
+func (d *echoDispatcher) DispatchLink(ctx context.Context, dest net.Destination, link *transport.Link) error {
+	return errors.New("not implemented")
+}
+
+// testPolicy is a policy.Manager that adjusts the default session policy
+// of each level with its function.
+type testPolicy func(level uint32, s *policy.Session)
+
+func (testPolicy) Type() interface{} { return policy.ManagerType() }
+func (testPolicy) Start() error      { return nil }
+func (testPolicy) Close() error      { return nil }
+
+func (p testPolicy) ForLevel(level uint32) policy.Session {
+	s := policy.SessionDefault()
+	p(level, &s)
+	return s
+}
+
+func (testPolicy) ForSystem() policy.System { return policy.System{} }
+
+func newTestHandler(t *testing.T, config *reflex.InboundConfig) *Handler {
+	t.Helper()
+	if config.Clients == nil {
+		config.Clients = []*reflex.User{{Id: testUserID}}
+	}
+	h, err := New(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.(*Handler)
+}
+
+// serve runs h.Process on the server end of a pipe and returns the client end
+// together with a channel that yields Process' result.
+func serve(t *testing.T, h *Handler, dispatcher routing.Dispatcher) (stdnet.Conn, <-chan error) {
+	t.Helper()
+	client, server := stdnet.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Process(context.Background(), net.Network_TCP, server, dispatcher)
+		server.Close()
+	}()
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client, done
+}
+
+func newTestClientHandshake(t *testing.T, userID string) (*protocol.ClientHandshake, [32]byte) {
+	t.Helper()
+	priv, pub, err := protocol.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := uuid.ParseString(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := &protocol.ClientHandshake{
+		PublicKey: pub,
+		UserID:    id,
+		Timestamp: time.Now().Unix(),
+	}
+	rand.Read(hs.Nonce[:])
+	return hs, priv
+}
+
+// clientSessionFromResponse reads the server handshake and derives the
+// client's session.
+func clientSessionFromResponse(t *testing.T, reader *bufio.Reader, hs *protocol.ClientHandshake, priv [32]byte) (*protocol.Session, *protocol.ServerHandshake) {
+	t.Helper()
+	sess, serverHS, _ := clientSessionWithProfile(t, reader, hs, priv)
+	return sess, serverHS
+}
+
+// clientSessionWithProfile is clientSessionFromResponse that also returns
+// the profile the server granted.
+func clientSessionWithProfile(t *testing.T, reader *bufio.Reader, hs *protocol.ClientHandshake, priv [32]byte) (*protocol.Session, *protocol.ServerHandshake, string) {
+	t.Helper()
+	serverHS, err := readServerHandshake(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, profile := clientSessionFromServer(t, hs, priv, serverHS)
+	return sess, serverHS, profile
+}
+
+// clientSessionFromServer derives the client's session from a server
+// handshake read however it was framed, and returns it with the profile
+// the server granted.
+func clientSessionFromServer(t *testing.T, hs *protocol.ClientHandshake, priv [32]byte, serverHS *protocol.ServerHandshake) (*protocol.Session, string) {
+	t.Helper()
+	sess, err := protocol.NewSession(clientSessionKey(t, hs, priv, serverHS), protocol.RoleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, err := protocol.GrantedProfile(sess, serverHS.PolicyGrant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.BindIdentity(hs.UserID, profile)
+	return sess, profile
+}
+
+// clientSessionKey derives the client's session key from the handshakes.
+func clientSessionKey(t *testing.T, hs *protocol.ClientHandshake, priv [32]byte, serverHS *protocol.ServerHandshake) []byte {
+	t.Helper()
+	shared, err := protocol.DeriveSharedKey(priv, serverHS.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return protocol.DeriveSessionKey(shared, hs.Nonce[:])
+}
+
+// echoRoundTrip sends a request for dest with payload and expects it echoed.
+func echoRoundTrip(t *testing.T, conn io.Writer, reader io.Reader, sess *protocol.Session, dest net.Destination, payload string) {
+	t.Helper()
+	header, err := protocol.EncodeDestination(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.WriteFrame(conn, protocol.FrameTypeData, append(header, payload...)); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := sess.ReadFrame(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Type != protocol.FrameTypeData || string(frame.Payload) != payload {
+		t.Fatalf("unexpected echo frame: type %d payload %q", frame.Type, frame.Payload)
+	}
+}
+
+func TestHandshakeMagicEcho(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	dispatcher := newEchoDispatcher()
+	conn, _ := serve(t, h, dispatcher)
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	dest := net.TCPDestination(net.DomainAddress("example.com"), 443)
+	echoRoundTrip(t, conn, reader, sess, dest, "hello reflex")
+
+	if got := <-dispatcher.dests; got != dest {
+		t.Errorf("dispatched to %v, want %v", got, dest)
+	}
+}
+
+func TestHandshakeVersion(t *testing.T) {
+	hs, priv := newTestClientHandshake(t, testUserID)
+	var flight bytes.Buffer
+	if err := writeClientHandshakeMagic(&flight, hs); err != nil {
+		t.Fatal(err)
+	}
+	if flight.Bytes()[4] != protocol.HandshakeVersion {
+		t.Fatalf("handshake sent with version %d", flight.Bytes()[4])
+	}
+
+	// An unknown version is refused with 426 even when there is a
+	// fallback, as its sender is a reflex client.
+	h := newTestHandler(t, &reflex.InboundConfig{Fallback: &reflex.Fallback{Dest: 1}})
+	unknown := bytes.Clone(flight.Bytes())
+	unknown[4] = protocol.HandshakeVersion + 1
+	conn, done := serve(t, h, newEchoDispatcher())
+	go conn.Write(unknown)
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	if !strings.HasPrefix(line, "HTTP/1.1 426") {
+		t.Errorf("unknown handshake version answered with %q", line)
+	}
+	if err := <-done; err == nil {
+		t.Error("expected Process to fail for an unknown handshake version")
+	}
+
+	// Version 1 authenticates as before.
+	conn, _ = serve(t, h, newEchoDispatcher())
+	go conn.Write(flight.Bytes())
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "version 1")
+}
+
+func TestHandshakeHTTPPostEcho(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	conn, _ := serve(t, h, newEchoDispatcher())
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeHTTP(conn, hs, "example.com")
+
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "over http")
+}
+
+func TestHandshakeHTTPUpgradeEcho(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{HandshakeStatus: 201, HTTPUpgrade: "websocket"})
+	conn, _ := serve(t, h, newEchoDispatcher())
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	raw, err := hs.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go conn.Write(protocol.AppendHTTPUpgradeHandshake(nil, raw, "example.com", "websocket"))
+
+	reader := bufio.NewReader(conn)
+	want := "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"
+	if head, err := reader.Peek(len(want)); err != nil || string(head) != want {
+		t.Fatalf("response starts %q, %v, want %q", head, err, want)
+	}
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "after the upgrade")
+}
+
+func TestHandshakeHTTPUpgradeOtherProtocolFallsBack(t *testing.T) {
+	hs, _ := newTestClientHandshake(t, testUserID)
+	raw, err := hs.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tc := range map[string]struct {
+		accepted, asked string
+	}{
+		"other protocol":   {"websocket", "h2c"},
+		"upgrade disabled": {"", "websocket"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			request := protocol.AppendHTTPUpgradeHandshake(nil, raw, "example.com", tc.asked)
+			port, received := startFallbackServer(t, len(request), "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n")
+			h := newTestHandler(t, &reflex.InboundConfig{
+				Fallback:      &reflex.Fallback{Dest: port},
+				HTTPUpgrade:   tc.accepted,
+				WebSocketPath: "/ws",
+			})
+			conn, _ := serve(t, h, newEchoDispatcher())
+			go conn.Write(request)
+			select {
+			case got := <-received:
+				if got != string(request) {
+					t.Errorf("fallback received %q, want the request", got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("upgrade request not handed to fallback")
+			}
+		})
+	}
+}
+
+func TestHandshakeGrantsProfile(t *testing.T) {
+	for policy, want := range map[string]string{"": "", "mimic-youtube": "youtube", "no-such-profile": ""} {
+		h := newTestHandler(t, &reflex.InboundConfig{Clients: []*reflex.User{{Id: testUserID, Policy: policy}}})
+		conn, _ := serve(t, h, newEchoDispatcher())
+		hs, priv := newTestClientHandshake(t, testUserID)
+		go writeClientHandshakeMagic(conn, hs)
+		_, _, got := clientSessionWithProfile(t, bufio.NewReader(conn), hs, priv)
+		if got != want {
+			t.Errorf("policy %q granted profile %q, want %q", policy, got, want)
+		}
+	}
+}
+
+func TestPolicyGrantIsSealed(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{Clients: []*reflex.User{{Id: testUserID, Policy: "http2-api"}}})
+	conn, _ := serve(t, h, newEchoDispatcher())
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+
+	reader := bufio.NewReader(conn)
+	serverHS, err := readServerHandshake(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(serverHS.PolicyGrant, []byte("http2-api")) {
+		t.Errorf("profile name in the clear in grant %x", serverHS.PolicyGrant)
+	}
+
+	// Another key cannot open it.
+	other, err := protocol.NewSession(make([]byte, 32), protocol.RoleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := protocol.GrantedProfile(other, bytes.Clone(serverHS.PolicyGrant)); err == nil {
+		t.Error("grant opened under the wrong key")
+	}
+
+	sess, err := protocol.NewSession(clientSessionKey(t, hs, priv, serverHS), protocol.RoleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, err := protocol.GrantedProfile(sess, serverHS.PolicyGrant)
+	if err != nil || profile != "http2-api" {
+		t.Fatalf("protocol.GrantedProfile = %q, %v, want http2-api", profile, err)
+	}
+	sess.BindIdentity(hs.UserID, profile)
+	// The grant took the first nonce on both ends; frames follow it.
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "after the grant")
+}
+
+func TestFramesBoundToGrantedProfile(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{Clients: []*reflex.User{{Id: testUserID, Policy: "http2-api"}}})
+	conn, done := serve(t, h, newEchoDispatcher())
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _, profile := clientSessionWithProfile(t, reader, hs, priv)
+	if profile != "http2-api" {
+		t.Fatalf("granted %q, want http2-api", profile)
+	}
+
+	// A client that disagrees on the profile cannot talk to the server,
+	// though it holds the session key.
+	sess.BindIdentity(hs.UserID, "zoom")
+	header, err := protocol.EncodeDestination(net.TCPDestination(net.LocalHostIP, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.WriteFrame(conn, protocol.FrameTypeData, append(header, "hello"...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err == nil {
+		t.Error("server opened a frame bound to another profile")
+	}
+}
+
+func TestNetworkDefaultProfile(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{
+		Clients: []*reflex.User{
+			{Id: testUserID},
+			{Id: "a1b2c3d4-0000-4000-8000-000000000002", Policy: "zoom"},
+		},
+		NetworkProfiles: map[string]string{"tcp": "http2-api", "udp": "mimic-youtube"},
+	})
+	for _, tc := range []struct {
+		network net.Network
+		user    string
+		want    string
+	}{
+		{net.Network_TCP, testUserID, "http2-api"},
+		{net.Network_UDP, testUserID, "youtube"},
+		// A user's own Policy wins over the network default.
+		{net.Network_UDP, "a1b2c3d4-0000-4000-8000-000000000002", "zoom"},
+	} {
+		client, server := conntest.Pipe()
+		hs, priv := newTestClientHandshake(t, tc.user)
+		if err := writeClientHandshakeMagic(client, hs); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			h.Process(context.Background(), tc.network, server, newEchoDispatcher())
+			server.Close()
+		}()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _, got := clientSessionWithProfile(t, bufio.NewReader(client), hs, priv)
+		if got != tc.want {
+			t.Errorf("%v user %s got profile %q, want %q", tc.network, tc.user, got, tc.want)
+		}
+		client.Close()
+	}
+}
+
+func TestNewRejectsInvalidNetworkProfile(t *testing.T) {
+	for _, profiles := range []map[string]string{
+		{"sctp": "youtube"},
+		{"tcp": "no-such-profile"},
+	} {
+		if _, err := New(context.Background(), &reflex.InboundConfig{NetworkProfiles: profiles}); err == nil {
+			t.Errorf("accepted network profiles %v", profiles)
+		}
+	}
+}
+
+func TestHandshakeXChaChaEcho(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	conn, _ := serve(t, h, newEchoDispatcher())
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	hs.PolicyReq = protocol.AppendExtension(nil, protocol.ExtCipherSuite, []byte{protocol.CipherSuiteXChaCha20Poly1305})
+	go writeClientHandshakeMagic(conn, hs)
+
+	reader := bufio.NewReader(conn)
+	serverHS, err := readServerHandshake(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := protocol.DeriveSharedKey(priv, serverHS.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := protocol.NewSessionWithCipherSuite(protocol.DeriveSessionKey(shared, hs.Nonce[:]), protocol.CipherSuiteXChaCha20Poly1305, protocol.RoleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := protocol.GrantedProfile(sess, serverHS.PolicyGrant); err != nil {
+		t.Fatal(err)
+	}
+	sess.BindIdentity(hs.UserID, "")
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "over xchacha")
+}
+
+func TestHandshakeUnsupportedCipherSuiteRejected(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	conn, done := serve(t, h, newEchoDispatcher())
+
+	hs, _ := newTestClientHandshake(t, testUserID)
+	hs.PolicyReq = protocol.AppendExtension(nil, protocol.ExtCipherSuite, []byte{0x7f})
+	go writeClientHandshakeMagic(conn, hs)
+
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	if !strings.HasPrefix(line, "HTTP/1.1 403") {
+		t.Errorf("unexpected response %q", line)
+	}
+	if err := <-done; err == nil {
+		t.Error("expected Process to fail for an unsupported cipher suite")
+	}
+}
+
+func TestAuthUnknownUUIDRejected(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	conn, done := serve(t, h, newEchoDispatcher())
+
+	hs, _ := newTestClientHandshake(t, "00000000-0000-0000-0000-000000000001")
+	go writeClientHandshakeMagic(conn, hs)
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "HTTP/1.1 403") {
+		t.Errorf("unexpected response %q", line)
+	}
+	if err := <-done; err == nil {
+		t.Error("expected Process to fail for an unknown user")
+	}
+}
+
+func TestHandshakeStaleTimestampRejected(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	conn, done := serve(t, h, newEchoDispatcher())
+
+	hs, _ := newTestClientHandshake(t, testUserID)
+	hs.Timestamp -= 2 * handshakeTimestampWindow
+	go writeClientHandshakeMagic(conn, hs)
+
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	if !strings.HasPrefix(line, "HTTP/1.1 403") {
+		t.Errorf("unexpected response %q", line)
+	}
+	if err := <-done; err == nil {
+		t.Error("expected Process to fail for a stale timestamp")
+	}
+}
+
+func TestReplayedFirstFlightRejected(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	hs, priv := newTestClientHandshake(t, testUserID)
+	var flight bytes.Buffer
+	if err := writeClientHandshakeMagic(&flight, hs); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, _ := serve(t, h, newEchoDispatcher())
+	go conn.Write(flight.Bytes())
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "original")
+
+	// The exact captured bytes on a fresh connection, well within the
+	// timestamp window.
+	replayConn, done := serve(t, h, newEchoDispatcher())
+	go replayConn.Write(flight.Bytes())
+	line, _ := bufio.NewReader(replayConn).ReadString('\n')
+	if !strings.HasPrefix(line, "HTTP/1.1 403") {
+		t.Errorf("replayed first flight answered with %q", line)
+	}
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "replay detected") {
+		t.Errorf("expected Process to fail with replay detected, got %v", err)
+	}
+}
+
+func TestHandshakeTLSLikeFlights(t *testing.T) {
+	gap := 50 * time.Millisecond
+	h := newTestHandler(t, &reflex.InboundConfig{
+		HandshakeMode:        HandshakeModeTLSLike,
+		HandshakeFlightGapMs: uint32(gap / time.Millisecond),
+	})
+	conn, _ := serve(t, h, newEchoDispatcher())
+
+	// client hello
+	hs, priv := newTestClientHandshake(t, testUserID)
+	start := time.Now()
+	go writeClientHandshakeMagic(conn, hs)
+
+	// server hello
+	reader := bufio.NewReader(conn)
+	sess, serverHS := clientSessionFromResponse(t, reader, hs, priv)
+	if elapsed := time.Since(start); elapsed < gap {
+		t.Errorf("server hello after %v, want at least %v", elapsed, gap)
+	}
+
+	// client finished
+	if _, err := conn.Write(computeClientFinished(clientSessionKey(t, hs, priv, serverHS), hs.PublicKey, serverHS.PublicKey)); err != nil {
+		t.Fatal(err)
+	}
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "after finished")
+}
+
+func TestHandshakeTLSLikeHTTPPost(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{
+		HandshakeMode:        HandshakeModeTLSLike,
+		HandshakeFlightGapMs: 10,
+	})
+	conn, _ := serve(t, h, newEchoDispatcher())
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeHTTP(conn, hs, "example.com")
+
+	reader := bufio.NewReader(conn)
+	sess, serverHS := clientSessionFromResponse(t, reader, hs, priv)
+
+	// The finished flight keeps the HTTP shape of the exchange.
+	finished := computeClientFinished(clientSessionKey(t, hs, priv, serverHS), hs.PublicKey, serverHS.PublicKey)
+	if err := writeHTTPData(conn, finished, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "after http finished")
+}
+
+func TestHandshakeTLSLikeGapBeyondHandshakeTimeout(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{
+		HandshakeMode:        HandshakeModeTLSLike,
+		HandshakeFlightGapMs: 200,
+	})
+	h.policyManager = testPolicy(func(_ uint32, s *policy.Session) {
+		s.Timeouts.Handshake = 150 * time.Millisecond
+	})
+	conn, _ := serve(t, h, newEchoDispatcher())
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, serverHS := clientSessionFromResponse(t, reader, hs, priv)
+
+	if _, err := conn.Write(computeClientFinished(clientSessionKey(t, hs, priv, serverHS), hs.PublicKey, serverHS.PublicKey)); err != nil {
+		t.Fatal(err)
+	}
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "late finished")
+}
+
+func TestHandshakeResponseDelayDistribution(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{
+		HandshakeDelays: []reflex.HandshakeDelay{
+			{DelayMs: 20, Weight: 1},
+			{DelayMs: 80, Weight: 1},
+		},
+	})
+
+	var short, long int
+	for i := 0; i < 16; i++ {
+		conn, _ := serve(t, h, newEchoDispatcher())
+		hs, priv := newTestClientHandshake(t, testUserID)
+		start := time.Now()
+		go writeClientHandshakeMagic(conn, hs)
+		clientSessionFromResponse(t, bufio.NewReader(conn), hs, priv)
+		switch elapsed := time.Since(start); {
+		case elapsed < 20*time.Millisecond:
+			t.Fatalf("handshake response after %v, before the shortest delay", elapsed)
+		case elapsed < 60*time.Millisecond:
+			short++
+		case elapsed >= 80*time.Millisecond:
+			long++
+		}
+		conn.Close()
+	}
+	// Each bucket is missed by all 16 draws with probability 2^-16.
+	if short == 0 || long == 0 {
+		t.Errorf("got %d short and %d long delays, want both", short, long)
+	}
+}
+
+func TestHandshakeRejectionDelayed(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{
+		HandshakeDelays: []reflex.HandshakeDelay{{DelayMs: 50, Weight: 1}},
+	})
+	conn, done := serve(t, h, newEchoDispatcher())
+
+	// An unknown user is refused no sooner than a known one is answered.
+	hs, _ := newTestClientHandshake(t, "00000000-0000-0000-0000-000000000001")
+	start := time.Now()
+	go writeClientHandshakeMagic(conn, hs)
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("refused after %v, before the response delay", elapsed)
+	}
+	if !strings.HasPrefix(line, "HTTP/1.1 403") {
+		t.Errorf("unexpected response %q", line)
+	}
+	conn.Close()
+	if err := <-done; err == nil {
+		t.Error("expected Process to fail for an unknown user")
+	}
+}
+
+func TestNewRejectsInvalidHandshakeDelay(t *testing.T) {
+	_, err := New(context.Background(), &reflex.InboundConfig{
+		HandshakeDelays: []reflex.HandshakeDelay{{DelayMs: 10, Weight: 0}},
+	})
+	if err == nil {
+		t.Error("accepted a handshake delay with zero weight")
+	}
+}
+
+func TestHandshakeTLSLikeBadFinished(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{HandshakeMode: HandshakeModeTLSLike})
+	conn, done := serve(t, h, newEchoDispatcher())
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	clientSessionFromResponse(t, reader, hs, priv)
+
+	go conn.Write(make([]byte, clientFinishedSize))
+	line, _ := reader.ReadString('\n')
+	if !strings.HasPrefix(line, "HTTP/1.1 403") {
+		t.Errorf("unexpected response %q", line)
+	}
+	if err := <-done; err == nil {
+		t.Error("expected Process to fail for a bad client finished")
+	}
+}
+
+func TestNewRejectsNilConfig(t *testing.T) {
+	if _, err := New(context.Background(), nil); err == nil {
+		t.Error("expected an error for a nil config")
+	}
+}
+
+func TestNewRejectsUnknownHandshakeMode(t *testing.T) {
+	_, err := New(context.Background(), &reflex.InboundConfig{HandshakeMode: "quic-like"})
+	if err == nil {
+		t.Error("expected an error for an unknown handshake mode")
+	}
+}
+
+func TestNewUnknownPolicy(t *testing.T) {
+	clients := []*reflex.User{{Id: testUserID, Policy: "youtub"}}
+	if _, err := New(context.Background(), &reflex.InboundConfig{Clients: clients, StrictPolicy: true}); err == nil {
+		t.Error("expected an error for an unknown policy in strict mode")
+	}
+	if _, err := New(context.Background(), &reflex.InboundConfig{Clients: clients}); err != nil {
+		t.Errorf("unknown policy should only be logged outside strict mode: %v", err)
+	}
+	clients[0].Policy = "mimic-youtube"
+	if _, err := New(context.Background(), &reflex.InboundConfig{Clients: clients, StrictPolicy: true}); err != nil {
+		t.Errorf("known policy rejected: %v", err)
+	}
+}
+
+func TestDispatchAffinityKey(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	dispatcher := newEchoDispatcher()
+
+	dial := func(dest net.Destination) string {
+		conn, _ := serve(t, h, dispatcher)
+		hs, priv := newTestClientHandshake(t, testUserID)
+		go writeClientHandshakeMagic(conn, hs)
+		reader := bufio.NewReader(conn)
+		sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+		echoRoundTrip(t, conn, reader, sess, dest, "ping")
+		<-dispatcher.dests
+		return AffinityKeyFromContext(<-dispatcher.contexts)
+	}
+
+	dest := net.TCPDestination(net.DomainAddress("example.com"), 443)
+	first := dial(dest)
+	if first == "" {
+		t.Fatal("no affinity key in dispatch context")
+	}
+	if second := dial(dest); second != first {
+		t.Errorf("affinity key not stable: %q != %q", second, first)
+	}
+	if other := dial(net.TCPDestination(net.DomainAddress("example.org"), 443)); other == first {
+		t.Error("different destinations share an affinity key")
+	}
+}
+
+func TestDispatchInboundTag(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{Tag: "reflex-in"})
+	dispatcher := newEchoDispatcher()
+	conn, _ := serve(t, h, dispatcher)
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "tagged")
+
+	inbound := session.InboundFromContext(<-dispatcher.contexts)
+	if inbound == nil || inbound.Tag != "reflex-in" {
+		t.Errorf("inbound tag not in dispatch context: %+v", inbound)
+	}
+}
+
+func TestUserPolicyLevel(t *testing.T) {
+	const otherUserID = "a1b2c3d4-0000-4000-8000-000000000002"
+	h := newTestHandler(t, &reflex.InboundConfig{Clients: []*reflex.User{
+		{Id: testUserID},
+		{Id: otherUserID, Level: 1},
+	}})
+	// Level n has a ConnectionIdle of idle[n] and a per-connection buffer
+	// of 1000+n bytes.
+	idle := []time.Duration{time.Minute, 100 * time.Millisecond}
+	h.policyManager = testPolicy(func(level uint32, s *policy.Session) {
+		s.Timeouts.ConnectionIdle = idle[level]
+		s.Buffer.PerConnection = 1000 + int32(level)
+	})
+
+	for _, tc := range []struct {
+		id      string
+		level   uint32
+		expires bool
+	}{
+		{testUserID, 0, false},
+		{otherUserID, 1, true},
+	} {
+		dispatcher := newEchoDispatcher()
+		conn, _ := serve(t, h, dispatcher)
+		hs, priv := newTestClientHandshake(t, tc.id)
+		go writeClientHandshakeMagic(conn, hs)
+		reader := bufio.NewReader(conn)
+		sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+		echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "level")
+
+		ctx := <-dispatcher.contexts
+		if inbound := session.InboundFromContext(ctx); inbound == nil || inbound.User.Level != tc.level {
+			t.Errorf("user %s: dispatched at %+v, want level %d", tc.id, inbound, tc.level)
+		}
+		if bp := policy.BufferPolicyFromContext(ctx); bp.PerConnection != 1000+int32(tc.level) {
+			t.Errorf("user %s: buffer of %d bytes, want the one of level %d", tc.id, bp.PerConnection, tc.level)
+		}
+		// Only the level 1 idle timeout is short enough to end the
+		// connection while it sits idle.
+		select {
+		case <-ctx.Done():
+			if !tc.expires {
+				t.Errorf("user %s: connection ended by a level 1 idle timeout", tc.id)
+			}
+		case <-time.After(time.Second):
+			if tc.expires {
+				t.Errorf("user %s: idle connection outlived its level's timeout", tc.id)
+			}
+		}
+	}
+}
+
+// stalledDispatcher sizes its pipes from the buffer policy like Xray's
+// dispatcher, but its upstream reads nothing until release is closed and
+// then reports how many bytes arrived.
+type stalledDispatcher struct {
+	release  chan struct{}
+	received chan int
+}
+
+func (*stalledDispatcher) Type() interface{} { return nil }
+func (*stalledDispatcher) Start() error      { return nil }
+func (*stalledDispatcher) Close() error      { return nil }
+
+func (d *stalledDispatcher) Dispatch(ctx context.Context, dest net.Destination) (*transport.Link, error) {
+	opt := pipe.OptionsFromContext(ctx)
+	upReader, upWriter := pipe.New(opt...)
+	downReader, downWriter := pipe.New(opt...)
+	go func() {
+		<-d.release
+		var counter buf.SizeCounter
+		buf.Copy(upReader, buf.Discard, buf.CountSize(&counter))
+		downWriter.Close()
+		d.received <- int(counter.Size)
+	}()
+	return &transport.Link{Reader: downReader, Writer: upWriter}, nil
+}
+
+func (d *stalledDispatcher) DispatchLink(ctx context.Context, dest net.Destination, link *transport.Link) error {
+	return errors.New("not implemented")
+}
+
+func TestMaxInFlightStallsReadLoop(t *testing.T) {
+	const frameSize, frames = 16 << 10, 64
+	h := newTestHandler(t, &reflex.InboundConfig{MaxInFlightBytes: 64 << 10})
+	dispatcher := &stalledDispatcher{release: make(chan struct{}), received: make(chan int, 1)}
+	conn, _ := serve(t, h, dispatcher)
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	header, err := protocol.EncodeDestination(net.TCPDestination(net.LocalHostIP, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var written atomic.Int32
+	writeDone := make(chan error, 1)
+	go func() {
+		if err := sess.WriteFrame(conn, protocol.FrameTypeData, header); err != nil {
+			writeDone <- err
+			return
+		}
+		for i := 0; i < frames; i++ {
+			if err := sess.WriteFrame(conn, protocol.FrameTypeData, make([]byte, frameSize)); err != nil {
+				writeDone <- err
+				return
+			}
+			written.Add(1)
+		}
+		writeDone <- sess.WriteFrame(conn, protocol.FrameTypeClose, nil)
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	if n := written.Load(); n > 8 {
+		t.Fatalf("server read %d frames for a stalled upstream, want it to stop near the cap", n)
+	}
+
+	close(dispatcher.release)
+	if err := <-writeDone; err != nil {
+		t.Fatal(err)
+	}
+	if got := <-dispatcher.received; got != frameSize*frames {
+		t.Errorf("upstream received %d bytes, want %d", got, frameSize*frames)
+	}
+}
+
+// staticDNS resolves every domain to the same address.
+type staticDNS struct {
+	ip      net.IP
+	lookups chan string
+}
+
+func (*staticDNS) Type() interface{} { return nil }
+func (*staticDNS) Start() error      { return nil }
+func (*staticDNS) Close() error      { return nil }
+
+func (d *staticDNS) LookupIP(domain string, option dns.IPOption) ([]net.IP, uint32, error) {
+	d.lookups <- domain
+	return []net.IP{d.ip}, 600, nil
+}
+
+func TestResolveLocally(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{ResolveLocally: true})
+	resolver := &staticDNS{ip: net.IP{192, 0, 2, 7}, lookups: make(chan string, 1)}
+	h.dns = resolver
+	dispatcher := newEchoDispatcher()
+	conn, _ := serve(t, h, dispatcher)
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.DomainAddress("example.com"), 443), "resolved")
+
+	if domain := <-resolver.lookups; domain != "example.com" {
+		t.Errorf("looked up %q", domain)
+	}
+	want := net.TCPDestination(net.IPAddress([]byte{192, 0, 2, 7}), 443)
+	if got := <-dispatcher.dests; got != want {
+		t.Errorf("dispatched to %v, want %v", got, want)
+	}
+}
+
+func TestNoResolveMarker(t *testing.T) {
+	for _, allow := range []bool{true, false} {
+		h := newTestHandler(t, &reflex.InboundConfig{ResolveLocally: true, AllowConnectByDomain: allow})
+		resolver := &staticDNS{ip: net.IP{192, 0, 2, 7}, lookups: make(chan string, 1)}
+		h.dns = resolver
+		dispatcher := newEchoDispatcher()
+		conn, _ := serve(t, h, dispatcher)
+
+		hs, priv := newTestClientHandshake(t, testUserID)
+		go writeClientHandshakeMagic(conn, hs)
+		reader := bufio.NewReader(conn)
+		sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+		dest := net.TCPDestination(net.DomainAddress("example.com"), 443)
+		header, err := protocol.EncodeDestination(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header = append([]byte{protocol.NoResolveMarker}, header...)
+		if err := sess.WriteFrame(conn, protocol.FrameTypeData, append(header, "by name"...)); err != nil {
+			t.Fatal(err)
+		}
+		if frame, err := sess.ReadFrame(reader); err != nil || string(frame.Payload) != "by name" {
+			t.Fatalf("echo: %v", err)
+		}
+
+		// The marker is honoured only where the server allows it.
+		got := <-dispatcher.dests
+		if allow && (got != dest || got.Address.Family() != net.AddressFamilyDomain) {
+			t.Errorf("dispatched to %v, want the domain %v", got, dest)
+		}
+		if allow && len(resolver.lookups) != 0 {
+			t.Errorf("looked up %q despite the marker", <-resolver.lookups)
+		}
+		if want := net.TCPDestination(net.IPAddress([]byte{192, 0, 2, 7}), 443); !allow && got != want {
+			t.Errorf("without AllowConnectByDomain dispatched to %v, want %v", got, want)
+		}
+		conn.Close()
+	}
+}
+
+// streamingDispatcher's upstream sends data until its link is interrupted.
+type streamingDispatcher struct {
+	interrupted chan struct{}
+}
+
+func (*streamingDispatcher) Type() interface{} { return nil }
+func (*streamingDispatcher) Start() error      { return nil }
+func (*streamingDispatcher) Close() error      { return nil }
+
+func (d *streamingDispatcher) Dispatch(ctx context.Context, dest net.Destination) (*transport.Link, error) {
+	_, upWriter := pipe.New()
+	downReader, downWriter := pipe.New(pipe.WithSizeLimit(16 << 10))
+	go func() {
+		for {
+			b := buf.New()
+			b.Extend(buf.Size)
+			if err := downWriter.WriteMultiBuffer(buf.MultiBuffer{b}); err != nil {
+				close(d.interrupted)
+				return
+			}
+		}
+	}()
+	return &transport.Link{Reader: downReader, Writer: upWriter}, nil
+}
+
+func (d *streamingDispatcher) DispatchLink(ctx context.Context, dest net.Destination, link *transport.Link) error {
+	return errors.New("not implemented")
+}
+
+func TestClientCloseInterruptsUpstream(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	disconnects := new(appstats.Counter)
+	h.clientDisconnects = disconnects
+	dispatcher := &streamingDispatcher{interrupted: make(chan struct{})}
+	conn, done := serve(t, h, dispatcher)
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	header, err := protocol.EncodeDestination(net.TCPDestination(net.LocalHostIP, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.WriteFrame(conn, protocol.FrameTypeData, header); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.ReadFrame(reader); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	select {
+	case <-dispatcher.interrupted:
+	case <-time.After(time.Second):
+		t.Fatal("upstream link not interrupted after the client closed")
+	}
+	if err := <-done; err == nil {
+		t.Error("expected Process to report the client disconnect")
+	}
+	if n := disconnects.Value(); n != 1 {
+		t.Errorf("client disconnects = %d, want 1", n)
+	}
+}
+
+func TestServerAnswersPing(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	conn, _ := serve(t, h, newEchoDispatcher())
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "before ping")
+
+	go sess.SendPing(conn)
+	frame, err := sess.ReadFrame(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Type != protocol.FrameTypePong {
+		t.Fatalf("got frame type %d, want PONG", frame.Type)
+	}
+	if err := sess.HandleHeartbeat(io.Discard, frame); err != nil {
+		t.Fatal(err)
+	}
+	if sess.RTT() <= 0 {
+		t.Error("no RTT measured from the server's pong")
+	}
+}
+
+func TestMaxSessionLifetime(t *testing.T) {
+	const lifetime = 200 * time.Millisecond
+	h := newTestHandler(t, &reflex.InboundConfig{MaxSessionLifetimeMs: uint32(lifetime / time.Millisecond)})
+	conn, done := serve(t, h, newEchoDispatcher())
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	start := time.Now()
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "start")
+
+	// Keep the session busy well past its lifetime.
+	go func() {
+		for {
+			if err := sess.WriteFrame(conn, protocol.FrameTypeData, []byte("busy")); err != nil {
+				return
+			}
+			if _, err := sess.ReadFrame(reader); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected Process to report the expired lifetime")
+		}
+		if elapsed := time.Since(start); elapsed < lifetime-20*time.Millisecond {
+			t.Errorf("session closed after %v, before its %v lifetime", elapsed, lifetime)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("active session outlived its lifetime")
+	}
+}
+
+// TestMaxSessionLifetimeWithoutData checks that the lifetime also bounds
+// sessions that never send DATA: one that only pings, and a UDP
+// association.
+func TestMaxSessionLifetimeWithoutData(t *testing.T) {
+	const lifetime = 200 * time.Millisecond
+	for name, frameType := range map[string]uint8{"ping": protocol.FrameTypePing, "udp": protocol.FrameTypeUDP} {
+		t.Run(name, func(t *testing.T) {
+			h := newTestHandler(t, &reflex.InboundConfig{MaxSessionLifetimeMs: uint32(lifetime / time.Millisecond)})
+			conn, done := serve(t, h, newEchoDispatcher())
+
+			hs, priv := newTestClientHandshake(t, testUserID)
+			go writeClientHandshakeMagic(conn, hs)
+			reader := bufio.NewReader(conn)
+			sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+			start := time.Now()
+			payload := make([]byte, 8) // a PING echoed back as a PONG
+			if frameType == protocol.FrameTypeUDP {
+				header, _ := protocol.EncodeDestination(net.UDPDestination(net.LocalHostIP, 53))
+				payload = append(header, "query"...)
+			}
+			go func() {
+				for {
+					if err := sess.WriteFrame(conn, frameType, payload); err != nil {
+						return
+					}
+					if _, err := sess.ReadFrame(reader); err != nil {
+						return
+					}
+					time.Sleep(20 * time.Millisecond)
+				}
+			}()
+
+			select {
+			case <-done:
+				if elapsed := time.Since(start); elapsed < lifetime-20*time.Millisecond {
+					t.Errorf("session closed after %v, before its %v lifetime", elapsed, lifetime)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("session outlived its lifetime")
+			}
+		})
+	}
+}
+
+func TestHalfCloseClientDoneSending(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	conn, done := serve(t, h, newEchoDispatcher())
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	header, err := protocol.EncodeDestination(net.TCPDestination(net.LocalHostIP, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		sess.WriteFrame(conn, protocol.FrameTypeData, append(header, "abc"...))
+		sess.WriteFrame(conn, protocol.FrameTypeData, []byte("def"))
+		sess.WriteFrame(conn, protocol.FrameTypeCloseWrite, nil)
+	}()
+
+	// The echo upstream only finishes once it sees the client's EOF, so
+	// the whole echo arriving proves the half-close reached it.
+	var echoed []byte
+	for {
+		frame, err := sess.ReadFrame(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Type == protocol.FrameTypeCloseWrite {
+			break
+		}
+		echoed = append(echoed, frame.Payload...)
+	}
+	if string(echoed) != "abcdef" {
+		t.Errorf("echoed %q, want %q", echoed, "abcdef")
+	}
+	if err := <-done; err != nil {
+		t.Errorf("half-closed session ended with %v", err)
+	}
+}
+
+// greetingDispatcher's upstream sends a greeting and finishes sending at
+// once, then reports everything the client sends it.
+type greetingDispatcher struct {
+	received chan string
+}
+
+func (*greetingDispatcher) Type() interface{} { return nil }
+func (*greetingDispatcher) Start() error      { return nil }
+func (*greetingDispatcher) Close() error      { return nil }
+
+func (d *greetingDispatcher) Dispatch(ctx context.Context, dest net.Destination) (*transport.Link, error) {
+	upReader, upWriter := pipe.New()
+	downReader, downWriter := pipe.New()
+	downWriter.WriteMultiBuffer(buf.MergeBytes(nil, []byte("hello")))
+	downWriter.Close()
+	go func() {
+		var received []byte
+		for {
+			mb, err := upReader.ReadMultiBuffer()
+			for _, b := range mb {
+				received = append(received, b.Bytes()...)
+			}
+			buf.ReleaseMulti(mb)
+			if err != nil {
+				d.received <- string(received)
+				return
+			}
+		}
+	}()
+	return &transport.Link{Reader: downReader, Writer: upWriter}, nil
+}
+
+func (d *greetingDispatcher) DispatchLink(ctx context.Context, dest net.Destination, link *transport.Link) error {
+	return errors.New("not implemented")
+}
+
+func TestHalfCloseUpstreamDoneSending(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	dispatcher := &greetingDispatcher{received: make(chan string, 1)}
+	conn, done := serve(t, h, dispatcher)
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	header, err := protocol.EncodeDestination(net.TCPDestination(net.LocalHostIP, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sess.WriteFrame(conn, protocol.FrameTypeData, header)
+
+	for _, want := range []uint8{protocol.FrameTypeData, protocol.FrameTypeCloseWrite} {
+		frame, err := sess.ReadFrame(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Type != want {
+			t.Fatalf("got frame type %d, want %d", frame.Type, want)
+		}
+	}
+
+	// The server is done sending but must still carry what the client
+	// sends.
+	go func() {
+		sess.WriteFrame(conn, protocol.FrameTypeData, []byte("still sending"))
+		sess.WriteFrame(conn, protocol.FrameTypeCloseWrite, nil)
+	}()
+	if got := <-dispatcher.received; got != "still sending" {
+		t.Errorf("upstream received %q after its half-close", got)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("half-closed session ended with %v", err)
+	}
+}
+
+// answerDispatcher's upstream reads the whole request, then answers with
+// size bytes and finishes sending, or never answers if size is negative.
+type answerDispatcher struct {
+	size     int
+	received chan string
+}
+
+func (*answerDispatcher) Type() interface{} { return nil }
+func (*answerDispatcher) Start() error      { return nil }
+func (*answerDispatcher) Close() error      { return nil }
+
+func (d *answerDispatcher) Dispatch(ctx context.Context, dest net.Destination) (*transport.Link, error) {
+	upReader, upWriter := pipe.New()
+	downReader, downWriter := pipe.New()
+	go func() {
+		var received []byte
+		for {
+			mb, err := upReader.ReadMultiBuffer()
+			for _, b := range mb {
+				received = append(received, b.Bytes()...)
+			}
+			buf.ReleaseMulti(mb)
+			if err != nil {
+				break
+			}
+		}
+		d.received <- string(received)
+		if d.size < 0 {
+			return
+		}
+		answer := bytes.Repeat([]byte("0123456789abcdef"), d.size/16+1)[:d.size]
+		downWriter.WriteMultiBuffer(buf.MergeBytes(nil, answer))
+		downWriter.Close()
+	}()
+	return &transport.Link{Reader: downReader, Writer: upWriter}, nil
+}
+
+func (d *answerDispatcher) DispatchLink(ctx context.Context, dest net.Destination, link *transport.Link) error {
+	return errors.New("not implemented")
+}
+
+func TestHalfCloseClientCloseStillDownloads(t *testing.T) {
+	const size = 1 << 20
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	dispatcher := &answerDispatcher{size: size, received: make(chan string, 1)}
+	conn, done := serve(t, h, dispatcher)
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	header, err := protocol.EncodeDestination(net.TCPDestination(net.LocalHostIP, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		sess.WriteFrame(conn, protocol.FrameTypeData, append(header, "GET /large"...))
+		sess.WriteFrame(conn, protocol.FrameTypeClose, nil)
+	}()
+
+	// The upstream only answers once it sees the client's EOF, so the
+	// whole answer arriving proves the close left the downlink open.
+	if got := <-dispatcher.received; got != "GET /large" {
+		t.Errorf("upstream received %q", got)
+	}
+	n := 0
+	for {
+		frame, err := sess.ReadFrame(reader)
+		if err != nil {
+			t.Fatalf("after %d bytes: %v", n, err)
+		}
+		if frame.Type == protocol.FrameTypeCloseWrite {
+			break
+		}
+		if frame.Type == protocol.FrameTypeData {
+			n += len(frame.Payload)
+		}
+	}
+	if n != size {
+		t.Errorf("downloaded %d bytes, want %d", n, size)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("half-closed session ended with %v", err)
+	}
+}
+
+func TestHalfCloseDownlinkIdleTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	h.policyManager = testPolicy(func(_ uint32, s *policy.Session) {
+		s.Timeouts.DownlinkOnly = timeout
+	})
+	dispatcher := &answerDispatcher{size: -1, received: make(chan string, 1)}
+	conn, done := serve(t, h, dispatcher)
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	header, err := protocol.EncodeDestination(net.TCPDestination(net.LocalHostIP, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		sess.WriteFrame(conn, protocol.FrameTypeData, header)
+		sess.WriteFrame(conn, protocol.FrameTypeClose, nil)
+	}()
+	<-dispatcher.received
+	start := time.Now()
+	go io.Copy(io.Discard, conn)
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected Process to report the idle downlink")
+		}
+		if elapsed := time.Since(start); elapsed < timeout/2 {
+			t.Errorf("idle downlink closed after %v, before its %v timeout", elapsed, timeout)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle downlink outlived its timeout")
+	}
+}
+
+func TestHandshakeStatus(t *testing.T) {
+	for _, status := range []uint32{201, 204, 205} {
+		h := newTestHandler(t, &reflex.InboundConfig{HandshakeStatus: status})
+		conn, _ := serve(t, h, newEchoDispatcher())
+
+		hs, priv := newTestClientHandshake(t, testUserID)
+		go writeClientHandshakeMagic(conn, hs)
+		reader := bufio.NewReader(conn)
+		line, err := reader.Peek(12)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "HTTP/1.1 " + strconv.Itoa(int(status)); string(line) != want {
+			t.Errorf("status line starts %q, want %q", line, want)
+		}
+		sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+		echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "status "+strconv.Itoa(int(status)))
+	}
+
+	for _, status := range []uint32{404, 299} {
+		if _, err := New(context.Background(), &reflex.InboundConfig{HandshakeStatus: status}); err == nil {
+			t.Errorf("expected an error for handshake status %d", status)
+		}
+	}
+}
+
+// noAddrConn is a connection without a remote address.
+type noAddrConn struct {
+	stdnet.Conn
+}
+
+func (noAddrConn) RemoteAddr() stdnet.Addr { return nil }
+
+// zeroAddrConn reports an unset TCP address.
+type zeroAddrConn struct {
+	stdnet.Conn
+}
+
+func (*zeroAddrConn) RemoteAddr() stdnet.Addr { return &stdnet.TCPAddr{} }
+
+// accessLogRecorder collects access log entries.
+type accessLogRecorder struct {
+	entries chan string
+}
+
+func (r *accessLogRecorder) Handle(msg log.Message) {
+	if access, ok := msg.(*log.AccessMessage); ok {
+		r.entries <- access.String()
+	}
+}
+
+func TestNilRemoteAddr(t *testing.T) {
+	recorder := &accessLogRecorder{entries: make(chan string, 16)}
+	log.RegisterHandler(recorder)
+	t.Cleanup(func() { log.RegisterHandler(log.NewLogger(log.CreateStdoutLogWriter())) })
+
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	client, server := conntest.Pipe()
+	defer client.Close()
+	hs, _ := newTestClientHandshake(t, "00000000-0000-0000-0000-000000000001")
+	if err := writeClientHandshakeMagic(client, hs); err != nil {
+		t.Fatal(err)
+	}
+	// The hello is buffered and so is the rejection, so the handshake
+	// runs to its end here.
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := h.Process(context.Background(), net.Network_TCP, noAddrConn{server}, newEchoDispatcher()); err == nil {
+		t.Fatal("expected the unknown user to be rejected")
+	}
+	select {
+	case entry := <-recorder.entries:
+		if !strings.HasPrefix(entry, "from unknown rejected") {
+			t.Errorf("unexpected access log entry %q", entry)
+		}
+	default:
+		t.Error("no access log entry for the rejected handshake")
+	}
+
+	if got := remoteAddr(noAddrConn{}); got.String() != "unknown" {
+		t.Errorf("nil address logged as %q", got)
+	}
+	if got := remoteAddr(&zeroAddrConn{}); got.String() != "unknown" {
+		t.Errorf("zero address logged as %q", got)
+	}
+}
+
+func TestBlockedPorts(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		blocked []uint32
+		port    net.Port
+		allowed bool
+	}{
+		{"smtp blocked by default", nil, 25, false},
+		{"submission blocked by default", nil, 587, false},
+		{"https allowed by default", nil, 443, true},
+		{"override allows smtp", []uint32{}, 25, true},
+		{"override blocks custom port", []uint32{8080}, 8080, false},
+		{"override replaces defaults", []uint32{8080}, 25, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHandler(t, &reflex.InboundConfig{BlockedPorts: tc.blocked})
+			dispatcher := newEchoDispatcher()
+			conn, done := serve(t, h, dispatcher)
+			hs, priv := newTestClientHandshake(t, testUserID)
+			go writeClientHandshakeMagic(conn, hs)
+			reader := bufio.NewReader(conn)
+			sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+			dest := net.TCPDestination(net.DomainAddress("mail.example.com"), tc.port)
+
+			if tc.allowed {
+				echoRoundTrip(t, conn, reader, sess, dest, "EHLO")
+				return
+			}
+			header, _ := protocol.EncodeDestination(dest)
+			if err := sess.WriteFrame(conn, protocol.FrameTypeData, append(header, "EHLO"...)); err != nil {
+				t.Fatal(err)
+			}
+			err := <-done
+			if err == nil || !strings.Contains(err.Error(), "is blocked") {
+				t.Errorf("expected port %d to be blocked, got %v", tc.port, err)
+			}
+			if len(dispatcher.dests) != 0 {
+				t.Error("blocked destination was dispatched")
+			}
+		})
+	}
+}
+
+func TestNewRejectsInvalidBlockedPort(t *testing.T) {
+	if _, err := New(context.Background(), &reflex.InboundConfig{BlockedPorts: []uint32{70000}}); err == nil {
+		t.Error("expected an out-of-range blocked port to be rejected")
+	}
+}
+
+func TestGreasedHandshake(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{GreaseMaxBytes: 8})
+	openings := make(map[string]bool)
+	for i := 0; i < 8; i++ {
+		hs, priv := newTestClientHandshake(t, testUserID)
+		var hello bytes.Buffer
+		if err := writeClientHandshakeMagic(&hello, hs); err != nil {
+			t.Fatal(err)
+		}
+		flight := append(protocol.AppendGrease(nil, 8), hello.Bytes()...)
+		openings[string(flight[:4])] = true
+
+		conn, _ := serve(t, h, newEchoDispatcher())
+		go conn.Write(flight)
+		reader := bufio.NewReader(conn)
+		sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+		echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "greased")
+	}
+	if len(openings) < 2 {
+		t.Error("greased connections all opened with the same bytes")
+	}
+}
+
+func TestGreaseBeyondLimitFallsBack(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{GreaseMaxBytes: 2})
+	hs, _ := newTestClientHandshake(t, testUserID)
+	var hello bytes.Buffer
+	writeClientHandshakeMagic(&hello, hs)
+	conn, done := serve(t, h, newEchoDispatcher())
+	go conn.Write(append([]byte{0x1a, 0x2a, 0x3a}, hello.Bytes()...))
+	if err := <-done; err == nil {
+		t.Error("accepted more grease than configured")
+	}
+
+	// Without grease configured, even one byte is not skipped.
+	h = newTestHandler(t, &reflex.InboundConfig{})
+	conn, done = serve(t, h, newEchoDispatcher())
+	go conn.Write(append([]byte{0x1a}, hello.Bytes()...))
+	if err := <-done; err == nil {
+		t.Error("skipped grease that was not configured")
+	}
+}
+
+func TestClockSkewCounters(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{FutureSkewToleranceSec: 30})
+	future, past := new(appstats.Counter), new(appstats.Counter)
+	h.futureSkew, h.pastSkew = future, past
+
+	for _, tc := range []struct {
+		offset       int64
+		accepted     bool
+		future, past int64
+	}{
+		{offset: 20, accepted: true},
+		{offset: 60, future: 1},
+		{offset: -60, accepted: true, future: 1},
+		{offset: -handshakeTimestampWindow - 60, future: 1, past: 1},
+		{offset: handshakeTimestampWindow, future: 2, past: 1},
+	} {
+		conn, done := serve(t, h, newEchoDispatcher())
+		hs, _ := newTestClientHandshake(t, testUserID)
+		hs.Timestamp += tc.offset
+		go writeClientHandshakeMagic(conn, hs)
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		if accepted := strings.HasPrefix(line, "HTTP/1.1 200"); accepted != tc.accepted {
+			t.Errorf("offset %ds: answered %q", tc.offset, line)
+		}
+		conn.Close()
+		<-done
+		if future.Value() != tc.future || past.Value() != tc.past {
+			t.Errorf("offset %ds: future skew %d, past skew %d, want %d and %d",
+				tc.offset, future.Value(), past.Value(), tc.future, tc.past)
+		}
+	}
+
+	if _, err := New(context.Background(), &reflex.InboundConfig{FutureSkewToleranceSec: handshakeTimestampWindow + 1}); err == nil {
+		t.Error("accepted a future tolerance beyond the replay window")
+	}
+}
+
+func TestPerUserConnectionLimit(t *testing.T) {
+	const otherUserID = "a1b2c3d4-0000-4000-8000-000000000002"
+	h := newTestHandler(t, &reflex.InboundConfig{
+		Clients: []*reflex.User{
+			{Id: testUserID, MaxConns: 2},
+			{Id: otherUserID},
+		},
+		MaxConnsPerUser: 1,
+	})
+	connect := func(userID string) (stdnet.Conn, <-chan error, string) {
+		conn, done := serve(t, h, newEchoDispatcher())
+		hs, _ := newTestClientHandshake(t, userID)
+		go writeClientHandshakeMagic(conn, hs)
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		return conn, done, line
+	}
+
+	first, firstDone, _ := connect(testUserID)
+	connect(testUserID)
+	if _, done, line := connect(testUserID); !strings.HasPrefix(line, "HTTP/1.1 429") {
+		t.Errorf("third connection answered with %q, want 429", line)
+	} else if err := <-done; err == nil {
+		t.Error("expected Process to fail over the limit")
+	}
+
+	// The other user has the default limit of one and their own count.
+	connect(otherUserID)
+	if _, _, line := connect(otherUserID); !strings.HasPrefix(line, "HTTP/1.1 429") {
+		t.Errorf("other user's second connection answered with %q, want 429", line)
+	}
+
+	// Ending a session frees its slot.
+	first.Close()
+	<-firstDone
+	if _, _, line := connect(testUserID); !strings.HasPrefix(line, "HTTP/1.1 200") {
+		t.Errorf("connection after one ended answered with %q", line)
+	}
+}
+
+func TestReadFrameStalledBodyTimesOut(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{FrameReadTimeoutMs: 100})
+	conn, done := serve(t, h, newEchoDispatcher())
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	clientSessionFromResponse(t, bufio.NewReader(conn), hs, priv)
+
+	// A DATA frame header announcing a body that never comes.
+	if _, err := conn.Write([]byte{0x04, 0x00, protocol.FrameTypeData}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected Process to fail on a stalled frame")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stalled frame was not timed out")
+	}
+}
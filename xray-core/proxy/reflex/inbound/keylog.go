@@ -0,0 +1,6 @@
+//go:build !reflexdebug
+
+package inbound
+
+// logSessionKey does nothing outside debug builds, see keylog_debug.go.
+func logSessionKey(nonce [16]byte, sessionKey []byte) {}
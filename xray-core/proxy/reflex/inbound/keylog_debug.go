@@ -0,0 +1,45 @@
+//go:build reflexdebug
+
+package inbound
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/xtls/xray-core/common/errors"
+)
+
+// KeyLogEnv names the file that builds with the reflexdebug tag append
+// session keys to, one "REFLEX_SESSION_KEY <nonce> <key>" line per
+// session in hex, so captured traffic can be decrypted offline. Such builds
+// must never be deployed: anyone with the file can read every session.
+const KeyLogEnv = "REFLEX_KEYLOG_FILE"
+
+var (
+	keyLogMu   sync.Mutex
+	keyLogWarn sync.Once
+)
+
+// logSessionKey appends the key of the session whose hello carried nonce to
+// the key log, if KeyLogEnv names one.
+func logSessionKey(nonce [16]byte, sessionKey []byte) {
+	path := os.Getenv(KeyLogEnv)
+	if path == "" {
+		return
+	}
+	keyLogWarn.Do(func() {
+		errors.LogWarning(context.Background(), "REFLEX DEBUG BUILD: writing session keys to ", path, ", anyone with this file can decrypt the captured traffic; do not use this build in production")
+	})
+
+	keyLogMu.Lock()
+	defer keyLogMu.Unlock()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		errors.LogWarningInner(context.Background(), err, "failed to open reflex key log")
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "REFLEX_SESSION_KEY %x %x\n", nonce, sessionKey)
+}
@@ -0,0 +1,39 @@
+//go:build reflexdebug
+
+package inbound
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xtls/xray-core/proxy/reflex"
+)
+
+func TestKeyLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.log")
+	t.Setenv(KeyLogEnv, path)
+
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	var want []string
+	for i := 0; i < 2; i++ {
+		conn, _ := serve(t, h, newEchoDispatcher())
+		hs, priv := newTestClientHandshake(t, testUserID)
+		go writeClientHandshakeMagic(conn, hs)
+		_, serverHS := clientSessionFromResponse(t, bufio.NewReader(conn), hs, priv)
+		want = append(want, fmt.Sprintf("REFLEX_SESSION_KEY %x %x", hs.Nonce, clientSessionKey(t, hs, priv, serverHS)))
+		conn.Close()
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("key log:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,94 @@
+package inbound
+
+import (
+	"sync"
+	"time"
+
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+)
+
+// learnWindow is how many of the most recent packet sizes and delays a
+// learned profile is built from.
+const learnWindow = 1024
+
+// maxLearnedDelay is the longest gap between two packets taken for a
+// delay. A longer one is idle time between bursts, not pacing.
+const maxLearnedDelay = time.Second
+
+// trafficLearner records the shape of a user's real traffic: the sizes of
+// the payloads sent to them and the delays between consecutive ones, over
+// a rolling window.
+type trafficLearner struct {
+	mu      sync.Mutex
+	sizes   [learnWindow]int
+	delays  [learnWindow]time.Duration
+	nSizes  int // sizes observed so far; the window holds the last ones
+	nDelays int
+}
+
+// observe records a payload of size bytes sent delay after the previous
+// one of its session, or as the first of a burst if delay is negative.
+func (l *trafficLearner) observe(size int, delay time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sizes[l.nSizes%learnWindow] = size
+	l.nSizes++
+	if delay >= 0 && delay <= maxLearnedDelay {
+		l.delays[l.nDelays%learnWindow] = delay.Round(time.Millisecond)
+		l.nDelays++
+	}
+}
+
+// profile builds a profile from the window, as CreateProfileFromCapture
+// does from a capture. It reports false until a size and a delay have
+// been seen.
+func (l *trafficLearner) profile() (*protocol.TrafficProfile, bool) {
+	l.mu.Lock()
+	sizes := append([]int(nil), l.sizes[:min(l.nSizes, learnWindow)]...)
+	delays := append([]time.Duration(nil), l.delays[:min(l.nDelays, learnWindow)]...)
+	l.mu.Unlock()
+	if len(sizes) == 0 || len(delays) == 0 {
+		return nil, false
+	}
+	return protocol.CreateProfileFromCapture(sizes, delays), true
+}
+
+// learners holds the trafficLearner of every user seen so far.
+type learners struct {
+	byEmail sync.Map // email -> *trafficLearner
+}
+
+func (l *learners) get(email string) *trafficLearner {
+	if t, ok := l.byEmail.Load(email); ok {
+		return t.(*trafficLearner)
+	}
+	t, _ := l.byEmail.LoadOrStore(email, &trafficLearner{})
+	return t.(*trafficLearner)
+}
+
+// LearnedProfile returns the profile learned from the traffic sent to the
+// user with email, the user's ID, named "learned-" followed by it, as it
+// would be configured in InboundConfig.Profiles. It reports false if
+// LearnProfiles is off or too little traffic has been seen.
+func (h *Handler) LearnedProfile(email string) (reflex.Profile, bool) {
+	if !h.learnProfiles {
+		return reflex.Profile{}, false
+	}
+	t, ok := h.learners.byEmail.Load(email)
+	if !ok {
+		return reflex.Profile{}, false
+	}
+	learned, ok := t.(*trafficLearner).profile()
+	if !ok {
+		return reflex.Profile{}, false
+	}
+	p := reflex.Profile{Name: "learned-" + email}
+	for _, s := range learned.PacketSizes {
+		p.PacketSizes = append(p.PacketSizes, reflex.ProfilePacketSize{Size: uint32(s.Size), Weight: s.Weight})
+	}
+	for _, d := range learned.Delays {
+		p.Delays = append(p.Delays, reflex.ProfileDelay{Ms: uint32(d.Delay / time.Millisecond), Weight: d.Weight})
+	}
+	return p, true
+}
@@ -0,0 +1,141 @@
+package inbound
+
+import (
+	"bufio"
+	"math"
+	mrand "math/rand"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+)
+
+// draw picks a value from a distribution given as value -> weight, with
+// weights summing to 1.
+func draw[T comparable](rng *mrand.Rand, dist map[T]float64, order []T) T {
+	x := rng.Float64()
+	for _, v := range order {
+		if x -= dist[v]; x < 0 {
+			return v
+		}
+	}
+	return order[len(order)-1]
+}
+
+func TestTrafficLearnerApproximatesInput(t *testing.T) {
+	sizes := map[int]float64{100: 0.2, 600: 0.3, 1400: 0.5}
+	delays := map[time.Duration]float64{5 * time.Millisecond: 0.5, 20 * time.Millisecond: 0.3, 50 * time.Millisecond: 0.2}
+	sizeOrder := []int{100, 600, 1400}
+	delayOrder := []time.Duration{5 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond}
+
+	rng := mrand.New(mrand.NewSource(1))
+	var l trafficLearner
+	for i := 0; i < 5000; i++ {
+		delay := draw(rng, delays, delayOrder) + time.Duration(rng.Intn(400))*time.Microsecond
+		switch {
+		case i%100 == 0:
+			delay = -1 // a new session
+		case i%100 == 50:
+			delay = 5 * time.Second // idle between bursts
+		}
+		l.observe(draw(rng, sizes, sizeOrder), delay)
+	}
+
+	p, ok := l.profile()
+	if !ok {
+		t.Fatal("nothing learned")
+	}
+	// The window holds 1024 packets, so each weight is off by about 0.015.
+	const tolerance = 0.06
+	if len(p.PacketSizes) != len(sizes) {
+		t.Errorf("learned sizes %v, want %v", p.PacketSizes, sizes)
+	}
+	for _, s := range p.PacketSizes {
+		if math.Abs(s.Weight-sizes[s.Size]) > tolerance {
+			t.Errorf("size %d learned with weight %.3f, want %.3f", s.Size, s.Weight, sizes[s.Size])
+		}
+	}
+	if len(p.Delays) != len(delays) {
+		t.Errorf("learned delays %v, want %v", p.Delays, delays)
+	}
+	for _, d := range p.Delays {
+		if math.Abs(d.Weight-delays[d.Delay]) > tolerance {
+			t.Errorf("delay %v learned with weight %.3f, want %.3f", d.Delay, d.Weight, delays[d.Delay])
+		}
+	}
+}
+
+func TestTrafficLearnerWindow(t *testing.T) {
+	var l trafficLearner
+	if _, ok := l.profile(); ok {
+		t.Error("profile learned from no traffic")
+	}
+	for i := 0; i < learnWindow; i++ {
+		l.observe(100, time.Millisecond)
+	}
+	for i := 0; i < learnWindow; i++ {
+		l.observe(200, 2*time.Millisecond)
+	}
+	p, _ := l.profile()
+	if len(p.PacketSizes) != 1 || p.PacketSizes[0].Size != 200 || len(p.Delays) != 1 || p.Delays[0].Delay != 2*time.Millisecond {
+		t.Errorf("learned %v and %v, want only the latest traffic", p.PacketSizes, p.Delays)
+	}
+}
+
+func TestLearnedProfile(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{LearnProfiles: true})
+	if _, ok := h.LearnedProfile(testUserID); ok {
+		t.Error("profile learned before any traffic")
+	}
+
+	for _, payload := range []string{"short", "a somewhat longer payload", "short"} {
+		conn, _ := serve(t, h, newEchoDispatcher())
+		hs, priv := newTestClientHandshake(t, testUserID)
+		go writeClientHandshakeMagic(conn, hs)
+		reader := bufio.NewReader(conn)
+		sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+		dest := net.TCPDestination(net.LocalHostIP, 80)
+		echoRoundTrip(t, conn, reader, sess, dest, payload)
+		if err := sess.WriteFrame(conn, protocol.FrameTypeData, []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+		if frame, err := sess.ReadFrame(reader); err != nil || string(frame.Payload) != payload {
+			t.Fatalf("second echo: %v", err)
+		}
+	}
+
+	p, ok := h.LearnedProfile(testUserID)
+	if !ok {
+		t.Fatal("nothing learned from three sessions")
+	}
+	if p.Name != "learned-"+testUserID {
+		t.Errorf("learned profile named %q", p.Name)
+	}
+	weights := make(map[uint32]float64)
+	for _, s := range p.PacketSizes {
+		weights[s.Size] = s.Weight
+	}
+	if len(weights) != 2 || weights[5] != 4.0/6 || weights[25] != 2.0/6 {
+		t.Errorf("learned sizes %v, want 5 bytes 2/3 and 25 bytes 1/3 of the time", p.PacketSizes)
+	}
+	if len(p.Delays) == 0 {
+		t.Error("no delays learned")
+	}
+	// The profile can be configured as it is.
+	if _, err := newCustomProfile(p); err != nil {
+		t.Errorf("learned profile does not configure: %v", err)
+	}
+
+	off := newTestHandler(t, &reflex.InboundConfig{})
+	conn, _ := serve(t, off, newEchoDispatcher())
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "short")
+	if _, ok := off.LearnedProfile(testUserID); ok {
+		t.Error("profile learned without LearnProfiles")
+	}
+}
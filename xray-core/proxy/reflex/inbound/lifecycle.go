@@ -0,0 +1,121 @@
+package inbound
+
+import (
+	"context"
+
+	"github.com/xtls/xray-core/common/errors"
+)
+
+// connState is a stage in the lifecycle of a connection to the inbound.
+type connState uint8
+
+const (
+	// stateAccepted is a connection nothing has been read from yet.
+	stateAccepted connState = iota
+	// statePeeked is a connection whose first bytes have been read but
+	// whose protocol is not yet decided.
+	statePeeked
+	// stateHandshake is a connection whose Reflex hello has been parsed
+	// and is being authenticated and answered.
+	stateHandshake
+	// stateSession is a connection with an established session, read
+	// frame by frame until the first DATA or UDP frame.
+	stateSession
+	// stateData is a connection whose destination has been dispatched and
+	// whose data is being relayed.
+	stateData
+	// stateFallback is a connection handed to fallback or the decoy.
+	stateFallback
+	// stateClosed is a connection that is done with.
+	stateClosed
+)
+
+var connStateNames = [...]string{
+	stateAccepted:  "accepted",
+	statePeeked:    "peeked",
+	stateHandshake: "handshake",
+	stateSession:   "session",
+	stateData:      "data",
+	stateFallback:  "fallback",
+	stateClosed:    "closed",
+}
+
+func (s connState) String() string {
+	if int(s) < len(connStateNames) {
+		return connStateNames[s]
+	}
+	return "unknown"
+}
+
+// connLifecycle records the state of one connection. Which state may
+// follow which is not checked here but fixed by the types below: every
+// state past stateAccepted is entered only through a method of the state
+// it follows, and every stage takes the state it runs in as an argument,
+// so a connection cannot, say, be relayed before its session is
+// established or fall back once its handshake has been accepted for
+// processing. A connection can close at any stage.
+type connLifecycle struct {
+	state   connState
+	observe func(connState) // called on every transition, if set
+}
+
+// enter records that the connection moved to next. A nil lifecycle, as a
+// stage driven without Process has, records nothing.
+func (l *connLifecycle) enter(ctx context.Context, next connState) {
+	if l == nil {
+		return
+	}
+	errors.LogDebug(ctx, "connection ", l.state, " -> ", next)
+	l.state = next
+	if l.observe != nil {
+		l.observe(next)
+	}
+}
+
+// acceptedConn is a connection in stateAccepted.
+type acceptedConn struct{ l *connLifecycle }
+
+// peekedConn is a connection in statePeeked.
+type peekedConn struct{ l *connLifecycle }
+
+// handshakeConn is a connection in stateHandshake.
+type handshakeConn struct{ l *connLifecycle }
+
+// sessionConn is a connection in stateSession.
+type sessionConn struct{ l *connLifecycle }
+
+// dataConn is a connection in stateData.
+type dataConn struct{ l *connLifecycle }
+
+// fallbackConn is a connection in stateFallback.
+type fallbackConn struct{ l *connLifecycle }
+
+func (c acceptedConn) peeked(ctx context.Context) peekedConn {
+	c.l.enter(ctx, statePeeked)
+	return peekedConn(c)
+}
+
+func (c acceptedConn) fallback(ctx context.Context) fallbackConn {
+	c.l.enter(ctx, stateFallback)
+	return fallbackConn(c)
+}
+
+func (c peekedConn) handshake(ctx context.Context) handshakeConn {
+	c.l.enter(ctx, stateHandshake)
+	return handshakeConn(c)
+}
+
+func (c peekedConn) fallback(ctx context.Context) fallbackConn {
+	c.l.enter(ctx, stateFallback)
+	return fallbackConn(c)
+}
+
+func (c handshakeConn) session(ctx context.Context) sessionConn {
+	c.l.enter(ctx, stateSession)
+	return sessionConn(c)
+}
+
+func (c sessionConn) data(ctx context.Context) dataConn {
+	c.l.enter(ctx, stateData)
+	return dataConn(c)
+}
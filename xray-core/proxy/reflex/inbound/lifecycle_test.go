@@ -0,0 +1,74 @@
+package inbound
+
+import (
+	"bufio"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/proxy/reflex"
+)
+
+// recordStates makes h record the states its connections enter.
+func recordStates(h *Handler) func() []connState {
+	var mu sync.Mutex
+	var states []connState
+	h.observeState = func(s connState) {
+		mu.Lock()
+		states = append(states, s)
+		mu.Unlock()
+	}
+	return func() []connState {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(states)
+	}
+}
+
+func TestConnLifecycleSession(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	states := recordStates(h)
+	conn, done := serve(t, h, newEchoDispatcher())
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "lifecycle")
+	conn.Close()
+	<-done
+
+	want := []connState{statePeeked, stateHandshake, stateSession, stateData, stateClosed}
+	if got := states(); !slices.Equal(got, want) {
+		t.Errorf("states %v, want %v", got, want)
+	}
+}
+
+func TestConnLifecycleFallback(t *testing.T) {
+	const request = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	const reply = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	port, received := startFallbackServer(t, len(request), reply)
+	h := newTestHandler(t, &reflex.InboundConfig{Fallback: &reflex.Fallback{Dest: port}})
+	states := recordStates(h)
+	conn, done := serve(t, h, newEchoDispatcher())
+
+	go conn.Write([]byte(request))
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("fallback received nothing")
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(reply))); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	<-done
+
+	want := []connState{statePeeked, stateFallback, stateClosed}
+	if got := states(); !slices.Equal(got, want) {
+		t.Errorf("states %v, want %v", got, want)
+	}
+}
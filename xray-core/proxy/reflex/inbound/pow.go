@@ -0,0 +1,35 @@
+package inbound
+
+import (
+	"context"
+	"time"
+
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+	"github.com/xtls/xray-core/transport/internet/stat"
+)
+
+// hasProofOfWork reports whether clientHS carries the proof of work the
+// inbound requires, if it requires one.
+func (h *Handler) hasProofOfWork(clientHS *protocol.ClientHandshake) bool {
+	if h.powDifficulty == 0 {
+		return true
+	}
+	exts, err := protocol.ParseExtensions(clientHS.PolicyReq)
+	return err == nil && protocol.VerifyProofOfWork(h.magicSecret, exts[protocol.ExtProofOfWork], h.powDifficulty, clientHS.PublicKey, clientHS.Nonce, time.Now())
+}
+
+// handleMissingProofOfWork hands a hello without a valid proof of work to
+// fallback with everything it sent, like any other connection that is not
+// Reflex, so a probe cannot tell the requirement from an ordinary web
+// server.
+func (h *Handler) handleMissingProofOfWork(ctx context.Context, c peekedConn, recorder *recordingReader, conn stat.Connection) error {
+	log.Record(&log.AccessMessage{
+		From:   remoteAddr(conn),
+		To:     "",
+		Status: log.AccessRejected,
+		Reason: errors.New("missing or invalid proof of work"),
+	})
+	return h.handleFallback(ctx, c.fallback(ctx), recorder, conn)
+}
@@ -0,0 +1,61 @@
+package inbound
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+)
+
+func TestHandshakeProofOfWork(t *testing.T) {
+	const secret = "shared secret"
+	h := newTestHandler(t, &reflex.InboundConfig{PowDifficulty: 8, MagicSecret: secret})
+
+	conn, _ := serve(t, h, newEchoDispatcher())
+	hs, priv := newTestClientHandshake(t, testUserID)
+	challenge := protocol.ProofOfWorkChallenge([]byte(secret), time.Now())
+	hs.PolicyReq = protocol.AppendExtension(nil, protocol.ExtProofOfWork, protocol.SolveProofOfWork(challenge, 8, hs.PublicKey, hs.Nonce))
+	go writeClientHandshakeWithMagic(conn, protocol.TimeGatedMagic([]byte(secret), time.Now()), hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "after pow")
+}
+
+func TestHandshakeInvalidProofOfWorkFallsBack(t *testing.T) {
+	// An unknown user would be refused after authentication; reaching the
+	// fallback shows the proof of work was checked before that and before
+	// any key exchange, and that a probe gets no hint of the requirement.
+	missing, _ := newTestClientHandshake(t, "00000000-0000-0000-0000-000000000001")
+	invalid, _ := newTestClientHandshake(t, "00000000-0000-0000-0000-000000000001")
+	challenge := protocol.ProofOfWorkChallenge(nil, time.Now())
+	solution := binary.BigEndian.AppendUint64(challenge, 0)
+	for protocol.VerifyProofOfWork(nil, solution, 8, invalid.PublicKey, invalid.Nonce, time.Now()) {
+		binary.BigEndian.PutUint64(solution[len(challenge):], binary.BigEndian.Uint64(solution[len(challenge):])+1)
+	}
+	invalid.PolicyReq = protocol.AppendExtension(nil, protocol.ExtProofOfWork, solution)
+
+	for name, hs := range map[string]*protocol.ClientHandshake{"missing": missing, "invalid": invalid} {
+		t.Run(name, func(t *testing.T) {
+			var hello bytes.Buffer
+			writeClientHandshakeMagic(&hello, hs)
+			port, received := startFallbackServer(t, hello.Len(), "HTTP/1.1 200 OK\r\n\r\n")
+			h := newTestHandler(t, &reflex.InboundConfig{PowDifficulty: 8, Fallback: &reflex.Fallback{Dest: port}})
+			conn, _ := serve(t, h, newEchoDispatcher())
+
+			go conn.Write(hello.Bytes())
+			select {
+			case got := <-received:
+				if got != hello.String() {
+					t.Error("fallback did not receive the hello unchanged")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("hello without a valid proof of work did not reach fallback")
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package inbound
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/xtls/xray-core/common/net"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Destination logging modes, see reflex.InboundConfig.LogDestination.
+const (
+	LogDestinationFull   = "full"
+	LogDestinationDomain = "domain"
+	LogDestinationHash   = "hash"
+	LogDestinationNone   = "none"
+)
+
+// Access logging modes, see reflex.InboundConfig.AccessLog.
+const (
+	AccessLogStart      = "start"
+	AccessLogCompletion = "completion"
+	AccessLogBoth       = "both"
+)
+
+// loggedDestination returns what the logs show of dest under the
+// configured destination logging mode.
+func (h *Handler) loggedDestination(dest net.Destination) interface{} {
+	switch h.logDestination {
+	case LogDestinationDomain:
+		if !dest.Address.Family().IsDomain() {
+			return dest.Address.String()
+		}
+		domain := dest.Address.Domain()
+		if registrable, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+			return registrable
+		}
+		return domain
+	case LogDestinationHash:
+		mac := hmac.New(sha256.New, h.logDestinationKey)
+		mac.Write([]byte(dest.NetAddr()))
+		return "dest-" + hex.EncodeToString(mac.Sum(nil)[:8])
+	case LogDestinationNone:
+		return "hidden"
+	}
+	return dest
+}
@@ -0,0 +1,123 @@
+package inbound
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/proxy/reflex"
+)
+
+func TestLogDestination(t *testing.T) {
+	dest := net.TCPDestination(net.DomainAddress("www.example.co.uk"), 443)
+	for _, tc := range []struct {
+		mode  string
+		check func(string) bool
+	}{
+		{"", func(s string) bool { return s == "tcp:www.example.co.uk:443" }},
+		{LogDestinationFull, func(s string) bool { return s == "tcp:www.example.co.uk:443" }},
+		{LogDestinationDomain, func(s string) bool { return s == "example.co.uk" }},
+		{LogDestinationHash, func(s string) bool {
+			return strings.HasPrefix(s, "dest-") && len(s) == len("dest-")+16 && !strings.Contains(s, "example")
+		}},
+		{LogDestinationNone, func(s string) bool { return s == "hidden" }},
+	} {
+		h := newTestHandler(t, &reflex.InboundConfig{LogDestination: tc.mode})
+		dispatcher := newEchoDispatcher()
+		conn, _ := serve(t, h, dispatcher)
+		hs, priv := newTestClientHandshake(t, testUserID)
+		go writeClientHandshakeMagic(conn, hs)
+		reader := bufio.NewReader(conn)
+		sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+		echoRoundTrip(t, conn, reader, sess, dest, "x")
+		<-dispatcher.dests
+
+		logged := serial.ToString(log.AccessMessageFromContext(<-dispatcher.contexts).To)
+		if !tc.check(logged) {
+			t.Errorf("mode %q logged destination %q", tc.mode, logged)
+		}
+	}
+}
+
+func TestLogDestinationHashStable(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{LogDestination: LogDestinationHash})
+	a := net.TCPDestination(net.DomainAddress("example.com"), 443)
+	b := net.TCPDestination(net.DomainAddress("example.org"), 443)
+	if h.loggedDestination(a) != h.loggedDestination(a) {
+		t.Error("hash of a destination changed")
+	}
+	if h.loggedDestination(a) == h.loggedDestination(b) {
+		t.Error("different destinations share a hash")
+	}
+	if got := h.loggedDestination(net.TCPDestination(net.ParseAddress("192.0.2.1"), 80)); got == "192.0.2.1" {
+		t.Error("hash mode logged an IP in the clear")
+	}
+}
+
+func TestLogDestinationDomainIP(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{LogDestination: LogDestinationDomain})
+	if got := h.loggedDestination(net.TCPDestination(net.ParseAddress("192.0.2.1"), 80)); got != "192.0.2.1" {
+		t.Errorf("domain mode logged IP destination as %v", got)
+	}
+}
+
+func TestNewRejectsUnknownLogDestination(t *testing.T) {
+	if _, err := New(t.Context(), &reflex.InboundConfig{LogDestination: "partial"}); err == nil {
+		t.Error("expected an unknown destination logging mode to be rejected")
+	}
+}
+
+func TestAccessLogModes(t *testing.T) {
+	recorder := &accessLogRecorder{entries: make(chan string, 16)}
+	log.RegisterHandler(recorder)
+	t.Cleanup(func() { log.RegisterHandler(log.NewLogger(log.CreateStdoutLogWriter())) })
+
+	dest := net.TCPDestination(net.DomainAddress("example.com"), 443)
+	for _, tc := range []struct {
+		mode       string
+		start      bool
+		completion bool
+	}{
+		{"", true, false},
+		{AccessLogStart, true, false},
+		{AccessLogCompletion, false, true},
+		{AccessLogBoth, true, true},
+	} {
+		h := newTestHandler(t, &reflex.InboundConfig{AccessLog: tc.mode})
+		dispatcher := newEchoDispatcher()
+		conn, done := serve(t, h, dispatcher)
+		hs, priv := newTestClientHandshake(t, testUserID)
+		go writeClientHandshakeMagic(conn, hs)
+		reader := bufio.NewReader(conn)
+		sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+		echoRoundTrip(t, conn, reader, sess, dest, "hello")
+		conn.Close()
+		<-done
+
+		// The dispatcher records the message it finds in the context.
+		if started := log.AccessMessageFromContext(<-dispatcher.contexts) != nil; started != tc.start {
+			t.Errorf("mode %q: start log %v, want %v", tc.mode, started, tc.start)
+		}
+		var completed []string
+		for len(recorder.entries) > 0 {
+			completed = append(completed, <-recorder.entries)
+		}
+		if tc.completion {
+			if len(completed) != 1 || !strings.Contains(completed[0], "accepted tcp:example.com:443 closed after") ||
+				!strings.Contains(completed[0], "5 bytes up, 5 bytes down") {
+				t.Errorf("mode %q: completion log %q", tc.mode, completed)
+			}
+		} else if len(completed) != 0 {
+			t.Errorf("mode %q: unexpected completion log %q", tc.mode, completed)
+		}
+	}
+}
+
+func TestNewRejectsUnknownAccessLog(t *testing.T) {
+	if _, err := New(t.Context(), &reflex.InboundConfig{AccessLog: "never"}); err == nil {
+		t.Error("expected an unknown access logging mode to be rejected")
+	}
+}
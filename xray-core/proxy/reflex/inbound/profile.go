@@ -0,0 +1,136 @@
+package inbound
+
+import (
+	"time"
+
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+)
+
+// buildProfiles builds the custom profiles of an inbound config.
+func buildProfiles(configs []reflex.Profile) ([]*protocol.TrafficProfile, error) {
+	profiles := make([]*protocol.TrafficProfile, len(configs))
+	for i, c := range configs {
+		profile, err := newCustomProfile(c)
+		if err != nil {
+			return nil, errors.New("invalid reflex profile ", c.Name).Base(err).AtError()
+		}
+		profiles[i] = profile
+	}
+	return profiles, nil
+}
+
+// registerProfiles registers the custom profiles of an inbound. If a name
+// is taken, none of them stay registered.
+func registerProfiles(profiles []*protocol.TrafficProfile) error {
+	for i, profile := range profiles {
+		if err := protocol.RegisterProfile(profile.Name, profile); err != nil {
+			for _, registered := range profiles[:i] {
+				protocol.UnregisterProfile(registered.Name)
+			}
+			return errors.New("failed to register reflex profile").Base(err).AtError()
+		}
+	}
+	return nil
+}
+
+// unregisterProfiles removes the custom profiles of an inbound that is
+// closed, so that their names can be registered again.
+func unregisterProfiles(profiles []*protocol.TrafficProfile) {
+	for _, profile := range profiles {
+		protocol.UnregisterProfile(profile.Name)
+	}
+}
+
+// knownProfile reports whether name is a built-in or registered profile or
+// one of the inbound's own, which are registered only once New succeeds.
+func (h *Handler) knownProfile(name string) bool {
+	if protocol.GetProfileByName(name) != nil {
+		return true
+	}
+	key := protocol.ProfileKey(name)
+	for _, profile := range h.profiles {
+		if profile.Name == key {
+			return true
+		}
+	}
+	return false
+}
+
+// newCustomProfile builds the traffic profile c declares, with its weights
+// normalized, or loads it from its capture.
+func newCustomProfile(c reflex.Profile) (*protocol.TrafficProfile, error) {
+	name := protocol.ProfileKey(c.Name)
+	if name == "" {
+		return nil, errors.New("profile has no name")
+	}
+	if c.Pcap != "" {
+		return newCaptureProfile(name, c)
+	}
+	if c.PcapFlow != "" {
+		return nil, errors.New("profile has a capture flow but no capture")
+	}
+	if len(c.PacketSizes) == 0 || len(c.Delays) == 0 {
+		return nil, errors.New("profile needs both packet sizes and delays")
+	}
+
+	var sizeTotal, delayTotal float64
+	for _, s := range c.PacketSizes {
+		if s.Size == 0 || s.Size > 65535 {
+			return nil, errors.New("invalid packet size: ", s.Size)
+		}
+		if !(s.Weight >= 0) {
+			return nil, errors.New("negative packet size weight: ", s.Weight)
+		}
+		sizeTotal += s.Weight
+	}
+	for _, d := range c.Delays {
+		if !(d.Weight >= 0) {
+			return nil, errors.New("negative delay weight: ", d.Weight)
+		}
+		delayTotal += d.Weight
+	}
+	if !(sizeTotal > 0) || !(delayTotal > 0) {
+		return nil, errors.New("profile weights are all zero")
+	}
+
+	profile := &protocol.TrafficProfile{
+		Name:        name,
+		PacketSizes: make([]protocol.PacketSizeDist, len(c.PacketSizes)),
+		Delays:      make([]protocol.DelayDist, len(c.Delays)),
+	}
+	if c.CompressionDictionary != "" {
+		profile.CompressionDictionary = []byte(c.CompressionDictionary)
+	}
+	for i, s := range c.PacketSizes {
+		profile.PacketSizes[i] = protocol.PacketSizeDist{Size: int(s.Size), Weight: s.Weight / sizeTotal}
+	}
+	for i, d := range c.Delays {
+		profile.Delays[i] = protocol.DelayDist{Delay: time.Duration(d.Ms) * time.Millisecond, Weight: d.Weight / delayTotal}
+	}
+	return profile, nil
+}
+
+// newCaptureProfile loads the traffic profile c builds from a capture.
+func newCaptureProfile(name string, c reflex.Profile) (*protocol.TrafficProfile, error) {
+	if len(c.PacketSizes) > 0 || len(c.Delays) > 0 {
+		return nil, errors.New("profile has both a capture and packet sizes or delays")
+	}
+	var flow protocol.Flow
+	if c.PcapFlow != "" {
+		var err error
+		if flow, err = protocol.ParseFlow(c.PcapFlow); err != nil {
+			return nil, err
+		}
+	}
+	profile, err := protocol.LoadProfileFromPCAPFlow(c.Pcap, flow)
+	if err != nil {
+		return nil, err
+	}
+	profile.Name = name
+	if c.CompressionDictionary != "" {
+		profile.CompressionDictionary = []byte(c.CompressionDictionary)
+	}
+	return profile, nil
+}
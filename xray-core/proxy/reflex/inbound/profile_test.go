@@ -0,0 +1,211 @@
+package inbound
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+)
+
+func TestConfigProfile(t *testing.T) {
+	const data = `{
+		"clients": [{"id": "` + testUserID + `", "policy": "test-config-profile"}],
+		"strictPolicy": true,
+		"profiles": [{
+			"name": "test-config-profile",
+			"packetSizes": [{"size": 300, "weight": 3}, {"size": 900, "weight": 1}, {"size": 1200, "weight": 0}],
+			"delays": [{"ms": 15, "weight": 1}],
+			"compressionDictionary": "Content-Type: application/json\r\n"
+		}]
+	}`
+	var config reflex.InboundConfig
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { protocol.UnregisterProfile("test-config-profile") })
+	if _, err := New(context.Background(), &config); err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	profile := protocol.GetProfileByName("test-config-profile")
+	if profile == nil {
+		t.Fatal("profile not registered")
+	}
+	seen := map[int]int{}
+	for i := 0; i < 1000; i++ {
+		seen[profile.GetPacketSize()]++
+	}
+	if len(seen) != 2 || seen[300] == 0 || seen[900] == 0 {
+		t.Errorf("packet sizes = %v, want only 300 and 900", seen)
+	}
+	if seen[300] < seen[900] {
+		t.Errorf("packet sizes = %v, want 300 about three times as often as 900", seen)
+	}
+	if delay := profile.GetDelay(); delay.Milliseconds() != 15 {
+		t.Errorf("delay = %v, want 15ms", delay)
+	}
+	if dict := string(profile.CompressionDictionary); dict != "Content-Type: application/json\r\n" {
+		t.Errorf("compression dictionary = %q", dict)
+	}
+}
+
+func TestConfigProfileFromPCAP(t *testing.T) {
+	config := &reflex.InboundConfig{
+		Clients:      []*reflex.User{{Id: testUserID, Policy: "mimic-test-capture"}},
+		StrictPolicy: true,
+		Profiles:     []reflex.Profile{{Name: "test-capture", Pcap: "../internal/protocol/testdata/flow.pcap"}},
+	}
+	t.Cleanup(func() { protocol.UnregisterProfile("test-capture") })
+	if _, err := New(context.Background(), config); err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	profile := protocol.GetProfileByName("test-capture")
+	if profile == nil || len(profile.PacketSizes) == 0 || len(profile.Delays) == 0 {
+		t.Fatalf("capture profile = %+v", profile)
+	}
+	if size := profile.GetPacketSize(); size != 200 && size != 600 && size != 1400 {
+		t.Errorf("GetPacketSize() = %d, not a size from the capture", size)
+	}
+}
+
+func TestConfigProfileInvalid(t *testing.T) {
+	sizes := []reflex.ProfilePacketSize{{Size: 500, Weight: 1}}
+	delays := []reflex.ProfileDelay{{Ms: 10, Weight: 1}}
+	for _, tc := range []struct {
+		name    string
+		profile reflex.Profile
+	}{
+		{"no name", reflex.Profile{PacketSizes: sizes, Delays: delays}},
+		{"no packet sizes", reflex.Profile{Name: "test-invalid", Delays: delays}},
+		{"no delays", reflex.Profile{Name: "test-invalid", PacketSizes: sizes}},
+		{"negative weight", reflex.Profile{Name: "test-invalid", PacketSizes: []reflex.ProfilePacketSize{{Size: 500, Weight: -1}, {Size: 600, Weight: 2}}, Delays: delays}},
+		{"zero weights", reflex.Profile{Name: "test-invalid", PacketSizes: sizes, Delays: []reflex.ProfileDelay{{Ms: 10}}}},
+		{"oversized packet", reflex.Profile{Name: "test-invalid", PacketSizes: []reflex.ProfilePacketSize{{Size: 70000, Weight: 1}}, Delays: delays}},
+		{"built-in name", reflex.Profile{Name: "youtube", PacketSizes: sizes, Delays: delays}},
+		{"capture and sizes", reflex.Profile{Name: "test-invalid", PacketSizes: sizes, Pcap: "../internal/protocol/testdata/flow.pcap"}},
+		{"missing capture", reflex.Profile{Name: "test-invalid", Pcap: "testdata/missing.pcap"}},
+		{"flow without capture", reflex.Profile{Name: "test-invalid", PacketSizes: sizes, Delays: delays, PcapFlow: "tcp 192.0.2.1:443 > 198.51.100.7:50312"}},
+		{"invalid flow", reflex.Profile{Name: "test-invalid", Pcap: "../internal/protocol/testdata/flow.pcap", PcapFlow: "192.0.2.1:443"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := &reflex.InboundConfig{Profiles: []reflex.Profile{tc.profile}}
+			if _, err := New(context.Background(), config); err == nil {
+				t.Error("expected an error")
+			}
+			if tc.profile.Name == "test-invalid" && protocol.GetProfileByName("test-invalid") != nil {
+				t.Error("invalid profile registered")
+			}
+		})
+	}
+}
+
+func TestConfigProfileRegistersAllOrNone(t *testing.T) {
+	profile := reflex.Profile{
+		Name:        "test-all-or-none",
+		PacketSizes: []reflex.ProfilePacketSize{{Size: 500, Weight: 1}},
+		Delays:      []reflex.ProfileDelay{{Ms: 10, Weight: 1}},
+	}
+	clash := profile
+	clash.Name = "youtube"
+	config := &reflex.InboundConfig{Profiles: []reflex.Profile{profile, clash}}
+	if _, err := New(context.Background(), config); err == nil {
+		t.Fatal("expected an error for a clashing name")
+	}
+	if protocol.GetProfileByName("test-all-or-none") != nil {
+		protocol.UnregisterProfile("test-all-or-none")
+		t.Error("profile before the clash stayed registered")
+	}
+}
+
+func TestConfigProfileUnregistered(t *testing.T) {
+	profile := reflex.Profile{
+		Name:        "test-unregistered",
+		PacketSizes: []reflex.ProfilePacketSize{{Size: 500, Weight: 1}},
+		Delays:      []reflex.ProfileDelay{{Ms: 10, Weight: 1}},
+	}
+	t.Cleanup(func() { protocol.UnregisterProfile("test-unregistered") })
+
+	// A config error after the profiles leaves none of them registered.
+	config := &reflex.InboundConfig{
+		Clients:       []*reflex.User{{Id: testUserID, Policy: "test-unregistered"}},
+		Profiles:      []reflex.Profile{profile},
+		HandshakeMode: "unknown",
+	}
+	if _, err := New(context.Background(), config); err == nil {
+		t.Fatal("expected an error for an unknown handshake mode")
+	}
+	if protocol.GetProfileByName("test-unregistered") != nil {
+		t.Fatal("profile of a failed config stayed registered")
+	}
+
+	// Closing the inbound frees the name for the next one.
+	config.HandshakeMode = ""
+	h := newTestHandler(t, config)
+	if protocol.GetProfileByName("test-unregistered") == nil {
+		t.Fatal("profile not registered")
+	}
+	h.Close()
+	if protocol.GetProfileByName("test-unregistered") != nil {
+		t.Error("profile stayed registered after Close")
+	}
+	newTestHandler(t, config).Close()
+}
+
+func TestDownlinkMorphingNegotiated(t *testing.T) {
+	config := &reflex.InboundConfig{
+		Clients: []*reflex.User{{Id: testUserID, Policy: "test-downlink"}},
+		Profiles: []reflex.Profile{{
+			Name:        "test-downlink",
+			PacketSizes: []reflex.ProfilePacketSize{{Size: 200, Weight: 1}},
+			Delays:      []reflex.ProfileDelay{{Ms: 1, Weight: 1}},
+		}},
+	}
+	t.Cleanup(func() { protocol.UnregisterProfile("test-downlink") })
+	h := newTestHandler(t, config)
+	payload := strings.Repeat("x", 1000)
+
+	for _, asked := range []bool{false, true} {
+		conn, _ := serve(t, h, newEchoDispatcher())
+		hs, priv := newTestClientHandshake(t, testUserID)
+		if asked {
+			hs.PolicyReq = protocol.AppendExtension(nil, protocol.ExtMorphDownlink, nil)
+		}
+		go writeClientHandshakeMagic(conn, hs)
+		reader := bufio.NewReader(conn)
+		sess, _, granted := clientSessionWithProfile(t, reader, hs, priv)
+		if granted != "test-downlink" {
+			t.Fatalf("granted %q", granted)
+		}
+		header, err := protocol.EncodeDestination(net.TCPDestination(net.LocalHostIP, 80))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sess.WriteFrame(conn, protocol.FrameTypeData, append(header, payload...)); err != nil {
+			t.Fatal(err)
+		}
+
+		// Morphed, the echo comes back in frames of about 200 bytes.
+		var echoed string
+		frames := 0
+		for len(echoed) < len(payload) {
+			frame, err := sess.ReadFrame(reader)
+			if err != nil {
+				t.Fatalf("asked %v: %v", asked, err)
+			}
+			echoed += string(frame.Payload)
+			frames++
+		}
+		if echoed != payload {
+			t.Errorf("asked %v: echoed %d bytes, want %d", asked, len(echoed), len(payload))
+		}
+		if morphed := frames > 1; morphed != asked {
+			t.Errorf("asked %v: echo came back in %d frames", asked, frames)
+		}
+		conn.Close()
+	}
+}
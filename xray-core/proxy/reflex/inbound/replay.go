@@ -0,0 +1,50 @@
+package inbound
+
+import (
+	"sync"
+	"time"
+)
+
+// replayFilter remembers handshake nonces for at least interval and at most
+// twice that, in two generations swapped every interval like
+// common/antireplay's ReplayFilter. It keeps exact sets rather than cuckoo
+// filters: a false positive there would refuse a legitimate client, and
+// only authenticated hellos are ever added.
+type replayFilter struct {
+	mu       sync.Mutex
+	current  map[[16]byte]struct{}
+	previous map[[16]byte]struct{}
+	lastSwap time.Time
+	interval time.Duration
+}
+
+func newReplayFilter(interval time.Duration) *replayFilter {
+	return &replayFilter{
+		current:  make(map[[16]byte]struct{}),
+		previous: make(map[[16]byte]struct{}),
+		lastSwap: time.Now(),
+		interval: interval,
+	}
+}
+
+// Check records nonce and reports whether it was new.
+func (f *replayFilter) Check(nonce [16]byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if now := time.Now(); now.Sub(f.lastSwap) >= f.interval {
+		f.previous, f.current = f.current, make(map[[16]byte]struct{})
+		if now.Sub(f.lastSwap) >= 2*f.interval {
+			f.previous = make(map[[16]byte]struct{})
+		}
+		f.lastSwap = now
+	}
+	if _, found := f.current[nonce]; found {
+		return false
+	}
+	if _, found := f.previous[nonce]; found {
+		return false
+	}
+	f.current[nonce] = struct{}{}
+	return true
+}
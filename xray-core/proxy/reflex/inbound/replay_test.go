@@ -0,0 +1,28 @@
+package inbound
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayFilterExpiry(t *testing.T) {
+	f := newReplayFilter(time.Minute)
+	nonce := [16]byte{1}
+	if !f.Check(nonce) {
+		t.Fatal("new nonce reported as replayed")
+	}
+	if f.Check(nonce) {
+		t.Fatal("replayed nonce accepted")
+	}
+
+	// One generation later the nonce is still remembered.
+	f.lastSwap = f.lastSwap.Add(-time.Minute)
+	if f.Check(nonce) {
+		t.Error("nonce forgotten after one interval")
+	}
+	// Two more and it has aged out.
+	f.lastSwap = f.lastSwap.Add(-2 * time.Minute)
+	if !f.Check(nonce) {
+		t.Error("nonce remembered past two intervals")
+	}
+}
@@ -0,0 +1,69 @@
+package inbound
+
+import (
+	"context"
+	"slices"
+
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/common/session"
+)
+
+// RouteTagMarker starts an optional routing tag in front of the destination
+// header of the first DATA frame: [marker (1)][length (1)][tag]. It is
+// outside the address type range, so a header without a tag is unchanged.
+const RouteTagMarker = 0x7f
+
+// RouteTagAttribute is the content attribute a routing tag is exposed
+// under, so routing rules matching on attributes can select an outbound by
+// it.
+const RouteTagAttribute = "reflex-route"
+
+// EncodeRouteTag encodes tag to be sent in front of the destination header.
+func EncodeRouteTag(tag string) ([]byte, error) {
+	if len(tag) == 0 || len(tag) > 255 {
+		return nil, errors.New("invalid route tag length: ", len(tag))
+	}
+	return append([]byte{RouteTagMarker, byte(len(tag))}, tag...), nil
+}
+
+// parseRouteTag decodes a routing tag at the start of data, if there is
+// one, and returns it with the rest of data.
+func parseRouteTag(data []byte) (string, []byte, error) {
+	if len(data) == 0 || data[0] != RouteTagMarker {
+		return "", data, nil
+	}
+	if len(data) < 2 {
+		return "", nil, errors.New("truncated route tag")
+	}
+	tagLen := int(data[1])
+	if tagLen == 0 || len(data) < 2+tagLen {
+		return "", nil, errors.New("truncated route tag")
+	}
+	return string(data[2 : 2+tagLen]), data[2+tagLen:], nil
+}
+
+func (a *MemoryAccount) permitsRouteTag(tag string) bool {
+	return slices.Contains(a.RouteTags, tag)
+}
+
+// ContextWithRouteTag returns a context carrying the routing tag a client
+// requested. The tag is also set as the RouteTagAttribute of the session
+// content.
+func ContextWithRouteTag(ctx context.Context, tag string) context.Context {
+	content := session.ContentFromContext(ctx)
+	if content == nil {
+		content = &session.Content{}
+		ctx = session.ContextWithContent(ctx, content)
+	}
+	content.SetAttribute(RouteTagAttribute, tag)
+	return context.WithValue(ctx, routeTagContextKey, tag)
+}
+
+// RouteTagFromContext returns the routing tag the client requested, or ""
+// if it did not request one.
+func RouteTagFromContext(ctx context.Context) string {
+	if tag, ok := ctx.Value(routeTagContextKey).(string); ok {
+		return tag
+	}
+	return ""
+}
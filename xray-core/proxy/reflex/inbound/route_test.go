@@ -0,0 +1,71 @@
+package inbound
+
+import (
+	"bufio"
+	"testing"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+)
+
+func TestRouteTag(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{
+		Clients: []*reflex.User{{Id: testUserID, RouteTags: []string{"exit-eu"}}},
+	})
+	dest := net.TCPDestination(net.DomainAddress("example.com"), 443)
+
+	dial := func(tag string) (*echoDispatcher, <-chan error) {
+		dispatcher := newEchoDispatcher()
+		conn, done := serve(t, h, dispatcher)
+		hs, priv := newTestClientHandshake(t, testUserID)
+		go writeClientHandshakeMagic(conn, hs)
+		reader := bufio.NewReader(conn)
+		sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+
+		header, err := EncodeRouteTag(tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		destHeader, _ := protocol.EncodeDestination(dest)
+		header = append(header, destHeader...)
+		if err := sess.WriteFrame(conn, protocol.FrameTypeData, append(header, "hi"...)); err != nil {
+			t.Fatal(err)
+		}
+		return dispatcher, done
+	}
+
+	dispatcher, _ := dial("exit-eu")
+	if got := <-dispatcher.dests; got != dest {
+		t.Errorf("dispatched to %v, want %v", got, dest)
+	}
+	ctx := <-dispatcher.contexts
+	if got := RouteTagFromContext(ctx); got != "exit-eu" {
+		t.Errorf("route tag %q in dispatch context, want exit-eu", got)
+	}
+	if got := session.ContentFromContext(ctx).Attribute(RouteTagAttribute); got != "exit-eu" {
+		t.Errorf("route tag attribute %q, want exit-eu", got)
+	}
+
+	dispatcher, done := dial("exit-us")
+	if err := <-done; err == nil {
+		t.Error("expected an unpermitted route tag to be refused")
+	}
+	if len(dispatcher.dests) != 0 {
+		t.Error("unpermitted route tag was dispatched")
+	}
+}
+
+func TestParseRouteTag(t *testing.T) {
+	destHeader, _ := protocol.EncodeDestination(net.TCPDestination(net.LocalHostIP, 80))
+	tag, rest, err := parseRouteTag(destHeader)
+	if err != nil || tag != "" || len(rest) != len(destHeader) {
+		t.Errorf("header without a tag parsed as %q, %d bytes left, %v", tag, len(rest), err)
+	}
+	for _, data := range [][]byte{{RouteTagMarker}, {RouteTagMarker, 0}, {RouteTagMarker, 5, 'a'}} {
+		if _, _, err := parseRouteTag(data); err == nil {
+			t.Errorf("accepted truncated tag %x", data)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package inbound
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/transport/internet/stat"
+)
+
+// loadShedder counts the connections an inbound is serving and sheds new
+// ones once there are high of them, until fewer than low remain. The gap
+// keeps it from flapping at the limit.
+type loadShedder struct {
+	high, low int
+
+	mu       sync.Mutex
+	active   int
+	shedding bool
+
+	shed atomic.Uint64 // connections shed so far
+}
+
+func newLoadShedder(high, low int) *loadShedder {
+	if low == 0 {
+		low = high
+	}
+	return &loadShedder{high: high, low: low}
+}
+
+// admit counts a new connection and reports whether it may be served. A
+// connection admitted must be released when it ends.
+func (s *loadShedder) admit(ctx context.Context) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.shedding && s.active >= s.high {
+		s.shedding = true
+		errors.LogWarning(ctx, "reflex inbound at ", s.active, " connections, shedding load")
+	}
+	if s.shedding {
+		s.shed.Add(1)
+		return false
+	}
+	s.active++
+	return true
+}
+
+func (s *loadShedder) release(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	if s.shedding && s.active < s.low {
+		s.shedding = false
+		errors.LogWarning(ctx, "reflex inbound down to ", s.active, " connections, accepting again")
+	}
+}
+
+// limitConnection turns away a connection over MaxConnections: it is
+// handed to fallback if there is one, closed unread otherwise.
+func (h *Handler) limitConnection(ctx context.Context, c acceptedConn, conn stat.Connection) error {
+	if h.fallback != nil {
+		return h.handleFallback(ctx, c.fallback(ctx), newRecordingReader(conn), conn)
+	}
+	return errors.New("at the limit of ", h.limit.high, " connections, connection dropped").AtInfo()
+}
+
+// shedConnection turns away a connection that arrived while shedding
+// load: it is closed unread or, with ShedToFallback, handed to fallback.
+func (h *Handler) shedConnection(ctx context.Context, c acceptedConn, conn stat.Connection) error {
+	if h.shedToFallback && h.fallback != nil {
+		return h.handleFallback(ctx, c.fallback(ctx), newRecordingReader(conn), conn)
+	}
+	return errors.New("shedding load, connection dropped").AtInfo()
+}
@@ -0,0 +1,187 @@
+package inbound
+
+import (
+	"bufio"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/proxy/reflex"
+)
+
+// waitActive waits until h serves n connections.
+func waitActive(t *testing.T, h *Handler, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		h.load.mu.Lock()
+		active := h.load.active
+		h.load.mu.Unlock()
+		if active == n {
+			return
+		}
+	}
+	t.Fatalf("never reached %d active connections", n)
+}
+
+// expectShed checks that a new connection is turned away at once.
+func expectShed(t *testing.T, h *Handler, shed uint64) {
+	t.Helper()
+	_, done := serve(t, h, newEchoDispatcher())
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("shed connection served")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection not shed")
+	}
+	if got := h.Stats().ShedConnections; got != shed {
+		t.Errorf("ShedConnections = %d, want %d", got, shed)
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{ShedHighConns: 2, ShedLowConns: 1})
+
+	// Two idle connections reach the high watermark.
+	first, firstDone := serve(t, h, newEchoDispatcher())
+	second, secondDone := serve(t, h, newEchoDispatcher())
+	waitActive(t, h, 2)
+	expectShed(t, h, 1)
+
+	// One left is not below the low watermark: still shedding.
+	first.Close()
+	<-firstDone
+	waitActive(t, h, 1)
+	expectShed(t, h, 2)
+
+	// Below it, connections are served again.
+	second.Close()
+	<-secondDone
+	conn, _ := serve(t, h, newEchoDispatcher())
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "accepted again")
+	if got := h.Stats().ShedConnections; got != 2 {
+		t.Errorf("ShedConnections = %d after resuming, want 2", got)
+	}
+}
+
+func TestLoadSheddingToFallback(t *testing.T) {
+	const request = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	port, received := startFallbackServer(t, len(request), "HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\n\r\n")
+	h := newTestHandler(t, &reflex.InboundConfig{
+		Fallback:       &reflex.Fallback{Dest: port},
+		ShedHighConns:  1,
+		ShedToFallback: true,
+	})
+	serve(t, h, newEchoDispatcher())
+	waitActive(t, h, 1)
+
+	conn, _ := serve(t, h, newEchoDispatcher())
+	go conn.Write([]byte(request))
+	select {
+	case got := <-received:
+		if got != request {
+			t.Errorf("fallback received %q, want %q", got, request)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shed connection not handed to fallback")
+	}
+}
+
+func TestNewRejectsInvertedWatermarks(t *testing.T) {
+	if _, err := New(context.Background(), &reflex.InboundConfig{ShedHighConns: 10, ShedLowConns: 20}); err == nil {
+		t.Error("expected an error for a low watermark above the high one")
+	}
+}
+
+// waitConnections waits until h counts n connections against MaxConnections.
+func waitConnections(t *testing.T, h *Handler, n int) {
+	t.Helper()
+	active := func() int {
+		h.limit.mu.Lock()
+		defer h.limit.mu.Unlock()
+		return h.limit.active
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if active() == n {
+			return
+		}
+	}
+	t.Fatalf("%d connections counted, want %d", active(), n)
+}
+
+func TestMaxConnections(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{MaxConnections: 2})
+
+	first, firstDone := serve(t, h, newEchoDispatcher())
+	second, secondDone := serve(t, h, newEchoDispatcher())
+	waitConnections(t, h, 2)
+
+	_, done := serve(t, h, newEchoDispatcher())
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("connection over the limit served")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection over the limit not turned away")
+	}
+	if got := h.Stats().LimitedConnections; got != 1 {
+		t.Errorf("LimitedConnections = %d, want 1", got)
+	}
+
+	// Every way out of Process frees a slot: a client gone before sending,
+	// a failed handshake and a finished session.
+	first.Close()
+	<-firstDone
+	go second.Write([]byte("not a reflex hello, not HTTP either"))
+	<-secondDone
+	waitConnections(t, h, 0)
+
+	conn, done := serve(t, h, newEchoDispatcher())
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "under the limit")
+	conn.Close()
+	<-done
+	waitConnections(t, h, 0)
+	if got := h.Stats().LimitedConnections; got != 1 {
+		t.Errorf("LimitedConnections = %d, want 1", got)
+	}
+}
+
+func TestMaxConnectionsToFallback(t *testing.T) {
+	const request = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	port, received := startFallbackServer(t, len(request), "HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\n\r\n")
+	h := newTestHandler(t, &reflex.InboundConfig{
+		Fallback:       &reflex.Fallback{Dest: port},
+		MaxConnections: 1,
+	})
+	serve(t, h, newEchoDispatcher())
+	waitConnections(t, h, 1)
+
+	conn, _ := serve(t, h, newEchoDispatcher())
+	go conn.Write([]byte(request))
+	select {
+	case got := <-received:
+		if got != request {
+			t.Errorf("fallback received %q, want %q", got, request)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection over the limit not handed to fallback")
+	}
+	if got := h.Stats().LimitedConnections; got != 1 {
+		t.Errorf("LimitedConnections = %d, want 1", got)
+	}
+	// Nor is fallback left unbounded for the connections over the cap.
+	if got := cap(h.fallback.slots); got != 1 {
+		t.Errorf("fallback capped at %d connections, want 1", got)
+	}
+}
@@ -0,0 +1,54 @@
+package inbound
+
+import (
+	"context"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol/tls"
+	"github.com/xtls/xray-core/common/session"
+)
+
+// DestinationAttribute is the content attribute the requested destination
+// host, a domain or an IP, is exposed under.
+const DestinationAttribute = "reflex-destination"
+
+// SNIAttribute is the content attribute the server name of a TLS client
+// hello at the start of the request is exposed under.
+const SNIAttribute = "reflex-sni"
+
+// contextWithSniffedContent exposes what the request tells about its
+// destination to routing, through the session content: the requested host
+// and, when payload starts with a TLS client hello, its server name, with
+// "tls" as the protocol. With routeBySNI, for an IP destination the server
+// name also becomes the route target, see InboundConfig.RouteBySNI.
+func contextWithSniffedContent(ctx context.Context, dest net.Destination, payload []byte, routeBySNI bool) context.Context {
+	content := session.ContentFromContext(ctx)
+	if content == nil {
+		content = &session.Content{}
+		ctx = session.ContextWithContent(ctx, content)
+	}
+	content.SetAttribute(DestinationAttribute, dest.Address.String())
+
+	hello, err := tls.SniffTLS(payload)
+	if err != nil || hello.Domain() == "" {
+		return ctx
+	}
+	if content.Protocol == "" {
+		content.Protocol = hello.Protocol()
+	}
+	content.SetAttribute(SNIAttribute, hello.Domain())
+	if !routeBySNI || dest.Address.Family().IsDomain() {
+		return ctx
+	}
+	outbounds := session.OutboundsFromContext(ctx)
+	if len(outbounds) == 0 {
+		outbounds = []*session.Outbound{{}}
+		ctx = session.ContextWithOutbounds(ctx, outbounds)
+	}
+	outbounds[len(outbounds)-1].RouteTarget = net.Destination{
+		Network: dest.Network,
+		Address: net.DomainAddress(hello.Domain()),
+		Port:    dest.Port,
+	}
+	return ctx
+}
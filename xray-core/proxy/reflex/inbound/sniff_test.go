@@ -0,0 +1,114 @@
+package inbound
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	stdnet "net"
+	"testing"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/routing"
+	routingsession "github.com/xtls/xray-core/features/routing/session"
+	"github.com/xtls/xray-core/proxy/reflex"
+)
+
+// routingContext returns what the router sees of a request dispatched to
+// dest with ctx, after the dispatcher has set its target.
+func routingContext(ctx context.Context, dest net.Destination) routing.Context {
+	outbounds := session.OutboundsFromContext(ctx)
+	if len(outbounds) == 0 {
+		outbounds = []*session.Outbound{{}}
+		ctx = session.ContextWithOutbounds(ctx, outbounds)
+	}
+	outbounds[len(outbounds)-1].Target = dest
+	return routingsession.AsRoutingContext(ctx)
+}
+
+// clientHello returns the first record a TLS client sends for serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := stdnet.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+	defer client.Close()
+	record := make([]byte, 16<<10)
+	n, err := server.Read(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record[:n]
+}
+
+// dispatchWith sends a request for dest starting with payload to an
+// inbound with config and returns the context it was dispatched with.
+func dispatchWith(t *testing.T, config *reflex.InboundConfig, dest net.Destination, payload []byte) context.Context {
+	t.Helper()
+	h := newTestHandler(t, config)
+	dispatcher := newEchoDispatcher()
+	conn, _ := serve(t, h, dispatcher)
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	echoRoundTrip(t, conn, reader, sess, dest, string(payload))
+	return <-dispatcher.contexts
+}
+
+func TestSniffedDestinationDomain(t *testing.T) {
+	dest := net.TCPDestination(net.DomainAddress("example.com"), 443)
+	ctx := routingContext(dispatchWith(t, &reflex.InboundConfig{}, dest, []byte("GET / HTTP/1.1\r\n\r\n")), dest)
+	if got := ctx.GetTargetDomain(); got != "example.com" {
+		t.Errorf("routing sees domain %q, want example.com", got)
+	}
+	if got := ctx.GetAttributes()[DestinationAttribute]; got != "example.com" {
+		t.Errorf("destination attribute %q, want example.com", got)
+	}
+	if got := ctx.GetProtocol(); got != "" {
+		t.Errorf("protocol %q for a plain request", got)
+	}
+}
+
+func TestSniffedServerName(t *testing.T) {
+	dest := net.TCPDestination(net.ParseAddress("192.0.2.1"), 443)
+	ctx := routingContext(dispatchWith(t, &reflex.InboundConfig{RouteBySNI: true}, dest, clientHello(t, "www.example.org")), dest)
+	if got := ctx.GetTargetDomain(); got != "www.example.org" {
+		t.Errorf("routing sees domain %q, want the server name", got)
+	}
+	if got := ctx.GetTargetIPs(); len(got) != 1 || !got[0].Equal(dest.Address.IP()) {
+		t.Errorf("routing sees IPs %v, want %v", got, dest.Address)
+	}
+	if got := ctx.GetProtocol(); got != "tls" {
+		t.Errorf("protocol %q, want tls", got)
+	}
+	attributes := ctx.GetAttributes()
+	if got := attributes[SNIAttribute]; got != "www.example.org" {
+		t.Errorf("SNI attribute %q, want www.example.org", got)
+	}
+	if got := attributes[DestinationAttribute]; got != "192.0.2.1" {
+		t.Errorf("destination attribute %q, want 192.0.2.1", got)
+	}
+}
+
+func TestSniffedServerNameKeepsDomainDestination(t *testing.T) {
+	dest := net.TCPDestination(net.DomainAddress("example.com"), 443)
+	ctx := routingContext(dispatchWith(t, &reflex.InboundConfig{}, dest, clientHello(t, "cdn.example.net")), dest)
+	if got := ctx.GetTargetDomain(); got != "example.com" {
+		t.Errorf("routing sees domain %q, want the requested example.com", got)
+	}
+	if got := ctx.GetAttributes()[SNIAttribute]; got != "cdn.example.net" {
+		t.Errorf("SNI attribute %q, want cdn.example.net", got)
+	}
+}
+
+func TestSniffedServerNameNotRoutedByDefault(t *testing.T) {
+	dest := net.TCPDestination(net.ParseAddress("192.0.2.1"), 443)
+	ctx := routingContext(dispatchWith(t, &reflex.InboundConfig{}, dest, clientHello(t, "www.example.org")), dest)
+	if got := ctx.GetTargetDomain(); got != "" {
+		t.Errorf("routing sees domain %q without RouteBySNI", got)
+	}
+	if got := ctx.GetAttributes()[SNIAttribute]; got != "www.example.org" {
+		t.Errorf("SNI attribute %q, want www.example.org", got)
+	}
+}
@@ -0,0 +1,30 @@
+package inbound
+
+import (
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/transport/internet/stat"
+)
+
+// bufferSetter is implemented by connections whose socket buffers can be
+// sized, such as *net.TCPConn.
+type bufferSetter interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+// setSocketBuffers sets SO_RCVBUF and SO_SNDBUF of conn to size bytes. It
+// does nothing if size is zero or neither conn nor the connection it wraps
+// for stats has a socket to size.
+func setSocketBuffers(conn net.Conn, size int) error {
+	if size <= 0 {
+		return nil
+	}
+	s, ok := stat.TryUnwrapStatsConn(conn).(bufferSetter)
+	if !ok {
+		return nil
+	}
+	if err := s.SetReadBuffer(size); err != nil {
+		return err
+	}
+	return s.SetWriteBuffer(size)
+}
@@ -0,0 +1,41 @@
+package inbound
+
+import (
+	stdnet "net"
+	"syscall"
+	"testing"
+)
+
+func TestSetSocketBuffersTCP(t *testing.T) {
+	ln, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := stdnet.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	const size = 32 << 10
+	if err := setSocketBuffers(conn, size); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := conn.(*stdnet.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Control(func(fd uintptr) {
+		for _, opt := range []int{syscall.SO_RCVBUF, syscall.SO_SNDBUF} {
+			got, err := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Linux doubles the requested size for bookkeeping.
+			if got < size || got > 2*size {
+				t.Errorf("socket option %d is %d, want about %d", opt, got, size)
+			}
+		}
+	})
+}
@@ -0,0 +1,41 @@
+package inbound
+
+import (
+	stdnet "net"
+	"testing"
+
+	"github.com/xtls/xray-core/transport/internet/stat"
+)
+
+// bufferConn records the socket buffer sizes set on it.
+type bufferConn struct {
+	stdnet.Conn
+	read, write int
+}
+
+func (c *bufferConn) SetReadBuffer(bytes int) error  { c.read = bytes; return nil }
+func (c *bufferConn) SetWriteBuffer(bytes int) error { c.write = bytes; return nil }
+
+func TestSetSocketBuffers(t *testing.T) {
+	conn := &bufferConn{}
+	if err := setSocketBuffers(&stat.CounterConnection{Connection: conn}, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if conn.read != 1<<20 || conn.write != 1<<20 {
+		t.Errorf("buffers set to %d/%d through the stats wrapper, want %d", conn.read, conn.write, 1<<20)
+	}
+
+	conn = &bufferConn{}
+	setSocketBuffers(conn, 0)
+	if conn.read != 0 || conn.write != 0 {
+		t.Error("buffers set without a configured size")
+	}
+
+	// Connections without a socket are left alone.
+	client, server := stdnet.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if err := setSocketBuffers(server, 1<<20); err != nil {
+		t.Errorf("pipe: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package inbound
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/features/stats"
+	"github.com/xtls/xray-core/proxy/reflex"
+	reflexprotocol "github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+)
+
+// countUserTraffic adds the traffic of sess to the user's counters in the
+// stats manager, user>>>email>>>reflex>>>uplink and downlink, the plaintext
+// the client sent and received, destination headers included. Like the
+// dispatcher's traffic counters, each is kept only if the policy of the
+// user's level enables user uplink or downlink stats. A user's email is
+// their ID.
+func (h *Handler) countUserTraffic(sess *reflexprotocol.Session, user *protocol.MemoryUser) {
+	if h.statsManager == nil {
+		return
+	}
+	p := h.sessionPolicy(user.Level)
+	prefix := "user>>>" + user.Email + ">>>reflex>>>"
+	var uplink, downlink stats.Counter
+	if p.Stats.UserUplink {
+		uplink, _ = stats.GetOrRegisterCounter(h.statsManager, prefix+"uplink")
+	}
+	if p.Stats.UserDownlink {
+		downlink, _ = stats.GetOrRegisterCounter(h.statsManager, prefix+"downlink")
+	}
+	if uplink == nil && downlink == nil {
+		return
+	}
+	sess.SetByteCounters(uplink, downlink)
+}
+
+// Latency buckets are powers of two starting at latencyBucketBase, so 24 of
+// them cover 100µs to several minutes at a resolution of a factor of two.
+const (
+	latencyBucketBase  = 100 * time.Microsecond
+	latencyBucketCount = 24
+)
+
+// latencyHistogram is a fixed-size, lock-free histogram of durations.
+// Bucket i counts durations up to latencyBucketBase<<i; the last bucket
+// also takes everything longer.
+type latencyHistogram struct {
+	buckets [latencyBucketCount]atomic.Uint64
+	count   atomic.Uint64
+}
+
+func (l *latencyHistogram) Observe(d time.Duration) {
+	i := 0
+	for i < latencyBucketCount-1 && d > latencyBucketBase<<i {
+		i++
+	}
+	l.buckets[i].Add(1)
+	l.count.Add(1)
+}
+
+// Percentile returns the upper bound of the bucket holding the p-th
+// percentile, 0 < p <= 100, or 0 if nothing was observed.
+func (l *latencyHistogram) Percentile(p float64) time.Duration {
+	var counts [latencyBucketCount]uint64
+	var total uint64
+	for i := range l.buckets {
+		counts[i] = l.buckets[i].Load()
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(p / 100 * float64(total))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range counts {
+		seen += n
+		if seen >= rank {
+			return latencyBucketBase << i
+		}
+	}
+	return latencyBucketBase << (latencyBucketCount - 1)
+}
+
+// profileCounters counts the usage of one traffic profile.
+type profileCounters struct {
+	connections atomic.Uint64
+	uplink      atomic.Uint64
+	downlink    atomic.Uint64
+}
+
+// profileUsage holds the counters of every profile used so far.
+type profileUsage struct {
+	counters sync.Map // profile name -> *profileCounters
+}
+
+func (u *profileUsage) get(name string) *profileCounters {
+	if c, ok := u.counters.Load(name); ok {
+		return c.(*profileCounters)
+	}
+	c, _ := u.counters.LoadOrStore(name, &profileCounters{})
+	return c.(*profileCounters)
+}
+
+func (u *profileUsage) snapshot() map[string]reflex.ProfileStats {
+	stats := make(map[string]reflex.ProfileStats)
+	u.counters.Range(func(name, c any) bool {
+		counters := c.(*profileCounters)
+		stats[name.(string)] = reflex.ProfileStats{
+			Connections:   counters.connections.Load(),
+			UplinkBytes:   counters.uplink.Load(),
+			DownlinkBytes: counters.downlink.Load(),
+		}
+		return true
+	})
+	return stats
+}
+
+// Stats implements reflex.InboundHandler.
+func (h *Handler) Stats() reflex.Stats {
+	stats := reflex.Stats{
+		Handshakes:     h.handshakeLatency.count.Load(),
+		HandshakeP50:   h.handshakeLatency.Percentile(50),
+		HandshakeP90:   h.handshakeLatency.Percentile(90),
+		HandshakeP99:   h.handshakeLatency.Percentile(99),
+		Profiles:       h.profileUsage.snapshot(),
+		ClientVersions: h.clientVersions.snapshot(),
+	}
+	if h.load != nil {
+		stats.ShedConnections = h.load.shed.Load()
+	}
+	if h.limit != nil {
+		stats.LimitedConnections = h.limit.shed.Load()
+	}
+	return stats
+}
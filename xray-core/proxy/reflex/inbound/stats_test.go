@@ -0,0 +1,197 @@
+package inbound
+
+import (
+	"bufio"
+	"context"
+	"testing"
+	"time"
+
+	appstats "github.com/xtls/xray-core/app/stats"
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/features/policy"
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+)
+
+func TestLatencyHistogramPercentile(t *testing.T) {
+	var l latencyHistogram
+	if got := l.Percentile(50); got != 0 {
+		t.Errorf("empty histogram reports %v", got)
+	}
+	for i := 0; i < 90; i++ {
+		l.Observe(150 * time.Microsecond)
+	}
+	for i := 0; i < 10; i++ {
+		l.Observe(3 * time.Millisecond)
+	}
+	l.Observe(time.Hour)
+	if got := l.Percentile(50); got != 200*time.Microsecond {
+		t.Errorf("p50 = %v, want 200µs", got)
+	}
+	if got := l.Percentile(95); got != 3200*time.Microsecond {
+		t.Errorf("p95 = %v, want 3.2ms", got)
+	}
+	if got := l.Percentile(100); got != latencyBucketBase<<(latencyBucketCount-1) {
+		t.Errorf("p100 = %v, want the last bucket", got)
+	}
+}
+
+func TestInboundHandlerInterface(t *testing.T) {
+	obj, err := common.CreateObject(context.Background(), &reflex.InboundConfig{
+		Clients: []*reflex.User{{Id: testUserID}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, ok := obj.(reflex.InboundHandler)
+	if !ok {
+		t.Fatalf("%T does not implement reflex.InboundHandler", obj)
+	}
+	if len(h.Network()) == 0 {
+		t.Error("handler serves no network")
+	}
+	if stats := h.Stats(); stats.Handshakes != 0 {
+		t.Errorf("fresh handler reports %d handshakes", stats.Handshakes)
+	}
+}
+
+func TestHandshakeLatencyStats(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	const handshakes = 5
+	for i := 0; i < handshakes; i++ {
+		conn, done := serve(t, h, newEchoDispatcher())
+		hs, priv := newTestClientHandshake(t, testUserID)
+		go writeClientHandshakeMagic(conn, hs)
+		reader := bufio.NewReader(conn)
+		sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+		echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "x")
+		conn.Close()
+		<-done
+	}
+
+	stats := h.Stats()
+	if stats.Handshakes != handshakes {
+		t.Errorf("counted %d handshakes, want %d", stats.Handshakes, handshakes)
+	}
+	if stats.HandshakeP50 <= 0 || stats.HandshakeP50 > stats.HandshakeP90 || stats.HandshakeP90 > stats.HandshakeP99 {
+		t.Errorf("implausible percentiles %v %v %v", stats.HandshakeP50, stats.HandshakeP90, stats.HandshakeP99)
+	}
+	if stats.HandshakeP99 > 10*time.Second {
+		t.Errorf("p99 %v exceeds the test's own timeouts", stats.HandshakeP99)
+	}
+}
+
+func TestProfileUsageStats(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{Clients: []*reflex.User{{Id: testUserID, Policy: "youtube"}}})
+	conn, _ := serve(t, h, newEchoDispatcher())
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "through youtube")
+
+	profiles := h.Stats().Profiles
+	if len(profiles) != 1 {
+		t.Fatalf("usage recorded for %v, want youtube only", profiles)
+	}
+	got := profiles["youtube"]
+	want := uint64(len("through youtube"))
+	if got.Connections != 1 || got.UplinkBytes != want || got.DownlinkBytes != want {
+		t.Errorf("youtube usage %+v, want 1 connection and %d bytes each way", got, want)
+	}
+
+	// Sessions without a profile are not counted anywhere.
+	h = newTestHandler(t, &reflex.InboundConfig{})
+	conn, _ = serve(t, h, newEchoDispatcher())
+	hs, priv = newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader = bufio.NewReader(conn)
+	sess, _ = clientSessionFromResponse(t, reader, hs, priv)
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "plain")
+	if profiles := h.Stats().Profiles; len(profiles) != 0 {
+		t.Errorf("usage recorded for %v without a profile", profiles)
+	}
+}
+
+func TestUserTrafficStats(t *testing.T) {
+	manager, err := appstats.NewManager(context.Background(), &appstats.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	h.statsManager = manager
+	h.policyManager = testPolicy(func(_ uint32, s *policy.Session) {
+		s.Stats.UserUplink = true
+		s.Stats.UserDownlink = true
+	})
+	conn, done := serve(t, h, newEchoDispatcher())
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	dest := net.TCPDestination(net.LocalHostIP, 80)
+	header, err := protocol.EncodeDestination(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoRoundTrip(t, conn, reader, sess, dest, "hello reflex")
+	go sess.WriteFrame(conn, protocol.FrameTypeCloseWrite, nil)
+	for {
+		frame, err := sess.ReadFrame(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Type == protocol.FrameTypeCloseWrite {
+			break
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// The destination header travels in the first DATA frame, so it is
+	// part of the uplink.
+	for name, want := range map[string]int64{
+		"user>>>" + testUserID + ">>>reflex>>>uplink":   int64(len(header) + len("hello reflex")),
+		"user>>>" + testUserID + ">>>reflex>>>downlink": int64(len("hello reflex")),
+	} {
+		counter := manager.GetCounter(name)
+		if counter == nil {
+			t.Errorf("%s not registered", name)
+			continue
+		}
+		if got := counter.Value(); got != want {
+			t.Errorf("%s = %d, want %d", name, got, want)
+		}
+	}
+	if got := sess.Stats(); got.BytesWritten != uint64(len(header)+len("hello reflex")) || got.BytesRead != uint64(len("hello reflex")) {
+		t.Errorf("client session stats %+v", got)
+	}
+}
+
+func TestUserTrafficStatsFollowPolicy(t *testing.T) {
+	manager, err := appstats.NewManager(context.Background(), &appstats.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	h.statsManager = manager
+	h.policyManager = testPolicy(func(_ uint32, s *policy.Session) {
+		s.Stats.UserDownlink = true
+	})
+	conn, _ := serve(t, h, newEchoDispatcher())
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "hello reflex")
+
+	if manager.GetCounter("user>>>"+testUserID+">>>reflex>>>uplink") != nil {
+		t.Error("uplink counted without the policy's user uplink stats")
+	}
+	if manager.GetCounter("user>>>"+testUserID+">>>reflex>>>downlink") == nil {
+		t.Error("downlink not counted with the policy's user downlink stats")
+	}
+}
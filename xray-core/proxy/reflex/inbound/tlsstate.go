@@ -0,0 +1,24 @@
+package inbound
+
+import (
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/transport/internet/reality"
+	"github.com/xtls/xray-core/transport/internet/stat"
+	"github.com/xtls/xray-core/transport/internet/tls"
+)
+
+// tlsState returns the server name and ALPN the TLS or REALITY stream
+// security of conn negotiated, or empty strings if conn has none. It must
+// be called once the TLS handshake has completed, that is after the first
+// read.
+func tlsState(conn net.Conn) (serverName, alpn string) {
+	switch c := stat.TryUnwrapStatsConn(conn).(type) {
+	case *tls.Conn:
+		cs := c.ConnectionState()
+		return cs.ServerName, cs.NegotiatedProtocol
+	case *reality.Conn:
+		cs := c.ConnectionState()
+		return cs.ServerName, cs.NegotiatedProtocol
+	}
+	return "", ""
+}
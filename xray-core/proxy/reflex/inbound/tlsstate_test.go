@@ -0,0 +1,100 @@
+package inbound
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	gotls "crypto/tls"
+	stdnet "net"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol/tls/cert"
+	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/transport/internet/tls"
+)
+
+// serveTLS is serve behind Xray's TLS stream security offering alpn. The
+// returned client has completed its TLS handshake asking for clientALPN.
+func serveTLS(t *testing.T, h *Handler, dispatcher routing.Dispatcher, alpn []string, clientALPN string) (stdnet.Conn, <-chan error) {
+	t.Helper()
+	certPEM, keyPEM := cert.MustGenerate(nil, cert.DNSNames("example.com")).ToPEM()
+	keyPair, err := gotls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := stdnet.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		conn := tls.Server(server, &gotls.Config{Certificates: []gotls.Certificate{keyPair}, NextProtos: alpn})
+		done <- h.Process(context.Background(), net.Network_TCP, conn, dispatcher)
+		conn.Close()
+	}()
+	conn := gotls.Client(client, &gotls.Config{ServerName: "example.com", InsecureSkipVerify: true, NextProtos: []string{clientALPN}})
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return conn, done
+}
+
+func TestRequiredALPNWrongFallsBack(t *testing.T) {
+	hs, _ := newTestClientHandshake(t, testUserID)
+	var request bytes.Buffer
+	if err := writeClientHandshakeMagic(&request, hs); err != nil {
+		t.Fatal(err)
+	}
+	port, received := startFallbackServer(t, request.Len(), "HTTP/1.1 200 OK\r\n\r\n")
+	h := newTestHandler(t, &reflex.InboundConfig{
+		Fallback:     &reflex.Fallback{Dest: port},
+		RequiredAlpn: "h2",
+	})
+	conn, _ := serveTLS(t, h, newEchoDispatcher(), []string{"h2", "http/1.1"}, "http/1.1")
+
+	go conn.Write(request.Bytes())
+	select {
+	case got := <-received:
+		if got != request.String() {
+			t.Errorf("fallback received %q, want the handshake", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handshake with the wrong ALPN was not sent to fallback")
+	}
+}
+
+func TestRequiredALPNAccepted(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{RequiredAlpn: "h2"})
+	dispatcher := newEchoDispatcher()
+	conn, _ := serveTLS(t, h, dispatcher, []string{"h2", "http/1.1"}, "h2")
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	dest := net.TCPDestination(net.DomainAddress("example.com"), 443)
+	echoRoundTrip(t, conn, reader, sess, dest, "hello over h2")
+}
+
+func TestFallbackRuleALPNWithByteCap(t *testing.T) {
+	defaultPort, toDefault := startFallbackServer(t, 1, "")
+	rulePort, toRule := startFallbackServer(t, 1, "")
+	h := newTestHandler(t, &reflex.InboundConfig{Fallback: &reflex.Fallback{
+		Dest:     defaultPort,
+		MaxBytes: 1 << 20,
+		Rules:    []*reflex.FallbackRule{{Alpn: "h2", Dest: rulePort}},
+	}})
+	conn, _ := serveTLS(t, h, newEchoDispatcher(), []string{"h2", "http/1.1"}, "h2")
+
+	go conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	select {
+	case <-toRule:
+	case <-toDefault:
+		t.Error("connection negotiating h2 went to the default backend under a byte cap")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no fallback backend received the connection")
+	}
+}
@@ -0,0 +1,57 @@
+package inbound
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+
+	"github.com/xtls/xray-core/common/uuid"
+)
+
+const (
+	// authTokenStep is how long one authentication token stays current.
+	authTokenStep = 30 * time.Second
+
+	// authTokenSkewSteps is how many steps either side of the current one a
+	// token is still accepted, to absorb clock drift.
+	authTokenSkewSteps = 1
+
+	authTokenSize = 16
+)
+
+// UserIDHash returns the IdHash a server lists for a client that
+// authenticates with id: the hex SHA-256 of its bytes. A client with an
+// IdSalt authenticates with protocol.DeriveUserID of its UUID.
+func UserIDHash(id uuid.UUID) string {
+	sum := sha256.Sum256(id.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+// computeAuthToken returns the TOTP-like token for secret at time t.
+func computeAuthToken(secret []byte, t time.Time) []byte {
+	return authTokenForStep(secret, t.Unix()/int64(authTokenStep/time.Second))
+}
+
+func authTokenForStep(secret []byte, step int64) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("reflex auth token"))
+	binary.Write(mac, binary.BigEndian, step)
+	return mac.Sum(nil)[:authTokenSize]
+}
+
+// verifyAuthToken reports whether token is valid for secret around now.
+func verifyAuthToken(secret, token []byte, now time.Time) bool {
+	if len(token) != authTokenSize {
+		return false
+	}
+	step := now.Unix() / int64(authTokenStep/time.Second)
+	valid := false
+	for i := int64(-authTokenSkewSteps); i <= authTokenSkewSteps; i++ {
+		if hmac.Equal(token, authTokenForStep(secret, step+i)) {
+			valid = true
+		}
+	}
+	return valid
+}
@@ -0,0 +1,111 @@
+package inbound
+
+import (
+	"bufio"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/uuid"
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+)
+
+func TestVerifyAuthTokenWindow(t *testing.T) {
+	secret := []byte("shared secret")
+	now := time.Now()
+	if !verifyAuthToken(secret, computeAuthToken(secret, now.Add(-authTokenStep)), now) {
+		t.Error("token from the previous step rejected")
+	}
+	if verifyAuthToken(secret, computeAuthToken(secret, now.Add(-3*authTokenStep)), now) {
+		t.Error("expired token accepted")
+	}
+	if verifyAuthToken([]byte("other secret"), computeAuthToken(secret, now), now) {
+		t.Error("token for another secret accepted")
+	}
+}
+
+func TestHandshakeAuthToken(t *testing.T) {
+	secret := "per-user secret"
+	newHandler := func() *Handler {
+		return newTestHandler(t, &reflex.InboundConfig{
+			Clients: []*reflex.User{{Id: testUserID, TokenSecret: secret}},
+		})
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		conn, _ := serve(t, newHandler(), newEchoDispatcher())
+		hs, priv := newTestClientHandshake(t, testUserID)
+		hs.PolicyReq = protocol.AppendExtension(nil, protocol.ExtAuthToken, computeAuthToken([]byte(secret), time.Now()))
+		go writeClientHandshakeMagic(conn, hs)
+
+		reader := bufio.NewReader(conn)
+		sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+		echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "with token")
+	})
+
+	for name, policyReq := range map[string][]byte{
+		"missing": nil,
+		"invalid": protocol.AppendExtension(nil, protocol.ExtAuthToken, make([]byte, authTokenSize)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn, done := serve(t, newHandler(), newEchoDispatcher())
+			hs, _ := newTestClientHandshake(t, testUserID)
+			hs.PolicyReq = policyReq
+			go writeClientHandshakeMagic(conn, hs)
+
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			if !strings.HasPrefix(line, "HTTP/1.1 403") {
+				t.Errorf("unexpected response %q", line)
+			}
+			if err := <-done; err == nil {
+				t.Error("expected Process to fail")
+			}
+		})
+	}
+}
+
+func TestDerivedUserID(t *testing.T) {
+	raw := uuid.New()
+	derived := protocol.DeriveUserID("server salt", raw)
+	if derived == raw || derived == protocol.DeriveUserID("other salt", raw) {
+		t.Fatal("derived ID does not depend on the salt")
+	}
+	h := newTestHandler(t, &reflex.InboundConfig{
+		Clients: []*reflex.User{{IdHash: strings.ToUpper(UserIDHash(derived))}},
+	})
+
+	conn, _ := serve(t, h, newEchoDispatcher())
+	hs, priv := newTestClientHandshake(t, derived.String())
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+	echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "derived")
+
+	// The UUID the derived ID came from is not an ID of its own.
+	conn, done := serve(t, h, newEchoDispatcher())
+	hs, _ = newTestClientHandshake(t, raw.String())
+	go writeClientHandshakeMagic(conn, hs)
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	if !strings.HasPrefix(line, "HTTP/1.1 403") {
+		t.Errorf("raw UUID answered with %q", line)
+	}
+	if err := <-done; err == nil {
+		t.Error("expected Process to fail for the raw UUID")
+	}
+}
+
+func TestNewValidatesIdHash(t *testing.T) {
+	id := uuid.New()
+	for _, client := range []*reflex.User{
+		{IdHash: "not hex"},
+		{IdHash: UserIDHash(id)[:32]},
+		{Id: id.String(), IdHash: UserIDHash(id)},
+	} {
+		if _, err := New(context.Background(), &reflex.InboundConfig{Clients: []*reflex.User{client}}); err == nil {
+			t.Errorf("New accepted %+v", client)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package inbound
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/common/signal"
+	"github.com/xtls/xray-core/features/policy"
+	"github.com/xtls/xray-core/features/routing"
+	reflexprotocol "github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+	"github.com/xtls/xray-core/transport"
+	"github.com/xtls/xray-core/transport/internet/stat"
+)
+
+// maxUDPEndpoints caps the endpoints one association may reach, each of
+// which holds a dispatched link. Datagrams to further endpoints are dropped.
+const maxUDPEndpoints = 256
+
+// udpAssociation relays the datagrams of one session. Each endpoint the
+// client sends to gets its own dispatched link; datagrams coming back on it
+// are sent to the client addressed from that endpoint.
+type udpAssociation struct {
+	h          *Handler
+	ctx        context.Context
+	conn       stat.Connection
+	dispatcher routing.Dispatcher
+	sess       *reflexprotocol.Session
+	user       *protocol.MemoryUser
+	timer      *signal.ActivityTimer
+	morph      bool             // replies are padded, see reflexprotocol.ExtMorphDownlink
+	usage      *profileCounters // nil without a profile
+
+	mu    sync.Mutex
+	links map[net.Destination]*transport.Link
+	wg    sync.WaitGroup
+}
+
+// handleUDP relays a UDP association opened by a UDP frame instead of a
+// first DATA frame. Every UDP frame carries one datagram prefixed with the
+// destination header of its endpoint, and the association lasts until the
+// client closes the session or it stays idle. A datagram that cannot be
+// relayed is dropped, as UDP would; the association carries on.
+func (h *Handler) handleUDP(ctx context.Context, _ dataConn, first []byte, reader *bufio.Reader, conn stat.Connection, dispatcher routing.Dispatcher, sess *reflexprotocol.Session, user *protocol.MemoryUser) error {
+	if err := sess.SetReadDeadline(time.Time{}); err != nil {
+		return errors.New("unable to set read deadline").Base(err).AtWarning()
+	}
+	inbound := session.InboundFromContext(ctx)
+	if inbound == nil {
+		inbound = &session.Inbound{}
+		ctx = session.ContextWithInbound(ctx, inbound)
+	}
+	inbound.Name = "reflex"
+	if h.tag != "" {
+		inbound.Tag = h.tag
+	}
+	inbound.User = user
+	sessionPolicy := h.sessionPolicy(user.Level)
+	h.countUserTraffic(sess, user)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	a := &udpAssociation{
+		h:          h,
+		ctx:        policy.ContextWithBufferPolicy(ctx, h.bufferPolicy(sessionPolicy.Buffer)),
+		conn:       conn,
+		dispatcher: dispatcher,
+		sess:       sess,
+		user:       user,
+		timer:      signal.CancelAfterInactivity(ctx, cancel, sessionPolicy.Timeouts.ConnectionIdle),
+		morph:      morphsDownlink(ctx),
+		links:      make(map[net.Destination]*transport.Link),
+	}
+	if profile := sess.Profile(); profile != nil {
+		a.usage = h.profileUsage.get(profile.Name)
+		a.usage.connections.Add(1)
+	}
+	defer a.close()
+
+	a.send(first)
+	for {
+		frame, err := sess.ReadFrame(reader)
+		if err != nil {
+			if errors.Cause(err) == io.EOF {
+				return nil
+			}
+			return errors.New("failed to read frame").Base(err)
+		}
+		a.timer.Update()
+
+		switch frame.Type {
+		case reflexprotocol.FrameTypeUDP:
+			a.send(frame.Payload)
+		case reflexprotocol.FrameTypePadding, reflexprotocol.FrameTypeTiming:
+			if err := sess.HandleControlFrame(frame, sess.Profile()); err != nil {
+				return err
+			}
+		case reflexprotocol.FrameTypePing, reflexprotocol.FrameTypePong:
+			if err := sess.HandleHeartbeat(conn, frame); err != nil {
+				return err
+			}
+		case reflexprotocol.FrameTypeRekey:
+			if err := sess.HandleRekey(conn, frame); err != nil {
+				return err
+			}
+		case reflexprotocol.FrameTypeClose:
+			return nil
+		case reflexprotocol.FrameTypeCloseWrite:
+			// Replies may still be on their way; they are relayed until
+			// the downlink goes idle.
+			a.timer.SetTimeout(sessionPolicy.Timeouts.DownlinkOnly)
+			a.closeWrite()
+			a.wait(ctx)
+			// Like the downlink of a stream, the replies end with a
+			// CLOSE_WRITE.
+			if err := sess.FlushMorphed(); err != nil {
+				return errors.New("failed to write UDP response").Base(err)
+			}
+			return sess.WriteFrame(conn, reflexprotocol.FrameTypeCloseWrite, nil)
+		}
+	}
+}
+
+// send forwards the datagram in payload, dispatching a link for its
+// endpoint the first time it is seen. A datagram that cannot be forwarded
+// is logged and dropped.
+func (a *udpAssociation) send(payload []byte) {
+	if err := a.forward(payload); err != nil {
+		errors.LogInfoInner(a.ctx, err, "dropped UDP datagram")
+	}
+}
+
+func (a *udpAssociation) forward(payload []byte) error {
+	dest, datagram, err := sessionDestination(a.ctx, net.Network_UDP, payload)
+	if err != nil {
+		return err
+	}
+	link, err := a.link(dest)
+	if err != nil {
+		return err
+	}
+	b := buf.NewWithSize(int32(len(datagram)))
+	b.Write(datagram)
+	if err := link.Writer.WriteMultiBuffer(buf.MultiBuffer{b}); err != nil {
+		// The endpoint's link is gone; the next datagram to it dispatches
+		// a new one.
+		a.remove(dest, link)
+		return errors.New("failed to transfer UDP datagram").Base(err)
+	}
+	if a.usage != nil {
+		a.usage.uplink.Add(uint64(len(datagram)))
+	}
+	return nil
+}
+
+// link returns the link for endpoint, dispatching it if need be. Resolving
+// and dispatching happen outside mu, so replies keep flowing meanwhile.
+func (a *udpAssociation) link(endpoint net.Destination) (*transport.Link, error) {
+	a.mu.Lock()
+	link, found := a.links[endpoint]
+	count := len(a.links)
+	a.mu.Unlock()
+	if found {
+		return link, nil
+	}
+	if count >= maxUDPEndpoints {
+		return nil, errors.New("UDP association reached ", maxUDPEndpoints, " endpoints")
+	}
+	if a.h.blockedPorts[endpoint.Port] {
+		return nil, errors.New("destination port ", endpoint.Port, " is blocked").AtWarning()
+	}
+	dest, err := a.h.resolveDestination(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	header, err := reflexprotocol.EncodeDestination(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	loggedDest := a.h.loggedDestination(dest)
+	ctx := log.ContextWithAccessMessage(a.ctx, &log.AccessMessage{
+		From:   remoteAddr(a.conn),
+		To:     loggedDest,
+		Status: log.AccessAccepted,
+		Reason: "",
+		Email:  a.user.Email,
+	})
+	errors.LogInfo(ctx, "received UDP request for ", loggedDest)
+	link, err = a.dispatcher.Dispatch(ContextWithAffinityKey(ctx, affinityKey(a.user.Email, dest)), dest)
+	if err != nil {
+		return nil, errors.New("failed to dispatch UDP request to ", loggedDest).Base(err)
+	}
+
+	// Only the frame loop adds links, so none was added for endpoint
+	// meanwhile.
+	a.mu.Lock()
+	a.links[endpoint] = link
+	a.mu.Unlock()
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		a.relayReplies(link, header)
+	}()
+	return link, nil
+}
+
+// remove forgets the link of endpoint and interrupts it.
+func (a *udpAssociation) remove(endpoint net.Destination, link *transport.Link) {
+	a.mu.Lock()
+	if a.links[endpoint] == link {
+		delete(a.links, endpoint)
+	}
+	a.mu.Unlock()
+	common.Interrupt(link.Reader)
+	common.Interrupt(link.Writer)
+}
+
+// relayReplies sends every datagram read from link to the client in a UDP
+// frame prefixed with header, until link ends. Replies are padded like the
+// downlink of a stream when the client asked for it, but never split.
+func (a *udpAssociation) relayReplies(link *transport.Link, header []byte) {
+	for {
+		mb, err := link.Reader.ReadMultiBuffer()
+		for _, b := range mb {
+			frame := append(header[:len(header):len(header)], b.Bytes()...)
+			var werr error
+			if profile := a.sess.Profile(); a.morph && profile != nil {
+				werr = a.sess.WriteFrameWithPadding(a.conn, reflexprotocol.FrameTypeUDP, frame, profile)
+			} else {
+				werr = a.sess.WriteFrame(a.conn, reflexprotocol.FrameTypeUDP, frame)
+			}
+			if werr != nil {
+				errors.LogInfoInner(a.ctx, werr, "failed to write UDP reply")
+				buf.ReleaseMulti(mb)
+				return
+			}
+			if a.usage != nil {
+				a.usage.downlink.Add(uint64(b.Len()))
+			}
+			a.timer.Update()
+		}
+		buf.ReleaseMulti(mb)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// closeWrite tells every endpoint the client is done sending.
+func (a *udpAssociation) closeWrite() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, link := range a.links {
+		common.Close(link.Writer)
+	}
+}
+
+// wait returns once every reply relay has ended or ctx is done.
+func (a *udpAssociation) wait(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// close interrupts every link and waits for the reply relays.
+func (a *udpAssociation) close() {
+	a.mu.Lock()
+	for _, link := range a.links {
+		common.Interrupt(link.Reader)
+		common.Interrupt(link.Writer)
+	}
+	a.mu.Unlock()
+	a.wg.Wait()
+}
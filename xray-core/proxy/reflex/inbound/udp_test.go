@@ -0,0 +1,133 @@
+package inbound
+
+import (
+	"bufio"
+	"context"
+	"testing"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+)
+
+func TestUDPAssociation(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	dispatcher := newEchoDispatcher()
+	conn, done := serve(t, h, dispatcher)
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+
+	datagrams := map[net.Destination]string{
+		net.UDPDestination(net.IPAddress([]byte{8, 8, 8, 8}), 53): "dns query",
+		net.UDPDestination(net.DomainAddress("example.com"), 443): "quic initial",
+	}
+	go func() {
+		for dest, datagram := range datagrams {
+			header, _ := protocol.EncodeDestination(dest)
+			sess.WriteFrame(conn, protocol.FrameTypeUDP, append(header, datagram...))
+		}
+	}()
+
+	for range datagrams {
+		frame, err := sess.ReadFrame(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Type != protocol.FrameTypeUDP {
+			t.Fatalf("reply in a frame of type %d", frame.Type)
+		}
+		from, datagram, err := protocol.DecodeDestination(frame.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		from.Network = net.Network_UDP
+		if want, found := datagrams[from]; !found || string(datagram) != want {
+			t.Errorf("reply %q from %v, want %q", datagram, from, want)
+		}
+	}
+	for range datagrams {
+		if dest := <-dispatcher.dests; datagrams[dest] == "" {
+			t.Errorf("dispatched to %v", dest)
+		}
+	}
+
+	if err := sess.WriteFrame(conn, protocol.FrameTypeCloseWrite, nil); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := sess.ReadFrame(reader); err != nil || frame.Type != protocol.FrameTypeCloseWrite {
+		t.Errorf("after the replies: %v, %v; want CLOSE_WRITE", frame, err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("association did not end cleanly: %v", err)
+	}
+}
+
+func TestUDPAssociationDropsBadDatagrams(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{BlockedPorts: []uint32{25}})
+	conn, done := serve(t, h, newEchoDispatcher())
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+
+	blocked, _ := protocol.EncodeDestination(net.UDPDestination(net.LocalHostIP, 25))
+	good, _ := protocol.EncodeDestination(net.UDPDestination(net.LocalHostIP, 53))
+	go func() {
+		sess.WriteFrame(conn, protocol.FrameTypeUDP, []byte{0xff, 1, 2, 3})
+		sess.WriteFrame(conn, protocol.FrameTypeUDP, append(blocked, "mail"...))
+		sess.WriteFrame(conn, protocol.FrameTypeUDP, append(good, "query"...))
+	}()
+
+	// Only the last datagram is relayed, and the association survives the
+	// ones before it.
+	frame, err := sess.ReadFrame(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, datagram, err := protocol.DecodeDestination(frame.Payload); err != nil || string(datagram) != "query" {
+		t.Errorf("reply %q, %v; want the query echoed", datagram, err)
+	}
+	if err := sess.WriteFrame(conn, protocol.FrameTypeClose, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("association did not end cleanly: %v", err)
+	}
+}
+
+func TestUDPAssociationEndpointCap(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{})
+	dispatcher := &echoDispatcher{
+		dests:    make(chan net.Destination, 2*maxUDPEndpoints),
+		contexts: make(chan context.Context, 2*maxUDPEndpoints),
+	}
+	conn, done := serve(t, h, dispatcher)
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	go writeClientHandshakeMagic(conn, hs)
+	reader := bufio.NewReader(conn)
+	sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+
+	go func() {
+		for port := 1000; port <= 1000+maxUDPEndpoints; port++ {
+			header, _ := protocol.EncodeDestination(net.UDPDestination(net.LocalHostIP, net.Port(port)))
+			sess.WriteFrame(conn, protocol.FrameTypeUDP, append(header, "x"...))
+		}
+		sess.WriteFrame(conn, protocol.FrameTypeClose, nil)
+	}()
+	for {
+		if _, err := sess.ReadFrame(reader); err != nil {
+			break
+		}
+	}
+	if err := <-done; err != nil {
+		t.Errorf("association did not end cleanly: %v", err)
+	}
+	if len(dispatcher.dests) != maxUDPEndpoints {
+		t.Errorf("dispatched %d endpoints, want %d", len(dispatcher.dests), maxUDPEndpoints)
+	}
+}
@@ -0,0 +1,48 @@
+package inbound
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/transport/internet/stat"
+)
+
+func (h *Handler) isHTTPGetLike(data []byte) bool {
+	return (h.webSocketPath != "" || h.httpUpgrade != "") && bytes.HasPrefix(data, []byte("GET /"))
+}
+
+// handleHTTPGet reads a GET request and serves it as an upgrade handshake
+// if it asks to upgrade to HTTPUpgrade and carries a handshake, as a
+// WebSocket upgrade otherwise, see handleWebSocket.
+func (h *Handler) handleHTTPGet(reader *bufio.Reader, recorder *recordingReader, conn stat.Connection, dispatcher routing.Dispatcher, ctx context.Context, c peekedConn, start time.Time) error {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return h.handleFallback(ctx, c.fallback(ctx), recorder, conn)
+	}
+	if h.httpUpgrade != "" && strings.EqualFold(upgradeProtocol(req.Header), h.httpUpgrade) && req.Header.Get("Authorization") != "" {
+		return h.handleReflexUpgrade(req, reader, recorder, conn, dispatcher, ctx, c, start)
+	}
+	return h.handleWebSocket(req, reader, recorder, conn, dispatcher, ctx, c, start)
+}
+
+// handleReflexUpgrade serves the handshake carried by req, an upgrade
+// request for HTTPUpgrade, and answers it with a 101 switching to it.
+func (h *Handler) handleReflexUpgrade(req *http.Request, reader *bufio.Reader, recorder *recordingReader, conn stat.Connection, dispatcher routing.Dispatcher, ctx context.Context, c peekedConn, start time.Time) error {
+	framing := helloFraming{upgrade: h.httpUpgrade}
+	clientHS, err := h.readClientHandshakeUpgrade(req)
+	if err != nil {
+		return h.handleMalformedHandshake(ctx, c, recorder, conn, framing, err)
+	}
+	if !h.hasProofOfWork(&clientHS) {
+		return h.handleMissingProofOfWork(ctx, c, recorder, conn)
+	}
+	recorder.stop()
+	// After the 101 the connection no longer speaks HTTP, so a "tls-like"
+	// client finished follows raw.
+	return h.processHandshake(reader, conn, dispatcher, ctx, c, clientHS, framing, start)
+}
@@ -0,0 +1,132 @@
+package inbound
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxClientVersionLen bounds the client version a server accepts, and
+// maxTrackedVersions the number of distinct versions Stats reports on;
+// the rest are counted as otherClientVersions.
+const (
+	maxClientVersionLen  = 64
+	maxTrackedVersions   = 32
+	otherClientVersions  = "other"
+	unknownClientVersion = "unknown"
+)
+
+// clientVersion returns the software identifier a FrameTypeClientVersion
+// announces, such as "xray-reflex/1.1.0", in printable ASCII of at most
+// maxClientVersionLen bytes, or "" for anything else.
+func clientVersion(value []byte) string {
+	if len(value) == 0 || len(value) > maxClientVersionLen {
+		return ""
+	}
+	for _, c := range value {
+		if c < 0x21 || c > 0x7e {
+			return ""
+		}
+	}
+	return string(value)
+}
+
+// parseVersion returns the numeric components of the "x.y.z" that follows
+// the last "/" of a client version, or nil if there is none.
+func parseVersion(version string) []int {
+	if i := strings.LastIndexByte(version, '/'); i >= 0 {
+		version = version[i+1:]
+	}
+	if version == "" {
+		return nil
+	}
+	var parts []int
+	for _, field := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return nil
+		}
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+// versionAtLeast reports whether client is min or later. A client without a
+// parsable version is older than any min; an empty min admits everyone.
+func versionAtLeast(client, min string) bool {
+	want := parseVersion(min)
+	if want == nil {
+		return true
+	}
+	have := parseVersion(client)
+	if have == nil {
+		return false
+	}
+	for i := range max(len(have), len(want)) {
+		var h, w int
+		if i < len(have) {
+			h = have[i]
+		}
+		if i < len(want) {
+			w = want[i]
+		}
+		if h != w {
+			return h > w
+		}
+	}
+	return true
+}
+
+// ContextWithClientVersion returns a context carrying the version the
+// client announced in its handshake.
+func ContextWithClientVersion(ctx context.Context, version string) context.Context {
+	return context.WithValue(ctx, clientVersionContextKey, version)
+}
+
+// ClientVersionFromContext returns the version the client of the session
+// announced, or "" if it announced none.
+func ClientVersionFromContext(ctx context.Context) string {
+	version, _ := ctx.Value(clientVersionContextKey).(string)
+	return version
+}
+
+// versionCounts counts established sessions per client version.
+type versionCounts struct {
+	mu     sync.Mutex
+	counts map[string]*atomic.Uint64
+}
+
+func (v *versionCounts) add(version string) {
+	if version == "" {
+		version = unknownClientVersion
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.counts == nil {
+		v.counts = make(map[string]*atomic.Uint64)
+	}
+	c, found := v.counts[version]
+	if !found {
+		if len(v.counts) >= maxTrackedVersions {
+			version = otherClientVersions
+			c = v.counts[version]
+		}
+		if c == nil {
+			c = new(atomic.Uint64)
+			v.counts[version] = c
+		}
+	}
+	c.Add(1)
+}
+
+func (v *versionCounts) snapshot() map[string]uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	snapshot := make(map[string]uint64, len(v.counts))
+	for version, c := range v.counts {
+		snapshot[version] = c.Load()
+	}
+	return snapshot
+}
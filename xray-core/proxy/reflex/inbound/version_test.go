@@ -0,0 +1,111 @@
+package inbound
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+)
+
+func TestVersionAtLeast(t *testing.T) {
+	for _, tc := range []struct {
+		client, min string
+		want        bool
+	}{
+		{"xray-reflex/1.1.0", "1.1.0", true},
+		{"xray-reflex/1.2", "1.1.9", true},
+		{"xray-reflex/1.0.9", "1.1", false},
+		{"1.1", "1.1.0", true},
+		{"xray-reflex/1.1.0-beta", "1.0", false},
+		{"", "1.0", false},
+		{"", "", true},
+	} {
+		if got := versionAtLeast(tc.client, tc.min); got != tc.want {
+			t.Errorf("versionAtLeast(%q, %q) = %v", tc.client, tc.min, got)
+		}
+	}
+}
+
+func TestClientVersionRecordedAndGated(t *testing.T) {
+	profile := &protocol.TrafficProfile{Name: "cover", PacketSizes: []protocol.PacketSizeDist{{Size: 200, Weight: 1}}}
+	if err := protocol.RegisterProfile("test-version-cover", profile); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { protocol.UnregisterProfile("test-version-cover") })
+	h := newTestHandler(t, &reflex.InboundConfig{
+		Clients:                   []*reflex.User{{Id: testUserID, Policy: "test-version-cover"}},
+		IdleCoverMs:               20,
+		IdleCoverMinClientVersion: "1.1.0",
+	})
+
+	// coverFrames opens a session announcing version and counts the frames
+	// that arrive while it idles.
+	coverFrames := func(version string) int {
+		t.Helper()
+		conn, _ := serve(t, h, newEchoDispatcher())
+		hs, priv := newTestClientHandshake(t, testUserID)
+		go writeClientHandshakeMagic(conn, hs)
+		reader := bufio.NewReader(conn)
+		sess, _ := clientSessionFromResponse(t, reader, hs, priv)
+		if version != "" {
+			if err := sess.WriteFrame(conn, protocol.FrameTypeClientVersion, []byte(version)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		echoRoundTrip(t, conn, reader, sess, net.TCPDestination(net.LocalHostIP, 80), "x")
+
+		conn.SetReadDeadline(time.Now().Add(150 * time.Millisecond))
+		frames := 0
+		for {
+			if _, err := sess.ReadFrame(reader); err != nil {
+				break
+			}
+			frames++
+		}
+		conn.Close()
+		return frames
+	}
+
+	if n := coverFrames("xray-reflex/1.0.0"); n != 0 {
+		t.Errorf("old client got %d cover frames", n)
+	}
+	if n := coverFrames(""); n != 0 {
+		t.Errorf("client without a version got %d cover frames", n)
+	}
+	if n := coverFrames(protocol.ClientSoftware); n == 0 {
+		t.Error("current client got no cover")
+	}
+
+	versions := h.Stats().ClientVersions
+	want := map[string]uint64{"xray-reflex/1.0.0": 1, unknownClientVersion: 1, protocol.ClientSoftware: 1}
+	if len(versions) != len(want) {
+		t.Errorf("recorded versions %v, want %v", versions, want)
+	}
+	for version, n := range want {
+		if versions[version] != n {
+			t.Errorf("recorded versions %v, want %v", versions, want)
+			break
+		}
+	}
+}
+
+func TestClientVersionCountsBounded(t *testing.T) {
+	var v versionCounts
+	for i := 0; i < maxTrackedVersions+10; i++ {
+		v.add("client/" + string(rune('a'+i%26)) + string(rune('a'+i/26)))
+	}
+	counts := v.snapshot()
+	if len(counts) > maxTrackedVersions+1 || counts[otherClientVersions] == 0 {
+		t.Errorf("%d versions tracked, %d as other", len(counts), counts[otherClientVersions])
+	}
+	if clientVersion([]byte("bad\x00version")) != "" {
+		t.Error("accepted an unprintable client version")
+	}
+	if clientVersion(bytes.Repeat([]byte("v"), maxClientVersionLen+1)) != "" {
+		t.Error("accepted an overlong client version")
+	}
+}
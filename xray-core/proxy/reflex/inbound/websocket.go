@@ -0,0 +1,113 @@
+package inbound
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	stdnet "net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/features/routing"
+	reflexprotocol "github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+	"github.com/xtls/xray-core/transport/internet/stat"
+)
+
+// handleWebSocket upgrades req, a GET request read from reader, if it is a
+// WebSocket upgrade for the WebSocket path, and runs a magic-mode
+// handshake and the session after it over the WebSocket, each flight and
+// frame in a message of its own. Any other request goes to fallback
+// unchanged.
+func (h *Handler) handleWebSocket(req *http.Request, reader *bufio.Reader, recorder *recordingReader, conn stat.Connection, dispatcher routing.Dispatcher, ctx context.Context, c peekedConn, start time.Time) error {
+	if h.webSocketPath == "" || req.URL.Path != h.webSocketPath || !websocket.IsWebSocketUpgrade(req) {
+		return h.handleFallback(ctx, c.fallback(ctx), recorder, conn)
+	}
+	recorder.stop()
+
+	upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	wsConn, err := upgrader.Upgrade(&hijackWriter{conn: conn, reader: reader}, req, nil)
+	if err != nil {
+		return errors.New("failed to upgrade to WebSocket").Base(err)
+	}
+	ws := reflexprotocol.NewWebSocketConn(wsConn)
+	defer ws.Close()
+
+	wsReader := bufio.NewReader(ws)
+	peeked, err := wsReader.Peek(4)
+	if err != nil {
+		return errors.New("failed to read handshake over WebSocket").Base(err)
+	}
+	if n := reflexprotocol.GreaseLen(peeked[:wsReader.Buffered()], h.maxGrease); n > 0 {
+		wsReader.Discard(n)
+		peeked, _ = wsReader.Peek(4)
+	}
+	if !h.isReflexMagic(peeked) {
+		return errors.New("not a reflex handshake over WebSocket").AtInfo()
+	}
+	wsReader.Discard(4)
+	framing := helloFraming{webSocket: true}
+	clientHS, err := reflexprotocol.ReadVersionedClientHandshake(wsReader)
+	if errors.Cause(err) == reflexprotocol.ErrUnsupportedVersion {
+		return h.rejectHandshake(ctx, ws, framing, http.StatusUpgradeRequired, err)
+	}
+	if err == nil {
+		err = reflexprotocol.ReadMessageEnd(wsReader)
+	}
+	if err != nil {
+		return errors.New("malformed reflex handshake over WebSocket").Base(err).AtInfo()
+	}
+	if !h.hasProofOfWork(&clientHS) {
+		// The upgrade has been answered, so there is nothing to fall
+		// back with; the WebSocket just closes.
+		return errors.New("missing or invalid proof of work over WebSocket").AtInfo()
+	}
+	return h.processHandshake(wsReader, ws, dispatcher, ctx, c, clientHS, framing, start)
+}
+
+// hijackWriter is the http.ResponseWriter the WebSocket upgrader answers
+// through. It hands over the connection with the reader the request was
+// parsed from, and writes error responses the upgrader sends itself.
+type hijackWriter struct {
+	conn   stat.Connection
+	reader *bufio.Reader
+	header http.Header
+	status int
+}
+
+func (w *hijackWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *hijackWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *hijackWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	resp := &http.Response{
+		StatusCode:    w.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          io.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+	}
+	if err := resp.Write(w.conn); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w *hijackWriter) Hijack() (stdnet.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(w.reader, bufio.NewWriter(w.conn)), nil
+}
@@ -0,0 +1,135 @@
+package inbound
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	stdnet "net"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+)
+
+func TestWebSocketSession(t *testing.T) {
+	h := newTestHandler(t, &reflex.InboundConfig{WebSocketPath: "/ws"})
+	conn, _ := serve(t, h, newEchoDispatcher())
+	dialer := websocket.Dialer{
+		NetDialContext: func(context.Context, string, string) (stdnet.Conn, error) {
+			return conn, nil
+		},
+	}
+	wsConn, _, err := dialer.Dial("ws://example.com/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := protocol.NewWebSocketConn(wsConn)
+
+	hs, priv := newTestClientHandshake(t, testUserID)
+	if err := writeClientHandshakeMagic(ws, hs); err != nil {
+		t.Fatal(err)
+	}
+	sess, _ := clientSessionFromResponse(t, bufio.NewReader(ws), hs, priv)
+
+	header, err := protocol.EncodeDestination(net.TCPDestination(net.DomainAddress("example.com"), 443))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.WriteFrame(ws, protocol.FrameTypeData, append(header, "over websocket"...)); err != nil {
+		t.Fatal(err)
+	}
+	// The echo comes back as one frame in one message.
+	_, message, err := wsConn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := sess.ReadFrame(bytes.NewReader(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(frame.Payload) != "over websocket" {
+		t.Errorf("echo %q, want %q", frame.Payload, "over websocket")
+	}
+}
+
+func TestWebSocketFrameMustFillMessage(t *testing.T) {
+	for name, send := range map[string]func(*websocket.Conn, []byte, []byte) error{
+		"two frames in one message": func(ws *websocket.Conn, first, second []byte) error {
+			return ws.WriteMessage(websocket.BinaryMessage, append(first, second...))
+		},
+		"frame split across messages": func(ws *websocket.Conn, first, _ []byte) error {
+			if err := ws.WriteMessage(websocket.BinaryMessage, first[:3]); err != nil {
+				return err
+			}
+			// The server may have given up on the first part already.
+			ws.WriteMessage(websocket.BinaryMessage, first[3:])
+			return nil
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			h := newTestHandler(t, &reflex.InboundConfig{WebSocketPath: "/ws"})
+			conn, done := serve(t, h, newEchoDispatcher())
+			dialer := websocket.Dialer{
+				NetDialContext: func(context.Context, string, string) (stdnet.Conn, error) {
+					return conn, nil
+				},
+			}
+			wsConn, _, err := dialer.Dial("ws://example.com/ws", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ws := protocol.NewWebSocketConn(wsConn)
+
+			hs, priv := newTestClientHandshake(t, testUserID)
+			if err := writeClientHandshakeMagic(ws, hs); err != nil {
+				t.Fatal(err)
+			}
+			sess, _ := clientSessionFromResponse(t, bufio.NewReader(ws), hs, priv)
+			header, err := protocol.EncodeDestination(net.TCPDestination(net.DomainAddress("example.com"), 443))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var first, second bytes.Buffer
+			if err := sess.WriteFrame(&first, protocol.FrameTypeData, append(header, "first"...)); err != nil {
+				t.Fatal(err)
+			}
+			if err := sess.WriteFrame(&second, protocol.FrameTypeData, []byte("second")); err != nil {
+				t.Fatal(err)
+			}
+			if err := send(wsConn, first.Bytes(), second.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Error("expected Process to fail")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Process did not fail")
+			}
+		})
+	}
+}
+
+func TestWebSocketOtherPathFallsBack(t *testing.T) {
+	request := "GET /index.html HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"
+	port, received := startFallbackServer(t, len(request), "HTTP/1.1 404 Not Found\r\n\r\n")
+	h := newTestHandler(t, &reflex.InboundConfig{
+		Fallback:      &reflex.Fallback{Dest: port},
+		WebSocketPath: "/ws",
+	})
+	conn, _ := serve(t, h, newEchoDispatcher())
+
+	go conn.Write([]byte(request))
+	select {
+	case got := <-received:
+		if got != request {
+			t.Errorf("fallback received %q, want the request unchanged", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request for another path was not sent to fallback")
+	}
+}
@@ -0,0 +1,189 @@
+// Package conntest provides an in-memory connection for tests.
+//
+// Unlike net.Pipe, its writes are buffered: they never wait for the other
+// end to read, so a test can write a whole request and then read the
+// answer from one goroutine.
+package conntest
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Pipe returns the two ends of a buffered in-memory duplex connection.
+// Data written to one end is read from the other in order. Writes are
+// buffered without limit and never block.
+//
+// Close on one end makes its own reads and writes fail with
+// io.ErrClosedPipe, the other end's writes fail the same way, and the
+// other end's reads return io.EOF once they have drained what was written
+// before. CloseWrite only does the latter. Deadlines behave as for
+// net.Conn, failing with os.ErrDeadlineExceeded.
+func Pipe() (*Conn, *Conn) {
+	ab, ba := newBuffer(), newBuffer()
+	return &Conn{in: ba, out: ab}, &Conn{in: ab, out: ba}
+}
+
+// Conn is one end of a Pipe. It implements net.Conn.
+type Conn struct {
+	in  *buffer // read from by this end
+	out *buffer // written to by this end
+}
+
+// Read reads data written by the other end, waiting for some if there is
+// none yet.
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.in.read(p)
+}
+
+// Write buffers p for the other end.
+func (c *Conn) Write(p []byte) (int, error) {
+	return c.out.write(p)
+}
+
+// Close closes both directions of this end.
+func (c *Conn) Close() error {
+	c.in.closeReader()
+	c.out.closeWriter()
+	return nil
+}
+
+// CloseWrite closes the direction to the other end, which reads io.EOF
+// once it has read everything written so far.
+func (c *Conn) CloseWrite() error {
+	c.out.closeWriter()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return addr{} }
+func (c *Conn) RemoteAddr() net.Addr { return addr{} }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.in.setReadDeadline(t)
+	c.out.setWriteDeadline(t)
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.in.setReadDeadline(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.out.setWriteDeadline(t)
+	return nil
+}
+
+type addr struct{}
+
+func (addr) Network() string { return "conntest" }
+func (addr) String() string  { return "conntest" }
+
+// buffer is one direction of a Pipe, holding what one end has written and
+// the other has not read yet.
+type buffer struct {
+	mu           sync.Mutex
+	data         []byte
+	readerClosed bool
+	writerClosed bool
+	// readDeadline is the reading end's, writeDeadline the writing end's.
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// changed is closed, and replaced, whenever anything above changes, to
+	// wake a waiting read.
+	changed chan struct{}
+}
+
+func newBuffer() *buffer {
+	return &buffer{changed: make(chan struct{})}
+}
+
+// notify wakes waiting reads. b.mu must be held.
+func (b *buffer) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *buffer) read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		switch {
+		case b.readerClosed:
+			return 0, io.ErrClosedPipe
+		case len(b.data) > 0:
+			n := copy(p, b.data)
+			b.data = b.data[n:]
+			return n, nil
+		case b.writerClosed:
+			return 0, io.EOF
+		case !b.readDeadline.IsZero() && !time.Now().Before(b.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		case len(p) == 0:
+			return 0, nil
+		}
+		changed := b.changed
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !b.readDeadline.IsZero() {
+			timer = time.NewTimer(time.Until(b.readDeadline))
+			expired = timer.C
+		}
+		b.mu.Unlock()
+		select {
+		case <-changed:
+		case <-expired:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		b.mu.Lock()
+	}
+}
+
+func (b *buffer) write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.writerClosed, b.readerClosed:
+		return 0, io.ErrClosedPipe
+	case !b.writeDeadline.IsZero() && !time.Now().Before(b.writeDeadline):
+		return 0, os.ErrDeadlineExceeded
+	}
+	if len(p) > 0 {
+		b.data = append(b.data, p...)
+		b.notify()
+	}
+	return len(p), nil
+}
+
+func (b *buffer) setReadDeadline(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.readDeadline = t
+	b.notify()
+}
+
+func (b *buffer) setWriteDeadline(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.writeDeadline = t
+}
+
+func (b *buffer) closeReader() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.readerClosed = true
+	b.data = nil
+	b.notify()
+}
+
+func (b *buffer) closeWriter() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.writerClosed = true
+	b.notify()
+}
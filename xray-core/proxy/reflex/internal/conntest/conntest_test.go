@@ -0,0 +1,152 @@
+package conntest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+var _ net.Conn = (*Conn)(nil)
+
+func TestPipeOrdering(t *testing.T) {
+	a, b := Pipe()
+	// Writes complete with nobody reading.
+	var want bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&want, "a%d ", i)
+		if _, err := fmt.Fprintf(a, "a%d ", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.CloseWrite()
+	got, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("read %q, want %q", got, want.Bytes())
+	}
+
+	// The other direction is independent and keeps working.
+	if _, err := b.Write([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(a, reply); err != nil || string(reply) != "reply" {
+		t.Errorf("read %q, %v after CloseWrite, want reply", reply, err)
+	}
+}
+
+func TestPipeConcurrentReadWrite(t *testing.T) {
+	a, b := Pipe()
+	const n = 10000
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			a.Write([]byte{byte(i)})
+		}
+		a.Close()
+	}()
+	got, err := io.ReadAll(b)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != n {
+		t.Fatalf("read %d bytes, want %d", len(got), n)
+	}
+	for i, c := range got {
+		if c != byte(i) {
+			t.Fatalf("byte %d is %d, want %d", i, c, byte(i))
+		}
+	}
+}
+
+func TestPipeClose(t *testing.T) {
+	a, b := Pipe()
+	a.Write([]byte("before close"))
+	b.Write([]byte("unread"))
+
+	// A read waiting on the closing end is woken.
+	readErr := make(chan error, 1)
+	c, d := Pipe()
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+	if err := <-readErr; err != io.ErrClosedPipe {
+		t.Errorf("read waiting on a closed end: %v, want io.ErrClosedPipe", err)
+	}
+	if _, err := d.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("write to a closed peer: %v, want io.ErrClosedPipe", err)
+	}
+
+	a.Close()
+	if _, err := a.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Errorf("read from a closed end: %v, want io.ErrClosedPipe", err)
+	}
+	if _, err := a.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("write to a closed end: %v, want io.ErrClosedPipe", err)
+	}
+	if _, err := b.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("write to a closed peer: %v, want io.ErrClosedPipe", err)
+	}
+	// The peer still reads what was written before the close.
+	got, err := io.ReadAll(b)
+	if err != nil || string(got) != "before close" {
+		t.Errorf("peer read %q, %v, want what was written before close", got, err)
+	}
+	if err := a.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestPipeDeadlines(t *testing.T) {
+	a, b := Pipe()
+	b.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	start := time.Now()
+	if _, err := b.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read past its deadline: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("read timed out after %v, before its deadline", elapsed)
+	}
+
+	// Moving the deadline into the past wakes a waiting read, clearing it
+	// lets reads wait again.
+	readErr := make(chan error, 1)
+	b.SetReadDeadline(time.Time{})
+	go func() {
+		_, err := b.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	b.SetReadDeadline(time.Now().Add(-time.Second))
+	if err := <-readErr; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read woken by a past deadline: %v", err)
+	}
+	b.SetReadDeadline(time.Time{})
+	a.Write([]byte("x"))
+	if _, err := b.Read(make([]byte, 1)); err != nil {
+		t.Errorf("read after clearing the deadline: %v", err)
+	}
+
+	a.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := a.Write([]byte("x")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("write past its deadline: %v", err)
+	}
+	// The write deadline is a's alone.
+	if _, err := b.Write([]byte("x")); err != nil {
+		t.Errorf("peer write: %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+// frameCapture is the dataset a classifier would see of a session: the
+// size of every packet written and the gap before it.
+type frameCapture struct {
+	sizes []int
+	gaps  []time.Duration
+	last  time.Time
+}
+
+func (c *frameCapture) Write(p []byte) (int, error) {
+	now := time.Now()
+	if !c.last.IsZero() {
+		c.gaps = append(c.gaps, now.Sub(c.last))
+	}
+	c.last = now
+	c.sizes = append(c.sizes, len(p))
+	return len(p), nil
+}
+
+// captureMorphing writes n small DATA payloads morphed with profile, each
+// of which goes out as one padded frame, and captures the frames.
+func captureMorphing(t *testing.T, profile *TrafficProfile, n int) *frameCapture {
+	t.Helper()
+	s, _ := newTestSessionPair(t)
+	c := &frameCapture{}
+	for i := 0; i < n; i++ {
+		if err := s.WriteFrameWithMorphing(c, FrameTypeData, []byte{byte(i)}, profile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.FlushMorphed(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// sizeCounts counts the captured sizes per bucket of profile. A size the
+// profile does not have fails the test.
+func sizeCounts(t *testing.T, profile *TrafficProfile, sizes []int) []int {
+	t.Helper()
+	counts := make([]int, len(profile.PacketSizes))
+next:
+	for _, size := range sizes {
+		for i, d := range profile.PacketSizes {
+			if d.Size == size {
+				counts[i]++
+				continue next
+			}
+		}
+		t.Fatalf("packet size %d is not in profile %s", size, profile.Name)
+	}
+	return counts
+}
+
+// delayCounts counts the captured gaps per bucket of profile. A sleep never
+// ends early, so a gap belongs to the longest delay it is not shorter than;
+// what a loaded scheduler adds on top does not move it to the next bucket.
+func delayCounts(t *testing.T, profile *TrafficProfile, gaps []time.Duration) []int {
+	t.Helper()
+	counts := make([]int, len(profile.Delays))
+	for _, gap := range gaps {
+		bucket := -1
+		for i, d := range profile.Delays {
+			if gap >= d.Delay && (bucket < 0 || d.Delay > profile.Delays[bucket].Delay) {
+				bucket = i
+			}
+		}
+		if bucket < 0 {
+			t.Fatalf("gap %v is shorter than every delay of profile %s", gap, profile.Name)
+		}
+		counts[bucket]++
+	}
+	return counts
+}
+
+// chiSquared is Pearson's statistic of observed counts against the
+// distribution given by weights, which need not sum to 1.
+func chiSquared(observed []int, weights []float64) float64 {
+	total, sum := 0, 0.0
+	for i := range observed {
+		total += observed[i]
+		sum += weights[i]
+	}
+	var stat float64
+	for i, o := range observed {
+		expected := float64(total) * weights[i] / sum
+		stat += (float64(o) - expected) * (float64(o) - expected) / expected
+	}
+	return stat
+}
+
+// chiSquaredCritical holds the statistic exceeded with probability 0.001
+// by a sample from the expected distribution, by degrees of freedom.
+var chiSquaredCritical = map[int]float64{
+	2: 13.82,
+	3: 16.27,
+	4: 18.47,
+	5: 20.52,
+	6: 22.46,
+	8: 26.12,
+}
+
+func sizeWeights(profile *TrafficProfile) []float64 {
+	weights := make([]float64, len(profile.PacketSizes))
+	for i, d := range profile.PacketSizes {
+		weights[i] = d.Weight
+	}
+	return weights
+}
+
+func delayWeights(profile *TrafficProfile) []float64 {
+	weights := make([]float64, len(profile.Delays))
+	for i, d := range profile.Delays {
+		weights[i] = d.Weight
+	}
+	return weights
+}
+
+func TestYouTubeMorphingMatchesProfile(t *testing.T) {
+	profile := GetProfileByName("youtube")
+	c := captureMorphing(t, profile, 200)
+
+	sizes := chiSquared(sizeCounts(t, profile, c.sizes), sizeWeights(profile))
+	if limit := chiSquaredCritical[len(profile.PacketSizes)-1]; sizes > limit {
+		t.Errorf("packet sizes differ from the profile: chi-squared %.2f > %.2f", sizes, limit)
+	}
+	delays := chiSquared(delayCounts(t, profile, c.gaps), delayWeights(profile))
+	if limit := chiSquaredCritical[len(profile.Delays)-1]; delays > limit {
+		t.Errorf("delays differ from the profile: chi-squared %.2f > %.2f", delays, limit)
+	}
+}
+
+func TestMorphingMismatchDetected(t *testing.T) {
+	target := GetProfileByName("youtube")
+	// The same sizes drawn uniformly, without delays so the capture is
+	// quick.
+	uniform := &TrafficProfile{Name: "uniform"}
+	for _, d := range target.PacketSizes {
+		uniform.PacketSizes = append(uniform.PacketSizes, PacketSizeDist{Size: d.Size, Weight: 1})
+	}
+	c := captureMorphing(t, uniform, 2000)
+
+	stat := chiSquared(sizeCounts(t, target, c.sizes), sizeWeights(target))
+	if limit := chiSquaredCritical[len(target.PacketSizes)-1]; stat <= limit {
+		t.Errorf("uniform sizes pass as the youtube profile: chi-squared %.2f <= %.2f", stat, limit)
+	}
+}
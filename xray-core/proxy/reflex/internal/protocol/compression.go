@@ -0,0 +1,132 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"io"
+
+	"github.com/xtls/xray-core/common/errors"
+)
+
+// Compression toggle values carried by a COMPRESSION frame.
+const (
+	compressionOff = 0x00
+	compressionOn  = 0x01
+	// compressionOnDict switches compression on against the dictionary of
+	// the session's profile, named by the first dictionaryIDSize bytes of
+	// its SHA-256.
+	compressionOnDict = 0x02
+)
+
+const dictionaryIDSize = 4
+
+// SetCompression tells the peer that DATA frames written after this call
+// are compressed (or no longer compressed). Sessions start uncompressed so
+// the first frames look like any other TLS-like exchange; compression can be
+// switched on once the session carries bulk data. If the session's profile
+// has a CompressionDictionary, frames are compressed against it, and the
+// peer's profile must have the same one: a peer with another fails the
+// session rather than misread it.
+func (s *Session) SetCompression(writer io.Writer, enabled bool) error {
+	toggle := []byte{compressionOff}
+	if enabled {
+		toggle[0] = compressionOn
+		if dict := s.compressionDictionary(); len(dict) > 0 {
+			toggle = append([]byte{compressionOnDict}, dictionaryID(dict)...)
+		}
+	}
+	return s.WriteFrame(writer, FrameTypeCompression, toggle)
+}
+
+// compressionDictionary returns the dictionary of the session's profile,
+// nil if it has none.
+func (s *Session) compressionDictionary() []byte {
+	if s.profile == nil {
+		return nil
+	}
+	return s.profile.CompressionDictionary
+}
+
+func dictionaryID(dict []byte) []byte {
+	sum := sha256.Sum256(dict)
+	return sum[:dictionaryIDSize]
+}
+
+// applyCompressionFrame validates a COMPRESSION frame and returns the state
+// it selects: whether DATA frames are compressed and the dictionary they
+// are compressed against, nil for none.
+func (s *Session) applyCompressionFrame(payload []byte) (bool, []byte, error) {
+	if len(payload) == 0 {
+		return false, nil, errors.New("invalid compression frame")
+	}
+	switch payload[0] {
+	case compressionOff, compressionOn:
+		if len(payload) != 1 {
+			return false, nil, errors.New("invalid compression frame")
+		}
+		return payload[0] == compressionOn, nil, nil
+	case compressionOnDict:
+		if len(payload) != 1+dictionaryIDSize {
+			return false, nil, errors.New("invalid compression frame")
+		}
+		dict := s.compressionDictionary()
+		if len(dict) == 0 || !bytes.Equal(payload[1:], dictionaryID(dict)) {
+			return false, nil, errors.New("compression dictionary mismatch")
+		}
+		return true, dict, nil
+	}
+	return false, nil, errors.New("unknown compression toggle: ", payload[0])
+}
+
+// Deflate compresses data with DEFLATE, as DATA frame payloads and
+// handshake policy requests are compressed.
+func Deflate(data []byte) ([]byte, error) {
+	return deflateDict(data, nil)
+}
+
+// deflateDict is Deflate against a preset dictionary.
+func deflateDict(data, dict []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := flate.NewWriterDict(&b, flate.DefaultCompression, dict)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// decompressPayload inflates a DATA frame payload compressed against dict.
+// The output is bounded by MaxFramePayload so a small frame cannot expand
+// without limit.
+func decompressPayload(data, dict []byte) ([]byte, error) {
+	out, err := inflateDict(data, dict, MaxFramePayload)
+	if err != nil {
+		return nil, errors.New("failed to decompress frame").Base(err)
+	}
+	return out, nil
+}
+
+// Inflate decompresses data, failing if the output exceeds limit bytes.
+func Inflate(data []byte, limit int) ([]byte, error) {
+	return inflateDict(data, nil, limit)
+}
+
+// inflateDict is Inflate against a preset dictionary.
+func inflateDict(data, dict []byte, limit int) ([]byte, error) {
+	r := flate.NewReaderDict(bytes.NewReader(data), dict)
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, errors.New("decompressed size exceeds ", limit, " bytes")
+	}
+	return out, nil
+}
@@ -0,0 +1,160 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressionToggle(t *testing.T) {
+	writer, reader := newTestSessionPair(t)
+	payload := bytes.Repeat([]byte("compressible "), 200)
+
+	var wire bytes.Buffer
+	writeData := func() int {
+		before := wire.Len()
+		if err := writer.WriteFrame(&wire, FrameTypeData, payload); err != nil {
+			t.Fatal(err)
+		}
+		return wire.Len() - before
+	}
+
+	plainSize := writeData()
+	if err := writer.SetCompression(&wire, true); err != nil {
+		t.Fatal(err)
+	}
+	compressedSize := writeData()
+	if err := writer.SetCompression(&wire, false); err != nil {
+		t.Fatal(err)
+	}
+	plainAgainSize := writeData()
+
+	if plainSize < len(payload) || plainAgainSize != plainSize {
+		t.Errorf("frames outside the toggle are compressed: %d, %d", plainSize, plainAgainSize)
+	}
+	if compressedSize >= len(payload)/4 {
+		t.Errorf("frame after the toggle is not compressed: %d bytes", compressedSize)
+	}
+
+	var data int
+	for wire.Len() > 0 {
+		frame, err := reader.ReadFrame(&wire)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Type != FrameTypeData {
+			continue
+		}
+		data++
+		if !bytes.Equal(frame.Payload, payload) {
+			t.Fatalf("data frame %d did not round-trip", data)
+		}
+	}
+	if data != 3 {
+		t.Errorf("read %d data frames, want 3", data)
+	}
+}
+
+func TestCompressionKeepsMorphingSize(t *testing.T) {
+	writer, reader := newTestSessionPair(t)
+	profile := &TrafficProfile{
+		Name:        "test",
+		PacketSizes: []PacketSizeDist{{Size: 500, Weight: 1}},
+	}
+
+	var wire bytes.Buffer
+	if err := writer.SetCompression(&wire, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.ReadFrame(&wire); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("a"), 300)
+	if err := writer.WriteFrameWithMorphing(&wire, FrameTypeData, data, profile); err != nil {
+		t.Fatal(err)
+	}
+	if wire.Len() != 500 {
+		t.Errorf("compressed morphed frame is %d bytes, want 500", wire.Len())
+	}
+	frame, err := reader.ReadFrame(&wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame.Payload, data) {
+		t.Error("compressed morphed frame did not round-trip")
+	}
+}
+
+func TestCompressionInvalidToggle(t *testing.T) {
+	writer, _ := newTestSessionPair(t)
+	var wire bytes.Buffer
+	if err := writer.WriteFrame(&wire, FrameTypeCompression, []byte{7}); err == nil {
+		t.Error("expected an error for an unknown toggle value")
+	}
+}
+
+// httpDictionary holds the header lines browsers and servers send most.
+var httpDictionary = []byte("GET / HTTP/1.1\r\nHost: \r\nUser-Agent: Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36\r\n" +
+	"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8\r\nAccept-Encoding: gzip, deflate, br\r\nAccept-Language: en-US,en;q=0.9\r\n" +
+	"Connection: keep-alive\r\nCache-Control: max-age=0\r\nHTTP/1.1 200 OK\r\nContent-Type: text/html; charset=utf-8\r\nContent-Length: \r\nDate: \r\nServer: nginx\r\n\r\n")
+
+func TestCompressionDictionary(t *testing.T) {
+	requests := []string{
+		"GET /index.html HTTP/1.1\r\nHost: example.com\r\nUser-Agent: Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36\r\n" +
+			"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8\r\nAccept-Encoding: gzip, deflate, br\r\nAccept-Language: en-US,en;q=0.9\r\nConnection: keep-alive\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nDate: Fri, 16 Oct 2026 10:00:00 GMT\r\nServer: nginx\r\nContent-Type: text/html; charset=utf-8\r\nContent-Length: 5120\r\nConnection: keep-alive\r\nCache-Control: max-age=0\r\n\r\n",
+	}
+	compressedSize := func(dict []byte) int {
+		writer, reader := newTestSessionPair(t)
+		if dict != nil {
+			profile := &TrafficProfile{Name: "web", CompressionDictionary: dict}
+			writer.SetProfile(profile)
+			reader.SetProfile(profile.Clone())
+		}
+		var wire bytes.Buffer
+		if err := writer.SetCompression(&wire, true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reader.ReadFrame(&wire); err != nil {
+			t.Fatal(err)
+		}
+		total := 0
+		for _, request := range requests {
+			if err := writer.WriteFrame(&wire, FrameTypeData, []byte(request)); err != nil {
+				t.Fatal(err)
+			}
+			total += wire.Len()
+			frame, err := reader.ReadFrame(&wire)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(frame.Payload) != request {
+				t.Fatalf("read %q, want %q", frame.Payload, request)
+			}
+		}
+		return total
+	}
+
+	without, with := compressedSize(nil), compressedSize(httpDictionary)
+	t.Logf("HTTP headers compress to %d bytes without the dictionary, %d with it", without, with)
+	if with >= without*3/4 {
+		t.Errorf("dictionary saved too little: %d bytes with it, %d without", with, without)
+	}
+}
+
+func TestCompressionDictionaryMismatch(t *testing.T) {
+	for name, readerDict := range map[string][]byte{
+		"other dictionary": []byte("Content-Type: application/json\r\n"),
+		"no dictionary":    nil,
+	} {
+		writer, reader := newTestSessionPair(t)
+		writer.SetProfile(&TrafficProfile{Name: "web", CompressionDictionary: httpDictionary})
+		reader.SetProfile(&TrafficProfile{Name: "web", CompressionDictionary: readerDict})
+		var wire bytes.Buffer
+		if err := writer.SetCompression(&wire, true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reader.ReadFrame(&wire); err == nil {
+			t.Errorf("%s: reader accepted a dictionary it does not have", name)
+		}
+	}
+}
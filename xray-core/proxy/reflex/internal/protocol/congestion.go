@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"sync"
+	"time"
+)
+
+// A write that blocks for writeStallThreshold or longer, or an RTT sample
+// of congestionRTTFactor times the lowest seen, is a congestion signal.
+// congestionOnSignals signals in a row put the session in congestion mode;
+// congestionOffClear clear writes or samples in a row take it out again.
+const (
+	writeStallThreshold = 50 * time.Millisecond
+	congestionRTTFactor = 2
+	congestionOnSignals = 3
+	congestionOffClear  = 16
+
+	// congestedIntensity is the share of its padding and delays morphing
+	// keeps while the session is congested.
+	congestedIntensity = 0.25
+)
+
+// congestionState tracks whether a session's link looks congested.
+type congestionState struct {
+	mu        sync.Mutex
+	signals   int // congestion signals in a row
+	clear     int // clear observations in a row
+	congested bool
+	minRTT    time.Duration
+}
+
+// observe records one congestion signal or clear observation.
+func (c *congestionState) observe(signal bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if signal {
+		c.signals++
+		c.clear = 0
+		if c.signals >= congestionOnSignals {
+			c.congested = true
+		}
+		return
+	}
+	c.clear++
+	c.signals = 0
+	if c.clear >= congestionOffClear {
+		c.congested = false
+	}
+}
+
+// observeWrite feeds how long one frame write blocked.
+func (c *congestionState) observeWrite(d time.Duration) {
+	c.observe(d >= writeStallThreshold)
+}
+
+// observeRTT feeds a round-trip time sample, compared with the lowest one
+// seen as the uncongested baseline.
+func (c *congestionState) observeRTT(sample time.Duration) {
+	c.mu.Lock()
+	if c.minRTT == 0 || sample < c.minRTT {
+		c.minRTT = sample
+	}
+	signal := sample >= congestionRTTFactor*c.minRTT
+	c.mu.Unlock()
+	c.observe(signal)
+}
+
+// MorphingIntensity returns the share of a profile's padding and delays
+// morphing applies: 1 normally, less while writes stall or the RTT is well
+// above its baseline, so morphing does not add to congestion. It returns to
+// 1 once the link has been clear for a while.
+func (s *Session) MorphingIntensity() float64 {
+	s.congestion.mu.Lock()
+	defer s.congestion.mu.Unlock()
+	if s.congestion.congested {
+		return congestedIntensity
+	}
+	return 1
+}
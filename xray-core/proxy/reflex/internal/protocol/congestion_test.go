@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// stallWriter blocks every write for delay before buffering it.
+type stallWriter struct {
+	bytes.Buffer
+	delay time.Duration
+}
+
+func (w *stallWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	return w.Buffer.Write(p)
+}
+
+func TestMorphingBacksOffUnderCongestion(t *testing.T) {
+	s, _ := newTestSessionPair(t)
+	profile := &TrafficProfile{Name: "test", PacketSizes: []PacketSizeDist{{Size: 300, Weight: 1}}}
+	var w stallWriter
+	frameSize := func() int {
+		t.Helper()
+		w.Reset()
+		if err := s.WriteFrameWithMorphing(&w, FrameTypeData, []byte("x"), profile); err != nil {
+			t.Fatal(err)
+		}
+		return w.Len()
+	}
+
+	if got := frameSize(); got != 300 || s.MorphingIntensity() != 1 {
+		t.Fatalf("uncongested frame is %d bytes at intensity %v", got, s.MorphingIntensity())
+	}
+
+	w.delay = writeStallThreshold + 10*time.Millisecond
+	for i := 0; i < congestionOnSignals; i++ {
+		if s.MorphingIntensity() != 1 {
+			t.Fatalf("congested after %d stalled writes", i)
+		}
+		frameSize()
+	}
+	if s.MorphingIntensity() != congestedIntensity {
+		t.Fatalf("intensity %v after %d stalled writes", s.MorphingIntensity(), congestionOnSignals)
+	}
+
+	w.delay = 0
+	if got := frameSize(); got >= 300 {
+		t.Errorf("congested frame is still %d bytes", got)
+	}
+	for i := 1; i < congestionOffClear; i++ {
+		if s.MorphingIntensity() != congestedIntensity {
+			t.Fatalf("congestion cleared after %d clear writes", i)
+		}
+		frameSize()
+	}
+	if s.MorphingIntensity() != 1 {
+		t.Fatalf("intensity %v after %d clear writes", s.MorphingIntensity(), congestionOffClear)
+	}
+	if got := frameSize(); got != 300 {
+		t.Errorf("frame is %d bytes after congestion cleared, want 300", got)
+	}
+}
+
+func TestCongestionFromRTT(t *testing.T) {
+	var c congestionState
+	c.observeRTT(20 * time.Millisecond)
+	for i := 0; i < congestionOnSignals; i++ {
+		c.observeRTT(30 * time.Millisecond)
+	}
+	if c.congested {
+		t.Fatal("congested by an RTT below the threshold")
+	}
+	for i := 0; i < congestionOnSignals; i++ {
+		c.observeRTT(50 * time.Millisecond)
+	}
+	if !c.congested {
+		t.Fatal("not congested with the RTT at 2.5x its baseline")
+	}
+	for i := 0; i < congestionOffClear; i++ {
+		c.observeRTT(25 * time.Millisecond)
+	}
+	if c.congested {
+		t.Error("still congested once the RTT is back near its baseline")
+	}
+}
@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"encoding/binary"
+
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/common/net"
+)
+
+// Address types of the destination header carried by the first DATA frame:
+// [addrtype (1)][addr][port (2)].
+const (
+	AddrTypeIPv4   = 0x01
+	AddrTypeDomain = 0x03 // [length (1)][name]
+	AddrTypeIPv6   = 0x04
+)
+
+// NoResolveMarker, sent right in front of the destination header (after a
+// routing tag, if any), asks the server to pass a domain destination on
+// by name even if it resolves domains itself, so the upstream connection
+// is made to the name the client asked for. A server honours it only if
+// it allows connecting by domain. Like the routing tag marker it is
+// outside the address type range.
+const NoResolveMarker = 0x7e
+
+// DecodeDestination decodes the destination header at the start of data,
+// as written by EncodeDestination, and returns the destination together
+// with the rest of data. The destination's network is TCP.
+func DecodeDestination(data []byte) (net.Destination, []byte, error) {
+	if len(data) < 1 {
+		return net.Destination{}, nil, errors.New("empty destination")
+	}
+
+	var address net.Address
+	var rest []byte
+	switch data[0] {
+	case AddrTypeIPv4:
+		if len(data) < 1+4+2 {
+			return net.Destination{}, nil, errors.New("truncated IPv4 destination")
+		}
+		address = net.IPAddress(data[1:5])
+		rest = data[5:]
+	case AddrTypeIPv6:
+		if len(data) < 1+16+2 {
+			return net.Destination{}, nil, errors.New("truncated IPv6 destination")
+		}
+		address = net.IPAddress(data[1:17])
+		rest = data[17:]
+	case AddrTypeDomain:
+		if len(data) < 2 {
+			return net.Destination{}, nil, errors.New("truncated domain destination")
+		}
+		domainLen := int(data[1])
+		if domainLen == 0 || len(data) < 2+domainLen+2 {
+			return net.Destination{}, nil, errors.New("truncated domain destination")
+		}
+		address = net.ParseAddress(string(data[2 : 2+domainLen]))
+		rest = data[2+domainLen:]
+	default:
+		return net.Destination{}, nil, errors.New("unknown address type: ", data[0])
+	}
+
+	port := net.Port(binary.BigEndian.Uint16(rest[0:2]))
+	if port == 0 {
+		return net.Destination{}, nil, errors.New("invalid destination port")
+	}
+	return net.TCPDestination(address, port), rest[2:], nil
+}
+
+// EncodeDestination encodes dest as the destination header of a first DATA
+// frame. It is the inverse of DecodeDestination.
+func EncodeDestination(dest net.Destination) ([]byte, error) {
+	var b []byte
+	switch dest.Address.Family() {
+	case net.AddressFamilyIPv4:
+		b = append([]byte{AddrTypeIPv4}, dest.Address.IP().To4()...)
+	case net.AddressFamilyIPv6:
+		b = append([]byte{AddrTypeIPv6}, dest.Address.IP().To16()...)
+	case net.AddressFamilyDomain:
+		domain := dest.Address.Domain()
+		if len(domain) == 0 || len(domain) > 255 {
+			return nil, errors.New("invalid domain length: ", len(domain))
+		}
+		b = append([]byte{AddrTypeDomain, byte(len(domain))}, domain...)
+	default:
+		return nil, errors.New("unsupported address family")
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(dest.Port)), nil
+}
@@ -0,0 +1,60 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/xtls/xray-core/common/net"
+)
+
+func TestDecodeDestinationRoundTrip(t *testing.T) {
+	for _, dest := range []net.Destination{
+		net.TCPDestination(net.IPAddress([]byte{1, 2, 3, 4}), 80),
+		net.TCPDestination(net.ParseAddress("2001:db8::1"), 443),
+		net.TCPDestination(net.DomainAddress("example.com"), 8443),
+	} {
+		header, err := EncodeDestination(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, rest, err := DecodeDestination(append(header, "tail"...))
+		if err != nil {
+			t.Fatalf("%v: %v", dest, err)
+		}
+		if got != dest {
+			t.Errorf("got %v, want %v", got, dest)
+		}
+		if string(rest) != "tail" {
+			t.Errorf("%v: rest %q", dest, rest)
+		}
+	}
+}
+
+func TestDecodeDestinationTruncated(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,
+		{AddrTypeIPv4, 1, 2, 3},
+		{AddrTypeIPv6, 1},
+		{AddrTypeDomain},
+		{AddrTypeDomain, 0, 0, 80},
+		{AddrTypeDomain, 5, 'a', 'b'},
+		{AddrTypeIPv4, 1, 2, 3, 4, 0, 0},
+		{0x09, 1, 2},
+	} {
+		if _, _, err := DecodeDestination(data); err == nil {
+			t.Errorf("expected an error for %v", data)
+		}
+	}
+}
+
+func TestDecodeDestinationIPLiteralDomain(t *testing.T) {
+	// A client that always sends domains may send an address literal; it
+	// is dispatched the same as the IP encoding.
+	header := append([]byte{AddrTypeDomain, 7}, "1.2.3.4"...)
+	got, _, err := DecodeDestination(append(header, 0, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := net.TCPDestination(net.IPAddress([]byte{1, 2, 3, 4}), 80); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
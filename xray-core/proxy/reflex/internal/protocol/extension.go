@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"encoding/binary"
+
+	"github.com/xtls/xray-core/common/errors"
+)
+
+// Extensions carried in the policy request of a client handshake and in the
+// policy grant of the server's answer. Both are a sequence of
+// [type (1)][length (2)][value] entries; an empty one carries no extensions.
+const (
+	ExtAuthToken   = 0x01 // out-of-band authentication token
+	ExtCipherSuite = 0x02 // one byte naming the session cipher suite
+	ExtProofOfWork = 0x03 // challenge (16) and counter (8), see SolveProofOfWork
+	ExtProfile     = 0x04 // in a grant, the name of the profile the server morphs with
+
+	// 0x05 named the client version in the clear. It travels encrypted in
+	// a FrameTypeClientVersion now; a hello that still carries it has it
+	// ignored like any unknown extension.
+
+	// ExtMorphDownlink, empty, asks the server to morph what it sends with
+	// the profile it grants. The server morphs its side only for clients
+	// that ask and only when it grants a profile, so both ends know from
+	// the grant whether it does.
+	ExtMorphDownlink = 0x06
+)
+
+// ParseExtensions splits a policy request or grant into its extensions.
+// Unknown types are kept so callers can ignore them; a type may appear at
+// most once.
+func ParseExtensions(policyReq []byte) (map[uint8][]byte, error) {
+	exts := make(map[uint8][]byte)
+	for len(policyReq) > 0 {
+		if len(policyReq) < 3 {
+			return nil, errors.New("truncated handshake extension")
+		}
+		extType := policyReq[0]
+		extLen := int(binary.BigEndian.Uint16(policyReq[1:3]))
+		if len(policyReq) < 3+extLen {
+			return nil, errors.New("truncated handshake extension: ", extType)
+		}
+		if _, found := exts[extType]; found {
+			return nil, errors.New("duplicate handshake extension: ", extType)
+		}
+		exts[extType] = policyReq[3 : 3+extLen]
+		policyReq = policyReq[3+extLen:]
+	}
+	return exts, nil
+}
+
+// AppendExtension appends one extension to a policy request or grant.
+func AppendExtension(policyReq []byte, extType uint8, value []byte) []byte {
+	policyReq = append(policyReq, extType)
+	policyReq = binary.BigEndian.AppendUint16(policyReq, uint16(len(value)))
+	return append(policyReq, value...)
+}
+
+// GrantedProfile opens the sealed policy grant of a server handshake with
+// the client's session and returns the name of the traffic profile it
+// announces, or "" if it announces none. A response without a body carries
+// no grant; sealedGrant is then empty and sess is left untouched.
+func GrantedProfile(sess *Session, sealedGrant []byte) (string, error) {
+	if len(sealedGrant) == 0 {
+		return "", nil
+	}
+	grant, err := sess.DecryptFrame(FrameTypeData, sealedGrant)
+	if err != nil {
+		return "", errors.New("failed to open policy grant").Base(err)
+	}
+	exts, err := ParseExtensions(grant)
+	if err != nil {
+		return "", errors.New("invalid policy grant").Base(err)
+	}
+	return string(exts[ExtProfile]), nil
+}
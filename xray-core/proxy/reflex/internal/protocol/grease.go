@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"crypto/rand"
+	mrand "math/rand"
+)
+
+// MaxGreaseBytes is the most grease a client may send before the magic.
+const MaxGreaseBytes = 16
+
+// Grease bytes have 0xA in the low nibble and anything in the high one, like
+// TLS GREASE values. No byte of the magic has, so the server can skip grease
+// without being told how much there is.
+func isGreaseByte(b byte) bool {
+	return b&0x0f == 0x0a
+}
+
+// AppendGrease appends between 1 and maxLen random grease bytes to dst, to be
+// sent before the magic so that the first bytes of a connection differ
+// every time. maxLen is capped at MaxGreaseBytes; zero appends nothing.
+func AppendGrease(dst []byte, maxLen int) []byte {
+	maxLen = min(maxLen, MaxGreaseBytes)
+	if maxLen <= 0 {
+		return dst
+	}
+	grease := make([]byte, 1+mrand.Intn(maxLen))
+	rand.Read(grease)
+	for i := range grease {
+		grease[i] = grease[i]&0xf0 | 0x0a
+	}
+	return append(dst, grease...)
+}
+
+// GreaseLen returns how many grease bytes data starts with, up to maxLen.
+func GreaseLen(data []byte, maxLen int) int {
+	n := 0
+	for n < len(data) && n < maxLen && isGreaseByte(data[n]) {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,37 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestAppendGrease(t *testing.T) {
+	var magic [4]byte
+	binary.BigEndian.PutUint32(magic[:], ReflexMagic)
+	for _, b := range magic {
+		if isGreaseByte(b) {
+			t.Fatalf("magic byte %#x looks like grease", b)
+		}
+	}
+
+	lengths := make(map[int]bool)
+	for i := 0; i < 200; i++ {
+		grease := AppendGrease(nil, 4)
+		if len(grease) < 1 || len(grease) > 4 {
+			t.Fatalf("got %d grease bytes, want 1 to 4", len(grease))
+		}
+		if n := GreaseLen(append(grease, magic[:]...), MaxGreaseBytes); n != len(grease) {
+			t.Fatalf("GreaseLen = %d for % x", n, grease)
+		}
+		lengths[len(grease)] = true
+	}
+	if len(lengths) != 4 {
+		t.Errorf("grease lengths %v, want all of 1 to 4", lengths)
+	}
+	if got := AppendGrease(nil, 0); len(got) != 0 {
+		t.Errorf("AppendGrease(nil, 0) = % x", got)
+	}
+	if got := AppendGrease(nil, 100); len(got) > MaxGreaseBytes {
+		t.Errorf("got %d grease bytes past the cap", len(got))
+	}
+}
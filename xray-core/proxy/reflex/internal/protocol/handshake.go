@@ -0,0 +1,275 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/common/uuid"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// ReflexMagic is the 4-byte marker ("REFX", big-endian) that opens a
+// magic-mode client handshake.
+const ReflexMagic = 0x5246584C
+
+// HandshakeVersion is the version of the client handshake layout, sent
+// right after the magic. A server answers a version it does not support
+// with 426 Upgrade Required, so the layout can change without old peers
+// misreading it.
+const HandshakeVersion = 0x01
+
+const (
+	// clientHandshakeFixedSize is the size of a client handshake without the
+	// magic and the variable-length policy request:
+	// public key (32) + user id (16) + timestamp (8) + nonce (16) + policy length (2).
+	clientHandshakeFixedSize = 32 + 16 + 8 + 16 + 2
+
+	// maxPolicyReqSize bounds the policy request as sent on the wire, and
+	// maxPolicyReqInflated bounds it once decompressed.
+	maxPolicyReqSize     = 1024
+	maxPolicyReqInflated = 16 << 10
+
+	// policyReqCompressed is set in the policy length field when the policy
+	// request is deflate-compressed. Requests longer than
+	// policyCompressThreshold are sent compressed when that makes them
+	// smaller.
+	policyReqCompressed     = 0x8000
+	policyCompressThreshold = 256
+)
+
+// ErrUnsupportedVersion is the cause of the error for a client handshake
+// of a version other than HandshakeVersion.
+var ErrUnsupportedVersion = errors.New("unsupported handshake version")
+
+// ClientHandshake is the first message a client sends.
+type ClientHandshake struct {
+	PublicKey [32]byte // ephemeral X25519 public key
+	UserID    [16]byte // raw UUID
+	PolicyReq []byte   // policy request
+	Timestamp int64    // unix seconds
+	Nonce     [16]byte // replay protection
+}
+
+// DeriveUserID returns the ID a client with the given UUID sends in place
+// of it when its IdSalt is salt: an HMAC of the UUID under salt, in UUID
+// form. A server lists the client by the hash of the derived ID, so
+// neither the wire nor the server config carries the UUID.
+func DeriveUserID(salt string, id uuid.UUID) uuid.UUID {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte("reflex user id"))
+	mac.Write(id.Bytes())
+	var derived uuid.UUID
+	copy(derived[:], mac.Sum(nil))
+	return derived
+}
+
+// ServerHandshake is the server's answer to a successful client handshake.
+type ServerHandshake struct {
+	PublicKey   [32]byte // ephemeral X25519 public key
+	PolicyGrant []byte   // policy grant, sealed under the session key
+}
+
+// MarshalBinary encodes the handshake without the magic.
+func (hs *ClientHandshake) MarshalBinary() ([]byte, error) {
+	if len(hs.PolicyReq) > maxPolicyReqInflated {
+		return nil, errors.New("policy request too large: ", len(hs.PolicyReq))
+	}
+	policy, flags := hs.PolicyReq, uint16(0)
+	if len(policy) > policyCompressThreshold {
+		compressed, err := Deflate(policy)
+		if err != nil {
+			return nil, errors.New("failed to compress policy request").Base(err)
+		}
+		if len(compressed) < len(policy) {
+			policy, flags = compressed, policyReqCompressed
+		}
+	}
+	if len(policy) > maxPolicyReqSize {
+		return nil, errors.New("policy request too large: ", len(policy), " bytes on the wire")
+	}
+	b := make([]byte, clientHandshakeFixedSize+len(policy))
+	copy(b[0:32], hs.PublicKey[:])
+	copy(b[32:48], hs.UserID[:])
+	binary.BigEndian.PutUint64(b[48:56], uint64(hs.Timestamp))
+	copy(b[56:72], hs.Nonce[:])
+	binary.BigEndian.PutUint16(b[72:74], uint16(len(policy))|flags)
+	copy(b[74:], policy)
+	return b, nil
+}
+
+// AppendClientHandshake appends to dst a magic-mode client handshake
+// opening with magic, such as a time-gated one, and the version.
+func AppendClientHandshake(dst []byte, magic uint32, hs *ClientHandshake) ([]byte, error) {
+	body, err := hs.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	dst = binary.BigEndian.AppendUint32(dst, magic)
+	dst = append(dst, HandshakeVersion)
+	return append(dst, body...), nil
+}
+
+// ReadClientHandshake reads a handshake body (everything after the magic
+// and version).
+func ReadClientHandshake(reader io.Reader) (ClientHandshake, error) {
+	var hs ClientHandshake
+	var fixed [clientHandshakeFixedSize]byte
+	if _, err := io.ReadFull(reader, fixed[:]); err != nil {
+		return ClientHandshake{}, errors.New("failed to read client handshake").Base(err)
+	}
+	copy(hs.PublicKey[:], fixed[0:32])
+	copy(hs.UserID[:], fixed[32:48])
+	hs.Timestamp = int64(binary.BigEndian.Uint64(fixed[48:56]))
+	copy(hs.Nonce[:], fixed[56:72])
+	policyField := binary.BigEndian.Uint16(fixed[72:74])
+	policyLen := int(policyField &^ policyReqCompressed)
+	if policyLen > maxPolicyReqSize {
+		return ClientHandshake{}, errors.New("policy request too large: ", policyLen)
+	}
+	if policyLen > 0 {
+		hs.PolicyReq = make([]byte, policyLen)
+		if _, err := io.ReadFull(reader, hs.PolicyReq); err != nil {
+			return ClientHandshake{}, errors.New("failed to read policy request").Base(err)
+		}
+	}
+	if policyField&policyReqCompressed != 0 {
+		policy, err := Inflate(hs.PolicyReq, maxPolicyReqInflated)
+		if err != nil {
+			return ClientHandshake{}, errors.New("failed to decompress policy request").Base(err)
+		}
+		hs.PolicyReq = policy
+	}
+	return hs, nil
+}
+
+// ReadVersionedClientHandshake reads the version that follows the magic
+// and the client handshake after it.
+func ReadVersionedClientHandshake(reader io.Reader) (ClientHandshake, error) {
+	var version [1]byte
+	if _, err := io.ReadFull(reader, version[:]); err != nil {
+		return ClientHandshake{}, errors.New("failed to read handshake version").Base(err)
+	}
+	if version[0] != HandshakeVersion {
+		return ClientHandshake{}, errors.New("client handshake version ", version[0]).Base(ErrUnsupportedVersion)
+	}
+	return ReadClientHandshake(reader)
+}
+
+const (
+	// MagicBucket is how long one time-gated magic stays current.
+	MagicBucket = 60 * time.Second
+
+	// magicSkewBuckets is how many buckets either side of the current one a
+	// time-gated magic is still recognized in, to absorb clock drift.
+	magicSkewBuckets = 1
+)
+
+// TimeGatedMagic returns the magic that opens a handshake at time t for a
+// server sharing secret, in place of ReflexMagic: an HMAC of t's bucket
+// under secret. A first flight recorded and replayed once the bucket has
+// passed no longer opens with a magic the server recognizes.
+//
+// No byte of it is a grease byte (0x?A), as none of ReflexMagic is, so
+// grease can still precede it.
+func TimeGatedMagic(secret []byte, t time.Time) uint32 {
+	return magicForBucket(secret, t.Unix()/int64(MagicBucket/time.Second))
+}
+
+func magicForBucket(secret []byte, bucket int64) uint32 {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("reflex magic"))
+	binary.Write(mac, binary.BigEndian, bucket)
+	magic := mac.Sum(nil)[:4]
+	for i, b := range magic {
+		if b&0x0f == 0x0a {
+			magic[i] = b ^ 0x01
+		}
+	}
+	return binary.BigEndian.Uint32(magic)
+}
+
+// IsTimeGatedMagic reports whether magic is the time-gated magic for
+// secret of the bucket of now or of one next to it.
+func IsTimeGatedMagic(secret []byte, magic uint32, now time.Time) bool {
+	bucket := now.Unix() / int64(MagicBucket/time.Second)
+	for i := int64(-magicSkewBuckets); i <= magicSkewBuckets; i++ {
+		if magicForBucket(secret, bucket+i) == magic {
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateKeyPair returns a fresh X25519 key pair.
+func GenerateKeyPair() (privateKey [32]byte, publicKey [32]byte, err error) {
+	if _, err = rand.Read(privateKey[:]); err != nil {
+		return
+	}
+	pub, err := curve25519.X25519(privateKey[:], curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+	copy(publicKey[:], pub)
+	return
+}
+
+// DeriveSharedKey runs X25519. It fails on low-order peer keys, which
+// would otherwise yield an all-zero shared secret.
+func DeriveSharedKey(privateKey, peerPublicKey [32]byte) ([32]byte, error) {
+	var shared [32]byte
+	out, err := curve25519.X25519(privateKey[:], peerPublicKey[:])
+	if err != nil {
+		return shared, err
+	}
+	copy(shared[:], out)
+	return shared, nil
+}
+
+// Labels of the keys a session key is expanded into: one per direction
+// and purpose, a direction label followed by a purpose label.
+const (
+	clientToServerLabel = "reflex client to server"
+	serverToClientLabel = "reflex server to client"
+
+	frameKeyLabel  = ""
+	headerKeyLabel = " header"
+)
+
+// directionKeys expands sessionKey into the keys for purpose role reads
+// and writes frames with. The caller should clear them once it is done
+// with them.
+func directionKeys(sessionKey []byte, role Role, purpose string) (read, write []byte) {
+	clientWrite := expandKey(sessionKey, clientToServerLabel+purpose)
+	serverWrite := expandKey(sessionKey, serverToClientLabel+purpose)
+	if role == RoleClient {
+		return serverWrite, clientWrite
+	}
+	return clientWrite, serverWrite
+}
+
+// expandKey derives a 32-byte key for label from key.
+func expandKey(key []byte, label string) []byte {
+	out := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, key, []byte(label)), out); err != nil {
+		panic(err) // cannot happen for 32 bytes of SHA-256 HKDF output
+	}
+	return out
+}
+
+// DeriveSessionKey expands the shared secret into a 32-byte session key.
+// salt is the client's handshake nonce. Sessions do not seal frames under
+// it directly but under a key per direction derived from it.
+func DeriveSessionKey(sharedKey [32]byte, salt []byte) []byte {
+	kdf := hkdf.New(sha256.New, sharedKey[:], salt, []byte("reflex-session"))
+	sessionKey := make([]byte, 32)
+	if _, err := io.ReadFull(kdf, sessionKey); err != nil {
+		panic(err) // cannot happen for 32 bytes of SHA-256 HKDF output
+	}
+	return sessionKey
+}
@@ -0,0 +1,273 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/errors"
+)
+
+func TestHandshakeKeysRoundTrip(t *testing.T) {
+	clientPriv, clientPub, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPriv, serverPub, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nonce [16]byte
+	rand.Read(nonce[:])
+
+	clientShared, err := DeriveSharedKey(clientPriv, serverPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverShared, err := DeriveSharedKey(serverPriv, clientPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewSession(DeriveSessionKey(clientShared, nonce[:]), RoleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewSession(DeriveSessionKey(serverShared, nonce[:]), RoleServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wire bytes.Buffer
+	for _, payload := range []string{"hello", "world"} {
+		if err := client.WriteFrame(&wire, FrameTypeData, []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.WriteFrame(&wire, FrameTypeClose, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct {
+		frameType uint8
+		payload   string
+	}{{FrameTypeData, "hello"}, {FrameTypeData, "world"}, {FrameTypeClose, ""}} {
+		frame, err := server.ReadFrame(&wire)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Type != want.frameType || string(frame.Payload) != want.payload {
+			t.Errorf("read %d %q, want %d %q", frame.Type, frame.Payload, want.frameType, want.payload)
+		}
+	}
+}
+
+func TestDeriveSharedKeyRejectsLowOrderKey(t *testing.T) {
+	priv, _, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeriveSharedKey(priv, [32]byte{}); err == nil {
+		t.Error("accepted an all-zero peer key")
+	}
+}
+
+func TestTimeGatedMagic(t *testing.T) {
+	secret := []byte("magic secret")
+	now := time.Unix(1700000000, 0)
+	magic := TimeGatedMagic(secret, now)
+	for _, tc := range []struct {
+		at   time.Time
+		want bool
+	}{
+		{now, true},
+		{now.Add(MagicBucket), true},
+		{now.Add(-MagicBucket), true},
+		{now.Add(2 * MagicBucket), false},
+		{now.Add(-2 * MagicBucket), false},
+	} {
+		if got := IsTimeGatedMagic(secret, magic, tc.at); got != tc.want {
+			t.Errorf("magic checked %v later: recognized %v, want %v", tc.at.Sub(now), got, tc.want)
+		}
+	}
+	if IsTimeGatedMagic([]byte("other secret"), magic, now) {
+		t.Error("magic recognized under another secret")
+	}
+	if IsTimeGatedMagic(secret, ReflexMagic, now) {
+		t.Error("plain magic recognized")
+	}
+
+	for i := int64(0); i < 1000; i++ {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], magicForBucket(secret, i))
+		for _, c := range b {
+			if c&0x0f == 0x0a {
+				t.Fatalf("bucket %d magic %x has a grease byte", i, b)
+			}
+		}
+	}
+}
+
+// writeClientHandshakeMagic writes a magic-mode client handshake opening
+// with ReflexMagic.
+func writeClientHandshakeMagic(writer io.Writer, hs *ClientHandshake) error {
+	packet, err := AppendClientHandshake(nil, ReflexMagic, hs)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(packet)
+	return err
+}
+
+// readClientHandshakeMagic reads a magic-mode client handshake, magic
+// included. Process checks the magic itself and skips it instead.
+func readClientHandshakeMagic(reader io.Reader) (ClientHandshake, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(reader, magic[:]); err != nil {
+		return ClientHandshake{}, errors.New("failed to read magic").Base(err)
+	}
+	if binary.BigEndian.Uint32(magic[:]) != ReflexMagic {
+		return ClientHandshake{}, errors.New("invalid magic")
+	}
+	return ReadVersionedClientHandshake(reader)
+}
+
+func FuzzReadClientHandshakeMagic(f *testing.F) {
+	hs := ClientHandshake{Timestamp: 1700000000}
+	hs.PublicKey[0] = 1
+	hs.UserID[0] = 2
+	var valid bytes.Buffer
+	writeClientHandshakeMagic(&valid, &hs)
+	hs.PolicyReq = AppendExtension(nil, ExtAuthToken, make([]byte, 16))
+	var withPolicy bytes.Buffer
+	writeClientHandshakeMagic(&withPolicy, &hs)
+
+	f.Add(valid.Bytes())
+	f.Add(withPolicy.Bytes())
+	f.Add(valid.Bytes()[:4])
+	f.Add(valid.Bytes()[:len(valid.Bytes())-1])
+	f.Add(withPolicy.Bytes()[:len(withPolicy.Bytes())-1])
+	overlong := append([]byte(nil), valid.Bytes()...)
+	binary.BigEndian.PutUint16(overlong[5+72:], maxPolicyReqSize+1)
+	f.Add(overlong)
+	maxLen := append([]byte(nil), valid.Bytes()...)
+	binary.BigEndian.PutUint16(maxLen[5+72:], 0xffff)
+	f.Add(maxLen)
+	unknownVersion := append([]byte(nil), valid.Bytes()...)
+	unknownVersion[4] = HandshakeVersion + 1
+	f.Add(unknownVersion)
+	hs.PolicyReq = bytes.Repeat([]byte("inline profile "), 100)
+	var compressed bytes.Buffer
+	writeClientHandshakeMagic(&compressed, &hs)
+	f.Add(compressed.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		hs, err := readClientHandshakeMagic(bytes.NewReader(data))
+		if err != nil {
+			if hs.Timestamp != 0 || hs.PolicyReq != nil {
+				t.Fatal("a rejected handshake must not be returned partially parsed")
+			}
+			return
+		}
+		if len(hs.PolicyReq) > maxPolicyReqInflated {
+			t.Fatalf("accepted a %d byte policy request", len(hs.PolicyReq))
+		}
+		if binary.BigEndian.Uint16(data[5+72:])&policyReqCompressed != 0 || len(hs.PolicyReq) > policyCompressThreshold {
+			// Whether and how a long policy is deflated is up to the
+			// encoder, so only short ones re-encode byte for byte.
+			return
+		}
+		body, err := hs.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, data[5:5+len(body)]) {
+			t.Fatal("parsed handshake does not re-encode to its input")
+		}
+	})
+}
+
+func TestClientHandshakeCompressedPolicy(t *testing.T) {
+	hs := ClientHandshake{Timestamp: 1700000000}
+	for i := 0; i < 200; i++ {
+		hs.PolicyReq = AppendExtension(hs.PolicyReq, 0x40, []byte("profile=youtube;rtt=80"))
+	}
+	if len(hs.PolicyReq) <= maxPolicyReqSize {
+		t.Fatalf("test policy of %d bytes would fit uncompressed", len(hs.PolicyReq))
+	}
+
+	var wire bytes.Buffer
+	if err := writeClientHandshakeMagic(&wire, &hs); err != nil {
+		t.Fatal(err)
+	}
+	if wire.Len() >= len(hs.PolicyReq) {
+		t.Errorf("handshake is %d bytes for a %d byte policy", wire.Len(), len(hs.PolicyReq))
+	}
+	got, err := readClientHandshakeMagic(&wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.PolicyReq, hs.PolicyReq) {
+		t.Error("policy request did not survive the round trip")
+	}
+
+	// Short policies stay uncompressed.
+	hs.PolicyReq = AppendExtension(nil, ExtCipherSuite, []byte{CipherSuiteXChaCha20Poly1305})
+	body, err := hs.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body[clientHandshakeFixedSize:], hs.PolicyReq) {
+		t.Error("short policy request was compressed")
+	}
+}
+
+func TestClientHandshakeCompressedPolicyBomb(t *testing.T) {
+	compressed, err := Deflate(make([]byte, maxPolicyReqInflated+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := ClientHandshake{Timestamp: 1700000000}
+	body, _ := hs.MarshalBinary()
+	binary.BigEndian.PutUint16(body[72:], uint16(len(compressed))|policyReqCompressed)
+	body = append(body, compressed...)
+	if _, err := ReadClientHandshake(bytes.NewReader(body)); err == nil {
+		t.Error("accepted a policy request that inflates beyond the cap")
+	}
+}
+
+func TestReadClientHandshakeMagicConsumedOrNot(t *testing.T) {
+	hs := ClientHandshake{Timestamp: 1700000000, PolicyReq: AppendExtension(nil, ExtCipherSuite, []byte{CipherSuiteXChaCha20Poly1305})}
+	hs.PublicKey[0] = 1
+	var wire bytes.Buffer
+	if err := writeClientHandshakeMagic(&wire, &hs); err != nil {
+		t.Fatal(err)
+	}
+
+	// Magic still in the reader.
+	got, err := readClientHandshakeMagic(bufio.NewReader(bytes.NewReader(wire.Bytes())))
+	if err != nil || got.PublicKey != hs.PublicKey || !bytes.Equal(got.PolicyReq, hs.PolicyReq) {
+		t.Errorf("with magic: got %+v, %v", got, err)
+	}
+
+	// Magic peeked, checked and skipped, as the inbound does.
+	reader := bufio.NewReader(bytes.NewReader(wire.Bytes()))
+	peeked, err := reader.Peek(4)
+	if err != nil || binary.BigEndian.Uint32(peeked) != ReflexMagic {
+		t.Fatal("magic not peeked")
+	}
+	reader.Discard(4)
+	got, err = ReadVersionedClientHandshake(reader)
+	if err != nil || got.PublicKey != hs.PublicKey || !bytes.Equal(got.PolicyReq, hs.PolicyReq) {
+		t.Errorf("magic consumed: got %+v, %v", got, err)
+	}
+
+	// Parsing the magic again once it is consumed fails instead of
+	// misreading the handshake.
+	reader = bufio.NewReader(bytes.NewReader(wire.Bytes()[4:]))
+	if _, err := readClientHandshakeMagic(reader); err == nil {
+		t.Error("parsed a handshake whose magic was already consumed as if it had one")
+	}
+}
@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/xtls/xray-core/common/errors"
+)
+
+// rttWeight is the weight of a new sample in the smoothed round-trip time,
+// as in TCP's SRTT.
+const rttWeight = 0.125
+
+// SendPing writes a PING carrying the time since the session started. Only
+// the sender interprets it, so the peers' clocks need not agree. A PING
+// sent before the previous one was answered replaces it.
+func (s *Session) SendPing(writer io.Writer) error {
+	sent := uint64(time.Since(s.created))
+	s.rttMu.Lock()
+	s.pingSent, s.pingPending = sent, true
+	s.rttMu.Unlock()
+	return s.WriteFrame(writer, FrameTypePing, binary.BigEndian.AppendUint64(nil, sent))
+}
+
+// HandleHeartbeat answers a PING with a PONG echoing its payload and feeds a
+// PONG into the round-trip time estimate. Only the PONG to the last PING
+// sent counts, once; any other is ignored, so an unsolicited or replayed
+// one cannot skew the estimate.
+func (s *Session) HandleHeartbeat(writer io.Writer, frame *Frame) error {
+	if len(frame.Payload) != 8 {
+		return errors.New("invalid heartbeat frame")
+	}
+	switch frame.Type {
+	case FrameTypePing:
+		return s.WriteFrame(writer, FrameTypePong, frame.Payload)
+	case FrameTypePong:
+		if !s.answersPing(binary.BigEndian.Uint64(frame.Payload)) {
+			return nil
+		}
+		sent := time.Duration(binary.BigEndian.Uint64(frame.Payload))
+		sample := time.Since(s.created) - sent
+		s.updateRTT(sample)
+		s.congestion.observeRTT(sample)
+	}
+	return nil
+}
+
+// answersPing reports whether sent is the payload of the PING awaiting its
+// PONG, which it then no longer awaits.
+func (s *Session) answersPing(sent uint64) bool {
+	s.rttMu.Lock()
+	defer s.rttMu.Unlock()
+	if !s.pingPending || sent != s.pingSent {
+		return false
+	}
+	s.pingPending = false
+	return true
+}
+
+func (s *Session) updateRTT(sample time.Duration) {
+	s.rttMu.Lock()
+	defer s.rttMu.Unlock()
+	if s.rtt == 0 {
+		s.rtt = sample
+		return
+	}
+	s.rtt += time.Duration(rttWeight * float64(sample-s.rtt))
+}
+
+// RTT returns the smoothed round-trip time, or zero before the first PONG.
+func (s *Session) RTT() time.Duration {
+	s.rttMu.Lock()
+	defer s.rttMu.Unlock()
+	return s.rtt
+}
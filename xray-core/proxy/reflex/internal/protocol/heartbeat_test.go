@@ -0,0 +1,124 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+// delayedWriter holds every write for a fixed delay, like a slow link.
+type delayedWriter struct {
+	io.Writer
+	delay time.Duration
+}
+
+func (w *delayedWriter) Write(b []byte) (int, error) {
+	time.Sleep(w.delay)
+	return w.Writer.Write(b)
+}
+
+func TestHeartbeatMeasuresRTT(t *testing.T) {
+	client, server := newTestSessionPair(t)
+	var up, down bytes.Buffer
+	const delay = 40 * time.Millisecond
+
+	if client.RTT() != 0 {
+		t.Fatal("RTT before any pong should be zero")
+	}
+	for i := 0; i < 3; i++ {
+		if err := client.SendPing(&delayedWriter{&up, delay}); err != nil {
+			t.Fatal(err)
+		}
+		ping, err := server.ReadFrame(&up)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ping.Type != FrameTypePing {
+			t.Fatalf("got frame type %d, want PING", ping.Type)
+		}
+		if err := server.HandleHeartbeat(&delayedWriter{&down, delay}, ping); err != nil {
+			t.Fatal(err)
+		}
+		pong, err := client.ReadFrame(&down)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pong.Type != FrameTypePong {
+			t.Fatalf("got frame type %d, want PONG", pong.Type)
+		}
+		if err := client.HandleHeartbeat(io.Discard, pong); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if rtt := client.RTT(); rtt < delay || rtt > time.Second {
+		t.Errorf("RTT = %v, want around %v", rtt, delay)
+	}
+	if server.RTT() != 0 {
+		t.Error("answering pings must not change the responder's RTT")
+	}
+}
+
+func TestUpdateRTTSmoothing(t *testing.T) {
+	s, _ := newTestSessionPair(t)
+	s.updateRTT(100 * time.Millisecond)
+	s.updateRTT(200 * time.Millisecond)
+	if want := 112500 * time.Microsecond; s.RTT() != want {
+		t.Errorf("RTT = %v, want %v", s.RTT(), want)
+	}
+}
+
+func TestHandleHeartbeatInvalid(t *testing.T) {
+	s, _ := newTestSessionPair(t)
+	if err := s.HandleHeartbeat(io.Discard, &Frame{Type: FrameTypePing, Payload: []byte{1}}); err == nil {
+		t.Error("expected an error for a short ping")
+	}
+}
+
+func TestHeartbeatIgnoresUnmatchedPong(t *testing.T) {
+	client, server := newTestSessionPair(t)
+	pong := func(sent uint64) *Frame {
+		return &Frame{Type: FrameTypePong, Payload: binary.BigEndian.AppendUint64(nil, sent)}
+	}
+
+	if err := client.HandleHeartbeat(io.Discard, pong(0)); err != nil {
+		t.Fatal(err)
+	}
+	if client.RTT() != 0 {
+		t.Fatal("an unsolicited pong changed the RTT")
+	}
+
+	var up bytes.Buffer
+	if err := client.SendPing(&up); err != nil {
+		t.Fatal(err)
+	}
+	ping, err := server.ReadFrame(&up)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := binary.BigEndian.Uint64(ping.Payload)
+	if err := client.HandleHeartbeat(io.Discard, pong(sent-uint64(time.Second))); err != nil {
+		t.Fatal(err)
+	}
+	if client.RTT() != 0 {
+		t.Fatal("a pong to no ping sent changed the RTT")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if err := client.HandleHeartbeat(io.Discard, pong(sent)); err != nil {
+		t.Fatal(err)
+	}
+	rtt := client.RTT()
+	if rtt <= 0 {
+		t.Fatal("the pong to the last ping was not measured")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := client.HandleHeartbeat(io.Discard, pong(sent)); err != nil {
+		t.Fatal(err)
+	}
+	if client.RTT() != rtt {
+		t.Error("a replayed pong changed the RTT")
+	}
+}
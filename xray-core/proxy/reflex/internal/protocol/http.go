@@ -0,0 +1,167 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/xtls/xray-core/common/errors"
+)
+
+// maxHTTPHandshakeBody bounds the body of an HTTP handshake message.
+const maxHTTPHandshakeBody = 4096
+
+// httpHandshakeBody is the JSON body of the HTTP POST-like handshake.
+type httpHandshakeBody struct {
+	Data string `json:"data"`
+}
+
+// ReadHTTPData reads an HTTP POST-like request and returns the decoded
+// "data" field of its JSON body.
+func ReadHTTPData(reader *bufio.Reader) ([]byte, error) {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, errors.New("failed to read HTTP handshake").Base(err)
+	}
+	defer req.Body.Close()
+	if req.Method != http.MethodPost {
+		return nil, errors.New("unexpected HTTP method: ", req.Method)
+	}
+	if req.ContentLength < 0 || req.ContentLength > maxHTTPHandshakeBody {
+		return nil, errors.New("invalid HTTP handshake length: ", req.ContentLength)
+	}
+	var body httpHandshakeBody
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxHTTPHandshakeBody)).Decode(&body); err != nil {
+		return nil, errors.New("failed to decode HTTP handshake").Base(err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(body.Data)
+	if err != nil {
+		return nil, errors.New("failed to decode handshake data").Base(err)
+	}
+	return raw, nil
+}
+
+// AppendHTTPData appends data as the JSON body of an HTTP POST-like
+// request.
+func AppendHTTPData(dst, data []byte, host string) []byte {
+	body, _ := json.Marshal(httpHandshakeBody{Data: base64.StdEncoding.EncodeToString(data)})
+	b := bytes.NewBuffer(dst)
+	b.WriteString("POST /api/v1/endpoint HTTP/1.1\r\n")
+	b.WriteString("Host: " + host + "\r\n")
+	b.WriteString("Content-Type: application/json\r\n")
+	b.WriteString("Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n")
+	b.Write(body)
+	return b.Bytes()
+}
+
+// AppendHTTPUpgradeHandshake appends to dst an HTTP GET that asks to
+// upgrade the connection to protocol and carries handshake, the client
+// handshake without the magic and version, or with them for servers with
+// a MagicSecret, base64-encoded as a bearer token. A server with the same
+// HTTPUpgrade answers 101 Switching Protocols, and the session follows on
+// the same connection.
+func AppendHTTPUpgradeHandshake(dst, handshake []byte, host, protocol string) []byte {
+	b := bytes.NewBuffer(dst)
+	b.WriteString("GET /api/v1/endpoint HTTP/1.1\r\n")
+	b.WriteString("Host: " + host + "\r\n")
+	b.WriteString("Connection: Upgrade\r\n")
+	b.WriteString("Upgrade: " + protocol + "\r\n")
+	b.WriteString("Authorization: Bearer " + base64.StdEncoding.EncodeToString(handshake) + "\r\n\r\n")
+	return b.Bytes()
+}
+
+// ValidUpgradeProtocol reports whether protocol can be sent in an Upgrade
+// header: a token, optionally followed by a slash and a version token.
+func ValidUpgradeProtocol(protocol string) bool {
+	name, version, hasVersion := strings.Cut(protocol, "/")
+	return isHTTPToken(name) && (!hasVersion || isHTTPToken(version))
+}
+
+func isHTTPToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range []byte(s) {
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// httpServerHandshakeBody is the JSON body of the server's HTTP 200 response.
+type httpServerHandshakeBody struct {
+	Key   string `json:"key"`
+	Grant string `json:"grant,omitempty"`
+}
+
+// StatusHasBody reports whether a successful handshake response with the
+// given status carries its fields in a JSON body. 101, 204 and 205
+// responses have no body, so the server key travels in an ETag header
+// instead and no policy grant is sent.
+func StatusHasBody(status int) bool {
+	return status != http.StatusSwitchingProtocols && status != http.StatusNoContent && status != http.StatusResetContent
+}
+
+// FormatHTTPResponse renders the server handshake as an HTTP response with
+// the given 2xx status.
+func FormatHTTPResponse(hs *ServerHandshake, status int) []byte {
+	var b bytes.Buffer
+	b.WriteString("HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\n")
+	if !StatusHasBody(status) {
+		b.WriteString("ETag: \"" + base64.StdEncoding.EncodeToString(hs.PublicKey[:]) + "\"\r\n")
+		if status == http.StatusResetContent {
+			b.WriteString("Content-Length: 0\r\n")
+		}
+		b.WriteString("\r\n")
+		return b.Bytes()
+	}
+	body, _ := json.Marshal(httpServerHandshakeBody{
+		Key:   base64.StdEncoding.EncodeToString(hs.PublicKey[:]),
+		Grant: base64.StdEncoding.EncodeToString(hs.PolicyGrant),
+	})
+	b.WriteString("Content-Type: application/json\r\n")
+	b.WriteString("Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n")
+	b.Write(body)
+	return b.Bytes()
+}
+
+// FormatHTTPUpgradeResponse renders the server handshake as the 101
+// response that switches the connection to protocol.
+func FormatHTTPUpgradeResponse(hs *ServerHandshake, protocol string) []byte {
+	var b bytes.Buffer
+	b.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	b.WriteString("Connection: Upgrade\r\n")
+	b.WriteString("Upgrade: " + protocol + "\r\n")
+	b.WriteString("ETag: \"" + base64.StdEncoding.EncodeToString(hs.PublicKey[:]) + "\"\r\n\r\n")
+	return b.Bytes()
+}
+
+// DecodeHTTPServerHandshake decodes the server handshake that resp, a
+// successful response rendered by FormatHTTPResponse or
+// FormatHTTPUpgradeResponse, carries. It checks neither the status nor
+// anything else about how the response looks.
+func DecodeHTTPServerHandshake(resp *http.Response) (*ServerHandshake, error) {
+	var body httpServerHandshakeBody
+	if !StatusHasBody(resp.StatusCode) {
+		body.Key = strings.Trim(resp.Header.Get("ETag"), `"`)
+	} else if err := json.NewDecoder(io.LimitReader(resp.Body, maxHTTPHandshakeBody)).Decode(&body); err != nil {
+		return nil, errors.New("failed to decode server handshake").Base(err)
+	}
+	key, err := base64.StdEncoding.DecodeString(body.Key)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("invalid server public key")
+	}
+	grant, err := base64.StdEncoding.DecodeString(body.Grant)
+	if err != nil {
+		return nil, errors.New("invalid policy grant").Base(err)
+	}
+	hs := &ServerHandshake{PolicyGrant: grant}
+	copy(hs.PublicKey[:], key)
+	return hs, nil
+}
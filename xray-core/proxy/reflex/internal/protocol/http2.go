@@ -0,0 +1,141 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/xtls/xray-core/common/errors"
+)
+
+// In the HTTP/2 handshake variant the client opens like an HTTP/2 client:
+// with the connection preface, followed by what is framed as a SETTINGS
+// frame on stream 0. Its payload is the magic, the version and the
+// handshake, zero-padded to a whole number of 6-byte settings.
+const (
+	HTTP2Preface         = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	http2FrameHeaderSize = 9
+	http2FrameSettings   = 0x4
+	http2FrameGoAway     = 0x7
+	http2SettingSize     = 6
+
+	// http2ProtocolError is the GOAWAY error code of a server that makes no
+	// sense of what its client sent.
+	http2ProtocolError = 0x1
+
+	// HTTP2OpeningSize is what every HTTP/2 client sends at once: the
+	// preface and the header of its first SETTINGS frame.
+	HTTP2OpeningSize = len(HTTP2Preface) + http2FrameHeaderSize
+
+	// maxHTTP2SettingsPayload bounds the SETTINGS payload of a handshake.
+	maxHTTP2SettingsPayload = 4 + 1 + clientHandshakeFixedSize + maxPolicyReqSize + http2SettingSize
+
+	// maxHTTP2ServerPayload bounds the payload of a server's answer.
+	maxHTTP2ServerPayload = 4096
+)
+
+// appendHTTP2Frame appends a frame on stream 0 carrying payload, zero-padded
+// to a whole number of settings.
+func appendHTTP2Frame(dst []byte, frameType byte, payload []byte) []byte {
+	padded := (len(payload) + http2SettingSize - 1) / http2SettingSize * http2SettingSize
+	var header [http2FrameHeaderSize]byte
+	header[0] = byte(padded >> 16)
+	binary.BigEndian.PutUint16(header[1:3], uint16(padded))
+	header[3] = frameType
+	dst = append(dst, header[:]...)
+	dst = append(dst, payload...)
+	return append(dst, make([]byte, padded-len(payload))...)
+}
+
+// AppendHTTP2Handshake appends to dst the HTTP/2 preface and a SETTINGS
+// frame carrying packet, a magic-mode client handshake starting with the
+// magic and version.
+func AppendHTTP2Handshake(dst, packet []byte) []byte {
+	return appendHTTP2Frame(append(dst, HTTP2Preface...), http2FrameSettings, packet)
+}
+
+// HTTP2SettingsLength returns the payload length of the SETTINGS frame
+// that opening, HTTP2OpeningSize bytes, announces after the preface. It
+// reports false unless opening is the preface followed by the header of a
+// SETTINGS frame on stream 0.
+func HTTP2SettingsLength(opening []byte) (int, bool) {
+	if len(opening) < HTTP2OpeningSize || string(opening[:len(HTTP2Preface)]) != HTTP2Preface {
+		return 0, false
+	}
+	header := opening[len(HTTP2Preface):]
+	if header[3] != http2FrameSettings || binary.BigEndian.Uint32(header[5:9]) != 0 {
+		return 0, false
+	}
+	return int(header[0])<<16 | int(binary.BigEndian.Uint16(header[1:3])), true
+}
+
+// ReadHTTP2ClientHandshake parses the HTTP/2 variant of the handshake,
+// from the preface on. The caller has checked that the SETTINGS frame
+// opens with a magic it accepts.
+func ReadHTTP2ClientHandshake(reader *bufio.Reader) (ClientHandshake, error) {
+	var opening [HTTP2OpeningSize]byte
+	if _, err := io.ReadFull(reader, opening[:]); err != nil {
+		return ClientHandshake{}, errors.New("failed to read HTTP/2 preface").Base(err)
+	}
+	length, ok := HTTP2SettingsLength(opening[:])
+	if !ok || length < 4 || length%http2SettingSize != 0 || length > maxHTTP2SettingsPayload {
+		return ClientHandshake{}, errors.New("invalid SETTINGS frame length: ", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return ClientHandshake{}, errors.New("failed to read SETTINGS frame").Base(err)
+	}
+	return ReadVersionedClientHandshake(bytes.NewReader(payload[4:]))
+}
+
+// FormatHTTP2Response renders the server handshake the way an HTTP/2 server
+// opens its side of a connection: as a SETTINGS frame, whose payload is the
+// server key, the length of the policy grant and the grant.
+func FormatHTTP2Response(hs *ServerHandshake) []byte {
+	payload := binary.BigEndian.AppendUint16(append([]byte(nil), hs.PublicKey[:]...), uint16(len(hs.PolicyGrant)))
+	return appendHTTP2Frame(nil, http2FrameSettings, append(payload, hs.PolicyGrant...))
+}
+
+// FormatHTTP2Error renders the GOAWAY frame an HTTP/2 server closes a
+// connection with when its client's SETTINGS make no sense, which is how a
+// failed handshake in the HTTP/2 variant is answered.
+func FormatHTTP2Error() []byte {
+	var payload [8]byte
+	binary.BigEndian.PutUint32(payload[4:], http2ProtocolError)
+	return appendHTTP2Frame(nil, http2FrameGoAway, payload[:])
+}
+
+// ReadHTTP2ServerHandshake parses the server's answer to a handshake in the
+// HTTP/2 variant.
+func ReadHTTP2ServerHandshake(reader *bufio.Reader) (*ServerHandshake, error) {
+	var header [http2FrameHeaderSize]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, errors.New("failed to read server handshake").Base(err)
+	}
+	length := int(header[0])<<16 | int(binary.BigEndian.Uint16(header[1:3]))
+	if length > maxHTTP2ServerPayload {
+		return nil, errors.New("server frame of ", length, " bytes")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, errors.New("failed to read server handshake").Base(err)
+	}
+	switch header[3] {
+	case http2FrameSettings:
+	case http2FrameGoAway:
+		return nil, errors.New("handshake rejected with GOAWAY")
+	default:
+		return nil, errors.New("unexpected server frame type ", header[3])
+	}
+	if len(payload) < 34 {
+		return nil, errors.New("short server handshake")
+	}
+	grantLen := int(binary.BigEndian.Uint16(payload[32:34]))
+	if len(payload) < 34+grantLen {
+		return nil, errors.New("short policy grant")
+	}
+	hs := &ServerHandshake{PolicyGrant: payload[34 : 34+grantLen]}
+	copy(hs.PublicKey[:], payload)
+	return hs, nil
+}
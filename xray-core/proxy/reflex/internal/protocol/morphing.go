@@ -0,0 +1,622 @@
+package protocol
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	mrand "math/rand"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xtls/xray-core/common/errors"
+)
+
+// TrafficProfile describes the packet size and inter-packet delay
+// distributions a session imitates.
+type TrafficProfile struct {
+	Name        string
+	PacketSizes []PacketSizeDist
+	Delays      []DelayDist
+
+	// CompressionDictionary, if set, is the preset dictionary compressed
+	// DATA frames of sessions with this profile are compressed against,
+	// such as common HTTP headers for web traffic. Only its last 32KB
+	// count. Both ends must have the same one; see Session.SetCompression.
+	CompressionDictionary []byte
+
+	mu             sync.Mutex
+	rng            *mrand.Rand   // nil draws from the shared source
+	nextPacketSize int           // one-shot override set by PADDING_CTRL
+	nextDelay      time.Duration // one-shot override set by TIMING_CTRL
+}
+
+// PacketSizeDist is one bucket of a packet size distribution.
+type PacketSizeDist struct {
+	Size   int
+	Weight float64
+}
+
+// DelayDist is one bucket of a delay distribution.
+type DelayDist struct {
+	Delay  time.Duration
+	Weight float64
+}
+
+// YouTubeProfile imitates video streaming: mostly MTU-sized packets at short
+// intervals.
+var YouTubeProfile = TrafficProfile{
+	Name: "youtube",
+	PacketSizes: []PacketSizeDist{
+		{Size: 1400, Weight: 0.35},
+		{Size: 1200, Weight: 0.25},
+		{Size: 1000, Weight: 0.20},
+		{Size: 800, Weight: 0.10},
+		{Size: 600, Weight: 0.05},
+		{Size: 400, Weight: 0.05},
+	},
+	Delays: []DelayDist{
+		{Delay: 8 * time.Millisecond, Weight: 0.30},
+		{Delay: 12 * time.Millisecond, Weight: 0.25},
+		{Delay: 16 * time.Millisecond, Weight: 0.20},
+		{Delay: 20 * time.Millisecond, Weight: 0.15},
+		{Delay: 30 * time.Millisecond, Weight: 0.10},
+	},
+}
+
+// ZoomProfile imitates a video call: medium packets at a steady pace.
+var ZoomProfile = TrafficProfile{
+	Name: "zoom",
+	PacketSizes: []PacketSizeDist{
+		{Size: 500, Weight: 0.3},
+		{Size: 600, Weight: 0.4},
+		{Size: 700, Weight: 0.3},
+	},
+	Delays: []DelayDist{
+		{Delay: 30 * time.Millisecond, Weight: 0.4},
+		{Delay: 40 * time.Millisecond, Weight: 0.4},
+		{Delay: 50 * time.Millisecond, Weight: 0.2},
+	},
+}
+
+// HTTP2APIProfile imitates a chatty HTTP/2 API client.
+var HTTP2APIProfile = TrafficProfile{
+	Name: "http2-api",
+	PacketSizes: []PacketSizeDist{
+		{Size: 200, Weight: 0.2},
+		{Size: 500, Weight: 0.3},
+		{Size: 1000, Weight: 0.3},
+		{Size: 1500, Weight: 0.2},
+	},
+	Delays: []DelayDist{
+		{Delay: 5 * time.Millisecond, Weight: 0.3},
+		{Delay: 10 * time.Millisecond, Weight: 0.4},
+		{Delay: 15 * time.Millisecond, Weight: 0.3},
+	},
+}
+
+// profiles holds the built-in and registered profiles by name, guarded by
+// profilesMu. It changes only through RegisterProfile and
+// UnregisterProfile and is read through GetProfileByName, which hands out
+// copies, and SupportedProfiles.
+var profiles = map[string]*TrafficProfile{
+	"youtube":   &YouTubeProfile,
+	"zoom":      &ZoomProfile,
+	"http2-api": &HTTP2APIProfile,
+}
+
+var profilesMu sync.RWMutex
+
+// ProfileKey returns the key a profile name is registered under: lower case,
+// without a "mimic-" prefix.
+func ProfileKey(name string) string {
+	return strings.TrimPrefix(strings.ToLower(name), "mimic-")
+}
+
+// GetProfileByName returns a copy of the named profile, or nil if there is
+// none. A "mimic-" prefix is accepted, so "mimic-http2-api" selects
+// "http2-api". Every call returns a new copy, so the overrides control
+// frames set on one session's profile never reach another session, and
+// neither do its random draws.
+func GetProfileByName(name string) *TrafficProfile {
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+	return profiles[ProfileKey(name)].Clone()
+}
+
+// Clone returns a copy of p with its own distributions, no pending
+// overrides and its own random source seeded from crypto/rand, or nil if p
+// is nil. The compression dictionary, never modified, is shared.
+func (p *TrafficProfile) Clone() *TrafficProfile {
+	if p == nil {
+		return nil
+	}
+	var seed [8]byte
+	rand.Read(seed[:])
+	return &TrafficProfile{
+		Name:                  p.Name,
+		PacketSizes:           slices.Clone(p.PacketSizes),
+		Delays:                slices.Clone(p.Delays),
+		CompressionDictionary: p.CompressionDictionary,
+		rng:                   mrand.New(mrand.NewSource(int64(binary.BigEndian.Uint64(seed[:])))),
+	}
+}
+
+// float64 draws from p's random source. The caller holds p.mu.
+func (p *TrafficProfile) float64() float64 {
+	if p.rng == nil {
+		return mrand.Float64()
+	}
+	return p.rng.Float64()
+}
+
+// RegisterProfile makes a custom profile available to users by name.
+func RegisterProfile(name string, profile *TrafficProfile) error {
+	key := ProfileKey(name)
+	if key == "" || profile == nil {
+		return errors.New("invalid traffic profile: ", name)
+	}
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	if _, found := profiles[key]; found {
+		return errors.New("traffic profile already registered: ", key)
+	}
+	profiles[key] = profile
+	return nil
+}
+
+// UnregisterProfile removes a profile added with RegisterProfile.
+func UnregisterProfile(name string) {
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	delete(profiles, ProfileKey(name))
+}
+
+// SupportedProfiles returns the names of all profiles, built-in and
+// registered, in sorted order.
+func SupportedProfiles() []string {
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetPacketSize picks the next target packet size, honouring a pending
+// PADDING_CTRL override.
+func (p *TrafficProfile) GetPacketSize() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.nextPacketSize > 0 {
+		size := p.nextPacketSize
+		p.nextPacketSize = 0
+		return size
+	}
+	return p.samplePacketSize()
+}
+
+// samplePacketSize draws a packet size from the distribution, ignoring any
+// override. The caller holds p.mu.
+func (p *TrafficProfile) samplePacketSize() int {
+	if len(p.PacketSizes) == 0 {
+		return 0
+	}
+
+	r := p.float64()
+	cumsum := 0.0
+	for _, dist := range p.PacketSizes {
+		cumsum += dist.Weight
+		if r <= cumsum {
+			return dist.Size
+		}
+	}
+	return p.PacketSizes[len(p.PacketSizes)-1].Size
+}
+
+// GetDelay picks the next inter-packet delay, honouring a pending
+// TIMING_CTRL override.
+func (p *TrafficProfile) GetDelay() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.nextDelay > 0 {
+		delay := p.nextDelay
+		p.nextDelay = 0
+		return delay
+	}
+	if len(p.Delays) == 0 {
+		return 0
+	}
+
+	r := p.float64()
+	cumsum := 0.0
+	for _, dist := range p.Delays {
+		cumsum += dist.Weight
+		if r <= cumsum {
+			return dist.Delay
+		}
+	}
+	return p.Delays[len(p.Delays)-1].Delay
+}
+
+// SetNextPacketSize overrides the size of the next packet.
+func (p *TrafficProfile) SetNextPacketSize(size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextPacketSize = size
+}
+
+// SetNextDelay overrides the delay after the next packet.
+func (p *TrafficProfile) SetNextDelay(delay time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextDelay = delay
+}
+
+// AddPadding returns data padded with random bytes up to targetSize, or
+// truncated to it if data is longer.
+func (s *Session) AddPadding(data []byte, targetSize int) []byte {
+	if len(data) >= targetSize {
+		return data[:targetSize]
+	}
+	padded := make([]byte, targetSize)
+	copy(padded, data)
+	rand.Read(padded[len(data):])
+	return padded
+}
+
+// SetProfile enables morphing of written frames with the given profile. A nil
+// profile disables morphing.
+func (s *Session) SetProfile(profile *TrafficProfile) {
+	s.profile = profile
+	s.morphingEnabled = profile != nil
+}
+
+// Bounds of the factor adaptive delays scale a profile's delays by.
+const (
+	minDelayScale = 0.25
+	maxDelayScale = 4
+)
+
+// SetAdaptiveDelays makes morphing delays follow the measured RTT. A profile
+// captured on a link with round-trip time baseRTT has its delays scaled by
+// RTT()/baseRTT, bounded to [minDelayScale, maxDelayScale], so the mimicked
+// cadence stays plausible on faster and slower links. Zero turns scaling
+// off, as does the absence of an RTT measurement.
+func (s *Session) SetAdaptiveDelays(baseRTT time.Duration) {
+	s.delayBaseRTT = baseRTT
+}
+
+// morphingDelay returns the next delay of profile, scaled when adaptive
+// delays are on.
+func (s *Session) morphingDelay(profile *TrafficProfile) time.Duration {
+	delay := profile.GetDelay()
+	if s.delayBaseRTT <= 0 || delay <= 0 {
+		return delay
+	}
+	rtt := s.RTT()
+	if rtt <= 0 {
+		return delay
+	}
+	scale := float64(rtt) / float64(s.delayBaseRTT)
+	scale = max(minDelayScale, min(scale, maxDelayScale))
+	return time.Duration(float64(delay) * scale)
+}
+
+// Profile returns the session's traffic profile, or nil.
+func (s *Session) Profile() *TrafficProfile {
+	return s.profile
+}
+
+// WriteFrameWithMorphing writes data as one or more frames whose sizes and
+// spacing follow profile. Data larger than the target size is split; smaller
+// data is padded. Padding and delays are scaled by MorphingIntensity. A
+// delay spaces a frame from the next morphed one. A frame that comes
+// before its time is queued and written in the background once its time
+// comes, so the write returns without waiting, see pacer. An error writing
+// a queued frame is returned by a later morphed write or by FlushMorphed.
+// Other writes are never held up by the queue, so a frame that must
+// follow the data, such as CLOSE_WRITE, is written after FlushMorphed.
+func (s *Session) WriteFrameWithMorphing(writer io.Writer, frameType uint8, data []byte, profile *TrafficProfile) error {
+	for {
+		targetSize := s.morphingTarget(profile.GetPacketSize())
+
+		chunk := data
+		if len(chunk) > targetSize {
+			chunk = data[:targetSize]
+		}
+		intensity := s.MorphingIntensity()
+		padding := int(float64(targetSize-len(chunk)) * intensity)
+		delay := time.Duration(float64(s.morphingDelay(profile)) * intensity)
+		if err := s.pacer.write(s, pacedFrame{writer, frameType, chunk, padding, delay}); err != nil {
+			return err
+		}
+		data = data[len(chunk):]
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+// WriteFrameWithPadding is WriteFrameWithMorphing for data that must stay
+// in one frame, such as a datagram: data is padded to a size drawn from
+// profile but never split, and goes out unpadded if it is already larger.
+func (s *Session) WriteFrameWithPadding(writer io.Writer, frameType uint8, data []byte, profile *TrafficProfile) error {
+	targetSize := s.morphingTarget(profile.GetPacketSize())
+	intensity := s.MorphingIntensity()
+	padding := int(float64(max(targetSize-len(data), 0)) * intensity)
+	delay := time.Duration(float64(s.morphingDelay(profile)) * intensity)
+	return s.pacer.write(s, pacedFrame{writer, frameType, data, padding, delay})
+}
+
+// FlushMorphed waits until every queued morphed frame is written, and
+// returns the error a morphed write failed with, if any.
+func (s *Session) FlushMorphed() error {
+	p := &s.pacer
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.writing && p.err == nil {
+		p.wait()
+	}
+	return p.err
+}
+
+// maxPacedBytes bounds the payload a session queues for pacing. A writer
+// that would queue more waits for room, which is what slows a sender
+// faster than its profile down to it.
+const maxPacedBytes = 64 << 10
+
+// pacer spaces morphed frames by their profile's delays. A delay is the
+// least time from one frame to the next, not a pause after a frame, so the
+// time a writer spends waiting for more data counts toward it. A frame
+// that may go out at once, with nothing queued ahead of it, is written by
+// its writer; any other is queued, and a goroutine writes the queue out,
+// each frame when its time comes, until it is empty. No session lock is
+// held while the queue waits, so writes without morphing, such as
+// heartbeats and rekeys, go out in the meantime.
+type pacer struct {
+	mu      sync.Mutex
+	changed sync.Cond // broadcast when the queue shrinks or stops
+	next    time.Time // earliest time the next frame may go out
+	queue   []pacedFrame
+	queued  int           // payload bytes in queue
+	writing bool          // a frame or the queue is being written
+	wake    chan struct{} // closed by stop to end the queue's wait
+	err     error         // the error a paced write failed with
+}
+
+// pacedFrame is a morphed frame and the delay before the one after it.
+type pacedFrame struct {
+	writer    io.Writer
+	frameType uint8
+	data      []byte
+	padding   int
+	delay     time.Duration
+}
+
+// wait waits for changed, with mu held.
+func (p *pacer) wait() {
+	if p.changed.L == nil {
+		p.changed.L = &p.mu
+	}
+	p.changed.Wait()
+}
+
+// write writes f for s at once if it may go out and nothing is queued or
+// being written, and queues a copy of it otherwise.
+func (p *pacer) write(s *Session, f pacedFrame) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.err == nil && p.queued > 0 && p.queued+len(f.data) > maxPacedBytes {
+		p.wait()
+	}
+	if p.err != nil {
+		return p.err
+	}
+	if !p.writing && !time.Now().Before(p.next) {
+		p.writing = true
+		p.mu.Unlock()
+		err := s.writeFrame(f.writer, f.frameType, f.data, f.padding)
+		p.mu.Lock()
+		p.next = time.Now().Add(f.delay)
+		if err != nil && p.err == nil {
+			p.err = err
+		}
+		p.drain(s)
+		return err
+	}
+	f.data = append([]byte(nil), f.data...)
+	p.queue = append(p.queue, f)
+	p.queued += len(f.data)
+	if !p.writing {
+		p.writing = true
+		p.drain(s)
+	}
+	return nil
+}
+
+// drain hands the queue to a new goroutine that writes it out, or stops
+// writing if it is empty, with mu held and writing set.
+func (p *pacer) drain(s *Session) {
+	if len(p.queue) == 0 || p.err != nil {
+		p.queue, p.queued = nil, 0
+		p.writing = false
+		p.changed.Broadcast()
+		return
+	}
+	p.wake = make(chan struct{})
+	go p.run(s, p.wake)
+}
+
+// run writes the queue out for s until it is empty, a write fails or stop
+// closes wake.
+func (p *pacer) run(s *Session, wake <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.queue) > 0 && p.err == nil {
+		if wait := time.Until(p.next); wait > 0 {
+			p.mu.Unlock()
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-wake:
+				timer.Stop()
+			}
+			p.mu.Lock()
+			continue
+		}
+		f := p.queue[0]
+		p.mu.Unlock()
+		err := s.writeFrame(f.writer, f.frameType, f.data, f.padding)
+		p.mu.Lock()
+		p.queue = p.queue[1:]
+		p.queued -= len(f.data)
+		p.next = time.Now().Add(f.delay)
+		if err != nil && p.err == nil {
+			p.err = err
+		}
+		p.changed.Broadcast()
+	}
+	p.wake = nil
+	p.drain(s)
+}
+
+// stop drops the queue and fails every later paced write with err.
+func (p *pacer) stop(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+	if p.wake != nil {
+		close(p.wake)
+		p.wake = nil
+	}
+	p.changed.Broadcast()
+}
+
+// morphingTarget returns the frame payload size, data and padding together,
+// that makes a packet of size bytes on the wire, within [1, maxPayload].
+func (s *Session) morphingTarget(size int) int {
+	target := size - frameHeaderSize - frameBodyHeaderSize - s.overhead()
+	return max(1, min(target, s.maxPayload()))
+}
+
+// SendIdleCover keeps up the traffic envelope of an idle session. Whenever
+// nothing has been written for interval, it writes an empty DATA frame
+// padded to a packet size drawn from the session's profile, so cover
+// frames flow every interval until real data resumes. Peers skip empty
+// DATA frames. It returns when ctx is done or a write fails, and at once
+// if the session has no profile.
+func (s *Session) SendIdleCover(ctx context.Context, writer io.Writer, interval time.Duration) error {
+	if s.profile == nil || interval <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		wait := interval - time.Since(time.Unix(0, s.lastWrite.Load()))
+		if wait <= 0 {
+			s.profile.mu.Lock()
+			size := s.profile.samplePacketSize()
+			s.profile.mu.Unlock()
+			if err := s.writeFrame(writer, FrameTypeData, nil, s.morphingTarget(size)); err != nil {
+				return err
+			}
+			continue
+		}
+		timer.Reset(wait)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// SendPaddingControl asks the peer to make its next packet targetSize bytes.
+func (s *Session) SendPaddingControl(writer io.Writer, targetSize int) error {
+	ctrlData := make([]byte, 2)
+	binary.BigEndian.PutUint16(ctrlData, uint16(targetSize))
+	return s.WriteFrame(writer, FrameTypePadding, ctrlData)
+}
+
+// SendTimingControl asks the peer to wait delay after its next packet.
+func (s *Session) SendTimingControl(writer io.Writer, delay time.Duration) error {
+	ctrlData := make([]byte, 8)
+	binary.BigEndian.PutUint64(ctrlData, uint64(delay.Milliseconds()))
+	return s.WriteFrame(writer, FrameTypeTiming, ctrlData)
+}
+
+// HandleControlFrame applies a PADDING_CTRL or TIMING_CTRL frame to profile.
+func (s *Session) HandleControlFrame(frame *Frame, profile *TrafficProfile) error {
+	if profile == nil {
+		return nil
+	}
+	switch frame.Type {
+	case FrameTypePadding:
+		if len(frame.Payload) < 2 {
+			return errors.New("invalid padding control frame")
+		}
+		profile.SetNextPacketSize(int(binary.BigEndian.Uint16(frame.Payload)))
+	case FrameTypeTiming:
+		if len(frame.Payload) < 8 {
+			return errors.New("invalid timing control frame")
+		}
+		delayMs := binary.BigEndian.Uint64(frame.Payload)
+		profile.SetNextDelay(time.Duration(delayMs) * time.Millisecond)
+	}
+	return nil
+}
+
+// CreateProfileFromCapture builds a profile from observed packet sizes and
+// inter-packet delays.
+func CreateProfileFromCapture(packetSizes []int, delays []time.Duration) *TrafficProfile {
+	return &TrafficProfile{
+		PacketSizes: calculateSizeDistribution(packetSizes),
+		Delays:      calculateDelayDistribution(delays),
+	}
+}
+
+func calculateSizeDistribution(values []int) []PacketSizeDist {
+	freq := make(map[int]int)
+	for _, v := range values {
+		freq[v]++
+	}
+	dist := make([]PacketSizeDist, 0, len(freq))
+	for size, count := range freq {
+		dist = append(dist, PacketSizeDist{
+			Size:   size,
+			Weight: float64(count) / float64(len(values)),
+		})
+	}
+	sort.Slice(dist, func(i, j int) bool {
+		return dist[i].Size < dist[j].Size
+	})
+	return dist
+}
+
+func calculateDelayDistribution(values []time.Duration) []DelayDist {
+	freq := make(map[time.Duration]int)
+	for _, v := range values {
+		freq[v]++
+	}
+	dist := make([]DelayDist, 0, len(freq))
+	for delay, count := range freq {
+		dist = append(dist, DelayDist{
+			Delay:  delay,
+			Weight: float64(count) / float64(len(values)),
+		})
+	}
+	sort.Slice(dist, func(i, j int) bool {
+		return dist[i].Delay < dist[j].Delay
+	})
+	return dist
+}
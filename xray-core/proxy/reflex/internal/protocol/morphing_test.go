@@ -0,0 +1,445 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetProfileByName(t *testing.T) {
+	if p := GetProfileByName("youtube"); p == nil || p.Name != "youtube" {
+		t.Errorf("youtube profile not found")
+	}
+	if p := GetProfileByName("mimic-http2-api"); p == nil || p.Name != "http2-api" {
+		t.Errorf("mimic- prefix not accepted")
+	}
+	if GetProfileByName("default") != nil {
+		t.Errorf("default policy should not select a profile")
+	}
+}
+
+func TestSupportedProfiles(t *testing.T) {
+	names := SupportedProfiles()
+	for _, want := range []string{"http2-api", "youtube", "zoom"} {
+		if !slices.Contains(names, want) {
+			t.Errorf("built-in profile %q not reported in %v", want, names)
+		}
+	}
+
+	custom := CreateProfileFromCapture([]int{100, 200}, []time.Duration{time.Millisecond})
+	if err := RegisterProfile("Test-Custom", custom); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { UnregisterProfile("test-custom") })
+	if !slices.Contains(SupportedProfiles(), "test-custom") {
+		t.Error("registered profile not reported")
+	}
+	if got := GetProfileByName("mimic-test-custom"); got == nil || !slices.Equal(got.PacketSizes, custom.PacketSizes) {
+		t.Error("registered profile not found by name")
+	}
+	if err := RegisterProfile("youtube", custom); err == nil {
+		t.Error("expected an error when replacing a built-in profile")
+	}
+}
+
+func TestGetPacketSizeFromDistribution(t *testing.T) {
+	p := GetProfileByName("youtube")
+	valid := make(map[int]bool)
+	for _, d := range p.PacketSizes {
+		valid[d.Size] = true
+	}
+	for i := 0; i < 1000; i++ {
+		if size := p.GetPacketSize(); !valid[size] {
+			t.Fatalf("size %d not in profile", size)
+		}
+	}
+}
+
+func TestGetDelayOverride(t *testing.T) {
+	p := GetProfileByName("zoom")
+	p.SetNextDelay(7 * time.Millisecond)
+	if d := p.GetDelay(); d != 7*time.Millisecond {
+		t.Errorf("override not applied: %v", d)
+	}
+	if d := p.GetDelay(); d < 30*time.Millisecond {
+		t.Errorf("override not reset: %v", d)
+	}
+}
+
+func TestAddPadding(t *testing.T) {
+	s, _ := newTestSessionPair(t)
+	if got := s.AddPadding([]byte("abc"), 10); len(got) != 10 || string(got[:3]) != "abc" {
+		t.Errorf("unexpected padded data %q", got)
+	}
+	if got := s.AddPadding([]byte("abcdef"), 3); string(got) != "abc" {
+		t.Errorf("unexpected truncated data %q", got)
+	}
+}
+
+func TestMorphingFrameSizes(t *testing.T) {
+	writer, reader := newTestSessionPair(t)
+	profile := &TrafficProfile{
+		Name:        "test",
+		PacketSizes: []PacketSizeDist{{Size: 300, Weight: 1}},
+	}
+	data := bytes.Repeat([]byte("x"), 1000)
+
+	var wire bytes.Buffer
+	if err := writer.WriteFrameWithMorphing(&wire, FrameTypeData, data, profile); err != nil {
+		t.Fatal(err)
+	}
+	if wire.Len()%300 != 0 {
+		t.Errorf("wire length %d is not a multiple of the packet size", wire.Len())
+	}
+
+	var got []byte
+	for wire.Len() > 0 {
+		frame, err := reader.ReadFrame(&wire)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, frame.Payload...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("morphed data did not round-trip")
+	}
+}
+
+func TestWriteFrameWithPadding(t *testing.T) {
+	writer, reader := newTestSessionPair(t)
+	profile := &TrafficProfile{
+		Name:        "test",
+		PacketSizes: []PacketSizeDist{{Size: 300, Weight: 1}},
+	}
+	for _, size := range []int{10, 1000} {
+		data := bytes.Repeat([]byte("x"), size)
+		var wire bytes.Buffer
+		if err := writer.WriteFrameWithPadding(&wire, FrameTypeUDP, data, profile); err != nil {
+			t.Fatal(err)
+		}
+		if size < 300 && wire.Len() != 300 {
+			t.Errorf("%d bytes padded to %d on the wire, want 300", size, wire.Len())
+		}
+		frame, err := reader.ReadFrame(&wire)
+		if err != nil || !bytes.Equal(frame.Payload, data) {
+			t.Fatalf("ReadFrame = %v, %v", frame, err)
+		}
+		if wire.Len() != 0 {
+			t.Errorf("%d bytes split into more than one frame", size)
+		}
+	}
+}
+
+func TestPaddingTimingControlFrames(t *testing.T) {
+	writer, reader := newTestSessionPair(t)
+	profile := GetProfileByName("youtube")
+
+	var wire bytes.Buffer
+	if err := writer.SendPaddingControl(&wire, 512); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.SendTimingControl(&wire, 42*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		frame, err := reader.ReadFrame(&wire)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := reader.HandleControlFrame(frame, profile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if size := profile.GetPacketSize(); size != 512 {
+		t.Errorf("packet size %d, want 512", size)
+	}
+	if delay := profile.GetDelay(); delay != 42*time.Millisecond {
+		t.Errorf("delay %v, want 42ms", delay)
+	}
+
+	if err := reader.HandleControlFrame(&Frame{Type: FrameTypeTiming, Payload: []byte{1}}, profile); err == nil {
+		t.Error("expected an error for a short timing control frame")
+	}
+}
+
+func TestCreateProfileFromCapture(t *testing.T) {
+	p := CreateProfileFromCapture([]int{100, 100, 200, 300}, []time.Duration{time.Millisecond, 2 * time.Millisecond})
+	if len(p.PacketSizes) != 3 || p.PacketSizes[0].Size != 100 || p.PacketSizes[0].Weight != 0.5 {
+		t.Errorf("unexpected size distribution %+v", p.PacketSizes)
+	}
+	if len(p.Delays) != 2 || p.Delays[1].Weight != 0.5 {
+		t.Errorf("unexpected delay distribution %+v", p.Delays)
+	}
+}
+
+func TestAdaptiveDelaysScaleWithRTT(t *testing.T) {
+	profile := &TrafficProfile{Delays: []DelayDist{{Delay: 10 * time.Millisecond, Weight: 1}}}
+	s, _ := newTestSessionPair(t)
+
+	if d := s.morphingDelay(profile); d != 10*time.Millisecond {
+		t.Errorf("delay without adaptive mode = %v", d)
+	}
+	s.SetAdaptiveDelays(20 * time.Millisecond)
+	if d := s.morphingDelay(profile); d != 10*time.Millisecond {
+		t.Errorf("delay before any RTT sample = %v", d)
+	}
+	s.updateRTT(80 * time.Millisecond)
+	if d := s.morphingDelay(profile); d != 40*time.Millisecond {
+		t.Errorf("delay at 4x the base RTT = %v, want 40ms", d)
+	}
+
+	slow, _ := newTestSessionPair(t)
+	slow.SetAdaptiveDelays(20 * time.Millisecond)
+	slow.updateRTT(time.Second)
+	if d := slow.morphingDelay(profile); d != 10*time.Millisecond*maxDelayScale {
+		t.Errorf("delay at 50x the base RTT = %v, want it capped", d)
+	}
+}
+
+func TestMorphingPacing(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	profile := &TrafficProfile{
+		PacketSizes: []PacketSizeDist{{Size: 300, Weight: 1}},
+		Delays:      []DelayDist{{Delay: delay, Weight: 1}},
+	}
+	s, _ := newTestSessionPair(t)
+	wire := &frameCapture{}
+
+	// Writes return without waiting their delays, however early they are.
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := s.WriteFrameWithMorphing(wire, FrameTypeData, []byte("x"), profile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= delay {
+		t.Errorf("four writes took %v, waiting their delays", elapsed)
+	}
+
+	// Other writes are not held up by the queue.
+	start = time.Now()
+	if err := s.WriteFrame(io.Discard, FrameTypePing, make([]byte, 8)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= delay {
+		t.Errorf("unmorphed write waited %v for a morphing delay", elapsed)
+	}
+
+	// The frames still go out spaced by the delay.
+	if err := s.FlushMorphed(); err != nil {
+		t.Fatal(err)
+	}
+	if len(wire.sizes) != 4 {
+		t.Fatalf("%d frames written, want 4", len(wire.sizes))
+	}
+	for i, gap := range wire.gaps {
+		if gap < delay {
+			t.Errorf("gap %d is %v, want at least %v", i, gap, delay)
+		}
+	}
+
+	// Time between writes counts toward the delay, so a writer with data
+	// every delay is not slowed to one frame every two.
+	time.Sleep(delay)
+	wire = &frameCapture{}
+	start = time.Now()
+	const writes = 6
+	for i := 0; i < writes; i++ {
+		time.Sleep(delay)
+		if err := s.WriteFrameWithMorphing(wire, FrameTypeData, []byte("x"), profile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.FlushMorphed(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > writes*delay*3/2 {
+		t.Errorf("%d writes %v apart took %v, serialized with their delays", writes, delay, elapsed)
+	}
+}
+
+func TestMorphingQueueFailsAfterClose(t *testing.T) {
+	profile := &TrafficProfile{
+		PacketSizes: []PacketSizeDist{{Size: 300, Weight: 1}},
+		Delays:      []DelayDist{{Delay: time.Hour, Weight: 1}},
+	}
+	s, _ := newTestSessionPair(t)
+	wire := &frameCapture{}
+	for i := 0; i < 2; i++ {
+		if err := s.WriteFrameWithMorphing(wire, FrameTypeData, []byte("x"), profile); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Closing the session drops the frame waiting its hour.
+	done := make(chan error, 1)
+	go func() { done <- s.FlushMorphed() }()
+	s.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("flush succeeded on a closed session")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("flush still waiting after close")
+	}
+	if len(wire.sizes) != 1 {
+		t.Errorf("%d frames written, want 1", len(wire.sizes))
+	}
+	if err := s.WriteFrameWithMorphing(wire, FrameTypeData, []byte("x"), profile); err == nil {
+		t.Error("morphed write succeeded on a closed session")
+	}
+}
+
+func TestSendIdleCover(t *testing.T) {
+	writer, reader := newTestSessionPair(t)
+	writer.SetProfile(&TrafficProfile{PacketSizes: []PacketSizeDist{{Size: 300, Weight: 1}}})
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go writer.SendIdleCover(ctx, pw, 50*time.Millisecond)
+
+	frames := make(chan *Frame, 1024)
+	go func() {
+		defer close(frames)
+		for {
+			frame, err := reader.ReadFrame(pr)
+			if err != nil {
+				return
+			}
+			frames <- frame
+		}
+	}()
+	isCover := func(f *Frame) bool { return f.Type == FrameTypeData && len(f.Payload) == 0 }
+
+	for i := 0; i < 3; i++ {
+		select {
+		case f := <-frames:
+			if !isCover(f) {
+				t.Fatalf("unexpected frame type %d with %d bytes while idle", f.Type, len(f.Payload))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no cover frame while idle")
+		}
+	}
+
+	// While data flows more often than the interval, no cover is sent.
+	go func() {
+		for i := 0; i < 100; i++ {
+			if writer.WriteFrame(pw, FrameTypeData, []byte("data")) != nil {
+				return
+			}
+			time.Sleep(2 * time.Millisecond)
+		}
+		cancel()
+		pw.Close()
+	}()
+	sawData := false
+	for f := range frames {
+		switch {
+		case !isCover(f):
+			sawData = true
+		case sawData:
+			t.Fatal("cover frame sent while data was flowing")
+		}
+	}
+	if !sawData {
+		t.Error("data frames did not arrive")
+	}
+}
+
+func TestSendIdleCoverWithoutProfile(t *testing.T) {
+	writer, _ := newTestSessionPair(t)
+	var wire bytes.Buffer
+	done := make(chan error, 1)
+	go func() { done <- writer.SendIdleCover(context.Background(), &wire, time.Millisecond) }()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("SendIdleCover kept running without a profile")
+	}
+	if wire.Len() != 0 {
+		t.Error("cover sent without a profile")
+	}
+}
+
+func TestProfileOverridesArePerSession(t *testing.T) {
+	a, b := GetProfileByName("youtube"), GetProfileByName("youtube")
+	if a == b || &a.PacketSizes[0] == &b.PacketSizes[0] {
+		t.Fatal("sessions share one profile")
+	}
+
+	// Two sessions with the same profile take control frames concurrently.
+	// Neither may see the other's overrides.
+	var wg sync.WaitGroup
+	for _, tc := range []struct {
+		p    *TrafficProfile
+		size int
+	}{{a, 111}, {b, 222}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, _ := newTestSessionPair(t)
+			s.SetProfile(tc.p)
+			for i := 0; i < 1000; i++ {
+				ctrl := binary.BigEndian.AppendUint16(nil, uint16(tc.size))
+				if err := s.HandleControlFrame(&Frame{Type: FrameTypePadding, Payload: ctrl}, s.Profile()); err != nil {
+					t.Error(err)
+					return
+				}
+				if got := s.Profile().GetPacketSize(); got != tc.size {
+					t.Errorf("override %d came back as %d", tc.size, got)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if fresh := GetProfileByName("youtube"); fresh.nextPacketSize != 0 || !slices.Equal(fresh.PacketSizes, YouTubeProfile.PacketSizes) {
+		t.Error("overrides or edits leaked into the shared profile")
+	}
+}
+
+func TestProfileRandomnessIsPerSession(t *testing.T) {
+	a, b := GetProfileByName("zoom"), GetProfileByName("zoom")
+	if a.rng == nil || a.rng == b.rng {
+		t.Fatal("sessions share one random source")
+	}
+
+	// Draw from both in lockstep and count each pair of sizes. Independent
+	// draws fill the pairs in proportion to the product of their weights.
+	index := make(map[int]int)
+	for i, dist := range ZoomProfile.PacketSizes {
+		index[dist.Size] = i
+	}
+	buckets := len(ZoomProfile.PacketSizes)
+	observed := make([]int, buckets*buckets)
+	weights := make([]float64, buckets*buckets)
+	for i, x := range ZoomProfile.PacketSizes {
+		for j, y := range ZoomProfile.PacketSizes {
+			weights[i*buckets+j] = x.Weight * y.Weight
+		}
+	}
+	same := 0
+	const n = 3000
+	for i := 0; i < n; i++ {
+		x, y := a.GetPacketSize(), b.GetPacketSize()
+		observed[index[x]*buckets+index[y]]++
+		if x == y {
+			same++
+		}
+	}
+	if same == n {
+		t.Fatal("both profiles drew the same sequence")
+	}
+	if stat, critical := chiSquared(observed, weights), chiSquaredCritical[len(observed)-1]; stat > critical {
+		t.Errorf("draws of two profiles are correlated: chi-squared %.1f > %.1f\n%v", stat, critical, observed)
+	}
+}
@@ -0,0 +1,269 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/xtls/xray-core/common/errors"
+)
+
+// Flow is one direction of a captured TCP or UDP flow: its 5-tuple.
+type Flow struct {
+	Network  string // "tcp" or "udp"
+	Src, Dst netip.AddrPort
+}
+
+// String returns the flow as ParseFlow reads it, as in
+// "tcp 192.0.2.1:443 > 198.51.100.7:50312".
+func (f Flow) String() string {
+	return f.Network + " " + f.Src.String() + " > " + f.Dst.String()
+}
+
+// ParseFlow parses a flow in the form Flow.String returns.
+func ParseFlow(s string) (Flow, error) {
+	network, rest, _ := strings.Cut(strings.TrimSpace(s), " ")
+	src, dst, ok := strings.Cut(rest, ">")
+	if !ok || (network != "tcp" && network != "udp") {
+		return Flow{}, errors.New("invalid flow: ", s)
+	}
+	var err error
+	f := Flow{Network: network}
+	if f.Src, err = netip.ParseAddrPort(strings.TrimSpace(src)); err != nil {
+		return Flow{}, errors.New("invalid flow source: ", s).Base(err)
+	}
+	if f.Dst, err = netip.ParseAddrPort(strings.TrimSpace(dst)); err != nil {
+		return Flow{}, errors.New("invalid flow destination: ", s).Base(err)
+	}
+	f.Src = netip.AddrPortFrom(f.Src.Addr().Unmap(), f.Src.Port())
+	f.Dst = netip.AddrPortFrom(f.Dst.Addr().Unmap(), f.Dst.Port())
+	return f, nil
+}
+
+// pcap link types the reader understands.
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+)
+
+// maxPCAPRecord bounds the captured length of one packet, well above any
+// snap length in use.
+const maxPCAPRecord = 256 << 10
+
+// LoadProfileFromPCAP builds a profile from the busiest flow, the one
+// direction of a TCP or UDP flow with the most packets carrying payload,
+// of the pcap file at path. See LoadProfileFromPCAPFlow.
+func LoadProfileFromPCAP(path string) (*TrafficProfile, error) {
+	return LoadProfileFromPCAPFlow(path, Flow{})
+}
+
+// LoadProfileFromPCAPFlow builds a profile from one flow of the pcap file
+// at path, or from its busiest flow if flow is the zero Flow. Packet sizes
+// are the TCP or UDP payload lengths, so pure ACKs are left out, and
+// delays the times between consecutive payload packets, to the
+// millisecond. Only classic pcap files over Ethernet, raw IP, BSD loopback
+// or Linux cooked captures are read, not pcapng.
+func LoadProfileFromPCAPFlow(path string, flow Flow) (*TrafficProfile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New("failed to open capture").Base(err)
+	}
+	defer file.Close()
+	flows, order, err := readPCAPFlows(bufio.NewReader(file))
+	if err != nil {
+		return nil, errors.New("failed to read capture ", path).Base(err)
+	}
+
+	var packets []capturedPacket
+	if flow == (Flow{}) {
+		for _, f := range order {
+			if len(flows[f]) > len(packets) {
+				packets = flows[f]
+			}
+		}
+	} else {
+		packets = flows[flow]
+	}
+	if len(packets) < 2 {
+		return nil, errors.New("capture ", path, " has too few payload packets in flow ", flow)
+	}
+
+	sizes := make([]int, len(packets))
+	delays := make([]time.Duration, len(packets)-1)
+	for i, p := range packets {
+		sizes[i] = p.size
+		if i > 0 {
+			delays[i-1] = p.at.Sub(packets[i-1].at).Round(time.Millisecond)
+		}
+	}
+	return CreateProfileFromCapture(sizes, delays), nil
+}
+
+// capturedPacket is a packet with payload of a captured flow.
+type capturedPacket struct {
+	at   time.Time
+	size int
+}
+
+// readPCAPFlows reads a pcap stream and returns the packets with payload
+// of every flow, and the flows in the order they first appear.
+func readPCAPFlows(reader io.Reader) (map[Flow][]capturedPacket, []Flow, error) {
+	var header [24]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, nil, errors.New("failed to read pcap header").Base(err)
+	}
+	var order binary.ByteOrder
+	var nanos bool
+	switch magic := binary.LittleEndian.Uint32(header[0:4]); magic {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order, nanos = binary.LittleEndian, magic == 0xa1b23c4d
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order, nanos = binary.BigEndian, magic == 0x4d3cb2a1
+	default:
+		return nil, nil, errors.New("not a pcap file")
+	}
+	linkType := order.Uint32(header[20:24]) & 0x0fffffff
+
+	flows := make(map[Flow][]capturedPacket)
+	var seen []Flow
+	var record [16]byte
+	for {
+		if _, err := io.ReadFull(reader, record[:]); err != nil {
+			if err == io.EOF {
+				return flows, seen, nil
+			}
+			return nil, nil, errors.New("failed to read pcap record").Base(err)
+		}
+		capLen := order.Uint32(record[8:12])
+		if capLen > maxPCAPRecord {
+			return nil, nil, errors.New("pcap record of ", capLen, " bytes")
+		}
+		data := make([]byte, capLen)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, nil, errors.New("failed to read pcap record").Base(err)
+		}
+		frac := time.Duration(order.Uint32(record[4:8]))
+		if !nanos {
+			frac *= time.Microsecond
+		}
+		at := time.Unix(int64(order.Uint32(record[0:4])), int64(frac))
+
+		flow, size, ok := parseCapturedPacket(linkType, data)
+		if !ok || size == 0 {
+			continue
+		}
+		if _, known := flows[flow]; !known {
+			seen = append(seen, flow)
+		}
+		flows[flow] = append(flows[flow], capturedPacket{at: at, size: size})
+	}
+}
+
+// parseCapturedPacket returns the flow and payload length of a captured
+// TCP or UDP packet. Lengths come from the IP and transport headers, so a
+// snap length that cut the payload short does not shrink it.
+func parseCapturedPacket(linkType uint32, data []byte) (Flow, int, bool) {
+	var etherType uint16
+	switch linkType {
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return Flow{}, 0, false
+		}
+		etherType, data = binary.BigEndian.Uint16(data[12:14]), data[14:]
+		for etherType == 0x8100 || etherType == 0x88a8 {
+			if len(data) < 4 {
+				return Flow{}, 0, false
+			}
+			etherType, data = binary.BigEndian.Uint16(data[2:4]), data[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return Flow{}, 0, false
+		}
+		etherType, data = binary.BigEndian.Uint16(data[14:16]), data[16:]
+	case linkTypeNull:
+		if len(data) < 4 {
+			return Flow{}, 0, false
+		}
+		// The address family is in the capturing host's byte order.
+		// AF_INET is 2 everywhere; AF_INET6 differs between systems, so
+		// anything else is taken for IPv6 and checked below.
+		family := binary.LittleEndian.Uint32(data[:4])
+		etherType, data = 0x86dd, data[4:]
+		if family == 2 || family == 2<<24 {
+			etherType = 0x0800
+		}
+	case linkTypeRaw:
+		if len(data) < 1 {
+			return Flow{}, 0, false
+		}
+		etherType = 0x86dd
+		if data[0]>>4 == 4 {
+			etherType = 0x0800
+		}
+	default:
+		return Flow{}, 0, false
+	}
+
+	var src, dst netip.Addr
+	var proto uint8
+	var segment []byte
+	var segmentLen int
+	switch etherType {
+	case 0x0800:
+		if len(data) < 20 || data[0]>>4 != 4 {
+			return Flow{}, 0, false
+		}
+		headerLen, totalLen := int(data[0]&0x0f)*4, int(binary.BigEndian.Uint16(data[2:4]))
+		if headerLen < 20 || len(data) < headerLen || totalLen < headerLen {
+			return Flow{}, 0, false
+		}
+		if binary.BigEndian.Uint16(data[6:8])&0x1fff != 0 {
+			// A later fragment has no transport header.
+			return Flow{}, 0, false
+		}
+		proto = data[9]
+		src, dst = netip.AddrFrom4([4]byte(data[12:16])), netip.AddrFrom4([4]byte(data[16:20]))
+		segment, segmentLen = data[headerLen:], totalLen-headerLen
+	case 0x86dd:
+		if len(data) < 40 || data[0]>>4 != 6 {
+			return Flow{}, 0, false
+		}
+		proto = data[6]
+		src, dst = netip.AddrFrom16([16]byte(data[8:24])), netip.AddrFrom16([16]byte(data[24:40]))
+		segment, segmentLen = data[40:], int(binary.BigEndian.Uint16(data[4:6]))
+	default:
+		return Flow{}, 0, false
+	}
+
+	var flow Flow
+	var payload int
+	switch proto {
+	case 6:
+		if len(segment) < 20 {
+			return Flow{}, 0, false
+		}
+		flow.Network = "tcp"
+		payload = segmentLen - int(segment[12]>>4)*4
+	case 17:
+		if len(segment) < 8 {
+			return Flow{}, 0, false
+		}
+		flow.Network = "udp"
+		payload = int(binary.BigEndian.Uint16(segment[4:6])) - 8
+	default:
+		return Flow{}, 0, false
+	}
+	if payload < 0 {
+		return Flow{}, 0, false
+	}
+	flow.Src = netip.AddrPortFrom(src.Unmap(), binary.BigEndian.Uint16(segment[0:2]))
+	flow.Dst = netip.AddrPortFrom(dst.Unmap(), binary.BigEndian.Uint16(segment[2:4]))
+	return flow, payload, true
+}
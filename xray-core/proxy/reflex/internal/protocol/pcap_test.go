@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testdata/flow.pcap holds an Ethernet capture, cut at a snap length of 96
+// bytes, of a TCP flow between 192.0.2.1:443 and 198.51.100.7:50312 and one
+// stray DNS answer. The server sends 1400, 1400, 600, 1400 and 200 bytes,
+// 10, 10, 30 and 10ms apart; the client 300 and 120 bytes, 26ms apart.
+
+func TestLoadProfileFromPCAP(t *testing.T) {
+	p, err := LoadProfileFromPCAP("testdata/flow.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSizes := []PacketSizeDist{{200, 0.2}, {600, 0.2}, {1400, 0.6}}
+	if len(p.PacketSizes) != len(wantSizes) {
+		t.Fatalf("sizes = %+v, want %+v", p.PacketSizes, wantSizes)
+	}
+	for i, want := range wantSizes {
+		if got := p.PacketSizes[i]; got.Size != want.Size || got.Weight != want.Weight {
+			t.Errorf("sizes = %+v, want %+v", p.PacketSizes, wantSizes)
+			break
+		}
+	}
+	wantDelays := []DelayDist{{10 * time.Millisecond, 0.75}, {30 * time.Millisecond, 0.25}}
+	if len(p.Delays) != len(wantDelays) {
+		t.Fatalf("delays = %+v, want %+v", p.Delays, wantDelays)
+	}
+	for i, want := range wantDelays {
+		if got := p.Delays[i]; got.Delay != want.Delay || got.Weight != want.Weight {
+			t.Errorf("delays = %+v, want %+v", p.Delays, wantDelays)
+			break
+		}
+	}
+	if size := p.GetPacketSize(); size != 200 && size != 600 && size != 1400 {
+		t.Errorf("GetPacketSize() = %d", size)
+	}
+}
+
+func TestLoadProfileFromPCAPFlow(t *testing.T) {
+	flow, err := ParseFlow("tcp 198.51.100.7:50312 > 192.0.2.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := flow.String(); s != "tcp 198.51.100.7:50312 > 192.0.2.1:443" {
+		t.Errorf("String() = %q", s)
+	}
+	p, err := LoadProfileFromPCAPFlow("testdata/flow.pcap", flow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.PacketSizes) != 2 || p.PacketSizes[0].Size != 120 || p.PacketSizes[1].Size != 300 {
+		t.Errorf("sizes = %+v, want 120 and 300", p.PacketSizes)
+	}
+	if len(p.Delays) != 1 || p.Delays[0].Delay != 26*time.Millisecond {
+		t.Errorf("delays = %+v, want 26ms", p.Delays)
+	}
+
+	// The stray UDP answer is a single packet, too few for a profile.
+	flow, _ = ParseFlow("udp 203.0.113.9:53 > 198.51.100.7:40000")
+	if _, err := LoadProfileFromPCAPFlow("testdata/flow.pcap", flow); err == nil {
+		t.Error("expected an error for a one-packet flow")
+	}
+}
+
+func TestLoadProfileFromPCAPInvalid(t *testing.T) {
+	if _, err := LoadProfileFromPCAP("testdata/missing.pcap"); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+	path := filepath.Join(t.TempDir(), "capture.pcapng")
+	if err := os.WriteFile(path, []byte("\x0a\x0d\x0d\x0a\x1c\x00\x00\x00\x4d\x3c\x2b\x1a"+string(make([]byte, 16))), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadProfileFromPCAP(path); err == nil {
+		t.Error("expected an error for a pcapng file")
+	}
+	for _, s := range []string{"", "tcp 192.0.2.1:443", "sctp 192.0.2.1:1 > 192.0.2.2:2", "tcp 192.0.2.1 > 192.0.2.2:2"} {
+		if _, err := ParseFlow(s); err == nil {
+			t.Errorf("ParseFlow(%q) accepted", s)
+		}
+	}
+}
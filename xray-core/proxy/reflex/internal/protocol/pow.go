@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+	"time"
+)
+
+const (
+	// powChallengeStep is how long one proof-of-work challenge stays
+	// current. The previous challenge is still accepted, so a client always
+	// has at least one full step to solve it.
+	powChallengeStep = time.Minute
+
+	powChallengeSize = 16
+	powSolutionSize  = powChallengeSize + 8
+
+	// MaxPoWDifficulty is the highest difficulty inbounds and outbounds
+	// accept. It keeps a misconfigured difficulty from locking every client
+	// out; 24 bits already take millions of hashes.
+	MaxPoWDifficulty = 32
+)
+
+// powChallengeForStep derives the challenge for a time step from the
+// secret the server shares with its clients, the MagicSecret, so clients
+// compute the challenge themselves and the server keeps no per-client state.
+// Without a MagicSecret the key is empty and the challenge only changes with
+// the time step.
+func powChallengeForStep(secret []byte, step int64) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("reflex pow challenge"))
+	binary.Write(mac, binary.BigEndian, step)
+	return mac.Sum(nil)[:powChallengeSize]
+}
+
+func powStep(t time.Time) int64 {
+	return t.Unix() / int64(powChallengeStep/time.Second)
+}
+
+// powWork returns the number of leading zero bits of the hash that binds a
+// solution to the challenge and to the client hello it is sent in.
+func powWork(challenge []byte, publicKey [32]byte, nonce [16]byte, counter uint64) int {
+	h := sha256.New()
+	h.Write(challenge)
+	h.Write(publicKey[:])
+	h.Write(nonce[:])
+	binary.Write(h, binary.BigEndian, counter)
+	sum := h.Sum(nil)
+	work := 0
+	for _, b := range sum {
+		work += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return work
+}
+
+// ProofOfWorkChallenge returns the challenge current at t for servers with
+// the given MagicSecret, nil for none.
+func ProofOfWorkChallenge(secret []byte, t time.Time) []byte {
+	return powChallengeForStep(secret, powStep(t))
+}
+
+// SolveProofOfWork finds a solution to challenge at the given difficulty for
+// a client hello with publicKey and nonce, and returns it as the value of an
+// ExtProofOfWork extension.
+func SolveProofOfWork(challenge []byte, difficulty uint32, publicKey [32]byte, nonce [16]byte) []byte {
+	var counter uint64
+	for powWork(challenge, publicKey, nonce, counter) < int(difficulty) {
+		counter++
+	}
+	return binary.BigEndian.AppendUint64(append([]byte(nil), challenge...), counter)
+}
+
+// VerifyProofOfWork reports whether solution answers a current challenge
+// at the given difficulty for the client hello with publicKey and nonce.
+// It costs a few hashes, well below the key exchange it protects.
+func VerifyProofOfWork(secret, solution []byte, difficulty uint32, publicKey [32]byte, nonce [16]byte, now time.Time) bool {
+	if len(solution) != powSolutionSize {
+		return false
+	}
+	challenge, counter := solution[:powChallengeSize], binary.BigEndian.Uint64(solution[powChallengeSize:])
+	step := powStep(now)
+	if !hmac.Equal(challenge, powChallengeForStep(secret, step)) && !hmac.Equal(challenge, powChallengeForStep(secret, step-1)) {
+		return false
+	}
+	return powWork(challenge, publicKey, nonce, counter) >= int(difficulty)
+}
@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestVerifyProofOfWork(t *testing.T) {
+	secret := []byte("server secret")
+	now := time.Now()
+	var publicKey [32]byte
+	var nonce [16]byte
+	rand.Read(publicKey[:])
+	rand.Read(nonce[:])
+	solution := SolveProofOfWork(powChallengeForStep(secret, powStep(now)), 8, publicKey, nonce)
+
+	if !VerifyProofOfWork(secret, solution, 8, publicKey, nonce, now) {
+		t.Error("valid solution rejected")
+	}
+	if !VerifyProofOfWork(secret, solution, 8, publicKey, nonce, now.Add(powChallengeStep)) {
+		t.Error("solution to the previous challenge rejected")
+	}
+	if VerifyProofOfWork(secret, solution, 8, publicKey, nonce, now.Add(2*powChallengeStep)) {
+		t.Error("solution to an expired challenge accepted")
+	}
+	// A solution is bound to its hello. Pick another hello it does not
+	// happen to solve by chance.
+	otherNonce := nonce
+	for powWork(solution[:powChallengeSize], publicKey, otherNonce, binary.BigEndian.Uint64(solution[powChallengeSize:])) >= 8 {
+		rand.Read(otherNonce[:])
+	}
+	if VerifyProofOfWork(secret, solution, 8, publicKey, otherNonce, now) {
+		t.Error("solution accepted for another hello")
+	}
+	if VerifyProofOfWork(secret, solution[:powChallengeSize], 8, publicKey, nonce, now) {
+		t.Error("truncated solution accepted")
+	}
+}
@@ -0,0 +1,175 @@
+package protocol
+
+import (
+	"crypto/cipher"
+	"io"
+	"sync"
+
+	"github.com/xtls/xray-core/common/errors"
+)
+
+// A rekey replaces the session key with one derived from a fresh X25519
+// exchange, so a key that leaks exposes only the frames written under it.
+// Like the first, the new session key is expanded into a key per
+// direction.
+// The side that starts it sends a REKEY frame with an ephemeral public key;
+// the peer answers with its own. Once a side has both keys it derives the
+// new key and writes an empty REKEY, the last frame it seals under the old
+// key. Each direction thus switches at a frame boundary both ends see: the
+// writer after writing its empty REKEY, the reader after reading it. If
+// both sides start at once, each takes the other's key as the answer, and
+// the exchange completes the same way. Nothing follows a CLOSE or
+// CLOSE_WRITE, so a side that has written one neither starts nor answers a
+// rekey, though it still switches reads if the peer answers one it started
+// before.
+type rekeyState struct {
+	mu           sync.Mutex
+	key          []byte      // current session key, the salt of the next one
+	private      *[32]byte   // our ephemeral key while waiting for the peer's
+	nextReadKey  cipher.AEAD // set from deriving the new key until the peer's empty REKEY
+	nextWriteKey cipher.AEAD // set from deriving the new key until our empty REKEY
+	threshold    uint64      // frames written under one key before a rekey starts, under writeMu
+	due          uint64      // writeNonce at which the next rekey starts, under writeMu
+	writeClosed  bool        // a CLOSE or CLOSE_WRITE has been written, under writeMu
+}
+
+// SetRekeyThreshold makes the session start a rekey once it has written
+// frames frames under the current key. Zero, the default, never starts one;
+// a session answers a rekey its peer starts either way, as long as its
+// reader passes REKEY frames to HandleRekey. Rekeying needs the frames of
+// both directions to arrive in order and is not for datagram transports.
+func (s *Session) SetRekeyThreshold(frames uint64) {
+	s.writeMu.Lock()
+	defer s.unlockWrite()
+	s.rekey.threshold = frames
+	s.rekey.due = s.writeNonce + frames
+}
+
+// startRekeyIfDue sends a REKEY with a new ephemeral key once the threshold
+// is reached and no rekey is under way. It is called with writeMu held.
+func (s *Session) startRekeyIfDue(writer io.Writer) error {
+	if s.rekey.threshold == 0 || s.writeNonce < s.rekey.due || s.rekey.writeClosed {
+		return nil
+	}
+	s.rekey.mu.Lock()
+	if s.rekey.private != nil || s.rekey.nextReadKey != nil || s.rekey.nextWriteKey != nil {
+		s.rekey.mu.Unlock()
+		return nil
+	}
+	privateKey, publicKey, err := GenerateKeyPair()
+	if err != nil {
+		s.rekey.mu.Unlock()
+		return err
+	}
+	s.rekey.private = &privateKey
+	s.rekey.mu.Unlock()
+	return s.writeFrameLocked(writer, FrameTypeRekey, publicKey[:], 0)
+}
+
+// HandleRekey answers a REKEY frame carrying the peer's public key: with
+// its own public key if the peer started the rekey, then with the empty
+// REKEY after which it writes under the new key. An empty REKEY has already
+// switched the read key when ReadFrame returned it, and needs no answer.
+func (s *Session) HandleRekey(writer io.Writer, frame *Frame) error {
+	switch len(frame.Payload) {
+	case 0:
+		return nil
+	case 32:
+	default:
+		return errors.New("invalid rekey frame")
+	}
+
+	s.writeMu.Lock()
+	defer s.unlockWrite()
+	s.rekey.mu.Lock()
+	privateKey := s.rekey.private
+	s.rekey.private = nil
+	busy := s.rekey.nextReadKey != nil || s.rekey.nextWriteKey != nil
+	s.rekey.mu.Unlock()
+	if busy {
+		return errors.New("rekey started during a rekey")
+	}
+
+	if s.rekey.writeClosed {
+		if privateKey == nil {
+			// Without our answer the peer keeps its key.
+			return nil
+		}
+		// The peer answered our rekey and switches after its empty REKEY,
+		// so reads still move to the new key.
+		return s.deriveNextKey(*privateKey, frame.Payload, false)
+	}
+	var publicKey []byte
+	if privateKey == nil {
+		private, public, err := GenerateKeyPair()
+		if err != nil {
+			return err
+		}
+		privateKey, publicKey = &private, public[:]
+	}
+	if err := s.deriveNextKey(*privateKey, frame.Payload, true); err != nil {
+		return err
+	}
+	if publicKey != nil {
+		if err := s.writeFrameLocked(writer, FrameTypeRekey, publicKey, 0); err != nil {
+			return err
+		}
+	}
+	return s.writeFrameLocked(writer, FrameTypeRekey, nil, 0)
+}
+
+// deriveNextKey derives the new session key from our ephemeral key and the
+// peer's public key, and from it the new key of each direction: the peer's
+// for reads and, unless we no longer write, ours for writes. As under the
+// first key, the two directions never seal under the same key.
+func (s *Session) deriveNextKey(privateKey [32]byte, peerPublicKey []byte, write bool) error {
+	shared, err := DeriveSharedKey(privateKey, [32]byte(peerPublicKey))
+	if err != nil {
+		return errors.New("invalid rekey public key").Base(err)
+	}
+	s.rekey.mu.Lock()
+	defer s.rekey.mu.Unlock()
+	key := DeriveSessionKey(shared, s.rekey.key)
+	readAEAD, writeAEAD, err := newDirectionAEADs(s.suite, key, s.role)
+	if err != nil {
+		return err
+	}
+	clear(s.rekey.key)
+	s.rekey.key = key
+	s.rekey.nextReadKey = readAEAD
+	if write {
+		s.rekey.nextWriteKey = writeAEAD
+	}
+	return nil
+}
+
+// nextWriteKey returns the key the next empty REKEY switches writes to, or
+// nil if there is none. It is called with writeMu held.
+func (s *Session) nextWriteKey() cipher.AEAD {
+	s.rekey.mu.Lock()
+	defer s.rekey.mu.Unlock()
+	return s.rekey.nextWriteKey
+}
+
+// switchWriteKey switches writes to aead once the empty REKEY has been
+// sealed. It is called with writeMu held.
+func (s *Session) switchWriteKey(aead cipher.AEAD) {
+	s.rekey.mu.Lock()
+	s.rekey.nextWriteKey = nil
+	s.rekey.mu.Unlock()
+	s.writeAEAD = aead
+	s.rekey.due = s.writeNonce + s.rekey.threshold
+}
+
+// switchReadKey switches reads to the new key once the peer's empty REKEY
+// has been read. It is called with readMu held.
+func (s *Session) switchReadKey() error {
+	s.rekey.mu.Lock()
+	defer s.rekey.mu.Unlock()
+	if s.rekey.nextReadKey == nil {
+		return errors.New("rekey finished before it started")
+	}
+	s.readAEAD = s.rekey.nextReadKey
+	s.rekey.nextReadKey = nil
+	return nil
+}
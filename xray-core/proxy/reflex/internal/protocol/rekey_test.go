@@ -0,0 +1,179 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/xtls/xray-core/proxy/reflex/internal/conntest"
+)
+
+// exchangeData has a and b each write count DATA frames over their ends of
+// a connection while reading the other's, answering REKEY frames as they
+// come, and returns what each received. Each writes a CLOSE once it has
+// received all the other's frames.
+func exchangeData(t *testing.T, a, b *Session, count int) (gotByA, gotByB []string) {
+	t.Helper()
+	connA, connB := conntest.Pipe()
+	defer connA.Close()
+	defer connB.Close()
+	type result struct {
+		data []string
+		err  error
+	}
+	run := func(s *Session, conn net.Conn, name string, done chan<- result) {
+		received := make(chan struct{})
+		go func() {
+			for i := 0; i < count; i++ {
+				if err := s.WriteFrame(conn, FrameTypeData, []byte(fmt.Sprint(name, i))); err != nil {
+					return
+				}
+			}
+			<-received
+			s.WriteFrame(conn, FrameTypeClose, nil)
+		}()
+		go func() {
+			var r result
+			defer func() { done <- r }()
+			for {
+				frame, err := s.ReadFrame(conn)
+				if err != nil {
+					r.err = err
+					return
+				}
+				switch frame.Type {
+				case FrameTypeData:
+					if r.data = append(r.data, string(frame.Payload)); len(r.data) == count {
+						close(received)
+					}
+				case FrameTypeRekey:
+					if r.err = s.HandleRekey(conn, frame); r.err != nil {
+						return
+					}
+				case FrameTypeClose:
+					return
+				}
+			}
+		}()
+	}
+	doneA, doneB := make(chan result, 1), make(chan result, 1)
+	run(a, connA, "a", doneA)
+	run(b, connB, "b", doneB)
+	resultA, resultB := <-doneA, <-doneB
+	if resultA.err != nil || resultB.err != nil {
+		t.Fatalf("read errors: %v, %v", resultA.err, resultB.err)
+	}
+	return resultA.data, resultB.data
+}
+
+func TestRekeyDataKeepsFlowing(t *testing.T) {
+	for name, thresholds := range map[string][2]uint64{
+		"one side":   {3, 0},
+		"both sides": {2, 3},
+	} {
+		for suite, newPair := range map[uint8]func(*testing.T) (*Session, *Session){
+			CipherSuiteChaCha20Poly1305:  newTestSessionPair,
+			CipherSuiteXChaCha20Poly1305: newTestXChaChaSessionPair,
+		} {
+			a, b := newPair(t)
+			original := bytes.Clone(b.rekey.key)
+			a.SetRekeyThreshold(thresholds[0])
+			b.SetRekeyThreshold(thresholds[1])
+
+			const count = 100
+			gotByA, gotByB := exchangeData(t, a, b, count)
+			if len(gotByA) != count || len(gotByB) != count {
+				t.Fatalf("%s, suite %d: received %d and %d frames, want %d", name, suite, len(gotByA), len(gotByB), count)
+			}
+			for i := 0; i < count; i++ {
+				if gotByA[i] != fmt.Sprint("b", i) || gotByB[i] != fmt.Sprint("a", i) {
+					t.Fatalf("%s, suite %d: frame %d is %q and %q", name, suite, i, gotByA[i], gotByB[i])
+				}
+			}
+			// b reads a's first REKEY before it has all of a's frames, so
+			// it answers it before closing.
+			b.rekey.mu.Lock()
+			if bytes.Equal(b.rekey.key, original) {
+				t.Errorf("%s, suite %d: session key never changed", name, suite)
+			}
+			b.rekey.mu.Unlock()
+
+			// The new keys differ per direction, as the first ones do.
+			nonce := make([]byte, a.writeAEAD.NonceSize())
+			up := a.writeAEAD.Seal(nil, nonce, []byte("same"), nil)
+			if bytes.Equal(up, b.writeAEAD.Seal(nil, nonce, []byte("same"), nil)) {
+				t.Errorf("%s, suite %d: both directions rekeyed to the same key", name, suite)
+			}
+			if _, err := b.readAEAD.Open(nil, nonce, up, nil); err != nil {
+				t.Errorf("%s, suite %d: directions out of step after rekey: %v", name, suite, err)
+			}
+		}
+	}
+}
+
+func TestRekeyOldKeyCannotRead(t *testing.T) {
+	key := make([]byte, 32)
+	a, _ := NewSession(bytes.Clone(key), RoleClient)
+	b, _ := NewSession(bytes.Clone(key), RoleServer)
+	eavesdropper, _ := NewSession(bytes.Clone(key), RoleServer)
+	a.SetRekeyThreshold(1)
+
+	var up, down bytes.Buffer
+	if err := a.WriteFrame(&up, FrameTypeData, []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []uint8{FrameTypeData, FrameTypeRekey} {
+		header := bytes.Clone(up.Bytes()[:frameHeaderSize])
+		maskHeader(b.readHeaderKey, b.readNonce, header)
+		raw := bytes.Clone(up.Bytes()[:frameHeaderSize+int(binary.BigEndian.Uint16(header))])
+		frame, err := b.ReadFrame(&up)
+		if err != nil || frame.Type != want {
+			t.Fatalf("ReadFrame = %v, %v; want type %d", frame, err, want)
+		}
+		if _, err := eavesdropper.ReadFrame(bytes.NewReader(raw)); err != nil {
+			t.Fatalf("frame under the old key: %v", err)
+		}
+		if want == FrameTypeRekey {
+			if err := b.HandleRekey(&down, frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < 2; i++ {
+		frame, err := a.ReadFrame(&down)
+		if err != nil || frame.Type != FrameTypeRekey {
+			t.Fatalf("answer %d: %v, %v", i, frame, err)
+		}
+		if err := a.HandleRekey(&up, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.WriteFrame(&up, FrameTypeData, []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+
+	if frame, err := b.ReadFrame(&up); err != nil || frame.Type != FrameTypeRekey || len(frame.Payload) != 0 {
+		t.Fatalf("ReadFrame = %v, %v; want empty REKEY", frame, err)
+	}
+	eavesdropper.readNonce = b.readNonce
+	raw := bytes.Clone(up.Bytes())
+	frame, err := b.ReadFrame(&up)
+	if err != nil || string(frame.Payload) != "after" {
+		t.Fatalf("ReadFrame = %v, %v; want the frame after the rekey", frame, err)
+	}
+	if _, err := eavesdropper.ReadFrame(bytes.NewReader(raw)); err == nil {
+		t.Error("the old key decrypted a frame written after the rekey")
+	}
+}
+
+func TestRekeyUnexpected(t *testing.T) {
+	a, b := newTestSessionPair(t)
+	if err := a.WriteFrame(&bytes.Buffer{}, FrameTypeRekey, nil); err == nil {
+		t.Error("wrote an empty REKEY with no new key")
+	}
+	if err := b.HandleRekey(&bytes.Buffer{}, &Frame{Type: FrameTypeRekey, Payload: make([]byte, 16)}); err == nil {
+		t.Error("accepted a REKEY with a short public key")
+	}
+}
@@ -0,0 +1,1037 @@
+// Package protocol implements the parts of the Reflex wire format that the
+// inbound and the outbound share: handshake messages and their HTTP and
+// HTTP/2 framing, handshake keys, encrypted frame sessions and traffic
+// morphing.
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtls/xray-core/common/errors"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Frame types.
+const (
+	FrameTypeData    = 0x01
+	FrameTypePadding = 0x02
+	FrameTypeTiming  = 0x03
+	FrameTypeClose   = 0x04
+
+	// FrameTypeCompression switches compression of the sender's subsequent
+	// DATA frames on or off.
+	FrameTypeCompression = 0x05
+
+	// FrameTypePing carries a timestamp the peer echoes back in a
+	// FrameTypePong, so the sender can measure the round-trip time.
+	FrameTypePing = 0x06
+	FrameTypePong = 0x07
+
+	// FrameTypeCloseWrite tells the peer the sender is done sending but
+	// still reading, like a TCP half-close. FrameTypeClose ends the session.
+	FrameTypeCloseWrite = 0x08
+
+	// FrameTypeUDP carries one datagram of a UDP association, prefixed with
+	// the destination header of the endpoint it is for or comes from.
+	FrameTypeUDP = 0x09
+
+	// FrameTypeRekey carries an ephemeral public key for a new session key,
+	// or, when empty, is the last frame its sender writes under the old key.
+	// See SetRekeyThreshold.
+	FrameTypeRekey = 0x0a
+
+	// FrameTypeClientVersion names the client software and its version,
+	// such as "xray-reflex/1.1.0". The client sends it as its first frame,
+	// where it is encrypted like any other, rather than in its hello.
+	FrameTypeClientVersion = 0x0b
+)
+
+const (
+	// frameHeaderSize is the header: length (2) + type (1). It goes out
+	// encrypted, see maskHeader.
+	frameHeaderSize = 3
+
+	// frameBodyHeaderSize is the encrypted length prefix that separates the
+	// payload from morphing padding.
+	frameBodyHeaderSize = 2
+
+	// frameSequenceSize is the frame's sequence number, its nonce counter.
+	// It is not sent: both ends count frames, and it is authenticated as
+	// part of the associated data.
+	frameSequenceSize = 8
+
+	// packetHeaderSize is the header of a frame sent as a packet: sequence
+	// number (8) + type (1). Its length is the packet's. See
+	// WriteFrameToPacket.
+	packetHeaderSize = frameSequenceSize + 1
+
+	// packetSampleSize is how much of a packet's body keys the mask of its
+	// header, see maskPacketHeader.
+	packetSampleSize = chacha20.NonceSize
+
+	// replayWindowSize is how far behind the newest packet read another
+	// packet may arrive and still be read.
+	replayWindowSize = 64
+
+	// MaxFramePayload is the largest payload a single frame can carry with
+	// the default cipher suite.
+	MaxFramePayload = 65535 - chacha20poly1305.Overhead - frameBodyHeaderSize
+)
+
+// Cipher suites. ChaCha20-Poly1305 derives its 12-byte nonce from the frame
+// counter. XChaCha20-Poly1305 sends a random 24-byte nonce with every frame,
+// so nonce space is never a concern, and relies on the frame counter in the
+// associated data to reject replayed or reordered frames.
+// AES-256-GCM derives its 12-byte nonce from the frame counter like
+// ChaCha20-Poly1305 and is the faster choice on CPUs with AES instructions.
+const (
+	CipherSuiteChaCha20Poly1305  = 0x01
+	CipherSuiteXChaCha20Poly1305 = 0x02
+	CipherSuiteAES256GCM         = 0x03
+)
+
+var cipherSuiteNames = map[string]uint8{
+	"chacha20-poly1305":  CipherSuiteChaCha20Poly1305,
+	"xchacha20-poly1305": CipherSuiteXChaCha20Poly1305,
+	"aes-256-gcm":        CipherSuiteAES256GCM,
+}
+
+// SupportedCipherSuites returns the names of the cipher suites this build
+// supports, in sorted order.
+func SupportedCipherSuites() []string {
+	names := make([]string, 0, len(cipherSuiteNames))
+	for name := range cipherSuiteNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseCipherSuite returns the cipher suite with the given name. An empty
+// name selects ChaCha20-Poly1305.
+func ParseCipherSuite(name string) (uint8, error) {
+	if name == "" {
+		return CipherSuiteChaCha20Poly1305, nil
+	}
+	if suite, found := cipherSuiteNames[name]; found {
+		return suite, nil
+	}
+	return 0, errors.New("unknown cipher suite: ", name)
+}
+
+// Frame is a decrypted Reflex frame.
+type Frame struct {
+	Length  uint16 // length of the encrypted body on the wire
+	Type    uint8
+	Payload []byte
+}
+
+// Role is the end of the connection a session is on. Each direction is
+// sealed under a key of its own, derived from the session key, so frame n
+// of one direction never shares a key and nonce with frame n of the other.
+// The two ends of a session must take different roles.
+type Role uint8
+
+const (
+	RoleClient Role = 1
+	RoleServer Role = 2
+)
+
+// Session encrypts and decrypts frames with the key negotiated during the
+// handshake. Reads and writes keep independent keys and nonce counters and
+// may be used from different goroutines.
+type Session struct {
+	suite   uint8
+	role    Role
+	tagSize int         // overhead of the AEAD, the same under every key
+	closed  atomic.Bool // see Close
+
+	// explicitNonce is the size of the nonce sent with each frame, zero when
+	// the nonce is derived from the frame counter.
+	explicitNonce int
+
+	readMu         sync.Mutex
+	readAEAD       cipher.AEAD
+	readHeaderKey  []byte // see maskHeader
+	readNonce      uint64
+	replayWindow   uint64 // packets read below readNonce, see markPacketRead
+	readCompressed bool
+	readDict       []byte // dictionary compressed frames are read with
+
+	writeMu         sync.Mutex
+	writeAEAD       cipher.AEAD
+	writeHeaderKey  []byte // see maskHeader
+	writeNonce      uint64
+	writeCompressed bool
+	writeDict       []byte       // dictionary frames are compressed against
+	lastWrite       atomic.Int64 // unix nanoseconds, see SendIdleCover
+
+	rekey rekeyState
+
+	obfuscator FrameObfuscator // nil when frames go out as sealed
+
+	// identity follows the sequence number in the associated data of every
+	// frame, see BindIdentity.
+	identity []byte
+
+	dropDuplicates  bool          // see SetDropDuplicateFrames
+	droppedFrames   atomic.Uint64 // packets dropped under dropDuplicates
+	framePerMessage bool          // see SetFramePerMessage
+
+	// bytesRead and bytesWritten count traffic, see Stats. readCounter and
+	// writeCounter, when set, are guarded by readMu and writeMu.
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+	readCounter  ByteCounter
+	writeCounter ByteCounter
+
+	profile         *TrafficProfile
+	morphingEnabled bool
+	pacer           pacer         // spaces frames written with morphing
+	delayBaseRTT    time.Duration // see SetAdaptiveDelays
+	congestion      congestionState
+
+	deadlines     deadlineSetter
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	readDeadline  atomic.Int64 // unix nanoseconds, zero for none; see SetReadDeadline
+	writeDeadline atomic.Int64 // the same for writes
+
+	created     time.Time
+	rttMu       sync.Mutex
+	rtt         time.Duration
+	pingSent    uint64 // payload of the PING awaiting its PONG
+	pingPending bool
+}
+
+// deadlineSetter is the part of net.Conn that SetOperationTimeouts needs.
+type deadlineSetter interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// NewSession creates a ChaCha20-Poly1305 session for role from a 32-byte
+// session key.
+func NewSession(sessionKey []byte, role Role) (*Session, error) {
+	return NewSessionWithCipherSuite(sessionKey, CipherSuiteChaCha20Poly1305, role)
+}
+
+// NewSessionWithCipherSuite creates a session for role using the given
+// cipher suite.
+func NewSessionWithCipherSuite(sessionKey []byte, suite uint8, role Role) (*Session, error) {
+	if role != RoleClient && role != RoleServer {
+		return nil, errors.New("unknown session role: ", role)
+	}
+	if len(sessionKey) != 32 {
+		return nil, errors.New("session key must be 32 bytes, got ", len(sessionKey))
+	}
+	readAEAD, writeAEAD, err := newDirectionAEADs(suite, sessionKey, role)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{suite: suite, role: role, tagSize: writeAEAD.Overhead(), readAEAD: readAEAD, writeAEAD: writeAEAD, created: time.Now()}
+	s.readHeaderKey, s.writeHeaderKey = directionKeys(sessionKey, role, headerKeyLabel)
+	s.rekey.key = sessionKey
+	s.lastWrite.Store(s.created.UnixNano())
+	if suite == CipherSuiteXChaCha20Poly1305 {
+		s.explicitNonce = chacha20poly1305.NonceSizeX
+	}
+	return s, nil
+}
+
+// newSessionAEAD returns the AEAD of suite under key.
+func newSessionAEAD(suite uint8, key []byte) (cipher.AEAD, error) {
+	switch suite {
+	case CipherSuiteChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	case CipherSuiteXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	case CipherSuiteAES256GCM:
+		return newAES256GCM(key)
+	}
+	return nil, errors.New("unknown cipher suite: ", suite)
+}
+
+// newDirectionAEADs returns the AEADs role reads and writes with under
+// sessionKey.
+func newDirectionAEADs(suite uint8, sessionKey []byte, role Role) (read, write cipher.AEAD, err error) {
+	readKey, writeKey := directionKeys(sessionKey, role, frameKeyLabel)
+	defer clear(readKey)
+	defer clear(writeKey)
+	if read, err = newSessionAEAD(suite, readKey); err != nil {
+		return nil, nil, err
+	}
+	if write, err = newSessionAEAD(suite, writeKey); err != nil {
+		return nil, nil, err
+	}
+	return read, write, nil
+}
+
+// newAES256GCM returns AES-256-GCM with the standard 12-byte nonce. Unlike
+// aes.NewCipher it refuses keys of any size but 32 bytes.
+func newAES256GCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("AES-256-GCM needs a 32-byte key, got ", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// FrameObfuscator transforms frame bodies between the AEAD layer and the
+// wire, for deployments that dress frames up as some application format.
+// The header ahead of each body is encrypted either way, see maskHeader.
+// Wrap gets each sealed body as written and returns what goes on the wire
+// instead; Unwrap reverses it on the peer. Both ends of a session must use
+// the same obfuscator. The wrapped body must stay within 65535 bytes. Both
+// may modify their argument in place.
+type FrameObfuscator interface {
+	Wrap(sealed []byte) []byte
+	Unwrap(wire []byte) ([]byte, error)
+}
+
+// NopObfuscator leaves frame bodies as they are. It is what a session uses
+// until SetObfuscator is called.
+var NopObfuscator FrameObfuscator = nopObfuscator{}
+
+type nopObfuscator struct{}
+
+func (nopObfuscator) Wrap(sealed []byte) []byte          { return sealed }
+func (nopObfuscator) Unwrap(wire []byte) ([]byte, error) { return wire, nil }
+
+// SetObfuscator makes the session pass every frame body it writes through
+// o.Wrap and every one it reads through o.Unwrap. A nil o restores
+// NopObfuscator. It must be set before the first frame.
+func (s *Session) SetObfuscator(o FrameObfuscator) {
+	if o == NopObfuscator {
+		o = nil
+	}
+	s.obfuscator = o
+}
+
+// errSessionClosed is returned by reads and writes on a closed session.
+var errSessionClosed = errors.New("reflex session closed")
+
+// Close zeroes the session key, in place, and makes the session unusable:
+// every later read or write fails. It does not wait for a read or write in
+// progress, which may be blocked on its connection; that one fails or
+// finishes as it would have, and the header keys it uses are zeroed when
+// it returns. Close may be called more than once. The AEAD keeps its own
+// copy of the key, which Go gives no way to wipe; it is unreachable once
+// the session is.
+func (s *Session) Close() error {
+	s.closed.Store(true)
+	s.pacer.stop(errSessionClosed)
+	s.rekey.mu.Lock()
+	clear(s.rekey.key)
+	s.rekey.mu.Unlock()
+	s.wipeRead()
+	s.wipeWrite()
+	return nil
+}
+
+// unlockRead releases readMu, zeroing the read header key if the session
+// was closed meanwhile. Everything that takes readMu releases it here.
+func (s *Session) unlockRead() {
+	s.readMu.Unlock()
+	s.wipeRead()
+}
+
+// unlockWrite is unlockRead for writeMu.
+func (s *Session) unlockWrite() {
+	s.writeMu.Unlock()
+	s.wipeWrite()
+}
+
+// wipeRead zeroes the read header key once the session is closed, unless a
+// read holds readMu; that read calls it again on its way out.
+func (s *Session) wipeRead() {
+	if s.closed.Load() && s.readMu.TryLock() {
+		clear(s.readHeaderKey)
+		s.readMu.Unlock()
+	}
+}
+
+// wipeWrite is wipeRead for the write header key.
+func (s *Session) wipeWrite() {
+	if s.closed.Load() && s.writeMu.TryLock() {
+		clear(s.writeHeaderKey)
+		s.writeMu.Unlock()
+	}
+}
+
+// ErrFrameDropped is returned by ReadFrameFromPacket for a packet dropped
+// under SetDropDuplicateFrames. The session stays usable.
+var ErrFrameDropped = errors.New("reflex frame dropped")
+
+// errFrameAuth is the cause of the error for a frame that fails
+// authentication.
+var errFrameAuth = errors.New("frame authentication failed")
+
+// SetDropDuplicateFrames makes ReadFrameFromPacket drop a packet that fails
+// authentication or was read before, as a duplicated or replayed packet
+// does on an unreliable transport, instead of failing: the drop is counted
+// in DroppedFrames and ErrFrameDropped is returned so the caller can read
+// the next packet. Reordered packets are read either way. Stream reads are
+// not affected; on a stream such a frame still ends the session.
+func (s *Session) SetDropDuplicateFrames(drop bool) {
+	s.dropDuplicates = drop
+}
+
+// DroppedFrames returns the number of packets dropped under
+// SetDropDuplicateFrames.
+func (s *Session) DroppedFrames() uint64 {
+	return s.droppedFrames.Load()
+}
+
+// SetFramePerMessage makes ReadFrame read each frame as one whole message
+// of a WebSocketConn, read directly or through a buffer: a frame cut short
+// by the end of its message, or followed by more in it, fails the read.
+func (s *Session) SetFramePerMessage(on bool) {
+	s.framePerMessage = on
+}
+
+// SessionStats is the traffic a session has carried: the plaintext payload
+// of its DATA and UDP frames, before compression.
+type SessionStats struct {
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+// Stats returns the traffic the session has carried so far.
+func (s *Session) Stats() SessionStats {
+	return SessionStats{
+		BytesRead:    s.bytesRead.Load(),
+		BytesWritten: s.bytesWritten.Load(),
+	}
+}
+
+// ByteCounter is a counter traffic can be added to, such as Xray's
+// stats.Counter.
+type ByteCounter interface {
+	Add(int64) int64
+}
+
+// SetByteCounters makes the session add the traffic it reads and writes,
+// as counted by Stats, to read and written, starting with what it has
+// carried so far. Either may be nil.
+func (s *Session) SetByteCounters(read, written ByteCounter) {
+	s.readMu.Lock()
+	if s.readCounter = read; read != nil {
+		read.Add(int64(s.bytesRead.Load()))
+	}
+	s.unlockRead()
+	s.writeMu.Lock()
+	if s.writeCounter = written; written != nil {
+		written.Add(int64(s.bytesWritten.Load()))
+	}
+	s.unlockWrite()
+}
+
+// carriesTraffic reports whether frames of frameType carry user traffic.
+func carriesTraffic(frameType uint8) bool {
+	return frameType == FrameTypeData || frameType == FrameTypeUDP
+}
+
+// overhead is what encryption adds to a frame body on the wire.
+func (s *Session) overhead() int {
+	return s.tagSize + s.explicitNonce
+}
+
+// maxPayload is the largest payload plus padding one frame can carry.
+func (s *Session) maxPayload() int {
+	return 65535 - s.overhead() - frameBodyHeaderSize
+}
+
+// BindIdentity binds the frames sealed and opened from now on to the
+// authenticated user ID and the profile name negotiated for the session,
+// "" for none. A frame sealed by a session bound to another identity fails
+// to open, even under the same key. Both ends must bind the same identity
+// before exchanging frames.
+func (s *Session) BindIdentity(userID [16]byte, profile string) {
+	s.readMu.Lock()
+	defer s.unlockRead()
+	s.writeMu.Lock()
+	defer s.unlockWrite()
+	s.identity = append(userID[:], profile...)
+}
+
+// associatedData is what a frame is authenticated with besides its body:
+// the header it goes out with, length and type, as it is before any
+// obfuscation, its sequence number and the bound identity. A frame whose
+// type or length was changed on the way fails to open.
+func (s *Session) associatedData(frameType uint8, length int, sequence uint64) []byte {
+	ad := make([]byte, 0, frameHeaderSize+frameSequenceSize+len(s.identity))
+	ad = binary.BigEndian.AppendUint16(ad, uint16(length))
+	ad = append(ad, frameType)
+	ad = binary.BigEndian.AppendUint64(ad, sequence)
+	return append(ad, s.identity...)
+}
+
+// seal encrypts the body of a frame of frameType with the given counter as
+// its sequence number.
+func (s *Session) seal(dst []byte, frameType uint8, body []byte, counter uint64) ([]byte, error) {
+	ad := s.associatedData(frameType, s.overhead()+len(body), counter)
+	if s.explicitNonce == 0 {
+		return s.writeAEAD.Seal(dst, nonceFromCounter(counter), body, ad), nil
+	}
+	nonce := make([]byte, s.explicitNonce)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce...)
+	return s.writeAEAD.Seal(dst, nonce, body, ad), nil
+}
+
+// open decrypts the body of a frame of frameType with the given counter as
+// its sequence number. A frame that was dropped, reordered or replayed
+// fails to open like a tampered one.
+func (s *Session) open(frameType uint8, encrypted []byte, counter uint64) ([]byte, error) {
+	ad := s.associatedData(frameType, len(encrypted), counter)
+	nonce, ciphertext := nonceFromCounter(counter), encrypted
+	if s.explicitNonce > 0 {
+		nonce, ciphertext = encrypted[:s.explicitNonce], encrypted[s.explicitNonce:]
+	}
+	body, err := s.readAEAD.Open(ciphertext[:0], nonce, ciphertext, ad)
+	if err != nil {
+		return nil, errors.New("failed to decrypt frame: ", err).Base(errFrameAuth)
+	}
+	return body, nil
+}
+
+// SetOperationTimeouts bounds single frame operations on conn, independent
+// of any inactivity timeout: once a frame header has been read, the rest of
+// the frame must arrive within readTimeout, and writing a frame must finish
+// within writeTimeout. A zero timeout leaves that direction unbounded.
+// Deadlines on conn that outlast a frame, such as a handshake deadline, must
+// then be set through SetReadDeadline and SetWriteDeadline, so the session
+// can put them back after each frame.
+func (s *Session) SetOperationTimeouts(conn deadlineSetter, readTimeout, writeTimeout time.Duration) {
+	s.deadlines = conn
+	s.readTimeout = readTimeout
+	s.writeTimeout = writeTimeout
+}
+
+// errNoDeadlines is returned by SetReadDeadline and SetWriteDeadline before
+// SetOperationTimeouts.
+var errNoDeadlines = errors.New("no connection to set deadlines on")
+
+// SetReadDeadline sets the read deadline of the connection given to
+// SetOperationTimeouts and remembers it: a frame read bounded by the read
+// timeout is bounded by t too, if it is earlier, and restores t when done.
+// A zero t means no deadline.
+func (s *Session) SetReadDeadline(t time.Time) error {
+	if s.deadlines == nil {
+		return errNoDeadlines
+	}
+	s.readDeadline.Store(unixNano(t))
+	return s.deadlines.SetReadDeadline(t)
+}
+
+// SetWriteDeadline is SetReadDeadline for writes.
+func (s *Session) SetWriteDeadline(t time.Time) error {
+	if s.deadlines == nil {
+		return errNoDeadlines
+	}
+	s.writeDeadline.Store(unixNano(t))
+	return s.deadlines.SetWriteDeadline(t)
+}
+
+// operationDeadline is the deadline of a frame operation bounded by
+// timeout, or the one set for the connection, stored in set, if that is
+// earlier.
+func operationDeadline(timeout time.Duration, set *atomic.Int64) time.Time {
+	deadline := time.Now().Add(timeout)
+	if outer := fromUnixNano(set.Load()); !outer.IsZero() && outer.Before(deadline) {
+		return outer
+	}
+	return deadline
+}
+
+// unixNano is t in unix nanoseconds, zero for the zero time.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano reverses unixNano.
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+func isValidFrameType(frameType uint8) bool {
+	switch frameType {
+	case FrameTypeData, FrameTypePadding, FrameTypeTiming, FrameTypeClose, FrameTypeCompression,
+		FrameTypePing, FrameTypePong, FrameTypeCloseWrite, FrameTypeUDP, FrameTypeRekey, FrameTypeClientVersion:
+		return true
+	}
+	return false
+}
+
+func nonceFromCounter(counter uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// maskHeader encrypts or decrypts, in place, the header of the frame with
+// the given counter: it XORs it with ChaCha20 keystream under the header
+// key of the frame's direction, with the counter as the nonce, so neither
+// the length nor the type of a frame shows on the wire. The header is
+// authenticated with the body, see associatedData. Header keys come from
+// the first session key and do not change on rekey; the counter never
+// repeats under them either way.
+func maskHeader(key []byte, counter uint64, header []byte) {
+	stream, err := chacha20.NewUnauthenticatedCipher(key, nonceFromCounter(counter))
+	if err != nil {
+		panic(err) // cannot happen with a 32-byte key and 12-byte nonce
+	}
+	stream.XORKeyStream(header, header)
+}
+
+// maskPacketHeader encrypts or decrypts, in place, the header of a packet
+// whose body is body. A packet carries its sequence number, so it cannot
+// key the mask; the first bytes of the sealed body do instead, as QUIC
+// samples its header protection. The top bit of the sample is set so it
+// never collides with a counter nonce of maskHeader.
+func maskPacketHeader(key, body, header []byte) {
+	var nonce [packetSampleSize]byte
+	copy(nonce[:], body)
+	nonce[0] |= 0x80
+	stream, err := chacha20.NewUnauthenticatedCipher(key, nonce[:])
+	if err != nil {
+		panic(err) // cannot happen with a 32-byte key and 12-byte nonce
+	}
+	stream.XORKeyStream(header, header)
+}
+
+// ReadFrame reads and decrypts the next frame.
+func (s *Session) ReadFrame(reader io.Reader) (*Frame, error) {
+	s.readMu.Lock()
+	defer s.unlockRead()
+	if s.closed.Load() {
+		return nil, errSessionClosed
+	}
+
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+	maskHeader(s.readHeaderKey, s.readNonce, header[:])
+	length := binary.BigEndian.Uint16(header[0:2])
+	frameType := header[2]
+	if err := s.checkFrame(frameType, int(length)); err != nil {
+		return nil, err
+	}
+
+	if s.deadlines != nil && s.readTimeout > 0 {
+		if err := s.deadlines.SetReadDeadline(operationDeadline(s.readTimeout, &s.readDeadline)); err != nil {
+			return nil, err
+		}
+		defer func() { s.deadlines.SetReadDeadline(fromUnixNano(s.readDeadline.Load())) }()
+	}
+
+	encrypted := make([]byte, length)
+	if _, err := io.ReadFull(reader, encrypted); err != nil {
+		return nil, err
+	}
+	if s.framePerMessage {
+		if err := ReadMessageEnd(reader); err != nil {
+			return nil, err
+		}
+	}
+
+	payload, err := s.decryptFrame(frameType, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	return &Frame{
+		Length:  length,
+		Type:    frameType,
+		Payload: payload,
+	}, nil
+}
+
+// ReadFrameFromPacket parses and decrypts packet as exactly one frame
+// written by WriteFrameToPacket, for datagram transports that deliver each
+// frame as one packet. Packets may arrive out of order: one is read if it
+// is newer than any read so far, or no more than replayWindowSize behind
+// the newest and not read yet. A packet that is cut short or carries
+// trailing bytes fails to authenticate, and a rejected packet leaves the
+// session as it was. See also SetDropDuplicateFrames. packet is decrypted
+// in place.
+func (s *Session) ReadFrameFromPacket(packet []byte) (*Frame, error) {
+	if len(packet) < packetHeaderSize+packetSampleSize {
+		return nil, errors.New("packet too short for a frame: ", len(packet))
+	}
+
+	s.readMu.Lock()
+	defer s.unlockRead()
+	if s.closed.Load() {
+		return nil, errSessionClosed
+	}
+	var header [packetHeaderSize]byte
+	copy(header[:], packet)
+	body := packet[packetHeaderSize:]
+	maskPacketHeader(s.readHeaderKey, body, header[:])
+	sequence := binary.BigEndian.Uint64(header[:frameSequenceSize])
+	frameType := header[frameSequenceSize]
+	payload, err := s.readPacket(sequence, frameType, body)
+	if err != nil {
+		if s.dropDuplicates && errors.Cause(err) == errFrameAuth {
+			s.droppedFrames.Add(1)
+			return nil, ErrFrameDropped
+		}
+		return nil, err
+	}
+	return &Frame{
+		Length:  uint16(len(body)),
+		Type:    frameType,
+		Payload: payload,
+	}, nil
+}
+
+// readPacket does the work of ReadFrameFromPacket with readMu held, once the
+// header is unmasked.
+func (s *Session) readPacket(sequence uint64, frameType uint8, body []byte) ([]byte, error) {
+	// Only a header unmasked under the right key decodes to a type a packet
+	// may carry, so a misfit is a forged packet like any other.
+	if !isPacketFrameType(frameType) || len(body) > 65535 {
+		return nil, errors.New("invalid packet header").Base(errFrameAuth)
+	}
+	if err := s.checkFrame(frameType, len(body)); err != nil {
+		return nil, errors.New("invalid packet").Base(errFrameAuth)
+	}
+	if !s.packetUnread(sequence) {
+		return nil, errors.New("packet ", sequence, " already read or too old").Base(errFrameAuth)
+	}
+	sealed, err := s.unwrapFrame(body)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := s.open(frameType, sealed, sequence)
+	if err != nil {
+		return nil, err
+	}
+	s.markPacketRead(sequence)
+	return s.readBody(frameType, plain)
+}
+
+// isPacketFrameType reports whether frames of frameType may be sent as
+// packets. Compression and rekey frames change what the frames after them
+// mean, so they only go over a stream, where order is kept.
+func isPacketFrameType(frameType uint8) bool {
+	return isValidFrameType(frameType) && frameType != FrameTypeCompression && frameType != FrameTypeRekey
+}
+
+// packetUnread reports whether the packet with sequence may still be read.
+func (s *Session) packetUnread(sequence uint64) bool {
+	if sequence >= s.readNonce {
+		return true
+	}
+	age := s.readNonce - 1 - sequence
+	return age < replayWindowSize && s.replayWindow&(1<<age) == 0
+}
+
+// markPacketRead records that the packet with sequence was read. readNonce
+// follows the newest packet, and bit i of replayWindow stands for the
+// packet i behind it.
+func (s *Session) markPacketRead(sequence uint64) {
+	if sequence < s.readNonce {
+		s.replayWindow |= 1 << (s.readNonce - 1 - sequence)
+		return
+	}
+	if shift := sequence + 1 - s.readNonce; shift < replayWindowSize {
+		s.replayWindow <<= shift
+	} else {
+		s.replayWindow = 0
+	}
+	s.replayWindow |= 1
+	s.readNonce = sequence + 1
+}
+
+// DecryptFrame opens the ciphertext of the next frame of frameType, as
+// produced by EncryptFrame, and returns its payload. It advances the read
+// nonce but does no I/O, so transports that frame differently can use the
+// session's crypto directly. Frames must be decrypted in the order they
+// were encrypted. ciphertext is decrypted in place.
+func (s *Session) DecryptFrame(frameType uint8, ciphertext []byte) ([]byte, error) {
+	if err := s.checkFrame(frameType, len(ciphertext)); err != nil {
+		return nil, err
+	}
+	s.readMu.Lock()
+	defer s.unlockRead()
+	return s.decryptFrame(frameType, ciphertext)
+}
+
+func (s *Session) checkFrame(frameType uint8, length int) error {
+	if !isValidFrameType(frameType) {
+		return errors.New("invalid frame type: ", frameType)
+	}
+	// An obfuscated body may be of any length; decryptFrame checks it
+	// once unwrapped.
+	if s.obfuscator == nil && length < s.overhead()+frameBodyHeaderSize {
+		return errors.New("frame too short: ", length)
+	}
+	return nil
+}
+
+// decryptFrame does the work of DecryptFrame with readMu held.
+func (s *Session) decryptFrame(frameType uint8, encrypted []byte) ([]byte, error) {
+	if s.closed.Load() {
+		return nil, errSessionClosed
+	}
+	encrypted, err := s.unwrapFrame(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	body, err := s.open(frameType, encrypted, s.readNonce)
+	if err != nil {
+		return nil, err
+	}
+	s.readNonce++
+	return s.readBody(frameType, body)
+}
+
+// unwrapFrame undoes the obfuscator, if any, on the body of a frame.
+func (s *Session) unwrapFrame(encrypted []byte) ([]byte, error) {
+	if s.obfuscator == nil {
+		return encrypted, nil
+	}
+	encrypted, err := s.obfuscator.Unwrap(encrypted)
+	if err != nil {
+		return nil, errors.New("failed to unwrap frame").Base(err)
+	}
+	if len(encrypted) < s.overhead()+frameBodyHeaderSize {
+		return nil, errors.New("unwrapped frame too short: ", len(encrypted))
+	}
+	return encrypted, nil
+}
+
+// readBody extracts the payload from the decrypted body of a frame of
+// frameType and applies what the frame means for the session.
+func (s *Session) readBody(frameType uint8, body []byte) ([]byte, error) {
+	var err error
+	payloadLen := int(binary.BigEndian.Uint16(body[0:frameBodyHeaderSize]))
+	if payloadLen > len(body)-frameBodyHeaderSize {
+		return nil, errors.New("invalid frame payload length: ", payloadLen)
+	}
+
+	payload := body[frameBodyHeaderSize : frameBodyHeaderSize+payloadLen]
+
+	switch {
+	case frameType == FrameTypeCompression:
+		if s.readCompressed, s.readDict, err = s.applyCompressionFrame(payload); err != nil {
+			return nil, err
+		}
+	case frameType == FrameTypeData && s.readCompressed:
+		if payload, err = decompressPayload(payload, s.readDict); err != nil {
+			return nil, err
+		}
+	case frameType == FrameTypeRekey && len(payload) == 0:
+		if err := s.switchReadKey(); err != nil {
+			return nil, err
+		}
+	}
+	if carriesTraffic(frameType) {
+		s.bytesRead.Add(uint64(len(payload)))
+		if s.readCounter != nil {
+			s.readCounter.Add(int64(len(payload)))
+		}
+	}
+	return payload, nil
+}
+
+// WriteFrame encrypts data into a single frame and writes it. An unknown
+// frame type is refused before anything is written.
+func (s *Session) WriteFrame(writer io.Writer, frameType uint8, data []byte) error {
+	return s.writeFrame(writer, frameType, data, 0)
+}
+
+// WriteFrameToPacket encrypts data into a single frame and writes it with
+// one Write, in the format ReadFrameFromPacket reads, for datagram
+// transports that may drop, duplicate or reorder what they carry. Unlike a
+// frame on a stream, the packet carries its sequence number, encrypted with
+// its type, since the reader cannot count packets. Packets and stream
+// frames share the write nonce. Compression and rekey frames are refused:
+// see isPacketFrameType.
+func (s *Session) WriteFrameToPacket(writer io.Writer, frameType uint8, data []byte) error {
+	if !isPacketFrameType(frameType) {
+		return errors.New("frame type cannot be sent as a packet: ", frameType)
+	}
+	s.writeMu.Lock()
+	defer s.unlockWrite()
+	packet := make([]byte, packetHeaderSize, packetHeaderSize+s.overhead()+frameBodyHeaderSize+len(data))
+	sequence := s.writeNonce
+	packet, err := s.encryptFrame(packet, frameType, data, 0)
+	if err != nil {
+		return err
+	}
+	if len(packet) < packetHeaderSize+packetSampleSize {
+		return errors.New("obfuscated frame too short for a packet: ", len(packet)-packetHeaderSize)
+	}
+	binary.BigEndian.PutUint64(packet[:frameSequenceSize], sequence)
+	packet[frameSequenceSize] = frameType
+	maskPacketHeader(s.writeHeaderKey, packet[packetHeaderSize:], packet[:packetHeaderSize])
+	_, err = writer.Write(packet)
+	s.lastWrite.Store(time.Now().UnixNano())
+	return err
+}
+
+// EncryptFrame seals plaintext as the next frame of frameType and returns
+// the ciphertext that follows the frame header on the wire. It advances the
+// write nonce but does no I/O, so transports that frame differently can use
+// the session's crypto directly.
+func (s *Session) EncryptFrame(frameType uint8, plaintext []byte) ([]byte, error) {
+	if !isValidFrameType(frameType) {
+		return nil, errors.New("invalid frame type: ", frameType)
+	}
+	s.writeMu.Lock()
+	defer s.unlockWrite()
+	return s.encryptFrame(nil, frameType, plaintext, 0)
+}
+
+// writeFrame writes one frame whose body is followed by paddingLen random
+// bytes. Header and body go out in a single Write.
+func (s *Session) writeFrame(writer io.Writer, frameType uint8, data []byte, paddingLen int) error {
+	if !isValidFrameType(frameType) {
+		return errors.New("invalid frame type: ", frameType)
+	}
+	s.writeMu.Lock()
+	defer s.unlockWrite()
+	if err := s.writeFrameLocked(writer, frameType, data, paddingLen); err != nil {
+		return err
+	}
+	return s.startRekeyIfDue(writer)
+}
+
+// writeFrameLocked does the work of writeFrame with writeMu held.
+func (s *Session) writeFrameLocked(writer io.Writer, frameType uint8, data []byte, paddingLen int) error {
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+s.overhead()+frameBodyHeaderSize+len(data)+paddingLen)
+	counter := s.writeNonce
+	frame, err := s.encryptFrame(frame, frameType, data, paddingLen)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(frame[0:2], uint16(len(frame)-frameHeaderSize))
+	frame[2] = frameType
+	maskHeader(s.writeHeaderKey, counter, frame[:frameHeaderSize])
+
+	if s.deadlines != nil && s.writeTimeout > 0 {
+		if err := s.deadlines.SetWriteDeadline(operationDeadline(s.writeTimeout, &s.writeDeadline)); err != nil {
+			return err
+		}
+		defer func() { s.deadlines.SetWriteDeadline(fromUnixNano(s.writeDeadline.Load())) }()
+	}
+	start := time.Now()
+	_, err = writer.Write(frame)
+	now := time.Now()
+	s.lastWrite.Store(now.UnixNano())
+	if err == nil {
+		s.congestion.observeWrite(now.Sub(start))
+	}
+	return err
+}
+
+// encryptFrame appends the sealed body of the next frame to dst. It is
+// called with writeMu held.
+func (s *Session) encryptFrame(dst []byte, frameType uint8, data []byte, paddingLen int) ([]byte, error) {
+	if s.closed.Load() {
+		return nil, errSessionClosed
+	}
+	if len(data)+paddingLen > s.maxPayload() {
+		return nil, errors.New("frame payload too large: ", len(data)+paddingLen)
+	}
+	plainLen := len(data)
+
+	var compressed bool
+	var dict []byte
+	if frameType == FrameTypeCompression {
+		var err error
+		if compressed, dict, err = s.applyCompressionFrame(data); err != nil {
+			return nil, err
+		}
+	}
+	var nextKey cipher.AEAD
+	if frameType == FrameTypeRekey && len(data) == 0 {
+		if nextKey = s.nextWriteKey(); nextKey == nil {
+			return nil, errors.New("no new key to switch to")
+		}
+	}
+
+	if frameType == FrameTypeData && s.writeCompressed {
+		total := len(data) + paddingLen
+		var err error
+		if data, err = deflateDict(data, s.writeDict); err != nil {
+			return nil, err
+		}
+		if len(data) > s.maxPayload() {
+			return nil, errors.New("compressed frame payload too large: ", len(data))
+		}
+		// A padded frame keeps the size the caller asked for, so morphing
+		// still holds.
+		if paddingLen > 0 {
+			paddingLen = max(total-len(data), 0)
+		}
+	}
+
+	body := make([]byte, frameBodyHeaderSize+len(data)+paddingLen)
+	binary.BigEndian.PutUint16(body[0:frameBodyHeaderSize], uint16(len(data)))
+	copy(body[frameBodyHeaderSize:], data)
+	if paddingLen > 0 {
+		if _, err := rand.Read(body[frameBodyHeaderSize+len(data):]); err != nil {
+			return nil, err
+		}
+	}
+
+	var sealed []byte
+	var err error
+	if s.obfuscator == nil {
+		sealed, err = s.seal(dst, frameType, body, s.writeNonce)
+	} else {
+		sealed, err = s.seal(nil, frameType, body, s.writeNonce)
+		if err == nil {
+			sealed = s.obfuscator.Wrap(sealed)
+			if len(sealed) > 65535 {
+				return nil, errors.New("obfuscated frame too large: ", len(sealed))
+			}
+			sealed = append(dst, sealed...)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.writeNonce++
+	if frameType == FrameTypeCompression {
+		s.writeCompressed, s.writeDict = compressed, dict
+	}
+	if nextKey != nil {
+		s.switchWriteKey(nextKey)
+	}
+	if frameType == FrameTypeClose || frameType == FrameTypeCloseWrite {
+		s.rekey.writeClosed = true
+	}
+	if carriesTraffic(frameType) {
+		s.bytesWritten.Add(uint64(plainLen))
+		if s.writeCounter != nil {
+			s.writeCounter.Add(int64(plainLen))
+		}
+	}
+	return sealed, nil
+}
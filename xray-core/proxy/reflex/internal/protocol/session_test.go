@@ -0,0 +1,771 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/errors"
+)
+
+func newTestSessionPair(t *testing.T) (*Session, *Session) {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	a, err := NewSession(key, RoleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewSession(bytes.Clone(key), RoleServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+func newTestXChaChaSessionPair(t *testing.T) (*Session, *Session) {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	a, err := NewSessionWithCipherSuite(key, CipherSuiteXChaCha20Poly1305, RoleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewSessionWithCipherSuite(bytes.Clone(key), CipherSuiteXChaCha20Poly1305, RoleServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+func TestFrameEncryptRoundTrip(t *testing.T) {
+	writer, reader := newTestSessionPair(t)
+	var wire bytes.Buffer
+
+	payloads := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{0xab}, MaxFramePayload)}
+	for _, p := range payloads {
+		if err := writer.WriteFrame(&wire, FrameTypeData, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, p := range payloads {
+		frame, err := reader.ReadFrame(&wire)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if frame.Type != FrameTypeData || !bytes.Equal(frame.Payload, p) {
+			t.Errorf("frame %d: payload mismatch", i)
+		}
+	}
+}
+
+func TestWriteFrameTooLarge(t *testing.T) {
+	writer, _ := newTestSessionPair(t)
+	var wire bytes.Buffer
+	if err := writer.WriteFrame(&wire, FrameTypeData, make([]byte, MaxFramePayload+1)); err == nil {
+		t.Error("expected an error for an oversized payload")
+	}
+	if wire.Len() != 0 {
+		t.Error("oversized frame must not be written")
+	}
+}
+
+func TestWriteFrameInvalidType(t *testing.T) {
+	writer, _ := newTestSessionPair(t)
+	var wire bytes.Buffer
+	if err := writer.WriteFrame(&wire, 0xff, []byte("x")); err == nil {
+		t.Error("expected an error for an unknown frame type")
+	}
+	if wire.Len() != 0 || writer.writeNonce != 0 {
+		t.Error("a frame of unknown type must not be written or use a nonce")
+	}
+}
+
+func TestReadFrameTampered(t *testing.T) {
+	writer, reader := newTestSessionPair(t)
+	var wire bytes.Buffer
+	if err := writer.WriteFrame(&wire, FrameTypeData, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	b := wire.Bytes()
+	b[len(b)-1] ^= 0xff
+	if _, err := reader.ReadFrame(&wire); err == nil {
+		t.Error("expected decryption failure for a tampered frame")
+	}
+}
+
+// TestReadFrameOutOfSequence checks that a frame missing from a stream, or
+// one read twice, is refused: the sequence number is not on the wire but
+// counted by both ends, and out of sequence neither the header nor the body
+// decrypts.
+func TestReadFrameOutOfSequence(t *testing.T) {
+	for suite, newPair := range map[uint8]func(*testing.T) (*Session, *Session){
+		CipherSuiteChaCha20Poly1305:  newTestSessionPair,
+		CipherSuiteXChaCha20Poly1305: newTestXChaChaSessionPair,
+	} {
+		writer, reader := newPair(t)
+		var frames [][]byte
+		for _, p := range []string{"one", "two", "three"} {
+			var wire bytes.Buffer
+			if err := writer.WriteFrame(&wire, FrameTypeData, []byte(p)); err != nil {
+				t.Fatal(err)
+			}
+			if wire.Len() != frameHeaderSize+writer.overhead()+frameBodyHeaderSize+len(p) {
+				t.Fatalf("suite %d: %d byte frame carries more than its body", suite, wire.Len())
+			}
+			frames = append(frames, wire.Bytes())
+		}
+
+		stream := bytes.NewReader(append(bytes.Clone(frames[0]), frames[2]...))
+		if _, err := reader.ReadFrame(stream); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reader.ReadFrame(stream); err == nil {
+			t.Errorf("suite %d: read past a dropped frame", suite)
+		}
+		if _, err := reader.ReadFrame(bytes.NewReader(frames[0])); err == nil {
+			t.Errorf("suite %d: read a repeated frame", suite)
+		}
+		if frame, err := reader.ReadFrame(bytes.NewReader(frames[1])); err != nil || string(frame.Payload) != "two" {
+			t.Errorf("suite %d: next frame: %v, %v", suite, frame, err)
+		}
+	}
+}
+
+// TestReadFrameHeaderAuthenticated checks that a frame whose type was
+// changed on the way, as from DATA to CLOSE or PADDING, fails to open.
+func TestReadFrameHeaderAuthenticated(t *testing.T) {
+	for suite, newPair := range map[uint8]func(*testing.T) (*Session, *Session){
+		CipherSuiteChaCha20Poly1305:  newTestSessionPair,
+		CipherSuiteXChaCha20Poly1305: newTestXChaChaSessionPair,
+	} {
+		writer, reader := newPair(t)
+		var wire bytes.Buffer
+		if err := writer.WriteFrame(&wire, FrameTypeData, []byte("payload")); err != nil {
+			t.Fatal(err)
+		}
+		for _, to := range []uint8{FrameTypeClose, FrameTypePadding} {
+			tampered := bytes.Clone(wire.Bytes())
+			tampered[2] ^= FrameTypeData ^ to
+			if _, err := reader.ReadFrame(bytes.NewReader(tampered)); errors.Cause(err) != errFrameAuth {
+				t.Errorf("suite %d: DATA frame retyped to %d: %v", suite, to, err)
+			}
+		}
+		if frame, err := reader.ReadFrame(&wire); err != nil || string(frame.Payload) != "payload" {
+			t.Errorf("suite %d: untouched frame: %v, %v", suite, frame, err)
+		}
+	}
+}
+
+func TestReadFrameInvalidType(t *testing.T) {
+	_, reader := newTestSessionPair(t)
+	header := []byte{0, 18, 0x7f}
+	maskHeader(reader.readHeaderKey, 0, header)
+	if _, err := reader.ReadFrame(bytes.NewReader(header)); err == nil {
+		t.Error("expected an error for an invalid frame type")
+	}
+}
+
+func TestReadFrameReplayRejected(t *testing.T) {
+	writer, reader := newTestSessionPair(t)
+	var wire bytes.Buffer
+	if err := writer.WriteFrame(&wire, FrameTypeData, []byte("once")); err != nil {
+		t.Fatal(err)
+	}
+	captured := append([]byte(nil), wire.Bytes()...)
+	if _, err := reader.ReadFrame(&wire); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.ReadFrame(bytes.NewReader(captured)); err == nil {
+		t.Error("expected a replayed frame to fail")
+	}
+}
+
+func TestXChaChaFrameRoundTrip(t *testing.T) {
+	writer, reader := newTestXChaChaSessionPair(t)
+	var wire bytes.Buffer
+
+	payloads := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{0xab}, writer.maxPayload())}
+	for _, p := range payloads {
+		if err := writer.WriteFrame(&wire, FrameTypeData, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, p := range payloads {
+		frame, err := reader.ReadFrame(&wire)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if frame.Type != FrameTypeData || !bytes.Equal(frame.Payload, p) {
+			t.Errorf("frame %d: payload mismatch", i)
+		}
+	}
+}
+
+func TestXChaChaNoncesDoNotRepeat(t *testing.T) {
+	writer, reader := newTestXChaChaSessionPair(t)
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		var wire bytes.Buffer
+		if err := writer.WriteFrame(&wire, FrameTypeData, []byte("same payload")); err != nil {
+			t.Fatal(err)
+		}
+		nonce := string(wire.Bytes()[frameHeaderSize : frameHeaderSize+24])
+		if seen[nonce] {
+			t.Fatalf("frame %d reused a nonce", i)
+		}
+		seen[nonce] = true
+		if _, err := reader.ReadFrame(&wire); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+}
+
+func TestXChaChaReplayRejected(t *testing.T) {
+	writer, reader := newTestXChaChaSessionPair(t)
+	var wire bytes.Buffer
+	if err := writer.WriteFrame(&wire, FrameTypeData, []byte("once")); err != nil {
+		t.Fatal(err)
+	}
+	captured := append([]byte(nil), wire.Bytes()...)
+	if _, err := reader.ReadFrame(&wire); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.ReadFrame(bytes.NewReader(captured)); err == nil {
+		t.Error("expected a replayed frame to fail")
+	}
+}
+
+func TestCipherSuiteMismatch(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	writer, _ := NewSessionWithCipherSuite(key, CipherSuiteXChaCha20Poly1305, RoleClient)
+	reader, _ := NewSession(key, RoleServer)
+	var wire bytes.Buffer
+	if err := writer.WriteFrame(&wire, FrameTypeData, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.ReadFrame(&wire); err == nil {
+		t.Error("expected a frame sealed with another suite to fail")
+	}
+	if _, err := NewSessionWithCipherSuite(key, 0x7f, RoleClient); err == nil {
+		t.Error("expected an error for an unknown cipher suite")
+	}
+	if _, err := NewSessionWithCipherSuite(key[:16], CipherSuiteAES256GCM, RoleClient); err == nil {
+		t.Error("expected an error for an AES-128 key")
+	}
+}
+
+func TestBindIdentity(t *testing.T) {
+	alice := [16]byte{1}
+	bob := [16]byte{2}
+	for _, tc := range []struct {
+		name  string
+		bind  func(writer, reader *Session)
+		opens bool // whether reader opens what writer seals
+	}{
+		{"unbound", func(w, r *Session) {}, true},
+		{"same identity", func(w, r *Session) {
+			w.BindIdentity(alice, "zoom")
+			r.BindIdentity(alice, "zoom")
+		}, true},
+		{"other user", func(w, r *Session) {
+			w.BindIdentity(alice, "zoom")
+			r.BindIdentity(bob, "zoom")
+		}, false},
+		{"other profile", func(w, r *Session) {
+			w.BindIdentity(alice, "zoom")
+			r.BindIdentity(alice, "http2-api")
+		}, false},
+		{"no profile", func(w, r *Session) {
+			w.BindIdentity(alice, "zoom")
+			r.BindIdentity(alice, "")
+		}, false},
+		{"bound and unbound", func(w, r *Session) {
+			w.BindIdentity(alice, "")
+		}, false},
+	} {
+		for _, pair := range []func(*testing.T) (*Session, *Session){newTestSessionPair, newTestXChaChaSessionPair} {
+			writer, reader := pair(t)
+			tc.bind(writer, reader)
+			var wire bytes.Buffer
+			if err := writer.WriteFrame(&wire, FrameTypeData, []byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			frame, err := reader.ReadFrame(&wire)
+			if tc.opens && (err != nil || string(frame.Payload) != "hello") {
+				t.Errorf("%s: ReadFrame = %v, want the frame", tc.name, err)
+			}
+			if !tc.opens && errors.Cause(err) != errFrameAuth {
+				t.Errorf("%s: ReadFrame = %v, want an authentication failure", tc.name, err)
+			}
+		}
+	}
+}
+
+func TestSupportedCipherSuites(t *testing.T) {
+	names := SupportedCipherSuites()
+	want := []string{"aes-256-gcm", "chacha20-poly1305", "xchacha20-poly1305"}
+	if !slices.Equal(names, want) {
+		t.Errorf("SupportedCipherSuites() = %v, want %v", names, want)
+	}
+	for _, name := range names {
+		if _, err := ParseCipherSuite(name); err != nil {
+			t.Errorf("reported suite %q does not parse: %v", name, err)
+		}
+	}
+}
+
+func TestEncryptDecryptFrame(t *testing.T) {
+	for _, suite := range []uint8{CipherSuiteChaCha20Poly1305, CipherSuiteXChaCha20Poly1305, CipherSuiteAES256GCM} {
+		key := make([]byte, 32)
+		rand.Read(key)
+		sender, _ := NewSessionWithCipherSuite(key, suite, RoleClient)
+		receiver, _ := NewSessionWithCipherSuite(key, suite, RoleServer)
+
+		var sealed [][]byte
+		for i := 0; i < 3; i++ {
+			ciphertext, err := sender.EncryptFrame(FrameTypeData, []byte{byte(i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sender.writeNonce != uint64(i+1) {
+				t.Fatalf("suite %d: write nonce %d after %d frames", suite, sender.writeNonce, i+1)
+			}
+			sealed = append(sealed, ciphertext)
+		}
+		if bytes.Equal(sealed[0], sealed[1]) {
+			t.Errorf("suite %d: frames encrypted under the same nonce", suite)
+		}
+
+		if _, err := receiver.DecryptFrame(FrameTypeData, bytes.Clone(sealed[1])); err == nil {
+			t.Errorf("suite %d: out-of-order frame decrypted", suite)
+		}
+		for i, ciphertext := range sealed {
+			plaintext, err := receiver.DecryptFrame(FrameTypeData, ciphertext)
+			if err != nil {
+				t.Fatalf("suite %d frame %d: %v", suite, i, err)
+			}
+			if !bytes.Equal(plaintext, []byte{byte(i)}) {
+				t.Errorf("suite %d frame %d: got %v", suite, i, plaintext)
+			}
+		}
+		if receiver.readNonce != 3 {
+			t.Errorf("suite %d: read nonce %d after 3 frames", suite, receiver.readNonce)
+		}
+	}
+}
+
+func TestEncryptFrameMatchesWire(t *testing.T) {
+	writer, reader := newTestSessionPair(t)
+	var wire bytes.Buffer
+	if err := writer.WriteFrame(&wire, FrameTypeData, []byte("streamed")); err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := writer.EncryptFrame(FrameTypeData, []byte("datagram"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame, err := reader.ReadFrame(&wire)
+	if err != nil || string(frame.Payload) != "streamed" {
+		t.Fatalf("ReadFrame = %v, %v", frame, err)
+	}
+	plaintext, err := reader.DecryptFrame(FrameTypeData, ciphertext)
+	if err != nil || string(plaintext) != "datagram" {
+		t.Fatalf("DecryptFrame = %q, %v", plaintext, err)
+	}
+}
+
+// writeTestPackets writes each payload as a DATA frame in a packet of its
+// own.
+func writeTestPackets(t *testing.T, writer *Session, payloads ...string) [][]byte {
+	t.Helper()
+	var packets [][]byte
+	for _, payload := range payloads {
+		var wire bytes.Buffer
+		if err := writer.WriteFrameToPacket(&wire, FrameTypeData, []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, wire.Bytes())
+	}
+	return packets
+}
+
+func TestReadFrameFromPacket(t *testing.T) {
+	writer, reader := newTestSessionPair(t)
+	packets := writeTestPackets(t, writer, "first", "", "third")
+
+	frame, err := reader.ReadFrameFromPacket(bytes.Clone(packets[0]))
+	if err != nil || frame.Type != FrameTypeData || string(frame.Payload) != "first" {
+		t.Fatalf("ReadFrameFromPacket = %v, %v", frame, err)
+	}
+
+	// Truncated and padded packets are rejected and leave the session
+	// alone, so the intact packet still decrypts afterwards.
+	for _, bad := range [][]byte{
+		nil,
+		packets[1][:2],
+		packets[1][:packetHeaderSize],
+		packets[1][:len(packets[1])-1],
+		append(bytes.Clone(packets[1]), 0),
+	} {
+		if _, err := reader.ReadFrameFromPacket(bytes.Clone(bad)); err == nil {
+			t.Errorf("accepted a %d byte packet holding a %d byte frame", len(bad), len(packets[1]))
+		}
+	}
+	if reader.readNonce != 1 || reader.replayWindow != 1 {
+		t.Fatalf("read nonce %d, window %b after rejected packets", reader.readNonce, reader.replayWindow)
+	}
+	for i, want := range []string{"", "third"} {
+		frame, err := reader.ReadFrameFromPacket(packets[i+1])
+		if err != nil || string(frame.Payload) != want {
+			t.Errorf("packet %d: %v, %v", i+1, frame, err)
+		}
+	}
+
+	// Neither the sequence number nor the type is on the wire.
+	for i, packet := range writeTestPackets(t, writer, "x", "x") {
+		if binary.BigEndian.Uint64(packet) == uint64(3+i) {
+			t.Errorf("packet sequence number in the clear: % x", packet[:packetHeaderSize])
+		}
+	}
+	if err := writer.WriteFrameToPacket(io.Discard, FrameTypeRekey, nil); err == nil {
+		t.Error("wrote a rekey frame as a packet")
+	}
+}
+
+func TestReadFrameFromPacketReordered(t *testing.T) {
+	writer, reader := newTestSessionPair(t)
+	payloads := make([]string, replayWindowSize+5)
+	for i := range payloads {
+		payloads[i] = string(rune('a' + i%26))
+	}
+	packets := writeTestPackets(t, writer, payloads...)
+
+	read := func(i int) error {
+		frame, err := reader.ReadFrameFromPacket(bytes.Clone(packets[i]))
+		if err == nil && string(frame.Payload) != payloads[i] {
+			t.Errorf("packet %d: payload %q, want %q", i, frame.Payload, payloads[i])
+		}
+		return err
+	}
+	for _, i := range []int{2, 0, 3, 1} {
+		if err := read(i); err != nil {
+			t.Errorf("packet %d out of order: %v", i, err)
+		}
+	}
+	for _, i := range []int{0, 1, 2, 3} {
+		if err := read(i); errors.Cause(err) != errFrameAuth {
+			t.Errorf("packet %d read twice: %v", i, err)
+		}
+	}
+	// Packet 4 falls out of the window once the newest is 64 ahead of it.
+	if err := read(replayWindowSize + 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := read(4); errors.Cause(err) != errFrameAuth {
+		t.Errorf("packet outside the window: %v", err)
+	}
+	if err := read(5); err != nil {
+		t.Errorf("oldest packet in the window: %v", err)
+	}
+}
+
+// xorObfuscator flips every byte with a key and prepends a marker, so a
+// wrapped body differs in length as well as content.
+type xorObfuscator byte
+
+func (x xorObfuscator) Wrap(sealed []byte) []byte {
+	wire := append([]byte{'X'}, sealed...)
+	for i := 1; i < len(wire); i++ {
+		wire[i] ^= byte(x)
+	}
+	return wire
+}
+
+func (x xorObfuscator) Unwrap(wire []byte) ([]byte, error) {
+	if len(wire) == 0 || wire[0] != 'X' {
+		return nil, errors.New("missing marker")
+	}
+	sealed := wire[1:]
+	for i := range sealed {
+		sealed[i] ^= byte(x)
+	}
+	return sealed, nil
+}
+
+func TestFrameObfuscator(t *testing.T) {
+	writer, reader := newTestSessionPair(t)
+	writer.SetObfuscator(xorObfuscator(0x5a))
+	reader.SetObfuscator(xorObfuscator(0x5a))
+
+	var plain bytes.Buffer
+	plainWriter, _ := newTestSessionPair(t)
+	plainWriter.WriteFrame(&plain, FrameTypeData, []byte("hello"))
+
+	var wire bytes.Buffer
+	for _, p := range []string{"hello", "", "world"} {
+		if err := writer.WriteFrame(&wire, FrameTypeData, []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := bytes.Clone(wire.Bytes()[:plain.Len()+1])
+	maskHeader(reader.readHeaderKey, 0, first[:frameHeaderSize])
+	if first[frameHeaderSize] != 'X' || int(binary.BigEndian.Uint16(first)) != plain.Len()-frameHeaderSize+1 {
+		t.Fatalf("frame was not wrapped: % x", first)
+	}
+	for _, want := range []string{"hello", "", "world"} {
+		frame, err := reader.ReadFrame(&wire)
+		if err != nil || string(frame.Payload) != want {
+			t.Fatalf("ReadFrame = %v, %v; want %q", frame, err, want)
+		}
+	}
+
+	// A peer with another obfuscator, or none, cannot read the frames.
+	for _, other := range []FrameObfuscator{xorObfuscator(0x33), nil} {
+		writer, reader := newTestSessionPair(t)
+		writer.SetObfuscator(xorObfuscator(0x5a))
+		reader.SetObfuscator(other)
+		var wire bytes.Buffer
+		if err := writer.WriteFrame(&wire, FrameTypeData, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reader.ReadFrame(&wire); err == nil {
+			t.Errorf("read an obfuscated frame with obfuscator %v", other)
+		}
+	}
+}
+
+func TestNopObfuscatorMatchesPlainFrames(t *testing.T) {
+	writer, reader := newTestSessionPair(t)
+	writer.SetObfuscator(NopObfuscator)
+	if writer.obfuscator != nil {
+		t.Error("NopObfuscator is not the default")
+	}
+	var wire bytes.Buffer
+	writer.WriteFrame(&wire, FrameTypeData, []byte("plain"))
+	if frame, err := reader.ReadFrame(&wire); err != nil || string(frame.Payload) != "plain" {
+		t.Errorf("ReadFrame = %v, %v", frame, err)
+	}
+}
+
+func TestDropDuplicateFrames(t *testing.T) {
+	writer, reader := newTestSessionPair(t)
+	packets := writeTestPackets(t, writer, "first", "second", "third")
+
+	// Without the option a duplicate is an error like any other.
+	if _, err := reader.ReadFrameFromPacket(bytes.Clone(packets[0])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.ReadFrameFromPacket(bytes.Clone(packets[0])); err == nil || err == ErrFrameDropped {
+		t.Errorf("duplicate without the option: %v", err)
+	}
+
+	reader.SetDropDuplicateFrames(true)
+	forged := bytes.Clone(packets[1])
+	forged[len(forged)-1] ^= 1
+	for _, dup := range [][]byte{packets[0], packets[0], forged} {
+		if _, err := reader.ReadFrameFromPacket(bytes.Clone(dup)); err != ErrFrameDropped {
+			t.Errorf("duplicate packet: %v, want ErrFrameDropped", err)
+		}
+	}
+	for i, want := range []string{"second", "third"} {
+		frame, err := reader.ReadFrameFromPacket(bytes.Clone(packets[i+1]))
+		if err != nil || string(frame.Payload) != want {
+			t.Errorf("packet %d after duplicates: %v, %v", i+1, frame, err)
+		}
+		// The same packet again is a duplicate now.
+		if _, err := reader.ReadFrameFromPacket(bytes.Clone(packets[i+1])); err != ErrFrameDropped {
+			t.Errorf("replayed packet %d: %v, want ErrFrameDropped", i+1, err)
+		}
+	}
+	if got := reader.DroppedFrames(); got != 5 {
+		t.Errorf("DroppedFrames = %d, want 5", got)
+	}
+
+	// Malformed packets are still errors, not drops.
+	if _, err := reader.ReadFrameFromPacket(packets[0][:2]); err == nil || err == ErrFrameDropped {
+		t.Errorf("truncated packet: %v", err)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	peer, err := NewSession(bytes.Clone(key), RoleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSession(key, RoleServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wire bytes.Buffer
+	if err := peer.WriteFrame(&wire, FrameTypeData, []byte("unread")); err != nil {
+		t.Fatal(err)
+	}
+	packet := bytes.Clone(wire.Bytes())
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, make([]byte, 32)) {
+		t.Errorf("key not zeroed: %x", key)
+	}
+	if err := s.WriteFrame(io.Discard, FrameTypeData, []byte("late")); err == nil {
+		t.Error("WriteFrame succeeded after Close")
+	}
+	if _, err := s.ReadFrame(&wire); err == nil {
+		t.Error("ReadFrame succeeded after Close")
+	}
+	if wire.Len() != len(packet) {
+		t.Error("ReadFrame consumed input after Close")
+	}
+	if _, err := s.ReadFrameFromPacket(packet); err == nil {
+		t.Error("ReadFrameFromPacket succeeded after Close")
+	}
+	if _, err := s.EncryptFrame(FrameTypeData, nil); err == nil {
+		t.Error("EncryptFrame succeeded after Close")
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+// TestSessionCloseDuringRead checks that Close does not wait for a read
+// blocked on its connection, and that the read zeroes its header key once
+// the connection lets it go.
+func TestSessionCloseDuringRead(t *testing.T) {
+	_, s := newTestSessionPair(t)
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.ReadFrame(pr)
+		done <- err
+	}()
+	// Wait for the read to block holding readMu.
+	for s.readMu.TryLock() {
+		s.readMu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for a blocked read")
+	}
+	pw.Close()
+	if err := <-done; err == nil {
+		t.Error("read succeeded on a closed pipe")
+	}
+	if !bytes.Equal(s.readHeaderKey, make([]byte, 32)) {
+		t.Error("read header key not zeroed after the read returned")
+	}
+}
+
+// deadlineRecorder records the read and write deadlines set on it.
+type deadlineRecorder struct {
+	read, write []time.Time
+}
+
+func (d *deadlineRecorder) SetReadDeadline(t time.Time) error {
+	d.read = append(d.read, t)
+	return nil
+}
+
+func (d *deadlineRecorder) SetWriteDeadline(t time.Time) error {
+	d.write = append(d.write, t)
+	return nil
+}
+
+func TestOperationTimeoutsRestoreDeadline(t *testing.T) {
+	writer, reader := newTestSessionPair(t)
+	var conn deadlineRecorder
+	writer.SetOperationTimeouts(&conn, time.Minute, time.Minute)
+	reader.SetOperationTimeouts(&conn, time.Minute, time.Minute)
+
+	handshake := time.Now().Add(time.Second)
+	if err := reader.SetReadDeadline(handshake); err != nil {
+		t.Fatal(err)
+	}
+	var wire bytes.Buffer
+	if err := writer.WriteFrame(&wire, FrameTypeData, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.ReadFrame(&wire); err != nil {
+		t.Fatal(err)
+	}
+	// The earlier handshake deadline bounds the frame, and is put back
+	// after it.
+	if want := []time.Time{handshake, handshake, handshake}; !slices.EqualFunc(conn.read, want, time.Time.Equal) {
+		t.Errorf("read deadlines %v, want %v", conn.read, want)
+	}
+	// With no deadline of its own the connection gets none back.
+	if len(conn.write) != 2 || !conn.write[1].IsZero() {
+		t.Errorf("write deadlines %v", conn.write)
+	}
+}
+
+func TestSessionStats(t *testing.T) {
+	writer, reader := newTestSessionPair(t)
+	var written, read atomic.Int64
+	writer.SetByteCounters(nil, &written)
+	reader.SetByteCounters(&read, nil)
+
+	// Frames go out whole under the write lock, so the writers may share
+	// the buffer. Compression shows the plaintext is what counts.
+	var wire bytes.Buffer
+	if err := writer.SetCompression(&wire, true); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var total atomic.Int64
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				payload := bytes.Repeat([]byte{byte(g)}, 10*i)
+				if err := writer.WriteFrame(&wire, FrameTypeData, payload); err != nil {
+					t.Error(err)
+					return
+				}
+				total.Add(int64(len(payload)))
+				// Control frames are not traffic.
+				if err := writer.WriteFrame(&wire, FrameTypePadding, []byte("control")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for wire.Len() > 0 {
+		if _, err := reader.ReadFrame(&wire); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := uint64(total.Load())
+	if got := writer.Stats(); got != (SessionStats{BytesWritten: want}) {
+		t.Errorf("writer stats %+v, want %d bytes written", got, want)
+	}
+	if got := reader.Stats(); got != (SessionStats{BytesRead: want}) {
+		t.Errorf("reader stats %+v, want %d bytes read", got, want)
+	}
+	if written.Load() != int64(want) || read.Load() != int64(want) {
+		t.Errorf("counters at %d written and %d read, want %d", written.Load(), read.Load(), want)
+	}
+}
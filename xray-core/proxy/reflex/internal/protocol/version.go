@@ -0,0 +1,10 @@
+package protocol
+
+// SoftwareVersion is the version of this Reflex implementation. The outbound
+// announces it as "xray-reflex/"+SoftwareVersion in a
+// FrameTypeClientVersion.
+const SoftwareVersion = "1.1.0"
+
+// ClientSoftware is what the outbound of this tree sends in a
+// FrameTypeClientVersion.
+const ClientSoftware = "xray-reflex/" + SoftwareVersion
@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/xtls/xray-core/common/errors"
+)
+
+// errMessageEnd is what a read of a WebSocketConn returns at the end of a
+// message.
+var errMessageEnd = errors.New("end of WebSocket message")
+
+// WebSocketConn carries a Reflex connection in the binary messages of a
+// WebSocket, one message per Write. A session writes every frame with a
+// single Write, so each frame travels in a message of its own, as does
+// each handshake flight. Reads return one message at a time: the end of
+// each is reported once, as an error ReadMessageEnd consumes, and only the
+// read after that starts the next message. A reader that expects more than
+// a message holds fails instead of reading on into the next one.
+type WebSocketConn struct {
+	*websocket.Conn
+	reader io.Reader // the rest of the message being read, nil between messages
+}
+
+// NewWebSocketConn wraps an established WebSocket.
+func NewWebSocketConn(conn *websocket.Conn) *WebSocketConn {
+	return &WebSocketConn{Conn: conn}
+}
+
+func (c *WebSocketConn) Read(b []byte) (int, error) {
+	for c.reader == nil {
+		messageType, reader, err := c.NextReader()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		if messageType == websocket.BinaryMessage {
+			c.reader = reader
+		}
+	}
+	n, err := c.reader.Read(b)
+	if err == io.EOF {
+		if n > 0 {
+			// The message reader reports its end again on the next read.
+			return n, nil
+		}
+		c.reader = nil
+		return 0, errMessageEnd
+	}
+	return n, err
+}
+
+// ReadMessageEnd reads the end of the message being read from a
+// WebSocketConn, directly or through a buffer such as a bufio.Reader. It
+// fails if the message holds more than has been read of it.
+func ReadMessageEnd(reader io.Reader) error {
+	var b [1]byte
+	n, err := reader.Read(b[:])
+	switch {
+	case n > 0:
+		return errors.New("WebSocket message holds more than one flight or frame")
+	case err == errMessageEnd:
+		return nil
+	case err == nil:
+		return errors.New("WebSocket message does not end")
+	}
+	return err
+}
+
+func (c *WebSocketConn) Write(b []byte) (int, error) {
+	if err := c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close sends a close message, without waiting for the peer's, and closes
+// the underlying connection.
+func (c *WebSocketConn) Close() error {
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return c.Conn.Close()
+}
+
+func (c *WebSocketConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
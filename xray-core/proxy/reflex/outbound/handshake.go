@@ -0,0 +1,301 @@
+package outbound
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	stdnet "net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+	"github.com/xtls/xray-core/transport/internet"
+	"github.com/xtls/xray-core/transport/internet/stat"
+)
+
+// errDisguiseMismatch is the cause of every error about a handshake response
+// that does not look like the one a reflex server sends.
+var errDisguiseMismatch = errors.New("server handshake does not match the reflex disguise")
+
+// clientConn is an established Reflex connection.
+type clientConn struct {
+	conn    stat.Connection
+	reader  *bufio.Reader // holds anything the server sent after its handshake
+	session *protocol.Session
+
+	grantedProfile string // profile the server announced, "" if none
+}
+
+// dialSession dials the server and performs the handshake. A handshake the
+// server rejects or answers malformed, as happens against a server that is
+// restarting or a meddling middlebox, is retried up to h.handshakeRetries
+// times on a new connection with new ephemeral keys. Dial errors are not
+// retried here.
+func (h *Handler) dialSession(ctx context.Context, dialer internet.Dialer) (*clientConn, error) {
+	for attempt := uint32(0); ; attempt++ {
+		conn, err := dialer.Dial(ctx, h.server)
+		if err != nil {
+			return nil, errors.New("failed to dial ", h.server).Base(err).AtWarning()
+		}
+		if h.webSocketPath != "" {
+			if conn, err = h.upgradeWebSocket(ctx, conn); err != nil {
+				return nil, err
+			}
+		}
+		c, err := h.clientHandshake(conn)
+		if err == nil {
+			c.session.SetProfile(h.sessionProfile(ctx, c.grantedProfile))
+			c.session.SetAdaptiveDelays(h.morphingBaseRTT)
+			c.session.SetRekeyThreshold(h.rekeyAfter)
+			// Compression is switched on once the session has its
+			// profile, whose dictionary it is negotiated with.
+			if h.compression {
+				err = c.session.SetCompression(c.conn, true)
+			}
+			if err == nil {
+				return c, nil
+			}
+		}
+		conn.Close()
+		if errors.Cause(err) == errDisguiseMismatch {
+			// Not a server having a bad moment but something else
+			// answering; trying again will not make it a reflex server.
+			return nil, errors.New("reflex handshake aborted").Base(err).AtWarning()
+		}
+		if attempt >= h.handshakeRetries {
+			return nil, errors.New("reflex handshake failed").Base(err).AtWarning()
+		}
+		errors.LogInfoInner(ctx, err, "reflex handshake failed, retrying")
+	}
+}
+
+// upgradeWebSocket upgrades conn to a WebSocket for the configured path,
+// which the session then runs over, one frame per message.
+func (h *Handler) upgradeWebSocket(ctx context.Context, conn stat.Connection) (stat.Connection, error) {
+	dialer := websocket.Dialer{
+		NetDialContext: func(context.Context, string, string) (stdnet.Conn, error) {
+			return conn, nil
+		},
+	}
+	u := url.URL{Scheme: "ws", Host: h.server.NetAddr(), Path: h.webSocketPath}
+	wsConn, resp, err := dialer.DialContext(ctx, u.String(), nil)
+	if resp != nil {
+		resp.Body.Close()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, errors.New("failed to upgrade to WebSocket").Base(err).AtWarning()
+	}
+	return protocol.NewWebSocketConn(wsConn), nil
+}
+
+// sessionProfile returns the profile to morph the uplink with: the one the
+// server granted, so both directions match, or the configured one if the
+// server granted none or one this client does not know. Each session gets
+// its own copy.
+func (h *Handler) sessionProfile(ctx context.Context, granted string) *protocol.TrafficProfile {
+	if granted == "" {
+		return h.profile.Clone()
+	}
+	profile := protocol.GetProfileByName(granted)
+	if profile == nil {
+		errors.LogWarning(ctx, "server granted unknown reflex profile ", granted)
+		return h.profile.Clone()
+	}
+	return profile
+}
+
+// magic returns the magic to open a handshake with now.
+func (h *Handler) magic() uint32 {
+	if h.magicSecret != nil {
+		return protocol.TimeGatedMagic(h.magicSecret, time.Now())
+	}
+	return protocol.ReflexMagic
+}
+
+// clientHandshake sends a magic-mode client handshake on conn and derives
+// the session from the server's answer, then announces the client version
+// in the session's first frame. The client requests a cipher suite other
+// than the default with handshake extensions, asks for the downlink to be
+// morphed with morphDownlink and solves the proof of work with
+// powDifficulty. Up to maxGrease grease bytes go out before the magic, or
+// with http2Preface the handshake goes out in the HTTP/2 variant. With
+// httpUpgrade it goes out as an HTTP POST asking to upgrade to that
+// protocol.
+func (h *Handler) clientHandshake(conn stat.Connection) (*clientConn, error) {
+	id, suite, upgrade := h.id, h.cipherSuite, h.httpUpgrade
+	privateKey, publicKey, err := protocol.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+
+	var policyReq []byte
+	if suite != protocol.CipherSuiteChaCha20Poly1305 {
+		policyReq = protocol.AppendExtension(policyReq, protocol.ExtCipherSuite, []byte{suite})
+	}
+	if h.morphDownlink {
+		policyReq = protocol.AppendExtension(policyReq, protocol.ExtMorphDownlink, nil)
+	}
+	if h.powDifficulty > 0 {
+		challenge := protocol.ProofOfWorkChallenge(h.magicSecret, time.Now())
+		solution := protocol.SolveProofOfWork(challenge, h.powDifficulty, publicKey, nonce)
+		policyReq = protocol.AppendExtension(policyReq, protocol.ExtProofOfWork, solution)
+	}
+
+	hs := &protocol.ClientHandshake{
+		PublicKey: publicKey,
+		UserID:    [16]byte(id.Bytes()),
+		PolicyReq: policyReq,
+		Timestamp: time.Now().Unix(),
+		Nonce:     nonce,
+	}
+	packet, err := protocol.AppendClientHandshake(nil, h.magic(), hs)
+	if err != nil {
+		return nil, errors.New("failed to encode client handshake").Base(err)
+	}
+	opening := append(protocol.AppendGrease(nil, h.maxGrease), packet...)
+	switch {
+	case h.http2Preface:
+		opening = protocol.AppendHTTP2Handshake(nil, packet)
+	case upgrade != "" && h.magicSecret != nil:
+		opening = protocol.AppendHTTPUpgradeHandshake(nil, packet, h.server.NetAddr(), upgrade)
+	case upgrade != "":
+		opening = protocol.AppendHTTPUpgradeHandshake(nil, packet[5:], h.server.NetAddr(), upgrade)
+	}
+	if _, err := conn.Write(opening); err != nil {
+		return nil, errors.New("failed to write client handshake").Base(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	var serverHS *protocol.ServerHandshake
+	if h.http2Preface {
+		serverHS, err = protocol.ReadHTTP2ServerHandshake(reader)
+	} else {
+		serverHS, err = readServerHandshake(reader, upgrade)
+	}
+	if err != nil {
+		return nil, err
+	}
+	shared, err := protocol.DeriveSharedKey(privateKey, serverHS.PublicKey)
+	if err != nil {
+		return nil, errors.New("invalid server public key").Base(err)
+	}
+	sess, err := protocol.NewSessionWithCipherSuite(protocol.DeriveSessionKey(shared, nonce[:]), suite, protocol.RoleClient)
+	if err != nil {
+		return nil, err
+	}
+	grantedProfile, err := protocol.GrantedProfile(sess, serverHS.PolicyGrant)
+	if err != nil {
+		return nil, err
+	}
+	sess.BindIdentity(id, grantedProfile)
+	webSocket := h.webSocketPath != ""
+	if webSocket {
+		if err := protocol.ReadMessageEnd(reader); err != nil {
+			return nil, errors.New("failed to read server handshake").Base(err)
+		}
+		sess.SetFramePerMessage(true)
+	}
+	var version bytes.Buffer
+	if err := sess.WriteFrame(&version, protocol.FrameTypeClientVersion, []byte(protocol.ClientSoftware)); err != nil {
+		return nil, errors.New("failed to seal client version").Base(err)
+	}
+	return &clientConn{
+		conn:           &leadingWriteConn{Connection: conn, leading: version.Bytes(), separate: webSocket},
+		reader:         reader,
+		session:        sess,
+		grantedProfile: grantedProfile,
+	}, nil
+}
+
+// leadingWriteConn sends leading ahead of the first write on the
+// connection. It carries the client version frame, sealed before any
+// other, so the handshake itself does not wait for the server to read it.
+// Every write goes through the session, under its write lock, so nothing
+// gets ahead of the first.
+type leadingWriteConn struct {
+	stat.Connection
+	leading []byte
+	// separate sends leading in a Write of its own, as over a WebSocket,
+	// where each message holds a single frame.
+	separate bool
+}
+
+func (c *leadingWriteConn) Write(b []byte) (int, error) {
+	if c.leading == nil {
+		return c.Connection.Write(b)
+	}
+	leading := c.leading
+	c.leading = nil
+	if c.separate {
+		if _, err := c.Connection.Write(leading); err != nil {
+			return 0, err
+		}
+		return c.Connection.Write(b)
+	}
+	if _, err := c.Connection.Write(append(leading, b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// readServerHandshake reads the server's HTTP answer. A handshake that
+// asked to upgrade to upgrade must be answered with a 101 switching to it.
+func readServerHandshake(reader *bufio.Reader, upgrade string) (*protocol.ServerHandshake, error) {
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return nil, errors.New("failed to read server handshake").Base(err)
+	}
+	defer resp.Body.Close()
+	if upgrade != "" {
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			return nil, errors.New("handshake not upgraded: ", resp.Status)
+		}
+		if !strings.EqualFold(resp.Header.Get("Upgrade"), upgrade) {
+			return nil, errors.New("upgraded to ", resp.Header.Get("Upgrade"), " instead of ", upgrade).Base(errDisguiseMismatch)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, errors.New("handshake rejected: ", resp.Status)
+	}
+	if err := checkDisguise(resp); err != nil {
+		return nil, err
+	}
+	return protocol.DecodeHTTPServerHandshake(resp)
+}
+
+// checkDisguise verifies that an accepted handshake response has the shape
+// the reflex inbound gives it: an HTTP/1.1 status line with the standard
+// reason phrase, and either a JSON body of declared length or, for statuses
+// without a body, the key in an ETag. A response that deviates comes from
+// something that only imitates a reflex server and is not trusted.
+func checkDisguise(resp *http.Response) error {
+	if resp.ProtoMajor != 1 || resp.ProtoMinor != 1 {
+		return errors.New("unexpected protocol ", resp.Proto).Base(errDisguiseMismatch)
+	}
+	if resp.Status != strconv.Itoa(resp.StatusCode)+" "+http.StatusText(resp.StatusCode) {
+		return errors.New("unexpected status line ", resp.Status).Base(errDisguiseMismatch)
+	}
+	if !protocol.StatusHasBody(resp.StatusCode) {
+		if resp.Header.Get("ETag") == "" {
+			return errors.New("missing ETag header").Base(errDisguiseMismatch)
+		}
+		return nil
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		return errors.New("unexpected Content-Type ", ct).Base(errDisguiseMismatch)
+	}
+	if resp.Header.Get("Content-Length") == "" {
+		return errors.New("missing Content-Length header").Base(errDisguiseMismatch)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package outbound
+
+import (
+	"context"
+	stdnet "net"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/proxy/reflex/inbound"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+	"github.com/xtls/xray-core/transport"
+	"github.com/xtls/xray-core/transport/internet/stat"
+	"github.com/xtls/xray-core/transport/pipe"
+)
+
+func TestCheckInterop(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		suite  string
+		server *reflex.InboundConfig
+		ok     bool
+	}{
+		{"default", "", &reflex.InboundConfig{Clients: []*reflex.User{{Id: testUserID}}}, true},
+		{"youtube", "", &reflex.InboundConfig{Clients: []*reflex.User{{Id: testUserID, Policy: "youtube"}}}, true},
+		{"mimic-http2-api", "", &reflex.InboundConfig{Clients: []*reflex.User{{Id: testUserID, Policy: "mimic-http2-api"}}}, true},
+		{"xchacha20-poly1305", "xchacha20-poly1305", &reflex.InboundConfig{Clients: []*reflex.User{{Id: testUserID, Policy: "youtube"}}}, true},
+		{"aes-256-gcm", "aes-256-gcm", &reflex.InboundConfig{Clients: []*reflex.User{{Id: testUserID, Policy: "youtube"}}}, true},
+		{"204 handshake", "", &reflex.InboundConfig{Clients: []*reflex.User{{Id: testUserID}}, HandshakeStatus: 204}, true},
+		{"unknown user", "", &reflex.InboundConfig{Clients: []*reflex.User{{Id: "00000000-0000-0000-0000-000000000001"}}}, false},
+		{"tls-like server", "", &reflex.InboundConfig{
+			Clients:       []*reflex.User{{Id: testUserID}},
+			HandshakeMode: inbound.HandshakeModeTLSLike,
+		}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkInterop(context.Background(), &reflex.OutboundConfig{Id: testUserID, CipherSuite: tc.suite}, tc.server)
+			if ok := err == nil; ok != tc.ok {
+				t.Errorf("checkInterop() = %v, want ok=%v", err, tc.ok)
+			}
+		})
+	}
+}
+
+// interopTimeout bounds a whole checkInterop run.
+const interopTimeout = 10 * time.Second
+
+// checkInterop runs a client and a server built from the given configs
+// against each other in memory: a real handshake, a real session and an echo
+// through the server's dispatcher. It returns nil if they interoperate. No
+// network is used, so the client's address and port are ignored.
+func checkInterop(ctx context.Context, client *reflex.OutboundConfig, server *reflex.InboundConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, interopTimeout)
+	defer cancel()
+
+	serverHandler, err := inbound.New(ctx, server)
+	if err != nil {
+		return errors.New("invalid server config").Base(err)
+	}
+	// No network is used, but New insists on a server destination.
+	placeholder := *client
+	placeholder.Address, placeholder.Port = "127.0.0.1", 443
+	clientHandler, err := New(ctx, &placeholder)
+	if err != nil {
+		return errors.New("invalid client config").Base(err)
+	}
+
+	clientConn, serverConn := stdnet.Pipe()
+	defer clientConn.Close()
+	deadline, _ := ctx.Deadline()
+	clientConn.SetDeadline(deadline)
+
+	serverDone := make(chan error, 1)
+	go func() {
+		serverDone <- serverHandler.Process(ctx, net.Network_TCP, serverConn, echoDispatcher{})
+		serverConn.Close()
+	}()
+
+	if err := interopEcho(ctx, clientHandler.(*Handler), clientConn); err != nil {
+		clientConn.Close()
+		if serverErr := <-serverDone; serverErr != nil {
+			return errors.New("server failed").Base(serverErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// interopEcho performs the client side of checkInterop on conn.
+func interopEcho(ctx context.Context, h *Handler, conn stat.Connection) error {
+	c, err := h.dialSession(ctx, &pipeDialer{conn: conn})
+	if err != nil {
+		return err
+	}
+	payload := []byte("reflex interop check")
+	header := []byte{0x01, 127, 0, 0, 1, 0, 80}
+	if err := c.session.WriteFrame(c.conn, protocol.FrameTypeData, append(header, payload...)); err != nil {
+		return errors.New("failed to write request").Base(err)
+	}
+	var echoed []byte
+	for len(echoed) < len(payload) {
+		frame, err := c.session.ReadFrame(c.reader)
+		if err != nil {
+			return errors.New("failed to read response").Base(err)
+		}
+		if frame.Type == protocol.FrameTypeData {
+			echoed = append(echoed, frame.Payload...)
+		}
+	}
+	if string(echoed) != string(payload) {
+		return errors.New("echo mismatch")
+	}
+	return c.session.WriteFrame(c.conn, protocol.FrameTypeClose, nil)
+}
+
+// pipeDialer hands out one prepared connection.
+type pipeDialer struct {
+	conn stat.Connection
+}
+
+func (d *pipeDialer) Dial(ctx context.Context, dest net.Destination) (stat.Connection, error) {
+	if d.conn == nil {
+		return nil, errors.New("in-memory connection already used")
+	}
+	conn := d.conn
+	d.conn = nil
+	return conn, nil
+}
+
+func (d *pipeDialer) DestIpAddress() net.IP { return nil }
+
+func (d *pipeDialer) SetOutboundGateway(ctx context.Context, ob *session.Outbound) {}
+
+// echoDispatcher echoes everything written to a dispatched link.
+type echoDispatcher struct{}
+
+func (echoDispatcher) Type() interface{} { return nil }
+func (echoDispatcher) Start() error      { return nil }
+func (echoDispatcher) Close() error      { return nil }
+
+func (echoDispatcher) Dispatch(ctx context.Context, dest net.Destination) (*transport.Link, error) {
+	upReader, upWriter := pipe.New()
+	downReader, downWriter := pipe.New()
+	go func() {
+		buf.Copy(upReader, downWriter)
+		downWriter.Close()
+	}()
+	return &transport.Link{Reader: downReader, Writer: upWriter}, nil
+}
+
+func (echoDispatcher) DispatchLink(ctx context.Context, dest net.Destination, link *transport.Link) error {
+	return errors.New("not implemented")
+}
@@ -1,12 +1,24 @@
-// Package outbound implements the Reflex outbound handler (stub).
+// Package outbound implements the Reflex outbound handler.
 package outbound
 
 import (
 	"context"
+	"io"
+	"time"
 
 	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/common/signal"
+	"github.com/xtls/xray-core/common/task"
+	"github.com/xtls/xray-core/common/uuid"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/policy"
 	"github.com/xtls/xray-core/proxy"
 	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
 	"github.com/xtls/xray-core/transport"
 	"github.com/xtls/xray-core/transport/internet"
 )
@@ -17,20 +29,272 @@ func init() {
 	}))
 }
 
-// Handler is the Reflex outbound handler (stub).
-type Handler struct{}
+// Handler is the Reflex outbound handler.
+type Handler struct {
+	server           net.Destination
+	id               uuid.UUID
+	handshakeRetries uint32
+	cipherSuite      uint8
+	profile          *protocol.TrafficProfile
+	morphingBaseRTT  time.Duration
+	morphDownlink    bool
+	compression      bool
+	rekeyAfter       uint64
+	sendDomain       bool
+	connectByDomain  bool
+	maxGrease        int
+	magicSecret      []byte // nil for the fixed magic
+	powDifficulty    uint32
+	http2Preface     bool
+	httpUpgrade      string
+	webSocketPath    string
+	policyManager    policy.Manager
+}
+
+// firstPayloadTimeout is how long Process waits for request data to send
+// along with the destination in the first frame.
+const firstPayloadTimeout = 100 * time.Millisecond
 
-// Process implements proxy.Outbound.Process(). Stub: returns nil.
+// Process implements proxy.Outbound.Process().
 func (h *Handler) Process(ctx context.Context, link *transport.Link, d internet.Dialer) error {
-	_ = ctx
-	_ = link
-	_ = d
+	outbounds := session.OutboundsFromContext(ctx)
+	ob := outbounds[len(outbounds)-1]
+	if !ob.Target.IsValid() {
+		return errors.New("target not specified").AtError()
+	}
+	ob.Name = "reflex"
+	switch ob.Target.Network {
+	case net.Network_TCP:
+	case net.Network_UDP:
+		return h.processUDP(ctx, ob, link, d)
+	default:
+		return errors.New("reflex only carries TCP and UDP, not ", ob.Target.Network).AtWarning()
+	}
+	header, err := h.requestHeader(ob)
+	if err != nil {
+		return errors.New("invalid destination ", ob.Target).Base(err)
+	}
+
+	c, err := h.dialSession(ctx, d)
+	if err != nil {
+		return err
+	}
+	// The connection closes first, so a read blocked on it returns.
+	defer c.session.Close()
+	defer c.conn.Close()
+	errors.LogInfo(ctx, "tunneling request to ", ob.Target, " via ", h.server)
+
+	sessionPolicy := h.sessionPolicy(0)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	timer := signal.CancelAfterInactivity(ctx, cancel, sessionPolicy.Timeouts.ConnectionIdle)
+
+	requestDone := func() error {
+		defer timer.SetTimeout(sessionPolicy.Timeouts.DownlinkOnly)
+		// The destination travels in the first DATA frame, together with
+		// whatever the request has ready, and that frame is not morphed:
+		// splitting it could cut the destination apart.
+		first := header
+		if reader, ok := link.Reader.(buf.TimeoutReader); ok {
+			mb, err := reader.ReadMultiBufferTimeout(firstPayloadTimeout)
+			if err != nil && err != buf.ErrReadTimeout {
+				return errors.New("failed to read request").Base(err)
+			}
+			for _, b := range mb {
+				first = append(first, b.Bytes()...)
+			}
+			buf.ReleaseMulti(mb)
+		}
+		if err := c.session.WriteFrame(c.conn, protocol.FrameTypeData, first); err != nil {
+			return errors.New("failed to write request").Base(err)
+		}
+		writer := &sessionWriter{session: c.session, writer: c.conn}
+		if err := buf.Copy(link.Reader, writer, buf.UpdateActivity(timer)); err != nil {
+			return errors.New("failed to write request").Base(err)
+		}
+		// The request is done; the response may still be flowing.
+		if err := c.session.FlushMorphed(); err != nil {
+			return errors.New("failed to write request").Base(err)
+		}
+		return c.session.WriteFrame(c.conn, protocol.FrameTypeCloseWrite, nil)
+	}
+
+	responseDone := func() error {
+		defer timer.SetTimeout(sessionPolicy.Timeouts.UplinkOnly)
+		for {
+			frame, err := c.session.ReadFrame(c.reader)
+			if err != nil {
+				if errors.Cause(err) == io.EOF {
+					return nil
+				}
+				return errors.New("failed to read frame").Base(err)
+			}
+			timer.Update()
+
+			switch frame.Type {
+			case protocol.FrameTypeData:
+				if len(frame.Payload) == 0 {
+					continue
+				}
+				if err := link.Writer.WriteMultiBuffer(buf.MergeBytes(nil, frame.Payload)); err != nil {
+					return errors.New("failed to transfer response").Base(err)
+				}
+			case protocol.FrameTypePadding, protocol.FrameTypeTiming:
+				if err := c.session.HandleControlFrame(frame, c.session.Profile()); err != nil {
+					return err
+				}
+			case protocol.FrameTypePing, protocol.FrameTypePong:
+				if err := c.session.HandleHeartbeat(c.conn, frame); err != nil {
+					return err
+				}
+			case protocol.FrameTypeRekey:
+				if err := c.session.HandleRekey(c.conn, frame); err != nil {
+					return err
+				}
+			case protocol.FrameTypeClose, protocol.FrameTypeCloseWrite:
+				return nil
+			}
+		}
+	}
+
+	responseDonePost := task.OnSuccess(responseDone, task.Close(link.Writer))
+	if err := task.Run(ctx, requestDone, responseDonePost); err != nil {
+		common.Interrupt(link.Reader)
+		common.Interrupt(link.Writer)
+		return errors.New("connection ends").Base(err)
+	}
+	return nil
+}
+
+// sessionPolicy returns the policy for level, or the default without a
+// policy manager.
+func (h *Handler) sessionPolicy(level uint32) policy.Session {
+	if h.policyManager == nil {
+		return policy.SessionDefault()
+	}
+	return h.policyManager.ForLevel(level)
+}
+
+// sessionWriter is a buf.Writer that encrypts everything into DATA frames,
+// morphed when the session has a traffic profile.
+type sessionWriter struct {
+	session *protocol.Session
+	writer  io.Writer
+}
+
+func (w *sessionWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	defer buf.ReleaseMulti(mb)
+	for _, b := range mb {
+		if b.IsEmpty() {
+			continue
+		}
+		var err error
+		if profile := w.session.Profile(); profile != nil {
+			err = w.session.WriteFrameWithMorphing(w.writer, protocol.FrameTypeData, b.Bytes(), profile)
+		} else {
+			err = w.session.WriteFrame(w.writer, protocol.FrameTypeData, b.Bytes())
+		}
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // New creates a new Reflex outbound handler.
-func New(ctx context.Context, config *reflex.OutboundConfig) (proxy.OutboundHandler, error) {
-	_ = ctx
-	_ = config
-	return &Handler{}, nil
+func New(ctx context.Context, config *reflex.OutboundConfig) (proxy.Outbound, error) {
+	if config == nil {
+		return nil, errors.New("reflex outbound config is nil").AtError()
+	}
+	if config.Address == "" {
+		return nil, errors.New("reflex server address is not set").AtError()
+	}
+	if config.Port == 0 || config.Port > 65535 {
+		return nil, errors.New("invalid reflex server port: ", config.Port).AtError()
+	}
+	id, err := uuid.ParseString(config.Id)
+	if err != nil {
+		return nil, errors.New("invalid reflex user id: ", config.Id).Base(err).AtError()
+	}
+	if config.IdSalt != "" {
+		id = protocol.DeriveUserID(config.IdSalt, id)
+	}
+	if config.GreaseMaxBytes > protocol.MaxGreaseBytes {
+		return nil, errors.New("reflex grease of ", config.GreaseMaxBytes, " bytes exceeds ", protocol.MaxGreaseBytes).AtError()
+	}
+	if config.HTTP2Preface && config.GreaseMaxBytes > 0 {
+		return nil, errors.New("reflex grease cannot precede the HTTP/2 preface").AtError()
+	}
+	if config.HTTPUpgrade != "" {
+		if !protocol.ValidUpgradeProtocol(config.HTTPUpgrade) {
+			return nil, errors.New("invalid reflex upgrade protocol: ", config.HTTPUpgrade).AtError()
+		}
+		if config.GreaseMaxBytes > 0 || config.HTTP2Preface || config.WebSocketPath != "" {
+			return nil, errors.New("reflex HTTP upgrade cannot be combined with grease, the HTTP/2 preface or WebSocket").AtError()
+		}
+	}
+	if config.PowDifficulty > protocol.MaxPoWDifficulty {
+		return nil, errors.New("reflex proof-of-work difficulty too high: ", config.PowDifficulty).AtError()
+	}
+	suite, err := protocol.ParseCipherSuite(config.CipherSuite)
+	if err != nil {
+		return nil, err
+	}
+	var profile *protocol.TrafficProfile
+	if config.Policy != "" {
+		if profile = protocol.GetProfileByName(config.Policy); profile == nil {
+			return nil, errors.New("unknown reflex policy: ", config.Policy).AtError()
+		}
+	}
+	handler := &Handler{
+		server:           net.TCPDestination(net.ParseAddress(config.Address), net.Port(config.Port)),
+		id:               id,
+		handshakeRetries: config.HandshakeRetries,
+		cipherSuite:      suite,
+		profile:          profile,
+		morphingBaseRTT:  time.Duration(config.MorphingBaseRttMs) * time.Millisecond,
+		morphDownlink:    config.MorphDownlink,
+		compression:      config.Compression,
+		rekeyAfter:       uint64(config.RekeyAfterFrames),
+		sendDomain:       config.SendDomain,
+		connectByDomain:  config.ConnectByDomain,
+		maxGrease:        int(config.GreaseMaxBytes),
+		powDifficulty:    config.PowDifficulty,
+		http2Preface:     config.HTTP2Preface,
+		httpUpgrade:      config.HTTPUpgrade,
+		webSocketPath:    config.WebSocketPath,
+	}
+	if config.MagicSecret != "" {
+		handler.magicSecret = []byte(config.MagicSecret)
+	}
+	if v := core.FromContext(ctx); v != nil {
+		if pm, ok := v.GetFeature(policy.ManagerType()).(policy.Manager); ok {
+			handler.policyManager = pm
+		}
+	}
+	return handler, nil
+}
+
+// requestDestination returns the destination to send to the server for ob:
+// its target, or with SendDomain the domain the target was resolved from.
+func (h *Handler) requestDestination(ob *session.Outbound) net.Destination {
+	dest := ob.Target
+	if h.sendDomain && ob.OriginalTarget.Address != nil && ob.OriginalTarget.Address.Family().IsDomain() {
+		dest.Address = ob.OriginalTarget.Address
+	}
+	return dest
+}
+
+// requestHeader encodes the destination to send to the server for ob,
+// marked to be connected to by name with ConnectByDomain.
+func (h *Handler) requestHeader(ob *session.Outbound) ([]byte, error) {
+	dest := h.requestDestination(ob)
+	header, err := protocol.EncodeDestination(dest)
+	if err != nil {
+		return nil, err
+	}
+	if h.connectByDomain && dest.Address.Family().IsDomain() {
+		header = append([]byte{protocol.NoResolveMarker}, header...)
+	}
+	return header, nil
 }
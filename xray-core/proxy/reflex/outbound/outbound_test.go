@@ -0,0 +1,735 @@
+package outbound
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	stdnet "net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/common/uuid"
+	"github.com/xtls/xray-core/proxy/reflex"
+	"github.com/xtls/xray-core/proxy/reflex/inbound"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+	"github.com/xtls/xray-core/transport"
+	"github.com/xtls/xray-core/transport/internet/stat"
+	"github.com/xtls/xray-core/transport/pipe"
+)
+
+const testUserID = "b831381d-6324-4d53-ad4f-8cda48b30811"
+
+// tcpDialer is an internet.Dialer that dials plain TCP.
+type tcpDialer struct{}
+
+func (tcpDialer) Dial(ctx context.Context, dest net.Destination) (stat.Connection, error) {
+	var d stdnet.Dialer
+	return d.DialContext(ctx, "tcp", dest.NetAddr())
+}
+
+func (tcpDialer) DestIpAddress() net.IP { return nil }
+
+func (tcpDialer) SetOutboundGateway(ctx context.Context, ob *session.Outbound) {}
+
+// startServer runs a reflex inbound on a local listener. The first
+// rejectFirst connections are answered with a 403 instead, like a server
+// that is still coming up.
+func startServer(t *testing.T, rejectFirst int32) (*reflex.OutboundConfig, *atomic.Int32) {
+	t.Helper()
+	return startServerWithConfig(t, &reflex.InboundConfig{
+		Clients: []*reflex.User{{Id: testUserID}},
+	}, rejectFirst)
+}
+
+// startServerWithConfig is startServer with the given inbound config.
+func startServerWithConfig(t *testing.T, serverConfig *reflex.InboundConfig, rejectFirst int32) (*reflex.OutboundConfig, *atomic.Int32) {
+	t.Helper()
+	h, err := inbound.New(context.Background(), serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if accepted.Add(1) <= rejectFirst {
+				go func() {
+					defer conn.Close()
+					io.ReadFull(conn, make([]byte, 78))
+					conn.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+				}()
+				continue
+			}
+			go func() {
+				defer conn.Close()
+				h.Process(context.Background(), net.Network_TCP, conn, echoDispatcher{})
+			}()
+		}
+	}()
+
+	addr := ln.Addr().(*stdnet.TCPAddr)
+	return &reflex.OutboundConfig{
+		Address: addr.IP.String(),
+		Port:    uint32(addr.Port),
+		Id:      testUserID,
+	}, &accepted
+}
+
+func newTestHandler(t *testing.T, config *reflex.OutboundConfig) *Handler {
+	t.Helper()
+	h, err := New(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.(*Handler)
+}
+
+// checkEcho sends a request for 127.0.0.1:80 over c and expects the payload
+// echoed.
+func checkEcho(t *testing.T, c *clientConn, payload string) {
+	t.Helper()
+	header := []byte{0x01, 127, 0, 0, 1, 0, 80}
+	if err := c.session.WriteFrame(c.conn, protocol.FrameTypeData, append(header, payload...)); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := c.session.ReadFrame(c.reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(frame.Payload) != payload {
+		t.Fatalf("echo %q, want %q", frame.Payload, payload)
+	}
+}
+
+func TestDialSession(t *testing.T) {
+	config, _ := startServer(t, 0)
+	c, err := newTestHandler(t, config).dialSession(context.Background(), tcpDialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.conn.Close()
+	checkEcho(t, c, "hello")
+}
+
+func TestDialSessionCompression(t *testing.T) {
+	const dict = "Content-Type: application/json\r\nCache-Control: no-cache\r\n"
+	t.Cleanup(func() { protocol.UnregisterProfile("test-compression") })
+	config, _ := startServerWithConfig(t, &reflex.InboundConfig{
+		Clients: []*reflex.User{{Id: testUserID, Policy: "test-compression"}},
+		Profiles: []reflex.Profile{{
+			Name:                  "test-compression",
+			PacketSizes:           []reflex.ProfilePacketSize{{Size: 1200, Weight: 1}},
+			Delays:                []reflex.ProfileDelay{{Ms: 1, Weight: 1}},
+			CompressionDictionary: dict,
+		}},
+	}, 0)
+	config.Compression = true
+	conn, err := tcpDialer{}.Dial(context.Background(), net.TCPDestination(net.ParseAddress(config.Address), net.Port(config.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &recordingConn{Connection: conn}
+	c, err := newTestHandler(t, config).dialSession(context.Background(), &pipeDialer{conn: recorder})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.conn.Close()
+	sent := recorder.written.Len()
+	payload := strings.Repeat(dict, 50)
+	checkEcho(t, c, payload)
+	if n := recorder.written.Len() - sent; n >= len(payload)/4 {
+		t.Errorf("%d bytes sent for a %d byte payload, want it compressed", n, len(payload))
+	}
+}
+
+// recordingConn records everything written to it.
+type recordingConn struct {
+	stat.Connection
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.written.Write(b)
+	return c.Connection.Write(b)
+}
+
+func TestDialSessionVersionEncrypted(t *testing.T) {
+	config, _ := startServer(t, 0)
+	conn, err := tcpDialer{}.Dial(context.Background(), net.TCPDestination(net.ParseAddress(config.Address), net.Port(config.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &recordingConn{Connection: conn}
+	c, err := newTestHandler(t, config).dialSession(context.Background(), &pipeDialer{conn: recorder})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.conn.Close()
+	checkEcho(t, c, "hello")
+	if bytes.Contains(recorder.written.Bytes(), []byte(protocol.ClientSoftware)) {
+		t.Error("client version sent in the clear")
+	}
+}
+
+func TestDialSessionDerivedID(t *testing.T) {
+	id, _ := uuid.ParseString(testUserID)
+	derived := protocol.DeriveUserID("server salt", id)
+	config, _ := startServerWithConfig(t, &reflex.InboundConfig{
+		Clients: []*reflex.User{{IdHash: inbound.UserIDHash(derived)}},
+	}, 0)
+	config.IdSalt = "server salt"
+	c, err := newTestHandler(t, config).dialSession(context.Background(), tcpDialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.conn.Close()
+	checkEcho(t, c, "hello")
+}
+
+func TestDialSessionRekey(t *testing.T) {
+	config, _ := startServerWithConfig(t, &reflex.InboundConfig{
+		Clients:          []*reflex.User{{Id: testUserID}},
+		RekeyAfterFrames: 3,
+	}, 0)
+	config.RekeyAfterFrames = 2
+	c, err := newTestHandler(t, config).dialSession(context.Background(), tcpDialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.conn.Close()
+
+	header := []byte{0x01, 127, 0, 0, 1, 0, 80}
+	for i := 0; i < 20; i++ {
+		payload := fmt.Sprint("frame ", i)
+		if err := c.session.WriteFrame(c.conn, protocol.FrameTypeData, append(header, payload...)); err != nil {
+			t.Fatal(err)
+		}
+		header = nil
+		for {
+			frame, err := c.session.ReadFrame(c.reader)
+			if err != nil {
+				t.Fatalf("frame %d: %v", i, err)
+			}
+			if frame.Type == protocol.FrameTypeRekey {
+				if err := c.session.HandleRekey(c.conn, frame); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			if string(frame.Payload) != payload {
+				t.Fatalf("echo %q, want %q", frame.Payload, payload)
+			}
+			break
+		}
+	}
+}
+
+func TestDialSessionHTTP2Preface(t *testing.T) {
+	config, _ := startServer(t, 0)
+	config.HTTP2Preface = true
+	c, err := newTestHandler(t, config).dialSession(context.Background(), tcpDialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.conn.Close()
+	checkEcho(t, c, "hello")
+}
+
+func TestDialSessionHTTPUpgrade(t *testing.T) {
+	config, _ := startServerWithConfig(t, &reflex.InboundConfig{
+		Clients:     []*reflex.User{{Id: testUserID}},
+		HTTPUpgrade: "websocket",
+	}, 0)
+	config.HTTPUpgrade = "websocket"
+	c, err := newTestHandler(t, config).dialSession(context.Background(), tcpDialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.conn.Close()
+	checkEcho(t, c, "after the upgrade")
+}
+
+func TestDialSessionWebSocket(t *testing.T) {
+	config, _ := startServerWithConfig(t, &reflex.InboundConfig{
+		Clients:       []*reflex.User{{Id: testUserID}},
+		WebSocketPath: "/ws",
+	}, 0)
+	config.WebSocketPath = "/ws"
+	c, err := newTestHandler(t, config).dialSession(context.Background(), tcpDialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.conn.Close()
+	if _, ok := c.conn.(*leadingWriteConn).Connection.(*protocol.WebSocketConn); !ok {
+		t.Errorf("session runs over %T, want a WebSocket", c.conn.(*leadingWriteConn).Connection)
+	}
+	checkEcho(t, c, "hello")
+}
+
+func TestDialSessionAppliesGrantedProfile(t *testing.T) {
+	for _, tc := range []struct {
+		server, client string
+		want           string
+	}{
+		{"zoom", "", "zoom"},
+		{"mimic-http2-api", "youtube", "http2-api"},
+		{"", "youtube", "youtube"},
+		{"", "", ""},
+	} {
+		config, _ := startServerWithConfig(t, &reflex.InboundConfig{
+			Clients: []*reflex.User{{Id: testUserID, Policy: tc.server}},
+		}, 0)
+		config.Policy = tc.client
+		c, err := newTestHandler(t, config).dialSession(context.Background(), tcpDialer{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if profile := c.session.Profile(); profile != nil {
+			got = profile.Name
+		}
+		if got != tc.want {
+			t.Errorf("server %q, client %q: session uses profile %q, want %q", tc.server, tc.client, got, tc.want)
+		}
+		checkEcho(t, c, "hello")
+		c.conn.Close()
+	}
+}
+
+func TestDialSessionMorphDownlink(t *testing.T) {
+	for _, tc := range []struct {
+		server        string
+		morphDownlink bool
+		want          bool
+	}{
+		{"zoom", true, true},
+		{"zoom", false, false},
+		// Nothing to morph with without a granted profile.
+		{"", true, false},
+	} {
+		config, _ := startServerWithConfig(t, &reflex.InboundConfig{
+			Clients: []*reflex.User{{Id: testUserID, Policy: tc.server}},
+		}, 0)
+		config.MorphDownlink = tc.morphDownlink
+		conn, err := tcpDialer{}.Dial(context.Background(), net.TCPDestination(net.ParseAddress(config.Address), net.Port(config.Port)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		counter := &countingConn{Connection: conn}
+		c, err := newTestHandler(t, config).dialSession(context.Background(), &pipeDialer{conn: counter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := counter.read.Load()
+		checkEcho(t, c, "hello")
+		// A morphed echo is padded to one of the profile's packet sizes,
+		// all of them 500 bytes or more.
+		if morphed := counter.read.Load()-before >= 500; morphed != tc.want {
+			t.Errorf("server %q, MorphDownlink %v: downlink morphed %v, want %v", tc.server, tc.morphDownlink, morphed, tc.want)
+		}
+		c.conn.Close()
+	}
+}
+
+// countingConn counts the bytes read from it.
+type countingConn struct {
+	stat.Connection
+	read atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Connection.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func TestDialSessionGreased(t *testing.T) {
+	config, _ := startServerWithConfig(t, &reflex.InboundConfig{
+		Clients:        []*reflex.User{{Id: testUserID}},
+		GreaseMaxBytes: 4,
+	}, 0)
+	config.GreaseMaxBytes = 4
+	h := newTestHandler(t, config)
+	for i := 0; i < 4; i++ {
+		c, err := h.dialSession(context.Background(), tcpDialer{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkEcho(t, c, "greased")
+		c.conn.Close()
+	}
+}
+
+func TestDialSessionTimeGatedMagic(t *testing.T) {
+	config, _ := startServerWithConfig(t, &reflex.InboundConfig{
+		Clients:        []*reflex.User{{Id: testUserID}},
+		GreaseMaxBytes: 4,
+		MagicSecret:    "magic secret",
+		HTTPUpgrade:    "reflex",
+	}, 0)
+	for _, opening := range []func(*reflex.OutboundConfig){
+		func(c *reflex.OutboundConfig) {},
+		func(c *reflex.OutboundConfig) { c.GreaseMaxBytes = 4 },
+		func(c *reflex.OutboundConfig) { c.HTTP2Preface = true },
+		func(c *reflex.OutboundConfig) { c.HTTPUpgrade = "reflex" },
+	} {
+		client := *config
+		client.MagicSecret = "magic secret"
+		opening(&client)
+		c, err := newTestHandler(t, &client).dialSession(context.Background(), tcpDialer{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkEcho(t, c, "gated")
+		c.conn.Close()
+	}
+
+	// The fixed magic is not recognized, nor an upgrade without the magic.
+	if c, err := newTestHandler(t, config).dialSession(context.Background(), tcpDialer{}); err == nil {
+		c.conn.Close()
+		t.Error("handshake with the fixed magic succeeded")
+	}
+	config.HTTPUpgrade = "reflex"
+	if c, err := newTestHandler(t, config).dialSession(context.Background(), tcpDialer{}); err == nil {
+		c.conn.Close()
+		t.Error("upgrade handshake without the magic succeeded")
+	}
+}
+
+func TestDialSessionProofOfWork(t *testing.T) {
+	config, _ := startServerWithConfig(t, &reflex.InboundConfig{
+		Clients:       []*reflex.User{{Id: testUserID}},
+		MagicSecret:   "magic secret",
+		PowDifficulty: 8,
+	}, 0)
+	config.MagicSecret = "magic secret"
+	config.PowDifficulty = 8
+	c, err := newTestHandler(t, config).dialSession(context.Background(), tcpDialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, c, "worked")
+	c.conn.Close()
+
+	// Without the proof the hello goes to fallback, which this server
+	// does not have.
+	config.PowDifficulty = 0
+	if c, err := newTestHandler(t, config).dialSession(context.Background(), tcpDialer{}); err == nil {
+		c.conn.Close()
+		t.Error("handshake without a proof of work succeeded")
+	}
+}
+
+func TestDialSessionRetriesRejectedHandshake(t *testing.T) {
+	config, accepted := startServer(t, 1)
+	config.HandshakeRetries = 2
+	c, err := newTestHandler(t, config).dialSession(context.Background(), tcpDialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.conn.Close()
+	checkEcho(t, c, "after retry")
+	if n := accepted.Load(); n != 2 {
+		t.Errorf("server saw %d connections, want 2", n)
+	}
+}
+
+func TestDialSessionGivesUpAfterRetries(t *testing.T) {
+	config, accepted := startServer(t, 10)
+	config.HandshakeRetries = 2
+	if _, err := newTestHandler(t, config).dialSession(context.Background(), tcpDialer{}); err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+	if n := accepted.Load(); n != 3 {
+		t.Errorf("server saw %d connections, want 3", n)
+	}
+}
+
+func TestDialSessionAbortsOnDisguiseMismatch(t *testing.T) {
+	// A JSON answer with a well-formed key, but without the Content-Type a
+	// reflex server sends.
+	body := `{"key":"` + base64.StdEncoding.EncodeToString(make([]byte, 32)) + `"}`
+	ln, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				io.ReadFull(conn, make([]byte, 78))
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body))
+			}()
+		}
+	}()
+
+	addr := ln.Addr().(*stdnet.TCPAddr)
+	h := newTestHandler(t, &reflex.OutboundConfig{
+		Address:          addr.IP.String(),
+		Port:             uint32(addr.Port),
+		Id:               testUserID,
+		HandshakeRetries: 2,
+	})
+	_, err = h.dialSession(context.Background(), tcpDialer{})
+	if err == nil {
+		t.Fatal("trusted a handshake response without Content-Type")
+	}
+	if errors.Cause(err) != errDisguiseMismatch {
+		t.Errorf("got %v, want a disguise mismatch", err)
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("server saw %d connections, want the handshake aborted after 1", n)
+	}
+}
+
+func TestCheckDisguise(t *testing.T) {
+	for _, status := range []uint32{0, 201, 204, 205} {
+		config, _ := startServerWithConfig(t, &reflex.InboundConfig{
+			Clients:         []*reflex.User{{Id: testUserID}},
+			HandshakeStatus: status,
+		}, 0)
+		c, err := newTestHandler(t, config).dialSession(context.Background(), tcpDialer{})
+		if err != nil {
+			t.Fatalf("status %d: the real server's answer was rejected: %v", status, err)
+		}
+		c.conn.Close()
+	}
+
+	for _, response := range []string{
+		"HTTP/1.0 200 OK\r\nContent-Type: application/json\r\nContent-Length: 2\r\n\r\n{}",
+		"HTTP/1.1 200 Okay\r\nContent-Type: application/json\r\nContent-Length: 2\r\n\r\n{}",
+		"HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: 2\r\n\r\n{}",
+		"HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nTransfer-Encoding: chunked\r\n\r\n2\r\n{}\r\n0\r\n\r\n",
+		"HTTP/1.1 204 No Content\r\n\r\n",
+	} {
+		resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(response)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkDisguise(resp); errors.Cause(err) != errDisguiseMismatch {
+			t.Errorf("%q: got %v, want a disguise mismatch", response, err)
+		}
+	}
+}
+
+func TestNewMorphingConfig(t *testing.T) {
+	h := newTestHandler(t, &reflex.OutboundConfig{Address: "127.0.0.1", Port: 443, Id: testUserID, Policy: "mimic-youtube", MorphingBaseRttMs: 30})
+	if h.profile == nil || h.profile.Name != "youtube" || h.morphingBaseRTT != 30*time.Millisecond {
+		t.Errorf("morphing config not applied: %v %v", h.profile, h.morphingBaseRTT)
+	}
+	if _, err := New(context.Background(), &reflex.OutboundConfig{Address: "127.0.0.1", Port: 443, Id: testUserID, Policy: "youtub"}); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
+
+// recordingDispatcher echoes like echoDispatcher and reports every
+// destination it is asked for.
+type recordingDispatcher struct {
+	echoDispatcher
+	dests chan net.Destination
+}
+
+func (d recordingDispatcher) Dispatch(ctx context.Context, dest net.Destination) (*transport.Link, error) {
+	d.dests <- dest
+	return d.echoDispatcher.Dispatch(ctx, dest)
+}
+
+func TestNewValidatesConfig(t *testing.T) {
+	for name, config := range map[string]*reflex.OutboundConfig{
+		"nil config":    nil,
+		"empty address": {Port: 443, Id: testUserID},
+		"zero port":     {Address: "127.0.0.1", Id: testUserID},
+		"empty id":      {Address: "127.0.0.1", Port: 443},
+		// Short strings map to a UUID, but this is neither short nor a UUID.
+		"invalid id":                   {Address: "127.0.0.1", Port: 443, Id: "b831381d-6324-4d53-ad4f-8cda48b3081z"},
+		"grease before HTTP/2 preface": {Address: "127.0.0.1", Port: 443, Id: testUserID, GreaseMaxBytes: 4, HTTP2Preface: true},
+		"invalid upgrade protocol":     {Address: "127.0.0.1", Port: 443, Id: testUserID, HTTPUpgrade: "web socket"},
+		"upgrade over WebSocket":       {Address: "127.0.0.1", Port: 443, Id: testUserID, HTTPUpgrade: "reflex", WebSocketPath: "/ws"},
+		"proof of work too hard":       {Address: "127.0.0.1", Port: 443, Id: testUserID, PowDifficulty: 64},
+	} {
+		if _, err := New(context.Background(), config); err == nil {
+			t.Errorf("%s: New accepted %+v", name, config)
+		}
+	}
+}
+
+func TestConnectByDomain(t *testing.T) {
+	for _, tc := range []struct {
+		target          net.Destination
+		connectByDomain bool
+		marked          bool
+	}{
+		{net.TCPDestination(net.DomainAddress("example.com"), 443), false, false},
+		{net.TCPDestination(net.DomainAddress("example.com"), 443), true, true},
+		{net.TCPDestination(net.IPAddress([]byte{192, 0, 2, 1}), 443), true, false},
+	} {
+		h := newTestHandler(t, &reflex.OutboundConfig{Address: "127.0.0.1", Port: 443, Id: testUserID, ConnectByDomain: tc.connectByDomain})
+		header, err := h.requestHeader(&session.Outbound{OriginalTarget: tc.target, Target: tc.target})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := protocol.EncodeDestination(tc.target)
+		if tc.marked {
+			want = append([]byte{protocol.NoResolveMarker}, want...)
+		}
+		if !bytes.Equal(header, want) {
+			t.Errorf("ConnectByDomain=%v, %v: header %x, want %x", tc.connectByDomain, tc.target, header, want)
+		}
+	}
+}
+
+func TestSendDomain(t *testing.T) {
+	domain := net.DomainAddress("example.com")
+	resolved := net.IPAddress([]byte{192, 0, 2, 1})
+	ob := &session.Outbound{
+		OriginalTarget: net.TCPDestination(domain, 443),
+		Target:         net.TCPDestination(resolved, 443),
+	}
+	server, err := inbound.New(context.Background(), &reflex.InboundConfig{Clients: []*reflex.User{{Id: testUserID}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		sendDomain bool
+		want       net.Destination
+	}{
+		{false, net.TCPDestination(resolved, 443)},
+		{true, net.TCPDestination(domain, 443)},
+	} {
+		h := newTestHandler(t, &reflex.OutboundConfig{Address: "127.0.0.1", Port: 443, Id: testUserID, SendDomain: tc.sendDomain})
+		dest := h.requestDestination(ob)
+		if dest != tc.want {
+			t.Errorf("SendDomain=%v: sending %v, want %v", tc.sendDomain, dest, tc.want)
+		}
+
+		clientConn, serverConn := stdnet.Pipe()
+		dispatcher := recordingDispatcher{dests: make(chan net.Destination, 1)}
+		go server.Process(context.Background(), net.Network_TCP, serverConn, dispatcher)
+		c, err := h.dialSession(context.Background(), &pipeDialer{conn: clientConn})
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err := protocol.EncodeDestination(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.session.WriteFrame(c.conn, protocol.FrameTypeData, header); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-dispatcher.dests; got != tc.want {
+			t.Errorf("SendDomain=%v: server dispatched %v, want %v", tc.sendDomain, got, tc.want)
+		}
+		clientConn.Close()
+	}
+
+	// Without a domain to fall back to, the target goes out as it is.
+	h := newTestHandler(t, &reflex.OutboundConfig{Address: "127.0.0.1", Port: 443, Id: testUserID, SendDomain: true})
+	ipOnly := &session.Outbound{Target: net.TCPDestination(resolved, 443)}
+	if dest := h.requestDestination(ipOnly); dest != ipOnly.Target {
+		t.Errorf("sending %v for an IP-only target", dest)
+	}
+}
+
+// processEcho runs h.Process against a reflex inbound over a net.Pipe,
+// sends payload through it and returns what came back and the destination
+// the inbound dispatched.
+func processEcho(t *testing.T, h *Handler, target net.Destination, payload string) (string, net.Destination) {
+	t.Helper()
+	server, err := inbound.New(context.Background(), &reflex.InboundConfig{Clients: []*reflex.User{{Id: testUserID}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn := stdnet.Pipe()
+	dispatcher := recordingDispatcher{dests: make(chan net.Destination, 1)}
+	go server.Process(context.Background(), net.Network_TCP, serverConn, dispatcher)
+
+	upReader, upWriter := pipe.New()
+	downReader, downWriter := pipe.New()
+	ctx := session.ContextWithOutbounds(context.Background(), []*session.Outbound{{Target: target}})
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Process(ctx, &transport.Link{Reader: upReader, Writer: downWriter}, &pipeDialer{conn: clientConn})
+	}()
+
+	if err := upWriter.WriteMultiBuffer(buf.MergeBytes(nil, []byte(payload))); err != nil {
+		t.Fatal(err)
+	}
+	upWriter.Close()
+	var echoed []byte
+	for {
+		mb, err := downReader.ReadMultiBuffer()
+		for _, b := range mb {
+			echoed = append(echoed, b.Bytes()...)
+		}
+		buf.ReleaseMulti(mb)
+		if err != nil {
+			break
+		}
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Process: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Process did not return")
+	}
+	return string(echoed), <-dispatcher.dests
+}
+
+func TestProcessEcho(t *testing.T) {
+	target := net.TCPDestination(net.DomainAddress("example.com"), 443)
+	payload := strings.Repeat("reflex echo ", 1000)
+	for _, policy := range []string{"", "http2-api"} {
+		h := newTestHandler(t, &reflex.OutboundConfig{Address: "127.0.0.1", Port: 443, Id: testUserID, Policy: policy})
+		echoed, dest := processEcho(t, h, target, payload)
+		if echoed != payload {
+			t.Errorf("policy %q: echoed %d bytes, want %d", policy, len(echoed), len(payload))
+		}
+		if dest != target {
+			t.Errorf("policy %q: server dispatched %v, want %v", policy, dest, target)
+		}
+	}
+}
+
+func TestProcessUDP(t *testing.T) {
+	target := net.UDPDestination(net.LocalHostIP, 53)
+	for _, policy := range []string{"", "http2-api"} {
+		h := newTestHandler(t, &reflex.OutboundConfig{Address: "127.0.0.1", Port: 443, Id: testUserID, Policy: policy})
+		echoed, dest := processEcho(t, h, target, "dns query")
+		if echoed != "dns query" {
+			t.Errorf("policy %q: echoed %q", policy, echoed)
+		}
+		if dest != target {
+			t.Errorf("policy %q: server dispatched %v, want %v", policy, dest, target)
+		}
+	}
+}
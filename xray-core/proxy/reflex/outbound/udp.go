@@ -0,0 +1,136 @@
+package outbound
+
+import (
+	"context"
+	"io"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/common/signal"
+	"github.com/xtls/xray-core/common/task"
+	"github.com/xtls/xray-core/proxy/reflex/internal/protocol"
+	"github.com/xtls/xray-core/transport"
+	"github.com/xtls/xray-core/transport/internet"
+)
+
+// processUDP relays the datagrams of link over a UDP association. Every
+// datagram goes out in a UDP frame prefixed with the destination header of
+// its endpoint, the target unless the buffer names another, and every UDP
+// frame the server sends back is handed to link addressed from the
+// endpoint it names.
+func (h *Handler) processUDP(ctx context.Context, ob *session.Outbound, link *transport.Link, d internet.Dialer) error {
+	c, err := h.dialSession(ctx, d)
+	if err != nil {
+		return err
+	}
+	// The connection closes first, so a read blocked on it returns.
+	defer c.session.Close()
+	defer c.conn.Close()
+	errors.LogInfo(ctx, "tunneling UDP to ", ob.Target, " via ", h.server)
+
+	sessionPolicy := h.sessionPolicy(0)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	timer := signal.CancelAfterInactivity(ctx, cancel, sessionPolicy.Timeouts.ConnectionIdle)
+
+	requestDone := func() error {
+		defer timer.SetTimeout(sessionPolicy.Timeouts.DownlinkOnly)
+		writer := &udpWriter{session: c.session, writer: c.conn, target: h.requestDestination(ob)}
+		if err := buf.Copy(link.Reader, writer, buf.UpdateActivity(timer)); err != nil {
+			return errors.New("failed to write UDP request").Base(err)
+		}
+		// Replies may still be on their way.
+		if err := c.session.FlushMorphed(); err != nil {
+			return errors.New("failed to write UDP request").Base(err)
+		}
+		return c.session.WriteFrame(c.conn, protocol.FrameTypeCloseWrite, nil)
+	}
+
+	responseDone := func() error {
+		defer timer.SetTimeout(sessionPolicy.Timeouts.UplinkOnly)
+		for {
+			frame, err := c.session.ReadFrame(c.reader)
+			if err != nil {
+				if errors.Cause(err) == io.EOF {
+					return nil
+				}
+				return errors.New("failed to read frame").Base(err)
+			}
+			timer.Update()
+
+			switch frame.Type {
+			case protocol.FrameTypeUDP:
+				from, datagram, err := protocol.DecodeDestination(frame.Payload)
+				if err != nil {
+					errors.LogInfoInner(ctx, err, "dropped UDP reply")
+					continue
+				}
+				from.Network = net.Network_UDP
+				b := buf.NewWithSize(int32(len(datagram)))
+				b.Write(datagram)
+				b.UDP = &from
+				if err := link.Writer.WriteMultiBuffer(buf.MultiBuffer{b}); err != nil {
+					return errors.New("failed to transfer UDP reply").Base(err)
+				}
+			case protocol.FrameTypePadding, protocol.FrameTypeTiming:
+				if err := c.session.HandleControlFrame(frame, c.session.Profile()); err != nil {
+					return err
+				}
+			case protocol.FrameTypePing, protocol.FrameTypePong:
+				if err := c.session.HandleHeartbeat(c.conn, frame); err != nil {
+					return err
+				}
+			case protocol.FrameTypeRekey:
+				if err := c.session.HandleRekey(c.conn, frame); err != nil {
+					return err
+				}
+			case protocol.FrameTypeClose, protocol.FrameTypeCloseWrite:
+				return nil
+			}
+		}
+	}
+
+	responseDonePost := task.OnSuccess(responseDone, task.Close(link.Writer))
+	if err := task.Run(ctx, requestDone, responseDonePost); err != nil {
+		common.Interrupt(link.Reader)
+		common.Interrupt(link.Writer)
+		return errors.New("connection ends").Base(err)
+	}
+	return nil
+}
+
+// udpWriter is a buf.Writer that sends every buffer as one datagram in a
+// UDP frame, padded but never split when the session has a traffic
+// profile.
+type udpWriter struct {
+	session *protocol.Session
+	writer  io.Writer
+	target  net.Destination // endpoint of buffers that name none
+}
+
+func (w *udpWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	defer buf.ReleaseMulti(mb)
+	for _, b := range mb {
+		dest := w.target
+		if b.UDP != nil {
+			dest = *b.UDP
+		}
+		header, err := protocol.EncodeDestination(dest)
+		if err != nil {
+			return errors.New("invalid UDP destination ", dest).Base(err)
+		}
+		frame := append(header, b.Bytes()...)
+		if profile := w.session.Profile(); profile != nil {
+			err = w.session.WriteFrameWithPadding(w.writer, protocol.FrameTypeUDP, frame, profile)
+		} else {
+			err = w.session.WriteFrame(w.writer, protocol.FrameTypeUDP, frame)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}